@@ -0,0 +1,51 @@
+package memr
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ryandeivert/memr/avml"
+)
+
+// newAVMLReader returns an io.Reader for the block in the AVML version 2 format: the
+// header, followed by the block's data compressed using snappy, then the size of the
+// compressed data. Compression only begins once the block is first read, so only one
+// block is compressed at a time. Failures are returned as a *ReadError for the block.
+func newAVMLReader(blk *block, r io.Reader) io.Reader {
+	return &lazyReader{open: func() io.Reader {
+		rPipe, wPipe := newPipe(blk.ctx)
+		go func() {
+			writer, err := avml.NewBlockWriter(wPipe, blk.start, blk.end)
+			if err != nil {
+				wPipe.CloseWithError(blk.wrapError(err))
+				return
+			}
+
+			_, err = io.Copy(writer, r)
+			if err != nil {
+				err = blk.wrapError(err)
+			}
+
+			if cErr := writer.Close(); cErr != nil && err == nil {
+				err = blk.wrapError(fmt.Errorf("failed to close AVML block writer: %w", cErr))
+			}
+
+			wPipe.CloseWithError(err)
+		}()
+
+		return rPipe
+	}}
+}
+
+// lazyReader defers opening the underlying io.Reader until it is first read
+type lazyReader struct {
+	open func() io.Reader
+	io.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.Reader == nil {
+		l.Reader = l.open()
+	}
+	return l.Reader.Read(p)
+}
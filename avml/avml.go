@@ -0,0 +1,374 @@
+// Package avml implements the image format written by AVML (https://github.com/microsoft/avml).
+//
+// An AVML image is a sequence of blocks, each describing a range of physical memory.
+// Every block begins with a header, using little endian byte order:
+//
+//	typedef struct {
+//	    unsigned int magic;           // 0x4C694D45 (LiME) for version 1, 0x4C4D5641 (AVML) for version 2
+//	    unsigned int version;         // 1 (uncompressed) or 2 (snappy compressed)
+//	    unsigned long long s_addr;    // Starting address of physical RAM range
+//	    unsigned long long e_addr;    // Ending address of physical RAM range (inclusive)
+//	    unsigned char reserved[8];    // Currently all zeros
+//	}
+//
+// Version 1 blocks are LiME blocks, using the LiME magic and followed by the raw
+// contents of the range, so an uncompressed AVML image is also a LiME image.
+// Version 2 blocks use the AVML magic, and are followed by the contents of the range
+// compressed using the snappy framing format, then the size of the compressed data
+// as a little endian uint64. AVML splits ranges into blocks of at most MaxBlockSize bytes.
+package avml
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+
+	"github.com/ryandeivert/memr/internal/ranges"
+)
+
+const (
+	// Magic is the value of the magic for each version 2 header (AVML)
+	Magic uint32 = 0x4C4D5641
+
+	// MaxBlockSize is the maximum size of the range of a single version 2 block
+	MaxBlockSize = 0x1000 * 0x1000
+)
+
+// ErrInvalidHeader is returned when an image contains an invalid header
+var ErrInvalidHeader = errors.New("invalid AVML header")
+
+// Header is the header preceding each block of an AVML image
+type Header struct {
+	Magic     uint32  // magic (Magic, or the LiME magic for version 1)
+	Version   uint32  // version (1 or 2)
+	StartAddr uint64  // start address
+	EndAddr   uint64  // end address (inclusive)
+	reserved  [8]byte //nolint:unused,structcheck
+}
+
+// HeaderSize is the size of an encoded Header
+var HeaderSize = binary.Size(Header{})
+
+// Size returns the size of the range described by the header
+func (h *Header) Size() uint64 {
+	return h.EndAddr - h.StartAddr + 1
+}
+
+func (h *Header) validate() error {
+	switch {
+	case h.Version == 1 && h.Magic != ranges.LiMEMagic, h.Version == 2 && h.Magic != Magic:
+		return fmt.Errorf("%w: magic %#x for version %d", ErrInvalidHeader, h.Magic, h.Version)
+	case h.Version != 1 && h.Version != 2:
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, h.Version)
+	}
+	if h.EndAddr < h.StartAddr {
+		return fmt.Errorf("%w: start=%d; end=%d", ErrInvalidHeader, h.StartAddr, h.EndAddr)
+	}
+	return nil
+}
+
+// blockWriter compresses the data for a version 2 block,
+// writing the size of the compressed data once closed
+type blockWriter struct {
+	*snappy.Writer
+	dst        *countingWriter
+	remaining  uint64
+	start, end uint64
+}
+
+// NewBlockWriter writes the header for a version 2 block for the range of memory
+// from start to end (exclusive) to w, and returns a writer to which exactly
+// end-start bytes of memory must be written. Closing the writer flushes the
+// compressed data and writes the trailing size of the compressed data.
+func NewBlockWriter(w io.Writer, start, end uint64) (io.WriteCloser, error) {
+	if end <= start || end-start > MaxBlockSize {
+		return nil, fmt.Errorf("invalid block range: start=%d; end=%d", start, end)
+	}
+
+	header := &Header{Magic: Magic, Version: 2, StartAddr: start, EndAddr: end - 1}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return nil, fmt.Errorf("failed to write header: %w", err)
+	}
+
+	dst := &countingWriter{Writer: w}
+	return &blockWriter{
+		Writer:    snappy.NewBufferedWriter(dst),
+		dst:       dst,
+		remaining: end - start,
+		start:     start,
+		end:       end,
+	}, nil
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	if uint64(len(p)) > b.remaining {
+		return 0, fmt.Errorf("write exceeds block range: start=%d; end=%d", b.start, b.end)
+	}
+	n, err := b.Writer.Write(p)
+	b.remaining -= uint64(n)
+	return n, err
+}
+
+func (b *blockWriter) Close() error {
+	if err := b.Writer.Close(); err != nil {
+		return err
+	}
+	if b.remaining != 0 {
+		return fmt.Errorf("block is missing %d byte(s): start=%d; end=%d", b.remaining, b.start, b.end)
+	}
+	return binary.Write(b.dst.Writer, binary.LittleEndian, b.dst.n)
+}
+
+// Reader reads the blocks of an AVML image in sequence. Next advances to the
+// next block, after which Read reads the (uncompressed) contents of its range.
+type Reader struct {
+	r       io.Reader
+	src     *countingReader // compressed data of the current version 2 block
+	header  *Header
+	data    io.Reader // remaining data of the current block
+	decoded uint64    // size of the data read for the current block
+}
+
+// NewReader returns a Reader for the AVML image read from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Next advances to the next block of the image, discarding any unread data of the
+// current block. The header of the block is returned, or io.EOF at the end of the image.
+func (r *Reader) Next() (*Header, error) {
+	if r.header != nil {
+		if err := r.finishBlock(); err != nil {
+			return nil, err
+		}
+		r.header = nil
+	}
+
+	raw := make([]byte, HeaderSize)
+	n, err := io.ReadFull(r.r, raw)
+	if n == 0 && err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	header := &Header{
+		Magic:     binary.LittleEndian.Uint32(raw[0:]),
+		Version:   binary.LittleEndian.Uint32(raw[4:]),
+		StartAddr: binary.LittleEndian.Uint64(raw[8:]),
+		EndAddr:   binary.LittleEndian.Uint64(raw[16:]),
+	}
+	if err := header.validate(); err != nil {
+		return nil, err
+	}
+
+	r.header = header
+	if header.Version == 1 {
+		r.data = io.LimitReader(r.r, int64(header.Size()))
+	} else {
+		r.src = &countingReader{Reader: r.r}
+		r.data = io.LimitReader(snappy.NewReader(r.src), int64(header.Size()))
+	}
+	r.decoded = 0
+
+	return header, nil
+}
+
+// Read reads the contents of the range for the current block
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.data == nil {
+		return 0, io.EOF
+	}
+	n, err := r.data.Read(p)
+	r.decoded += uint64(n)
+	if err == io.EOF && r.decoded < r.header.Size() {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// finishBlock discards the remaining data of the current block, and verifies
+// the trailing size of the compressed data for version 2 blocks
+func (r *Reader) finishBlock() error {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("failed to read block (start=%d; end=%d): %w", r.header.StartAddr, r.header.EndAddr, err)
+	}
+
+	r.data = nil
+	if r.header.Version == 1 {
+		return nil
+	}
+
+	var size uint64
+	if err := binary.Read(r.r, binary.LittleEndian, &size); err != nil {
+		return fmt.Errorf("failed to read compressed size (start=%d; end=%d): %w", r.header.StartAddr, r.header.EndAddr, err)
+	}
+	if size != r.src.n {
+		return fmt.Errorf("compressed size does not match (start=%d; end=%d): %d != %d", r.header.StartAddr, r.header.EndAddr, size, r.src.n)
+	}
+
+	return nil
+}
+
+type countingWriter struct {
+	io.Writer
+	n uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+type countingReader struct {
+	io.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// Block describes a block within an AVML image, as located by Index
+type Block struct {
+	Header
+	Offset         int64  // offset in the image of the block's data (following the header)
+	CompressedSize uint64 // size of the compressed data, for version 2 blocks
+}
+
+// DataSize returns the size of the block's data within the image,
+// excluding the header and the trailing size for version 2 blocks
+func (b *Block) DataSize() uint64 {
+	if b.Version == 1 {
+		return b.Size()
+	}
+	return b.CompressedSize
+}
+
+// Open returns an io.Reader of the (uncompressed) contents of the block's range
+func (b *Block) Open(r io.ReaderAt) io.Reader {
+	data := io.NewSectionReader(r, b.Offset, int64(b.DataSize()))
+	if b.Version == 1 {
+		return data
+	}
+	return io.LimitReader(snappy.NewReader(data), int64(b.Size()))
+}
+
+// Index locates all blocks within the AVML image of the given size, without
+// decompressing them. For version 2 blocks, the snappy framing of the compressed
+// data is walked to find its end, which must match the trailing compressed size.
+func Index(r io.ReaderAt, size int64) ([]Block, error) {
+	var blocks []Block
+	raw := make([]byte, HeaderSize)
+	var offset int64
+	for offset < size {
+		if _, err := r.ReadAt(raw, offset); err != nil {
+			return nil, fmt.Errorf("failed to read header at offset %d: %w", offset, err)
+		}
+
+		block := Block{
+			Header: Header{
+				Magic:     binary.LittleEndian.Uint32(raw[0:]),
+				Version:   binary.LittleEndian.Uint32(raw[4:]),
+				StartAddr: binary.LittleEndian.Uint64(raw[8:]),
+				EndAddr:   binary.LittleEndian.Uint64(raw[16:]),
+			},
+			Offset: offset + int64(HeaderSize),
+		}
+		if err := block.validate(); err != nil {
+			return nil, fmt.Errorf("header at offset %d: %w", offset, err)
+		}
+
+		offset = block.Offset + int64(block.Size())
+		if block.Version == 2 {
+			compressed, err := compressedSize(r, block.Offset, block.Size())
+			if err != nil {
+				return nil, fmt.Errorf("block at offset %d: %w", block.Offset, err)
+			}
+
+			var trailer [8]byte
+			if _, err := r.ReadAt(trailer[:], block.Offset+int64(compressed)); err != nil {
+				return nil, fmt.Errorf("failed to read compressed size at offset %d: %w", block.Offset+int64(compressed), err)
+			}
+			if size := binary.LittleEndian.Uint64(trailer[:]); size != compressed {
+				return nil, fmt.Errorf("compressed size does not match at offset %d: %d != %d", block.Offset, size, compressed)
+			}
+
+			block.CompressedSize = compressed
+			offset = block.Offset + int64(compressed) + int64(len(trailer))
+		}
+
+		if offset > size {
+			return nil, fmt.Errorf("image is truncated, expected %d bytes: %w", offset, io.ErrUnexpectedEOF)
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("image is empty: %w", io.ErrUnexpectedEOF)
+	}
+
+	return blocks, nil
+}
+
+// Chunk types of the snappy framing format, see:
+// https://github.com/google/snappy/blob/main/framing_format.txt
+const (
+	chunkCompressed   = 0x00
+	chunkUncompressed = 0x01
+	chunkStreamID     = 0xff
+	chunkChecksumSize = 4
+)
+
+// compressedSize walks the chunks of the snappy framing format starting at offset until
+// the decoded size is reached, returning the size of the compressed data consumed
+func compressedSize(r io.ReaderAt, offset int64, decodedSize uint64) (uint64, error) {
+	var compressed, decoded uint64
+	// chunk header, checksum and the maximum size of the varint for the decoded length
+	buf := make([]byte, 4+chunkChecksumSize+binary.MaxVarintLen32)
+	for decoded < decodedSize {
+		n, err := r.ReadAt(buf, offset+int64(compressed))
+		if n < 4 {
+			return 0, fmt.Errorf("failed to read snappy chunk at offset %d: %w", offset+int64(compressed), err)
+		}
+
+		chunkType := buf[0]
+		chunkLen := uint64(buf[1]) | uint64(buf[2])<<8 | uint64(buf[3])<<16
+		switch {
+		case chunkType == chunkCompressed:
+			if n < 4+chunkChecksumSize+1 {
+				return 0, fmt.Errorf("truncated snappy chunk at offset %d", offset+int64(compressed))
+			}
+			length, err := snappy.DecodedLen(buf[4+chunkChecksumSize : n])
+			if err != nil {
+				return 0, fmt.Errorf("invalid snappy chunk at offset %d: %w", offset+int64(compressed), err)
+			}
+			decoded += uint64(length)
+		case chunkType == chunkUncompressed:
+			if chunkLen < chunkChecksumSize {
+				return 0, fmt.Errorf("invalid snappy chunk at offset %d", offset+int64(compressed))
+			}
+			decoded += chunkLen - chunkChecksumSize
+		case chunkType == chunkStreamID || chunkType >= 0x80:
+			// stream identifier, or skippable/padding chunks
+		default:
+			return 0, fmt.Errorf("unsupported snappy chunk type at offset %d: %#x", offset+int64(compressed), chunkType)
+		}
+
+		compressed += 4 + chunkLen
+	}
+
+	if decoded != decodedSize {
+		return 0, fmt.Errorf("decoded size does not match: %d != %d", decoded, decodedSize)
+	}
+
+	return compressed, nil
+}
@@ -0,0 +1,114 @@
+package memr
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ryandeivert/memr/avml"
+)
+
+func TestFormatAVML(t *testing.T) {
+	source := &fakeSource{ReaderAt: patternReaderAt{}}
+
+	// The second range exceeds the maximum block size, so is split
+	memRanges := MemRanges{
+		{Start: 0x1000, End: 0x4fff},
+		{Start: 0x10000, End: 0x10000 + avml.MaxBlockSize + 0x1fff},
+	}
+	options := func(r *Reader) {
+		r.memRanges = memRanges
+		r.Format = FormatAVML
+	}
+
+	image, err := ioutil.ReadAll(newTestReader(context.Background(), t, source, options))
+	if err != nil {
+		t.Fatalf("failed to read AVML image: %v", err)
+	}
+
+	expected := []avml.Header{
+		{Magic: avml.Magic, Version: 2, StartAddr: 0x1000, EndAddr: 0x4fff},
+		{Magic: avml.Magic, Version: 2, StartAddr: 0x10000, EndAddr: 0x10000 + avml.MaxBlockSize - 1},
+		{Magic: avml.Magic, Version: 2, StartAddr: 0x10000 + avml.MaxBlockSize, EndAddr: 0x10000 + avml.MaxBlockSize + 0x1fff},
+	}
+
+	decoder := avml.NewReader(bytes.NewReader(image))
+	for i, want := range expected {
+		header, err := decoder.Next()
+		if err != nil {
+			t.Fatalf("[%d] failed to read header: %v", i, err)
+		}
+		if *header != want {
+			t.Errorf("[%d] unexpected header: %+v", i, header)
+		}
+
+		data, err := ioutil.ReadAll(decoder)
+		if err != nil {
+			t.Fatalf("[%d] failed to read data: %v", i, err)
+		}
+		raw := make([]byte, header.Size())
+		patternReaderAt{}.ReadAt(raw, int64(header.StartAddr))
+		if !bytes.Equal(data, raw) {
+			t.Errorf("[%d] data does not match", i)
+		}
+	}
+	if _, err := decoder.Next(); err != io.EOF {
+		t.Errorf("expected end of image: %v", err)
+	}
+
+	// A mismatched compressed size should fail to decode
+	binary.LittleEndian.PutUint64(image[len(image)-8:], 1)
+	decoder = avml.NewReader(bytes.NewReader(image))
+	for err == nil {
+		_, err = decoder.Next()
+	}
+	if err == io.EOF {
+		t.Error("expected compressed size mismatch")
+	}
+
+	// Other headers are invalid, including version 1 headers with the AVML magic
+	for _, header := range []avml.Header{{}, {Magic: avml.Magic, Version: 1, EndAddr: 0xfff}} {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, header) //nolint:errcheck
+		_, err = avml.NewReader(&buf).Next()
+		if !errors.Is(err, avml.ErrInvalidHeader) {
+			t.Errorf("expected invalid header for %+v: %v", header, err)
+		}
+	}
+}
+
+func TestFormatAVMLVersion1(t *testing.T) {
+	// An uncompressed AVML image is a LiME image
+	source := &fakeSource{ReaderAt: patternReaderAt{}}
+	image, err := ioutil.ReadAll(newTestReader(context.Background(), t, source))
+	if err != nil {
+		t.Fatalf("failed to read LiME image: %v", err)
+	}
+
+	blocks, err := avml.Index(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatalf("failed to index image: %v", err)
+	}
+	if len(blocks) != len(testRanges) {
+		t.Fatalf("unexpected number of blocks: %d != %d", len(blocks), len(testRanges))
+	}
+	for i, block := range blocks {
+		if block.Version != 1 || block.StartAddr != testRanges[i].Start || block.EndAddr != testRanges[i].End {
+			t.Errorf("[%d] unexpected block: %+v", i, block)
+		}
+
+		data, err := ioutil.ReadAll(block.Open(bytes.NewReader(image)))
+		if err != nil {
+			t.Fatalf("[%d] failed to read data: %v", i, err)
+		}
+		raw := make([]byte, block.Size())
+		patternReaderAt{}.ReadAt(raw, int64(block.StartAddr))
+		if !bytes.Equal(data, raw) {
+			t.Errorf("[%d] data does not match", i)
+		}
+	}
+}
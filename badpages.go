@@ -0,0 +1,103 @@
+package memr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"syscall"
+)
+
+// BadPage describes a page of memory that could not be read from the
+// memory source, and was zero-filled in the output instead
+type BadPage struct {
+	Addr   uint64        // physical address of the page
+	Length uint64        // number of bytes zero-filled
+	Errno  syscall.Errno // the errno of the last failure, or 0 if unavailable
+	Err    error         // the last error encountered reading the page
+}
+
+func (b BadPage) String() string {
+	return fmt.Sprintf("addr=%d; length=%d; err=%s", b.Addr, b.Length, b.Err)
+}
+
+// badPages collects the BadPage entries recorded during a read
+type badPages struct {
+	sync.Mutex
+	pages []BadPage
+}
+
+func (b *badPages) add(page BadPage) {
+	b.Lock()
+	defer b.Unlock()
+	b.pages = append(b.pages, page)
+}
+
+func (b *badPages) list() []BadPage {
+	b.Lock()
+	defer b.Unlock()
+	return append([]BadPage(nil), b.pages...)
+}
+
+// tolerantReaderAt wraps the io.ReaderAt of a memory source, retrying any page
+// that fails to be read before zero-filling it and recording it as bad
+type tolerantReaderAt struct {
+	io.ReaderAt
+	pgsz      int
+	retries   int
+	physDelta uint64 // added to an offset to obtain its physical address
+	bad       *badPages
+}
+
+func (t *tolerantReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := t.ReaderAt.ReadAt(p, off)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	log.Printf("[DEBUG] read failed at offset %d, reading remaining pages individually: %s", off+int64(n), err)
+
+	// Read the remainder page by page, aligned to the page size
+	for n < len(p) {
+		pos := off + int64(n)
+		size := t.pgsz - int(pos%int64(t.pgsz))
+		if size > len(p)-n {
+			size = len(p) - n
+		}
+
+		c, err := t.readPage(p[n:n+size], pos)
+		n += c
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// readPage reads a single page, retrying on failure. A page that
+// still fails to be read is zero-filled and recorded as bad
+func (t *tolerantReaderAt) readPage(p []byte, off int64) (int, error) {
+	var err error
+	for i := 0; i <= t.retries; i++ {
+		var n int
+		n, err = t.ReaderAt.ReadAt(p, off)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		log.Printf("[DEBUG] failed to read page at %d (attempt %d of %d): %s", off, i+1, t.retries+1, err)
+	}
+
+	for i := range p {
+		p[i] = 0
+	}
+
+	page := BadPage{Addr: uint64(off) + t.physDelta, Length: uint64(len(p)), Err: err}
+	errors.As(err, &page.Errno)
+	t.bad.add(page)
+
+	log.Printf("[WARN] zero-filled unreadable page: %s", page)
+
+	return len(p), nil
+}
@@ -1,11 +1,17 @@
 package memr
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"os"
 	"strings"
+
+	"github.com/ryandeivert/memr/avml"
 )
 
 type blocks []*block
@@ -19,12 +25,32 @@ func (b blocks) String() string {
 }
 
 // block embeds the io.Reader used for reading actual pages of
-// memory. This will either be an io.SectionReader that reads
-// over raw memory sources (/dev/crash or /dev/mem) or extracts the
-// pages (programs) from the /proc/kcore ELF file using *elf.Prog.Open()
+// memory. This is an io.SectionReader over the SourceFile of the
+// memory source, such as raw memory sources (/dev/crash or /dev/mem)
+// or the pages (programs) within the /proc/kcore ELF file
 type block struct {
 	io.Reader
 	start, end uint64
+	source     MemSource
+	offset     uint64 // number of bytes read from the block so far
+	output     uint64 // offset of the block's memory within the output
+	ctx        context.Context
+	hasher     *Hasher // hashes the memory of the block, if Hashes are specified
+
+	// open returns the io.Reader for the memory of the block, after skipping
+	// the first skip bytes (see Reader.StartOffset)
+	open func(skip uint64) io.Reader
+}
+
+// Read satisfies the io.Reader interface, wrapping any
+// failures from the underlying reader in a *ReadError
+func (b *block) Read(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := b.Reader.Read(p)
+	b.offset += uint64(n)
+	return n, b.wrapError(err)
 }
 
 func (b *block) String() string {
@@ -35,22 +61,200 @@ func (b *block) size() uint64 {
 	return b.end - b.start
 }
 
+// sourceBlocks creates blocks for reading the ranges from the SourceFile.
+// Certain character devices (eg: /dev/crash) require reads to be
+// block-aligned, so allow reading on exact OS page size
+func (r *Reader) sourceBlocks(file io.ReaderAt, rngs []SourceRange) (blks blocks) {
+	pgsz := os.Getpagesize()
+	strictPages := pageAligned(r.source)
+	for _, rng := range r.splitRanges(rngs) {
+		end := rng.End
+		if strictPages {
+			end = end - (end % uint64(pgsz))
+		}
+		if end <= rng.Start {
+			log.Printf("[DEBUG] skipping empty range: start=%d; end=%d", rng.Start, rng.End)
+			continue
+		}
+
+		var rdrAt io.ReaderAt = file
+		if r.SkipBadPages {
+			rdrAt = &tolerantReaderAt{
+				ReaderAt:  file,
+				pgsz:      pgsz,
+				retries:   r.PageRetries,
+				physDelta: rng.Start - uint64(rng.Offset),
+				bad:       r.badPages,
+			}
+		}
+
+		offset, size := rng.Offset, int64(end-rng.Start)
+		open := func(skip uint64) io.Reader {
+			// Reads must remain page-aligned, so discard any remainder of the page
+			var discard uint64
+			if strictPages {
+				discard = skip % uint64(pgsz)
+				skip -= discard
+			}
+			var blkRdr io.Reader = io.NewSectionReader(rdrAt, offset+int64(skip), size-int64(skip))
+			if strictPages {
+				blkRdr = blockReader(r.ctx, blkRdr, pgsz)
+			}
+			return newSkipReader(blkRdr, discard)
+		}
+		blks = append(blks, &block{start: rng.Start, end: end, open: open})
+	}
+
+	return blks
+}
+
+// splitRanges splits the ranges into those of at most avml.MaxBlockSize
+// bytes when using FormatAVML, matching the blocks written by AVML
+func (r *Reader) splitRanges(rngs []SourceRange) []SourceRange {
+	if r.Format != FormatAVML {
+		return rngs
+	}
+
+	var split []SourceRange
+	for _, rng := range rngs {
+		for start := rng.Start; start < rng.End; start += avml.MaxBlockSize {
+			end := start + avml.MaxBlockSize
+			if end > rng.End {
+				end = rng.End
+			}
+			split = append(split, SourceRange{
+				Start:  start,
+				End:    end,
+				Offset: rng.Offset + int64(start-rng.Start),
+			})
+		}
+	}
+
+	return split
+}
+
 func (r *Reader) initBlockReaders(blks blocks) (io.Reader, uint64) {
 
+	// Each portion of the output is added in order, skipping
+	// any bytes before the StartOffset without opening them
 	var total uint64
 	var readers []io.Reader
+	add := func(size uint64, open func(skip uint64) io.Reader) {
+		var skip uint64
+		if r.StartOffset > total {
+			skip = r.StartOffset - total
+			if skip > size {
+				skip = size
+			}
+		}
+		total += size
+		if skip < size {
+			readers = append(readers, open(skip))
+		}
+	}
+
+	if r.Format == FormatELF {
+		prologue := r.elfPrologue(blks)
+		add(uint64(len(prologue)), func(skip uint64) io.Reader {
+			return r.bar.NewProxyReader(bytes.NewReader(prologue[skip:]))
+		})
+	}
+
+	holes := r.holes
 	for _, blk := range blks {
-		if r.PageHeaderProvider != nil {
+		blk := blk
+
+		// Holes are only present when using FormatPadded
+		if len(holes) > 0 && holes[0].end == blk.start {
+			size := holes[0].size()
+			add(size, func(skip uint64) io.Reader {
+				return r.bar.NewProxyReader(&zeroReader{n: size - skip})
+			})
+			holes = holes[1:]
+		}
+
+		blk.source = r.source
+		blk.ctx = r.ctx
+		if r.PageHeaderProvider != nil && r.Format == FormatDefault {
 			header := r.PageHeaderProvider(blk.start, blk.end)
-			total += uint64(binary.Size(header))
-			readers = append(readers, r.bar.NewProxyReader(newHeaderReader(header, r.ByteOrder)))
+			add(uint64(binary.Size(header)), func(skip uint64) io.Reader {
+				return r.bar.NewProxyReader(newSkipReader(newHeaderReader(blk, header, r.ByteOrder), skip))
+			})
 		}
 
-		total += blk.size()
-		readers = append(readers, applyPageWriter(r.bar.NewProxyReader(blk), r.PageHandler))
+		blk.output = total
+		add(blk.size(), func(skip uint64) io.Reader {
+			blk.Reader = blk.open(skip)
+			blk.offset = skip
+
+			// Only blocks read in their entirety are hashed
+			var data io.Reader = blk
+			if r.hasher != nil && skip == 0 {
+				blk.hasher, _ = NewHasher(r.Hashes...) // already validated by the reader's hasher
+				data = io.TeeReader(blk, blk.hasher)
+			}
+
+			if r.Format == FormatAVML {
+				return newAVMLReader(blk, r.bar.NewProxyReader(data))
+			}
+			return applyPageWriter(blk, r.bar.NewProxyReader(data), r.PageHandler)
+		})
 	}
 
 	log.Printf("[DEBUG] total size to be read: %d", total)
 
 	return io.MultiReader(readers...), total
 }
+
+// skipReader discards the first n bytes read from the underlying io.Reader
+type skipReader struct {
+	io.Reader
+	n uint64
+}
+
+func newSkipReader(r io.Reader, n uint64) io.Reader {
+	if n == 0 {
+		return r
+	}
+	return &skipReader{Reader: r, n: n}
+}
+
+func (s *skipReader) Read(p []byte) (int, error) {
+	if s.n > 0 {
+		if _, err := io.CopyN(ioutil.Discard, s.Reader, int64(s.n)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		s.n = 0
+	}
+	return s.Reader.Read(p)
+}
+
+// contextReader stops reading from the underlying
+// io.Reader once its context is done
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.Reader.Read(p)
+}
+
+// newPipe returns an io.Pipe whose ends are both closed with ctx.Err()
+// once the context is done, unblocking any goroutine using either end
+func newPipe(ctx context.Context) (*io.PipeReader, *io.PipeWriter) {
+	rPipe, wPipe := io.Pipe()
+	go func() {
+		<-ctx.Done()
+		rPipe.CloseWithError(ctx.Err())
+		wPipe.CloseWithError(ctx.Err())
+	}()
+
+	return rPipe, wPipe
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// compression is a stream compression format, which can be
+// detected from the magic at the start of a compressed stream
+type compression struct {
+	name         string
+	magic        []byte
+	compressor   func(io.Writer) (io.WriteCloser, error)
+	decompressor func(io.Reader) (io.ReadCloser, error)
+}
+
+var compressions = []compression{
+	{
+		name:  "snappy",
+		magic: []byte("\xff\x06\x00\x00sNaPpY"), // stream identifier chunk
+		compressor: func(w io.Writer) (io.WriteCloser, error) {
+			return snappy.NewBufferedWriter(w), nil
+		},
+		decompressor: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(snappy.NewReader(r)), nil
+		},
+	},
+	{
+		name:  "lz4",
+		magic: []byte{0x04, 0x22, 0x4d, 0x18},
+		compressor: func(w io.Writer) (io.WriteCloser, error) {
+			return lz4.NewWriter(w), nil
+		},
+		decompressor: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(lz4.NewReader(r)), nil
+		},
+	},
+	{
+		name:  "gzip",
+		magic: []byte{0x1f, 0x8b},
+		compressor: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		decompressor: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		name:  "zstd",
+		magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		compressor: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+		decompressor: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+}
+
+// compressionNames returns the names of all supported compressions
+func compressionNames() string {
+	var names []string
+	for _, c := range compressions {
+		names = append(names, c.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// lookupCompression returns the named compression, or nil for "none"
+func lookupCompression(name string) (*compression, error) {
+	if name == "none" || name == "" {
+		return nil, nil
+	}
+	for i := range compressions {
+		if compressions[i].name == name {
+			return &compressions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("invalid compression %q; must be one of: none, %s", name, compressionNames())
+}
+
+// detectCompression peeks at the start of the reader to detect its compression, if any
+func detectCompression(r *bufio.Reader) *compression {
+	for i := range compressions {
+		magic, _ := r.Peek(len(compressions[i].magic))
+		if bytes.Equal(magic, compressions[i].magic) {
+			return &compressions[i]
+		}
+	}
+	return nil
+}
+
+// decompressStream detects and removes any layers of stream compression from r as it
+// is read, without temporary files. The decompressed reader is returned, along with
+// the names of the compressions that were removed (outermost first), and a function
+// to close the decompressors.
+func decompressStream(r io.Reader) (io.Reader, []string, func(), error) {
+	var layers []string
+	var decompressors []io.Closer
+	cleanup := func() {
+		for _, decompressor := range decompressors {
+			decompressor.Close()
+		}
+	}
+
+	buffered := bufio.NewReader(r)
+	for {
+		detected := detectCompression(buffered)
+		if detected == nil {
+			return buffered, layers, cleanup, nil
+		}
+		if len(layers) == maxCompressionLayers {
+			return nil, layers, cleanup, fmt.Errorf("input has more than %d layers of compression", maxCompressionLayers)
+		}
+
+		decompressor, err := detected.decompressor(buffered)
+		if err != nil {
+			return nil, layers, cleanup, fmt.Errorf("failed to read %s compressed input: %s", detected.name, err)
+		}
+
+		decompressors = append(decompressors, decompressor)
+		layers = append(layers, detected.name)
+		buffered = bufio.NewReader(decompressor)
+	}
+}
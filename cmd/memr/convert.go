@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ryandeivert/memr"
+	"github.com/ryandeivert/memr/image"
+	"github.com/spf13/cobra"
+)
+
+// maxCompressionLayers limits the number of layers of compression
+// stripped from an input image, guarding against decompression loops
+const maxCompressionLayers = 4
+
+var (
+	convertOutput      string
+	convertFormat      = "lime"
+	convertInputFormat = "auto"
+	convertRangeMap    string
+	convertCompression = "none"
+	convertTempDir     string
+)
+
+// convertCmd converts an existing image to another format
+var convertCmd = &cobra.Command{
+	Use:   "convert <INPUT>",
+	Short: "Convert an existing image between formats",
+	Long: `Convert an existing image between formats.
+
+LiME (including uncompressed AVML images, which use LiME headers), AVML version 2
+and ELF core input images are detected automatically.
+Raw images (ranges back to back) and padded raw images must be specified using
+--input-format, along with a --range-map (optional for padded raw images).
+
+Any stream compression of the input (snappy, lz4, gzip or zstd) is detected and
+stripped first, including multiple layers, using temporary files in --temp-dir.`,
+	Example: `
+Converting a snappy compressed LiME image to an uncompressed ELF core:
+memr convert capture.lime.sz --format elf --output capture.core
+
+Converting an AVML image to a padded raw image, with sparse holes for the gaps:
+memr convert capture.avml --format padded --output capture.padded
+
+Converting a raw image to LiME, compressed with zstd:
+memr convert capture.raw --input-format raw --range-map iomem.txt --compression zstd --output capture.lime.zst`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		formatOpt, err := formatOption(convertFormat)
+		if err != nil {
+			return err
+		}
+
+		outputCompression, err := lookupCompression(convertCompression)
+		if err != nil {
+			return err
+		}
+
+		input, _, cleanup, err := stripCompression(args[0], convertTempDir)
+		defer cleanup()
+		if err != nil {
+			return fmt.Errorf("failed to decompress input: %s", err)
+		}
+
+		source, err := convertSource(input)
+		if err != nil {
+			return err
+		}
+
+		reader, err := memr.NewReaderContext(cmd.Context(), source, formatOpt, func(m *memr.Reader) {
+			m.WithProgress = progress
+		})
+		if err != nil {
+			return fmt.Errorf("failed to load image reader: %s", err)
+		}
+		defer reader.Close()
+
+		var output io.WriteCloser = os.Stdout
+		if convertOutput != "-" {
+			file, err := os.Create(convertOutput)
+			if err != nil {
+				return fmt.Errorf("failed to open output file for writing %s", err)
+			}
+			defer file.Close()
+			output = file
+		}
+
+		writer := output
+		if outputCompression != nil {
+			if writer, err = outputCompression.compressor(output); err != nil {
+				return fmt.Errorf("failed to create %s compressor: %s", outputCompression.name, err)
+			}
+		}
+
+		written, err := io.Copy(writer, reader)
+		if err != nil {
+			return fmt.Errorf("failed to convert image: %s", err)
+		}
+
+		if outputCompression != nil {
+			if err := writer.Close(); err != nil {
+				return fmt.Errorf("failed to close %s compressor: %s", outputCompression.name, err)
+			}
+		}
+
+		reader.Close()
+
+		if !reader.Format.Compressed() && reader.Size() != uint64(written) {
+			return fmt.Errorf("failed to convert all data. expected=%d; written=%d ", reader.Size(), written)
+		}
+
+		log.Printf("converted %s to %s format: %s", args[0], convertFormat, convertOutput)
+
+		return nil
+	},
+}
+
+// convertSource returns the source for reading the input image
+func convertSource(path string) (memr.MemSource, error) {
+	var memRanges memr.MemRanges
+	if convertRangeMap != "" {
+		var err error
+		if memRanges, err = readRangeMap(convertRangeMap); err != nil {
+			return nil, err
+		}
+	}
+
+	switch convertInputFormat {
+	case "auto":
+		if memRanges != nil {
+			return nil, fmt.Errorf("\"--range-map\" flag requires the \"--input-format\" flag")
+		}
+		return memr.NewImageSource(path), nil
+	case "raw":
+		if memRanges == nil {
+			return nil, fmt.Errorf("\"--range-map\" flag must be supplied for raw images")
+		}
+		return memr.NewRawImageSource(path, memRanges), nil
+	case "padded":
+		return memr.NewPaddedImageSource(path, memRanges), nil
+	}
+
+	return nil, fmt.Errorf("invalid input format %q; must be one of: %s", convertInputFormat, strings.Join(inputFormats, ", "))
+}
+
+// stripCompression detects and removes any layers of stream compression from the
+// image at path, decompressing each to a temporary file in dir. The path to the
+// decompressed image is returned, along with the names of the compressions that were
+// removed (outermost first), and a function to remove the temporary files.
+func stripCompression(path, dir string) (string, []string, func(), error) {
+	var temps, layers []string
+	cleanup := func() {
+		for _, temp := range temps {
+			os.Remove(temp)
+		}
+	}
+
+	for {
+		// The last layer allowed may itself be compressed
+		if len(layers) == maxCompressionLayers {
+			detected, err := detectFileCompression(path)
+			if err == nil && detected != nil {
+				err = fmt.Errorf("input has more than %d layers of compression", maxCompressionLayers)
+			}
+			return path, layers, cleanup, err
+		}
+
+		decompressed, name, err := decompressLayer(path, dir)
+		if err != nil || decompressed == "" {
+			return path, layers, cleanup, err
+		}
+
+		temps = append(temps, decompressed)
+		layers = append(layers, name)
+		path = decompressed
+	}
+}
+
+// detectFileCompression detects the compression of the file at path, if any
+func detectFileCompression(path string) (*compression, error) {
+	input, err := image.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	return detectCompression(bufio.NewReader(input)), nil
+}
+
+// decompressLayer decompresses the file at path to a temporary file in dir, if its
+// compression is detected. The path to the temporary file is returned along with the
+// name of the compression, or an empty path if the file is not compressed.
+func decompressLayer(path, dir string) (string, string, error) {
+	input, err := image.OpenFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer input.Close()
+
+	buffered := bufio.NewReader(input)
+	detected := detectCompression(buffered)
+	if detected == nil {
+		return "", "", nil
+	}
+
+	decompressor, err := detected.decompressor(buffered)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read %s compressed input: %s", detected.name, err)
+	}
+	defer decompressor.Close()
+
+	temp, err := ioutil.TempFile(dir, "memr-")
+	if err != nil {
+		return "", "", err
+	}
+	defer temp.Close()
+
+	log.Printf("[INFO] decompressing %s compressed input %s to %s", detected.name, path, temp.Name())
+
+	if _, err := io.Copy(temp, decompressor); err != nil {
+		os.Remove(temp.Name())
+		return "", "", fmt.Errorf("failed to decompress %s input: %s", detected.name, err)
+	}
+
+	return temp.Name(), detected.name, nil
+}
+
+func init() {
+	convertCmd.Flags().StringVarP(&convertOutput, "output", "o", convertOutput, "file to which the converted image should be written, or - for stdout")
+	convertCmd.Flags().StringVar(&convertFormat, "format", convertFormat, fmt.Sprintf("output format (one of: %s)", formatNames()))
+	convertCmd.Flags().StringVar(&convertInputFormat, "input-format", convertInputFormat, fmt.Sprintf("input format (one of: %s)", strings.Join(inputFormats, ", ")))
+	convertCmd.Flags().StringVar(&convertRangeMap, "range-map", convertRangeMap, "copy of /proc/iomem from the captured host, describing the ranges of a raw or padded input")
+	convertCmd.Flags().StringVar(&convertCompression, "compression", convertCompression, fmt.Sprintf("compression for the output (one of: none, %s)", compressionNames()))
+	convertCmd.Flags().StringVar(&convertTempDir, "temp-dir", convertTempDir, "directory for temporary files used to decompress the input (default is the system temporary directory)")
+	_ = convertCmd.MarkFlagRequired("output")
+
+	rootCmd.AddCommand(convertCmd)
+}
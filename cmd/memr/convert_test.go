@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ryandeivert/memr/image"
+)
+
+func TestConvert(t *testing.T) {
+	lime, data := writeTestLiME(t, 11, testRange{0x1000, 0x2000}, testRange{0x10000, 0x1000})
+	dir := t.TempDir()
+	rngs := []image.Range{{Start: 0x1000, End: 0x3000}, {Start: 0x10000, End: 0x11000}}
+	rangeMap := filepath.Join(dir, "iomem")
+	if err := os.WriteFile(rangeMap, []byte("00001000-00002fff : System RAM\n00010000-00010fff : System RAM\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The memory of the image, with zeros for the gap between its ranges
+	expected := append(append([]byte(nil), data[32:32+0x2000]...), make([]byte, 0xd000)...)
+	expected = append(expected, data[32+0x2000+32:]...)
+
+	open := image.Open
+	openRaw := func(path string) (*image.Image, error) { return image.OpenRaw(path, rngs) }
+	openPadded := func(path string) (*image.Image, error) { return image.OpenPadded(path, rngs) }
+
+	// Each conversion is from the image converted by a previous case
+	paths := map[string]string{"lime": lime}
+	cases := []struct {
+		name        string
+		from        string
+		args        []string
+		open        func(path string) (*image.Image, error)
+		format      image.Format
+		compression []string
+	}{
+		{"elf", "lime", []string{"--format", "elf"}, open, image.FormatELF, nil},
+		{"padded", "lime", []string{"--format", "padded"}, openPadded, image.FormatPadded, nil},
+		{"raw", "lime", []string{"--format", "raw"}, openRaw, image.FormatRaw, nil},
+		{"avml", "lime", []string{"--format", "avml"}, open, image.FormatAVML, nil},
+		{"avml to lime", "avml", []string{"--format", "lime"}, open, image.FormatLiME, nil},
+		{"raw to lime", "raw", []string{"--format", "lime", "--input-format", "raw", "--range-map", rangeMap}, open, image.FormatLiME, nil},
+		{"padded to elf", "padded", []string{"--format", "elf", "--input-format", "padded", "--range-map", rangeMap}, open, image.FormatELF, nil},
+		{"compressed", "elf", []string{"--format", "lime", "--compression", "zstd"}, open, image.FormatLiME, []string{"zstd"}},
+		{"compressed to avml", "compressed", []string{"--format", "avml", "--temp-dir", dir}, open, image.FormatAVML, nil},
+	}
+	for _, tc := range cases {
+		output := filepath.Join(dir, strings.ReplaceAll(tc.name, " ", "-"))
+		args := append([]string{"convert", paths[tc.from], "--output", output, "--progress=false"}, tc.args...)
+		if out, err := runMemr(t, args...); err != nil {
+			t.Fatalf("[%s] failed to convert image: %v; output:\n%s", tc.name, err, out)
+		}
+		paths[tc.name] = output
+
+		path, layers, cleanup, err := stripCompression(output, dir)
+		defer cleanup()
+		if err != nil {
+			t.Fatalf("[%s] failed to decompress output: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(layers, tc.compression) {
+			t.Errorf("[%s] compression: got %v; want %v", tc.name, layers, tc.compression)
+		}
+
+		img, err := tc.open(path)
+		if err != nil {
+			t.Fatalf("[%s] failed to open output: %v", tc.name, err)
+		}
+		defer img.Close()
+		if img.Format != tc.format || len(img.Ranges) != len(rngs) {
+			t.Errorf("[%s] unexpected output: format=%s; ranges=%v", tc.name, img.Format, img.Ranges)
+		}
+		for i, rng := range img.Ranges {
+			if i < len(rngs) && (rng.Start != rngs[i].Start || rng.End != rngs[i].End) {
+				t.Errorf("[%s] range %d: got %s; want %s", tc.name, i, rng, rngs[i])
+			}
+		}
+
+		var buf bytes.Buffer
+		if _, err := img.Extract(&buf, 0x1000, uint64(len(expected)), true); err != nil {
+			t.Fatalf("[%s] failed to extract memory: %v", tc.name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("[%s] memory of the output does not match the input", tc.name)
+		}
+	}
+}
+
+func TestStripCompression(t *testing.T) {
+	lime, data := writeTestLiME(t, 10, testRange{0x1000, 0x2000})
+	dir := t.TempDir()
+
+	// Up to maxCompressionLayers layers are stripped, outermost first
+	path, layers, cleanup, err := stripCompression(compressFile(t, lime, "gzip", "lz4", "zstd", "snappy"), dir)
+	defer cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"snappy", "zstd", "lz4", "gzip"}; !reflect.DeepEqual(layers, want) {
+		t.Errorf("layers: got %v; want %v", layers, want)
+	}
+	if !bytes.Equal(mustReadFile(t, path), data) {
+		t.Error("decompressed image does not match")
+	}
+
+	// Uncompressed input is used as is
+	path, layers, cleanup, err = stripCompression(lime, dir)
+	defer cleanup()
+	if err != nil || path != lime || layers != nil {
+		t.Errorf("expected uncompressed input to be used as is: %s; %v; %v", path, layers, err)
+	}
+
+	// A further layer of compression is rejected, including when decompressing a stream
+	compressed := compressFile(t, lime, "gzip", "lz4", "zstd", "snappy", "gzip")
+	_, _, cleanup, err = stripCompression(compressed, dir)
+	defer cleanup()
+	if err == nil || !strings.Contains(err.Error(), "more than 4 layers") {
+		t.Errorf("expected too many layers of compression to be rejected: %v", err)
+	}
+	_, _, closeLayers, err := decompressStream(bytes.NewReader(mustReadFile(t, compressed)))
+	defer closeLayers()
+	if err == nil || !strings.Contains(err.Error(), "more than 4 layers") {
+		t.Errorf("expected too many layers of compression to be rejected from streams: %v", err)
+	}
+}
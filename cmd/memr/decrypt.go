@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/ryandeivert/memr"
+	"github.com/ryandeivert/memr/image"
+	"github.com/spf13/cobra"
+)
+
+var (
+	decryptIdentities []string
+	decryptOutput     = "-"
+)
+
+// decryptCmd decrypts output encrypted using --encrypt-to
+var decryptCmd = &cobra.Command{
+	Use:   "decrypt <INPUT>",
+	Short: "Decrypt output encrypted using --encrypt-to",
+	Long: `Decrypt output encrypted using --encrypt-to, using the identity of any of
+its recipients. Decryption fails if the output has been modified.
+
+Identities are either files of age identities (AGE-SECRET-KEY-1...), such as those
+generated by age-keygen, or PEM encoded X25519 private keys, such as those generated
+using: openssl genpkey -algorithm x25519
+
+Any compression of the output remains, and is detected and stripped by the
+convert, info, extract and verify commands.`,
+	Example: `
+Decrypting an image using an age identity:
+memr decrypt capture.lime.sz.age --identity key.txt --output capture.lime.sz
+
+Decrypting an image to stdout using an X25519 private key:
+memr decrypt capture.lime.age --identity key.pem`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		identities, err := loadIdentities(decryptIdentities)
+		if err != nil {
+			return fmt.Errorf("failed to load identities: %s", err)
+		}
+
+		if decryptOutput != "-" {
+			// Decrypt to a temporary file alongside the output, so that a failure
+			// (eg: the wrong identity, or modified input) leaves no partial output
+			decrypted, written, err := decryptTemp(args[0], filepath.Dir(decryptOutput), identities)
+			if err != nil {
+				return err
+			}
+			if err := os.Rename(decrypted, decryptOutput); err != nil {
+				os.Remove(decrypted)
+				return fmt.Errorf("failed to write output file %s", err)
+			}
+
+			log.Printf("decrypted %d byte(s) from %s", written, args[0])
+			return nil
+		}
+
+		input, err := image.OpenFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+
+		written, err := decrypt(os.Stdout, input, identities)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("decrypted %d byte(s) from %s", written, args[0])
+
+		return nil
+	},
+}
+
+// decrypt writes the decrypted data from r to w
+func decrypt(w io.Writer, r io.Reader, identities []age.Identity) (int64, error) {
+	decrypter, err := memr.NewDecryptReader(r, identities...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrypt: %s", err)
+	}
+
+	written, err := io.Copy(w, decrypter)
+	if err != nil {
+		return written, fmt.Errorf("failed to decrypt after %d byte(s): %s", written, err)
+	}
+
+	return written, nil
+}
+
+// decryptTemp decrypts the file at path to a temporary file in dir, returning its
+// path and the number of bytes decrypted. The temporary file is removed on failure.
+func decryptTemp(path, dir string, identities []age.Identity) (string, int64, error) {
+	input, err := image.OpenFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer input.Close()
+
+	output, err := ioutil.TempFile(dir, "memr-decrypted-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer output.Close()
+
+	written, err := decrypt(output, input, identities)
+	if err == nil {
+		err = output.Close()
+	}
+	if err != nil {
+		os.Remove(output.Name())
+		return "", 0, err
+	}
+
+	return output.Name(), written, nil
+}
+
+// loadRecipients loads the recipients from each of the values, which are either
+// an age recipient (age1...), or a file of age recipients or PEM encoded X25519 public key
+func loadRecipients(values []string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, value := range values {
+		if strings.HasPrefix(value, "age1") {
+			recipient, err := age.ParseX25519Recipient(value)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, recipient)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := memr.ParseRecipients(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipients in %s: %w", value, err)
+		}
+		recipients = append(recipients, parsed...)
+	}
+
+	return recipients, nil
+}
+
+// loadIdentities loads the identities from each of the files, containing either
+// age identities or a PEM encoded X25519 private key
+func loadIdentities(paths []string) ([]age.Identity, error) {
+	var identities []age.Identity
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := memr.ParseIdentities(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identities in %s: %w", path, err)
+		}
+		identities = append(identities, parsed...)
+	}
+
+	return identities, nil
+}
+
+// recipientNames describes each of the recipients (eg: age1...)
+func recipientNames(recipients []age.Recipient) []string {
+	names := make([]string, 0, len(recipients))
+	for _, recipient := range recipients {
+		if stringer, ok := recipient.(fmt.Stringer); ok {
+			names = append(names, stringer.String())
+		} else {
+			names = append(names, fmt.Sprintf("%T", recipient))
+		}
+	}
+	return names
+}
+
+func init() {
+	decryptCmd.Flags().StringSliceVarP(&decryptIdentities, "identity", "i", decryptIdentities, "file of age identities or PEM encoded X25519 private key with which to decrypt (may be repeated)")
+	decryptCmd.Flags().StringVarP(&decryptOutput, "output", "o", decryptOutput, "file to which the decrypted output should be written, or - for stdout")
+	_ = decryptCmd.MarkFlagRequired("identity")
+
+	rootCmd.AddCommand(decryptCmd)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/ryandeivert/memr"
+)
+
+// writeIdentity writes a new age identity to a file in dir, returning its path and recipient
+func writeIdentity(t *testing.T, dir, name string) (string, age.Recipient) {
+	t.Helper()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, identity.Recipient()
+}
+
+func TestDecrypt(t *testing.T) {
+	_, data := writeTestLiME(t, 12, testRange{0x1000, 0x3000})
+	dir := t.TempDir()
+	identity, recipient := writeIdentity(t, dir, "key.txt")
+	other, _ := writeIdentity(t, dir, "other.txt")
+
+	var buf bytes.Buffer
+	w, err := memr.NewEncryptWriter(&buf, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := filepath.Join(dir, "capture.lime.age")
+	if err := os.WriteFile(encrypted, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ciphertext is authenticated, so a modified chunk fails to decrypt
+	modified := append([]byte(nil), buf.Bytes()...)
+	modified[len(modified)-100] ^= 0xff
+	tampered := filepath.Join(dir, "tampered.lime.age")
+	if err := os.WriteFile(tampered, modified, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	outputDir := t.TempDir()
+	output := filepath.Join(outputDir, "capture.lime")
+	out, err := runMemr(t, "decrypt", encrypted, "--identity", identity, "--output", output)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %v; output:\n%s", err, out)
+	}
+	if !bytes.Equal(mustReadFile(t, output), data) {
+		t.Error("decrypted output does not match")
+	}
+
+	// A failure leaves any existing output in place, and no partial output
+	cases := []struct {
+		name     string
+		input    string
+		identity string
+		err      string
+	}{
+		{"wrong identity", encrypted, other, "no identity matched any of the recipients"},
+		{"modified", tampered, identity, "failed to decrypt after"},
+	}
+	for _, tc := range cases {
+		if err := os.WriteFile(output, []byte("previous"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		out, err := runMemr(t, "decrypt", tc.input, "--identity", tc.identity, "--output", output)
+		if err == nil || !strings.Contains(out, tc.err) {
+			t.Errorf("[%s] expected error %q: %v; output:\n%s", tc.name, tc.err, err, out)
+		}
+		if got := mustReadFile(t, output); string(got) != "previous" {
+			t.Errorf("[%s] expected the existing output to be unchanged: %d byte(s)", tc.name, len(got))
+		}
+		if files, _ := ioutil.ReadDir(outputDir); len(files) != 1 {
+			t.Errorf("[%s] expected no temporary files to remain: %d file(s)", tc.name, len(files))
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ryandeivert/memr/image"
+	"github.com/spf13/cobra"
+)
+
+var (
+	extractPhys        string
+	extractLen         string
+	extractOutput      = "-"
+	extractStrict      bool
+	extractInputFormat = "auto"
+	extractRangeMap    string
+	extractTempDir     string
+)
+
+// extractCmd writes a range of physical memory from an existing image
+var extractCmd = &cobra.Command{
+	Use:   "extract <IMAGE>",
+	Short: "Extract a range of physical memory from an existing image",
+	Long: `Extract a range of physical memory from an existing image, writing it raw.
+
+Addresses that are not within any range of the image (eg: gaps between ranges)
+are written as zeros, unless --strict is supplied, in which case extraction fails.
+
+Any stream compression of the image (snappy, lz4, gzip or zstd) is detected and
+removed as the image is read. Compressed LiME, padded and raw images are read
+sequentially up to the end of the range, without temporary files. Compressed AVML
+and ELF images must be read at random, so are first decompressed to temporary
+files in --temp-dir.`,
+	Example: `
+Extracting 16 MiB starting at physical address 0x1000000 to stdout:
+memr extract capture.lime --phys 0x1000000 --len 16M
+
+Extracting a single page from an AVML image to a file, failing if it is not captured:
+memr extract capture.avml --phys 0x7ffff000 --len 4K --strict --output page.raw`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		addr, err := parseNumber(extractPhys)
+		if err != nil {
+			return fmt.Errorf("invalid physical address %q: %s", extractPhys, err)
+		}
+
+		length, err := parseSize(extractLen)
+		if err != nil {
+			return fmt.Errorf("invalid length %q: %s", extractLen, err)
+		}
+
+		input, err := image.OpenFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+
+		decompressed, layers, closeLayers, err := decompressStream(input)
+		defer closeLayers()
+		if err != nil {
+			return fmt.Errorf("failed to decompress input: %s", err)
+		}
+
+		// Compressed LiME, padded and raw images are read sequentially as they are
+		// decompressed, while other images must be decompressed to a temporary file
+		var extract func(io.Writer) (int64, error)
+		if len(layers) > 0 {
+			stream, err := openStream(decompressed, extractInputFormat, extractRangeMap)
+			switch {
+			case err == nil:
+				extract = func(w io.Writer) (int64, error) {
+					return stream.Extract(w, addr, length, !extractStrict)
+				}
+			case errors.Is(err, image.ErrRandomAccess):
+				log.Printf("[INFO] %s", err)
+			default:
+				return fmt.Errorf("failed to open image %s: %s", args[0], err)
+			}
+		}
+
+		if extract == nil {
+			path, _, cleanup, err := stripCompression(args[0], extractTempDir)
+			defer cleanup()
+			if err != nil {
+				return fmt.Errorf("failed to decompress input: %s", err)
+			}
+
+			img, err := openImage(path, extractInputFormat, extractRangeMap, false)
+			if err != nil {
+				return err
+			}
+			defer img.Close()
+
+			extract = func(w io.Writer) (int64, error) {
+				return img.Extract(w, addr, length, !extractStrict)
+			}
+		}
+
+		var output io.WriteCloser = os.Stdout
+		if extractOutput != "-" {
+			file, err := os.Create(extractOutput)
+			if err != nil {
+				return fmt.Errorf("failed to open output file for writing %s", err)
+			}
+			defer file.Close()
+			output = file
+		}
+
+		written, err := extract(output)
+		if err != nil {
+			return fmt.Errorf("failed to extract range after %d byte(s): %s", written, err)
+		}
+
+		log.Printf("extracted %d byte(s) starting at %#x from %s", written, addr, args[0])
+
+		return nil
+	},
+}
+
+// parseSize parses a size in bytes as a decimal or hex value (see parseNumber), with
+// an optional binary unit suffix for decimal values (eg: 4K, 16M, 16MiB or 1G)
+func parseSize(value string) (uint64, error) {
+	multiplier := uint64(1)
+	if !strings.HasPrefix(strings.ToLower(value), "0x") {
+		trimmed := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(value), "B"), "I")
+		if n := len(trimmed); n > 0 {
+			if idx := strings.IndexByte("KMGT", trimmed[n-1]); idx >= 0 {
+				multiplier = 1 << (10 * uint(idx+1))
+				value = trimmed[:n-1]
+			}
+		}
+	}
+
+	size, err := parseNumber(value)
+	if err != nil {
+		return 0, err
+	}
+	if size*multiplier/multiplier != size {
+		return 0, fmt.Errorf("size overflows")
+	}
+
+	return size * multiplier, nil
+}
+
+// parseNumber parses a hex value with an explicit 0x prefix, or a decimal value otherwise.
+// Unlike strconv's base prefixes, leading zeros do not make a value octal (eg: 010 is 10).
+func parseNumber(value string) (uint64, error) {
+	if len(value) > 2 && strings.EqualFold(value[:2], "0x") {
+		return strconv.ParseUint(value[2:], 16, 64)
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func init() {
+	extractCmd.Flags().StringVar(&extractPhys, "phys", extractPhys, "physical address at which to start, in decimal or hex with a 0x prefix (eg: 0x1000000)")
+	extractCmd.Flags().StringVar(&extractLen, "len", extractLen, "number of bytes to extract, optionally with a unit (eg: 4096, 4K or 16M)")
+	extractCmd.Flags().StringVarP(&extractOutput, "output", "o", extractOutput, "file to which the range should be written, or - for stdout")
+	extractCmd.Flags().BoolVar(&extractStrict, "strict", extractStrict, "fail if any address is not within a range of the image, instead of zero-filling it")
+	extractCmd.Flags().StringVar(&extractInputFormat, "input-format", extractInputFormat, fmt.Sprintf("input format (one of: %s)", strings.Join(inputFormats, ", ")))
+	extractCmd.Flags().StringVar(&extractRangeMap, "range-map", extractRangeMap, "copy of /proc/iomem from the captured host, describing the ranges of a raw or padded image")
+	extractCmd.Flags().StringVar(&extractTempDir, "temp-dir", extractTempDir, "directory for temporary files used to decompress AVML and ELF images (default is the system temporary directory)")
+	_ = extractCmd.MarkFlagRequired("phys")
+	_ = extractCmd.MarkFlagRequired("len")
+
+	rootCmd.AddCommand(extractCmd)
+}
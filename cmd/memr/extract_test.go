@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compressFile compresses the file at path with each of the compressions in turn,
+// returning the path to the compressed file
+func compressFile(t *testing.T, path string, names ...string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		c, err := lookupCompression(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		w, err := c.compressor(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data = buf.Bytes()
+		path += "." + name
+	}
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExtractCompressed(t *testing.T) {
+	lime, data := writeTestLiME(t, 5, testRange{0x1000, 0x3000}, testRange{0x10000, 0x2000})
+	dir := t.TempDir()
+
+	// From the middle of the first range, across the gap, to the middle of the second
+	expected := append(append([]byte(nil), data[32+0x2000:32+0x3000]...), make([]byte, 0xc000)...)
+	expected = append(expected, data[32+0x3000+32:32+0x3000+32+0x1000]...)
+
+	avml := filepath.Join(dir, "image.avml")
+	if out, err := runMemr(t, "convert", lime, "--format", "avml", "--output", avml); err != nil {
+		t.Fatalf("failed to convert image: %v; output:\n%s", err, out)
+	}
+
+	// Compressed LiME images are read as they are decompressed, so the temporary
+	// directory is never used, while AVML images must be decompressed to it first
+	missing := filepath.Join(dir, "missing")
+	cases := []struct {
+		name    string
+		path    string
+		tempDir string
+		err     string
+	}{
+		{"lime", compressFile(t, lime, "gzip"), missing, ""},
+		{"lime layers", compressFile(t, lime, "snappy", "zstd"), missing, ""},
+		{"avml", compressFile(t, avml, "lz4"), dir, ""},
+		{"avml without temp dir", compressFile(t, avml, "lz4"), missing, "failed to decompress input"},
+	}
+	for _, tc := range cases {
+		output := filepath.Join(dir, "output.raw")
+		out, err := runMemr(t, "extract", tc.path, "--phys", "0x3000", "--len", "0xe000", "--temp-dir", tc.tempDir, "--output", output)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(out, tc.err) {
+				t.Errorf("[%s] expected error %q: %v; output:\n%s", tc.name, tc.err, err, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[%s] failed to extract: %v; output:\n%s", tc.name, err, out)
+		}
+		if got := mustReadFile(t, output); !bytes.Equal(got, expected) {
+			t.Errorf("[%s] extracted %d byte(s) not matching the %d expected", tc.name, len(got), len(expected))
+		}
+	}
+
+	// Strict extraction fails at the gap
+	out, err := runMemr(t, "extract", compressFile(t, lime, "gzip"), "--phys", "0x3000", "--len", "0xe000", "--strict", "--output", filepath.Join(dir, "strict.raw"))
+	if err == nil || !strings.Contains(out, "after 4096 byte(s)") {
+		t.Errorf("expected strict extraction to fail at the gap: %v; output:\n%s", err, out)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	valid := map[string]uint64{
+		"4096":   4096,
+		"010":    10,
+		"0x1000": 0x1000,
+		"0X10":   0x10,
+		"4K":     4 << 10,
+		"16MiB":  16 << 20,
+		"16mb":   16 << 20,
+		"1G":     1 << 30,
+	}
+	for value, want := range valid {
+		got, err := parseSize(value)
+		if err != nil || got != want {
+			t.Errorf("%q: got %d (%v); want %d", value, got, err, want)
+		}
+	}
+
+	// Only hex has a prefix, so octal, binary and digit separators are rejected, and hex has no units
+	for _, value := range []string{"0o10", "0b101", "1_000", "0x", "0x10M", "", "K", "-1", "16E", "0x10000000000000000", "16777216T"} {
+		if got, err := parseSize(value); err == nil {
+			t.Errorf("%q: expected an error, got %d", value, got)
+		}
+	}
+}
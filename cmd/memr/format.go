@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ryandeivert/memr"
+)
+
+// outputFormat is a value of the --format flag, along with
+// the option applied to the reader to produce the format
+type outputFormat struct {
+	name   string
+	option func(*memr.Reader)
+}
+
+var outputFormats = []outputFormat{
+	{"lime", func(m *memr.Reader) {
+		m.Format = memr.FormatDefault
+		m.PageHeaderProvider = memr.HeaderLime
+	}},
+	{"raw", func(m *memr.Reader) {
+		m.Format = memr.FormatDefault
+		m.PageHeaderProvider = nil
+	}},
+	{"elf", func(m *memr.Reader) {
+		m.Format = memr.FormatELF
+	}},
+	{"padded", func(m *memr.Reader) {
+		m.Format = memr.FormatPadded
+	}},
+	{"avml", func(m *memr.Reader) {
+		m.Format = memr.FormatAVML
+	}},
+}
+
+// formatNames returns the names of all supported output formats
+func formatNames() string {
+	var names []string
+	for _, format := range outputFormats {
+		names = append(names, format.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// formatOption returns the reader option for the named output format
+func formatOption(name string) (func(*memr.Reader), error) {
+	for _, format := range outputFormats {
+		if format.name == name {
+			return format.option, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid format %q; must be one of: %s", name, formatNames())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ryandeivert/memr/image"
+)
+
+var inputFormats = []string{"auto", "raw", "padded"}
+
+// openImage opens the image at path using the input format (auto, raw or padded),
+// where raw and padded images are described by the ranges of the range map. If
+// inspect is true, images with anomalies are opened instead of being rejected.
+func openImage(path, inputFormat, rangeMap string, inspect bool) (*image.Image, error) {
+	rngs, err := imageRanges(rangeMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return openImageRanges(path, inputFormat, rngs, inspect)
+}
+
+// openStream opens the image read sequentially from r using the input format, like
+// openImage. An error wrapping image.ErrRandomAccess is returned for AVML and ELF
+// images, which must be opened using openImage instead.
+func openStream(r io.Reader, inputFormat, rangeMap string) (*image.Stream, error) {
+	rngs, err := imageRanges(rangeMap)
+	if err != nil {
+		return nil, err
+	}
+
+	switch inputFormat {
+	case "auto":
+		if rngs != nil {
+			return nil, fmt.Errorf("\"--range-map\" flag requires the \"--input-format\" flag")
+		}
+		return image.NewStream(r)
+	case "raw":
+		if rngs == nil {
+			return nil, fmt.Errorf("\"--range-map\" flag must be supplied for raw images")
+		}
+		return image.NewRawStream(r, rngs)
+	case "padded":
+		return image.NewPaddedStream(r, rngs)
+	}
+
+	return nil, fmt.Errorf("invalid input format %q; must be one of: %s", inputFormat, strings.Join(inputFormats, ", "))
+}
+
+// imageRanges reads the ranges of the range map, if any, describing a raw or padded image
+func imageRanges(rangeMap string) ([]image.Range, error) {
+	if rangeMap == "" {
+		return nil, nil
+	}
+
+	memRanges, err := readRangeMap(rangeMap)
+	if err != nil {
+		return nil, err
+	}
+
+	var rngs []image.Range
+	for _, rng := range memRanges {
+		rngs = append(rngs, image.Range{Start: rng.Start, End: rng.End + 1}) // iomem ranges are inclusive
+	}
+
+	return rngs, nil
+}
+
+// openImageRanges opens the image at path using the input format, where raw and
+// padded images are described by rngs (which may only be nil for padded images)
+func openImageRanges(path, inputFormat string, rngs []image.Range, inspect bool) (*image.Image, error) {
+	switch inputFormat {
+	case "auto":
+		if rngs != nil {
+			return nil, fmt.Errorf("\"--range-map\" flag requires the \"--input-format\" flag")
+		}
+		if inspect {
+			return image.InspectFile(path)
+		}
+		return image.Open(path)
+	case "raw":
+		if rngs == nil {
+			return nil, fmt.Errorf("\"--range-map\" flag must be supplied for raw images")
+		}
+		return image.OpenRaw(path, rngs)
+	case "padded":
+		return image.OpenPadded(path, rngs)
+	}
+
+	return nil, fmt.Errorf("invalid input format %q; must be one of: %s", inputFormat, strings.Join(inputFormats, ", "))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ryandeivert/memr/image"
+	"github.com/spf13/cobra"
+)
+
+var (
+	infoInputFormat = "auto"
+	infoRangeMap    string
+	infoTempDir     string
+	infoJSON        bool
+)
+
+// infoCmd describes an existing image
+var infoCmd = &cobra.Command{
+	Use:   "info <IMAGE>",
+	Short: "Describe an existing image",
+	Long: `Describe an existing image, including its format, header version and byte order,
+each of its ranges, the total memory covered, any gaps between ranges, and any
+anomalies found in its headers (eg: unsorted or overlapping ranges, or end
+addresses that are off by one).
+
+Any stream compression of the image (snappy, lz4, gzip or zstd) is detected
+and stripped first, using temporary files in --temp-dir.`,
+	Example: `
+Describing a LiME image:
+memr info capture.lime
+
+Describing a compressed AVML image as JSON:
+memr info capture.avml.zst --json`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		input, layers, cleanup, err := stripCompression(args[0], infoTempDir)
+		defer cleanup()
+		if err != nil {
+			return fmt.Errorf("failed to decompress input: %s", err)
+		}
+
+		img, err := openImage(input, infoInputFormat, infoRangeMap, true)
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+
+		rpt := newInfoReport(args[0], img)
+		rpt.Compression = append(rpt.Compression, layers...)
+
+		if infoJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(rpt)
+		}
+
+		return rpt.print(os.Stdout)
+	},
+}
+
+// infoReport describes an image, and is written as JSON when using --json.
+// The end addresses of ranges and gaps are exclusive, and the image size
+// is that of the image after any compression is removed.
+type infoReport struct {
+	Image       string        `json:"image"`
+	Compression []string      `json:"compression"`
+	Format      string        `json:"format"`
+	Versions    []uint32      `json:"versions"`
+	ByteOrder   string        `json:"byte_order,omitempty"`
+	ImageSize   int64         `json:"image_size"`
+	Total       uint64        `json:"total"`
+	Ranges      []rangeInfo   `json:"ranges"`
+	Gaps        []rangeReport `json:"gaps"`
+	Anomalies   []string      `json:"anomalies"`
+}
+
+type rangeInfo struct {
+	Start      uint64 `json:"start"`
+	End        uint64 `json:"end"`
+	Size       uint64 `json:"size"`
+	Offset     int64  `json:"offset"`
+	Compressed uint64 `json:"compressed,omitempty"`
+}
+
+func newInfoReport(path string, img *image.Image) *infoReport {
+	rpt := &infoReport{
+		Image:       path,
+		Compression: []string{},
+		Format:      img.Format.String(),
+		Versions:    []uint32{},
+		ImageSize:   img.FileSize(),
+		Total:       img.Size(),
+		Ranges:      []rangeInfo{},
+		Gaps:        []rangeReport{},
+		Anomalies:   []string{},
+	}
+
+	switch img.ByteOrder {
+	case binary.LittleEndian:
+		rpt.ByteOrder = "little"
+	case binary.BigEndian:
+		rpt.ByteOrder = "big"
+	}
+
+	versions := make(map[uint32]bool)
+	for _, rng := range img.Ranges {
+		if rng.Version != 0 && !versions[rng.Version] {
+			versions[rng.Version] = true
+			rpt.Versions = append(rpt.Versions, rng.Version)
+		}
+		rpt.Ranges = append(rpt.Ranges, rangeInfo{
+			Start:      rng.Start,
+			End:        rng.End,
+			Size:       rng.Size(),
+			Offset:     rng.Offset,
+			Compressed: rng.Compressed,
+		})
+	}
+	sort.Slice(rpt.Versions, func(i, j int) bool { return rpt.Versions[i] < rpt.Versions[j] })
+
+	for _, gap := range img.Gaps() {
+		rpt.Gaps = append(rpt.Gaps, rangeReport{Start: gap.Start, End: gap.End})
+	}
+	rpt.Anomalies = append(rpt.Anomalies, img.Anomalies...)
+
+	return rpt
+}
+
+func (i *infoReport) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	compression := "none"
+	if len(i.Compression) > 0 {
+		compression = strings.Join(i.Compression, ", ")
+	}
+	versions := "n/a"
+	if len(i.Versions) > 0 {
+		var strs []string
+		for _, v := range i.Versions {
+			strs = append(strs, fmt.Sprint(v))
+		}
+		versions = strings.Join(strs, ", ")
+	}
+	byteOrder := "n/a"
+	if i.ByteOrder != "" {
+		byteOrder = i.ByteOrder + " endian"
+	}
+
+	fmt.Fprintf(tw, "Image:\t%s\n", i.Image)
+	fmt.Fprintf(tw, "Compression:\t%s\n", compression)
+	fmt.Fprintf(tw, "Format:\t%s\n", i.Format)
+	fmt.Fprintf(tw, "Version:\t%s\n", versions)
+	fmt.Fprintf(tw, "Byte order:\t%s\n", byteOrder)
+	fmt.Fprintf(tw, "Image size:\t%d (%s)\n", i.ImageSize, humanSize(uint64(i.ImageSize)))
+	fmt.Fprintf(tw, "Total memory:\t%d (%s)\n", i.Total, humanSize(i.Total))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nRanges (%d):\n", len(i.Ranges))
+	fmt.Fprintln(tw, "  START\tEND\tSIZE\tOFFSET")
+	for _, rng := range i.Ranges {
+		fmt.Fprintf(tw, "  %#016x\t%#016x\t%d (%s)\t%d\n", rng.Start, rng.End-1, rng.Size, humanSize(rng.Size), rng.Offset)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nGaps (%d):\n", len(i.Gaps))
+	for _, gap := range i.Gaps {
+		fmt.Fprintf(tw, "  %#016x\t%#016x\t%d (%s)\n", gap.Start, gap.End-1, gap.End-gap.Start, humanSize(gap.End-gap.Start))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nAnomalies (%d):\n", len(i.Anomalies))
+	for _, anomaly := range i.Anomalies {
+		fmt.Fprintf(w, "  %s\n", anomaly)
+	}
+
+	return nil
+}
+
+// humanSize formats the size using binary units (eg: 16.0 MiB)
+func humanSize(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	// Use the next unit when rounding would show 1024.0 of this one
+	if value := float64(size) / float64(div); value >= unit-0.05 && exp < 5 {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func init() {
+	infoCmd.Flags().StringVar(&infoInputFormat, "input-format", infoInputFormat, fmt.Sprintf("input format (one of: %s)", strings.Join(inputFormats, ", ")))
+	infoCmd.Flags().StringVar(&infoRangeMap, "range-map", infoRangeMap, "copy of /proc/iomem from the captured host, describing the ranges of a raw or padded image")
+	infoCmd.Flags().StringVar(&infoTempDir, "temp-dir", infoTempDir, "directory for temporary files used to decompress the image (default is the system temporary directory)")
+	infoCmd.Flags().BoolVar(&infoJSON, "json", infoJSON, "write the description as JSON")
+
+	rootCmd.AddCommand(infoCmd)
+}
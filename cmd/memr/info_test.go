@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ryandeivert/memr/internal/ranges"
+)
+
+// limeBlock is a block of a LiME image written by writeLiMEBlocks, whose
+// header holds the end address as given (inclusive, unless off by one)
+type limeBlock struct {
+	start, end, size uint64
+}
+
+// writeLiMEBlocks writes a LiME image of the blocks using the byte order to a file
+// in a temporary directory, returning its path
+func writeLiMEBlocks(t *testing.T, ord binary.ByteOrder, blocks ...limeBlock) string {
+	t.Helper()
+
+	var data []byte
+	for _, block := range blocks {
+		header := make([]byte, 32)
+		ord.PutUint32(header[0:], ranges.LiMEMagic)
+		ord.PutUint32(header[4:], 1)
+		ord.PutUint64(header[8:], block.start)
+		ord.PutUint64(header[16:], block.end)
+		data = append(data, header...)
+		data = append(data, randomData(int(block.size))...)
+	}
+
+	path := filepath.Join(t.TempDir(), "image.lime")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestInfo(t *testing.T) {
+	gap := writeLiMEBlocks(t, binary.LittleEndian, limeBlock{0x1000, 0x2fff, 0x2000}, limeBlock{0x10000, 0x10fff, 0x1000})
+
+	cases := []struct {
+		name        string
+		path        string
+		compression []string
+		byteOrder   string
+		ranges      []rangeInfo
+		gaps        []rangeReport
+		anomalies   []string
+	}{
+		{
+			name: "gap", path: gap, compression: []string{}, byteOrder: "little",
+			ranges: []rangeInfo{{Start: 0x1000, End: 0x3000, Size: 0x2000, Offset: 32}, {Start: 0x10000, End: 0x11000, Size: 0x1000, Offset: 0x2040}},
+			gaps:   []rangeReport{{Start: 0x3000, End: 0x10000}},
+		},
+		{
+			name: "compressed", path: compressFile(t, gap, "gzip"), compression: []string{"gzip"}, byteOrder: "little",
+			ranges: []rangeInfo{{Start: 0x1000, End: 0x3000, Size: 0x2000, Offset: 32}, {Start: 0x10000, End: 0x11000, Size: 0x1000, Offset: 0x2040}},
+			gaps:   []rangeReport{{Start: 0x3000, End: 0x10000}},
+		},
+		{
+			name: "off by one", compression: []string{}, byteOrder: "little",
+			path:      writeLiMEBlocks(t, binary.LittleEndian, limeBlock{0x1000, 0x3000, 0x2000}, limeBlock{0x3000, 0x3fff, 0x1000}),
+			ranges:    []rangeInfo{{Start: 0x1000, End: 0x3000, Size: 0x2000, Offset: 32}, {Start: 0x3000, End: 0x4000, Size: 0x1000, Offset: 0x2040}},
+			gaps:      []rangeReport{},
+			anomalies: []string{"header end address is exclusive, rather than inclusive (off by one): start=4096; end=12288; offset=32"},
+		},
+		{
+			name: "unsorted and overlapping", compression: []string{}, byteOrder: "big",
+			path: writeLiMEBlocks(t, binary.BigEndian, limeBlock{0x10000, 0x10fff, 0x1000}, limeBlock{0x1000, 0x1fff, 0x1000}, limeBlock{0x1800, 0x27ff, 0x1000}),
+			ranges: []rangeInfo{
+				{Start: 0x10000, End: 0x11000, Size: 0x1000, Offset: 32},
+				{Start: 0x1000, End: 0x2000, Size: 0x1000, Offset: 0x1040},
+				{Start: 0x1800, End: 0x2800, Size: 0x1000, Offset: 0x2060},
+			},
+			gaps: []rangeReport{{Start: 0x2800, End: 0x10000}},
+			anomalies: []string{
+				"range is out of order: start=4096; end=8192; offset=4160 follows start=65536; end=69632; offset=32",
+				"range overlaps the previous range: start=6144; end=10240; offset=8288 overlaps start=4096; end=8192; offset=4160",
+			},
+		},
+	}
+	for _, tc := range cases {
+		out, err := runMemr(t, "info", tc.path, "--json", "--temp-dir", t.TempDir())
+		if err != nil {
+			t.Fatalf("[%s] failed to describe image: %v; output:\n%s", tc.name, err, out)
+		}
+		var rpt infoReport
+		if err := json.Unmarshal([]byte(out), &rpt); err != nil {
+			t.Fatalf("[%s] invalid report: %v\n%s", tc.name, err, out)
+		}
+
+		if tc.anomalies == nil {
+			tc.anomalies = []string{}
+		}
+		if rpt.Format != "lime" || !reflect.DeepEqual(rpt.Versions, []uint32{1}) || rpt.ByteOrder != tc.byteOrder {
+			t.Errorf("[%s] format=%s; versions=%v; byte order=%s", tc.name, rpt.Format, rpt.Versions, rpt.ByteOrder)
+		}
+		if !reflect.DeepEqual(rpt.Compression, tc.compression) {
+			t.Errorf("[%s] compression: got %v; want %v", tc.name, rpt.Compression, tc.compression)
+		}
+		if !reflect.DeepEqual(rpt.Ranges, tc.ranges) {
+			t.Errorf("[%s] ranges: got %+v; want %+v", tc.name, rpt.Ranges, tc.ranges)
+		}
+		if !reflect.DeepEqual(rpt.Gaps, tc.gaps) {
+			t.Errorf("[%s] gaps: got %+v; want %+v", tc.name, rpt.Gaps, tc.gaps)
+		}
+		if !reflect.DeepEqual(rpt.Anomalies, tc.anomalies) {
+			t.Errorf("[%s] anomalies: got %q; want %q", tc.name, rpt.Anomalies, tc.anomalies)
+		}
+		var total uint64
+		for _, rng := range tc.ranges {
+			total += rng.Size
+		}
+		if rpt.Total != total {
+			t.Errorf("[%s] total: got %d; want %d", tc.name, rpt.Total, total)
+		}
+	}
+
+	// The same description, as text
+	out, err := runMemr(t, "info", gap)
+	if err != nil {
+		t.Fatalf("failed to describe image: %v; output:\n%s", err, out)
+	}
+	for _, want := range []string{"Format:        lime", "Byte order:    little endian", "Total memory:  12288 (12.0 KiB)", "Ranges (2):", "Gaps (1):", "0x0000000000003000  0x000000000000ffff  53248 (52.0 KiB)", "Anomalies (0):"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in description:\n%s", want, out)
+		}
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	cases := map[uint64]string{
+		0:             "0 B",
+		1023:          "1023 B",
+		1024:          "1.0 KiB",
+		1536:          "1.5 KiB",
+		1<<20 - 1:     "1.0 MiB",
+		1 << 20:       "1.0 MiB",
+		1<<30 - 1<<20: "1023.0 MiB",
+		1 << 30:       "1.0 GiB",
+		1 << 40:       "1.0 TiB",
+		1 << 50:       "1.0 PiB",
+		1 << 60:       "1.0 EiB",
+		1<<64 - 1:     "16.0 EiB",
+	}
+	for size, want := range cases {
+		if got := humanSize(size); got != want {
+			t.Errorf("%d: got %q; want %q", size, got, want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ryandeivert/memr"
+)
+
+// TestMain runs the CLI instead of the tests when MEMR_TEST_MAIN is set, so that tests can
+// run memr as a separate process (see runMemr), each with its own flags and state
+func TestMain(m *testing.M) {
+	if os.Getenv("MEMR_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMemr runs memr with the args in a new process, returning its output
+func runMemr(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(),
+		"MEMR_TEST_MAIN=1",
+		"AWS_ACCESS_KEY_ID=test",
+		"AWS_SECRET_ACCESS_KEY=test",
+		"AWS_EC2_METADATA_DISABLED=true",
+		"AWS_CONFIG_FILE="+filepath.Join(t.TempDir(), "config"),
+		"AWS_SHARED_CREDENTIALS_FILE="+filepath.Join(t.TempDir(), "credentials"),
+	)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// testRange is a range of memory in an image written by writeTestLiME
+type testRange struct {
+	start, size uint64
+}
+
+// writeTestLiME writes a LiME image of the ranges filled with random
+// (incompressible) data to a file in a temporary directory, returning its path and content
+func writeTestLiME(t *testing.T, seed int64, rngs ...testRange) (string, []byte) {
+	t.Helper()
+
+	random := rand.New(rand.NewSource(seed)) //nolint:gosec
+	var data []byte
+	for _, rng := range rngs {
+		header := memr.HeaderLime(rng.start, rng.start+rng.size).(*memr.DefaultHeader)
+		data = append(data, make([]byte, binary.Size(header))...)
+		buf := data[len(data)-binary.Size(header):]
+		binary.LittleEndian.PutUint32(buf[0:], header.Magic)
+		binary.LittleEndian.PutUint32(buf[4:], header.Version)
+		binary.LittleEndian.PutUint64(buf[8:], header.StartAddr)
+		binary.LittleEndian.PutUint64(buf[16:], header.EndAddr)
+
+		content := make([]byte, rng.size)
+		random.Read(content)
+		data = append(data, content...)
+	}
+
+	path := filepath.Join(t.TempDir(), "image.lime")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, data
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/ryandeivert/memr"
+)
+
+// signatureAlgorithm is the only algorithm used to sign manifests
+const signatureAlgorithm = "ed25519"
+
+// manifest describes an acquisition, including the hashes of the image and
+// each of its ranges, and is written as JSON to the file specified with --manifest
+type manifest struct {
+	MemrVersion   string          `json:"memr_version"`
+	Source        string          `json:"source"`
+	RangeProvider string          `json:"range_provider,omitempty"`
+	Format        string          `json:"format"`
+	Size          uint64          `json:"size"`
+	Output        string          `json:"output"`
+	OutputSize    int64           `json:"output_size"` // bytes written to the output
+	Compression   string          `json:"compression,omitempty"`
+	Encryption    string          `json:"encryption,omitempty"`
+	Recipients    []string        `json:"recipients,omitempty"`
+	Image         *digest         `json:"image,omitempty"`         // output of the reader, before any compression
+	OutputStream  *digest         `json:"output_stream,omitempty"` // data written to the output, after any compression
+	Ranges        []rangeDigest   `json:"ranges"`
+	MemoryRanges  []rangeReport   `json:"memory_ranges,omitempty"` // ranges of system RAM (inclusive)
+	Timings       timings         `json:"timings"`
+	Resumes       []resumeReport  `json:"resumes,omitempty"` // gaps in time after interrupted uploads
+	Host          hostInfo        `json:"host"`
+	KernelInfo    *kernelReport   `json:"kernel_info,omitempty"`
+	MissingRanges []rangeReport   `json:"missing_ranges"`
+	BadPages      []badPageReport `json:"bad_pages"`
+	Signature     *signature      `json:"signature,omitempty"`
+}
+
+type digest struct {
+	Size   uint64               `json:"size"`
+	Hashes map[memr.Hash]string `json:"hashes"`
+}
+
+type rangeDigest struct {
+	Start  uint64               `json:"start"`
+	End    uint64               `json:"end"` // exclusive
+	Size   uint64               `json:"size"`
+	Hashes map[memr.Hash]string `json:"hashes,omitempty"` // omitted if read before an upload was resumed
+}
+
+type timings struct {
+	Started   time.Time `json:"started"`
+	Completed time.Time `json:"completed"`
+	Duration  float64   `json:"duration_seconds"`
+}
+
+// resumeReport describes the resumption of an interrupted upload (see --resume-state).
+// Memory is likely to have changed between the output before and after the offset.
+type resumeReport struct {
+	Offset      uint64    `json:"offset"` // offset in the image at which reading resumed
+	Interrupted time.Time `json:"interrupted"`
+	Resumed     time.Time `json:"resumed"`
+	Gap         float64   `json:"gap_seconds"`
+}
+
+type hostInfo struct {
+	Hostname      string `json:"hostname"`
+	KernelRelease string `json:"kernel_release,omitempty"`
+	Arch          string `json:"arch"`
+}
+
+// signature is the ed25519 signature of the manifest, computed over its canonical
+// JSON encoding (see canonicalManifest), and included in the manifest itself
+type signature struct {
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"` // base64 encoded
+	Value     string `json:"value"`      // base64 encoded
+}
+
+type kernelReport struct {
+	OSRelease  string            `json:"os_release,omitempty"`
+	Notes      []noteReport      `json:"notes"`
+	VMCoreInfo map[string]string `json:"vmcoreinfo,omitempty"`
+}
+
+type noteReport struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int    `json:"size"`
+}
+
+type rangeReport struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+type badPageReport struct {
+	Addr   uint64 `json:"addr"`
+	Length uint64 `json:"length"`
+	Errno  int    `json:"errno"`
+	Error  string `json:"error"`
+}
+
+func newManifest(reader *memr.Reader, output string) *manifest {
+	m := &manifest{
+		MemrVersion:   version,
+		Source:        reader.Source().String(),
+		RangeProvider: reader.RangeProvider(),
+		Format:        reader.Format.String(),
+		Size:          reader.Size(),
+		Output:        output,
+		Ranges:        []rangeDigest{},
+		Host:          currentHost(),
+		MissingRanges: []rangeReport{},
+		BadPages:      []badPageReport{},
+	}
+
+	if sums := reader.ImageHashes(); sums != nil {
+		// The size of the output is not known up front for compressed formats
+		m.Image = &digest{Size: reader.BytesRead(), Hashes: sums}
+	}
+
+	for _, rng := range reader.RangeHashes() {
+		m.Ranges = append(m.Ranges, rangeDigest{
+			Start:  rng.Start,
+			End:    rng.End,
+			Size:   rng.End - rng.Start,
+			Hashes: rng.Sums,
+		})
+	}
+
+	if info := reader.KernelInfo(); info != nil {
+		m.KernelInfo = &kernelReport{
+			OSRelease:  info.OSRelease(),
+			Notes:      []noteReport{},
+			VMCoreInfo: info.VMCoreInfo,
+		}
+		for _, note := range info.Notes {
+			m.KernelInfo.Notes = append(m.KernelInfo.Notes, noteReport{
+				Name: note.Name,
+				Type: note.Type.String(),
+				Size: len(note.Desc),
+			})
+		}
+	}
+
+	for _, rng := range reader.MemRanges() {
+		m.MemoryRanges = append(m.MemoryRanges, rangeReport{Start: rng.Start, End: rng.End})
+	}
+
+	for _, rng := range reader.MissingRanges() {
+		m.MissingRanges = append(m.MissingRanges, rangeReport{Start: rng.Start, End: rng.End})
+	}
+
+	for _, page := range reader.BadPages() {
+		m.BadPages = append(m.BadPages, badPageReport{
+			Addr:   page.Addr,
+			Length: page.Length,
+			Errno:  int(page.Errno),
+			Error:  page.Err.Error(),
+		})
+	}
+
+	return m
+}
+
+// currentHost describes the host on which memr is running
+func currentHost() hostInfo {
+	host := hostInfo{Arch: runtime.GOARCH}
+	host.Hostname, _ = os.Hostname()
+	if release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		host.KernelRelease = strings.TrimSpace(string(release))
+	}
+	return host
+}
+
+// sign signs the manifest using the ed25519 private key
+func (m *manifest) sign(key ed25519.PrivateKey) error {
+	m.Signature = nil
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	payload, _, err := canonicalManifest(data)
+	if err != nil {
+		return err
+	}
+
+	m.Signature = &signature{
+		Algorithm: signatureAlgorithm,
+		PublicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		Value:     base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+	}
+
+	return nil
+}
+
+// canonicalManifest returns the canonical JSON encoding of the manifest in data, which
+// is signed, along with its signature (if any). The canonical encoding is the compact
+// encoding of the manifest's top level object, without its signature and with its keys
+// sorted, so it is unaffected by indentation or the order of fields in the manifest.
+func canonicalManifest(data []byte) ([]byte, *signature, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	var sig *signature
+	if raw, ok := fields["signature"]; ok {
+		if err := json.Unmarshal(raw, &sig); err != nil {
+			return nil, nil, fmt.Errorf("invalid manifest signature: %w", err)
+		}
+		delete(fields, "signature")
+	}
+
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return payload, sig, nil
+}
+
+func (m *manifest) write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// loadSigningKey reads an ed25519 private key from a PEM encoded PKCS #8 file,
+// such as one generated using: openssl genpkey -algorithm ed25519 -out key.pem
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", path, err)
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key in %s is not an ed25519 key: %T", path, key)
+	}
+
+	return edKey, nil
+}
+
+// loadVerifyKey reads an ed25519 public key from a PEM encoded PKIX file, such
+// as one generated using: openssl pkey -in key.pem -pubout -out public.pem
+func loadVerifyKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %s: %w", path, err)
+	}
+
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key in %s is not an ed25519 key: %T", path, key)
+	}
+
+	return edKey, nil
+}
+
+func readPEM(path, typ string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != typ {
+		return nil, fmt.Errorf("no PEM encoded %s found in %s", strings.ToLower(typ), path)
+	}
+
+	return block, nil
+}
@@ -2,21 +2,251 @@ package main
 
 import (
 	"context"
+	"crypto/md5" //nolint:gosec
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/url"
+	"strings"
+	"time"
 
+	"filippo.io/age"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/golang/snappy"
+	"github.com/ryandeivert/memr"
 )
 
-func S3Writer(reader io.ReadCloser, compress, useAccelerate bool, region, bucket, key string, concurrency int, memory_size uint64) (*manager.UploadOutput, error) {
+// abortTimeout is the time allowed for aborting a failed multipart upload
+const abortTimeout = 30 * time.Second
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
+// outputStages describes the transformations applied to the reader's output
+// before it is written, in order: compression with snappy, then encryption
+type outputStages struct {
+	compress   bool
+	recipients []age.Recipient
+}
+
+// empty returns true if the output is written as read
+func (o outputStages) empty() bool {
+	return !o.compress && len(o.recipients) == 0
+}
+
+// wrap returns a writer applying the stages to data written to it, before writing
+// it to dst. Closing the writer flushes each of the stages, but does not close dst.
+func (o outputStages) wrap(dst io.Writer) (io.WriteCloser, error) {
+	var closers []io.Closer
+	var writer io.Writer = dst
+
+	if len(o.recipients) > 0 {
+		encrypter, err := memr.NewEncryptWriter(writer, o.recipients...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize encryption: %w", err)
+		}
+		closers = append(closers, encrypter)
+		writer = encrypter
+	}
+
+	if o.compress {
+		compressor := snappy.NewBufferedWriter(writer)
+		closers = append(closers, compressor)
+		writer = compressor
+	}
+
+	return &stagesWriter{Writer: writer, closers: closers}, nil
+}
+
+// stagesWriter closes each stage from the outermost in, so that each stage
+// flushes its remaining data to the next before it is closed
+type stagesWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (s *stagesWriter) Close() error {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if err := s.closers[i].Close(); err != nil {
+			return fmt.Errorf("failed to close writer: %T; %w", s.closers[i], err)
+		}
+	}
+	return nil
+}
+
+// maxCopySize is the largest object that can be copied using CopyObject
+const maxCopySize = 5 * 1024 * 1024 * 1024
+
+// copyPartSize is the size of the parts used to copy objects larger than maxCopySize
+const copyPartSize = 1024 * 1024 * 1024
+
+// s3Options are the options applied to uploads to S3, from the CLI's flags
+type s3Options struct {
+	endpoint     string            // custom endpoint URL (eg: for MinIO or Ceph RGW)
+	pathStyle    bool              // use path-style addressing (eg: https://host/bucket/key)
+	acl          string            // canned ACL, or none
+	sse          string            // server-side encryption: none, s3, kms or c
+	kmsKeyID     string            // KMS key for sse=kms, or the default key if empty
+	sseCKeyFile  string            // file containing the 256-bit key for sse=c
+	tags         map[string]string // object tags
+	metadata     map[string]string // user metadata, in addition to that of the output
+	storageClass string            // eg: STANDARD_IA, or the bucket's default if empty
+	checksum     string            // checksum algorithm for each part (eg: SHA256), or none if empty
+}
+
+var s3Opts = s3Options{
+	acl: string(types.ObjectCannedACLBucketOwnerFullControl),
+	sse: "none",
+}
+
+// sseAlgorithms maps the values of --sse to server-side encryption algorithms
+var sseAlgorithms = map[string]types.ServerSideEncryption{
+	"s3":  types.ServerSideEncryptionAes256,
+	"kms": types.ServerSideEncryptionAwsKms,
+}
+
+// validate checks the options, without any requests to S3
+func (o s3Options) validate() error {
+	if o.endpoint != "" {
+		if u, err := url.Parse(o.endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid S3 endpoint URL: %s", o.endpoint)
+		}
+		if useAccelerate {
+			return fmt.Errorf("S3 Transfer Acceleration cannot be used with a custom endpoint")
+		}
+	}
+
+	if _, ok := sseAlgorithms[o.sse]; !ok && o.sse != "none" && o.sse != "c" {
+		return fmt.Errorf("invalid server-side encryption %q; must be one of: none, s3, kms, c", o.sse)
+	}
+	if o.kmsKeyID != "" && o.sse != "kms" {
+		return fmt.Errorf("a KMS key can only be used with server-side encryption \"kms\"")
+	}
+	if (o.sseCKeyFile != "") != (o.sse == "c") {
+		return fmt.Errorf("a customer key file must be supplied with (and only with) server-side encryption \"c\"")
+	}
+
+	var acls, classes, checksums []string
+	for _, v := range types.ObjectCannedACL("").Values() {
+		acls = append(acls, string(v))
+	}
+	for _, v := range types.StorageClass("").Values() {
+		classes = append(classes, string(v))
+	}
+	for _, v := range types.ChecksumAlgorithm("").Values() {
+		checksums = append(checksums, string(v))
+	}
+
+	if o.acl != "none" {
+		if err := validEnum(o.acl, acls); err != nil {
+			return fmt.Errorf("invalid ACL: %s", err)
+		}
+	}
+	if err := validEnum(o.storageClass, classes); err != nil {
+		return fmt.Errorf("invalid storage class: %s", err)
+	}
+	if err := validEnum(o.checksum, checksums); err != nil {
+		return fmt.Errorf("invalid checksum algorithm: %s", err)
+	}
+
+	return nil
+}
+
+// validEnum checks that the value is either empty or one of the values of an S3 enum
+func validEnum(value string, values []string) error {
+	if value == "" {
+		return nil
+	}
+	for _, v := range values {
+		if v == value {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q must be one of: %s", value, strings.Join(values, ", "))
+}
+
+// apply sets the options on the input for an upload, along with the metadata of the output
+func (o s3Options) apply(input *s3.PutObjectInput, metadata map[string]string) error {
+	if o.acl != "none" {
+		input.ACL = types.ObjectCannedACL(o.acl)
+	}
+
+	switch o.sse {
+	case "s3", "kms":
+		input.ServerSideEncryption = sseAlgorithms[o.sse]
+		if o.kmsKeyID != "" {
+			input.SSEKMSKeyId = aws.String(o.kmsKeyID)
+		}
+	case "c":
+		key, keyMD5, err := readCustomerKey(o.sseCKeyFile)
+		if err != nil {
+			return err
+		}
+		input.SSECustomerAlgorithm = aws.String(string(types.ServerSideEncryptionAes256))
+		input.SSECustomerKey = aws.String(key)
+		input.SSECustomerKeyMD5 = aws.String(keyMD5)
+	}
+
+	if len(o.tags) > 0 {
+		tags := make(url.Values, len(o.tags))
+		for k, v := range o.tags {
+			tags.Set(k, v)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+
+	input.Metadata = make(map[string]string, len(metadata)+len(o.metadata))
+	for k, v := range metadata {
+		input.Metadata[k] = v
+	}
+	for k, v := range o.metadata {
+		input.Metadata[k] = v // user supplied metadata takes precedence
+	}
+
+	input.StorageClass = types.StorageClass(o.storageClass)
+	input.ChecksumAlgorithm = types.ChecksumAlgorithm(o.checksum)
+
+	return nil
+}
+
+// readCustomerKey reads the 256-bit key for SSE-C from the file, which contains
+// either the raw key or its base64 encoding. The base64 encoded key and its MD5 are returned.
+func readCustomerKey(path string) (string, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	key := data
+	if len(key) != 32 {
+		if key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err != nil || len(key) != 32 {
+			return "", "", fmt.Errorf("customer key in %s must be 32 bytes, either raw or base64 encoded", path)
+		}
+	}
+
+	sum := md5.Sum(key) //nolint:gosec // required by SSE-C
+	return base64.StdEncoding.EncodeToString(key), base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// s3Object is the object written to by an S3 sink, along with the options of its upload
+type s3Object struct {
+	client *s3.Client
+	config aws.Config
+	input  s3.PutObjectInput // used for any later copy, when updating metadata
+}
+
+// newS3Object parses the s3://bucket/key URL, and applies the options and metadata to its upload
+func newS3Object(ctx context.Context, u *url.URL, opts sinkOptions) (*s3Object, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("output URL must be of the form s3://bucket/key: %s", u)
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx,
 		// client will only use this region if none is otherwise set using AWS_REGION or AWS_DEFAULT_REGION
 		config.WithDefaultRegion(region),
 	)
@@ -24,75 +254,297 @@ func S3Writer(reader io.ReadCloser, compress, useAccelerate bool, region, bucket
 		return nil, err
 	}
 
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UseAccelerate = useAccelerate
+		o.UsePathStyle = s3Opts.pathStyle
+		if s3Opts.endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(s3Opts.endpoint)
+		}
+	})
+
+	input := s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if err := s3Opts.apply(&input, opts.metadata); err != nil {
+		return nil, err
+	}
+
+	return &s3Object{client: s3Client, config: cfg, input: input}, nil
+}
+
+// partSize returns the size of each part of a multipart upload of size bytes
+func partSize(size uint64) int64 {
 	// Set size of multi part upload; by default the minimal is 5Mb
 	// A lower value here will have a lesser impact on memory pressure, and should be considered
 	// Increasing this value will directly impact how much memory we use
 	// Minimal size when possible will allow max 50GB memory size (5MB * 10,000)
 	const padSize = 1024 * 1024                    // Use an extra mb as padding, just in case
 	var partSize int64 = manager.MinUploadPartSize // Default to minimum part size (5MB)
-	if memory_size+padSize > uint64(manager.MaxUploadParts)*uint64(manager.MinUploadPartSize) {
+	if size+padSize > uint64(manager.MaxUploadParts)*uint64(manager.MinUploadPartSize) {
 		// For bigger memory than 50GB, we calculate the size of the part
 		// part size = (memory size / max upload parts) + 1MB
-		partSize = int64(memory_size/uint64(manager.MaxUploadParts)) + padSize
+		partSize = int64(size/uint64(manager.MaxUploadParts)) + padSize
 	}
 	log.Printf("[DEBUG] S3 part size set up to %d MBs", partSize/1024/1024)
 
-	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.UseAccelerate = useAccelerate
-	})
+	return partSize
+}
+
+// S3Writer is a Sink uploading the output to S3 using a multipart upload, with
+// an s3://bucket/key URL. Any failure aborts the upload, removing its parts.
+type S3Writer struct {
+	*s3Object
+	pipe     *io.PipeWriter
+	done     chan struct{}
+	err      error
+	location string
+	counter
+}
+
+func newS3Writer(ctx context.Context, u *url.URL, opts sinkOptions) (Sink, error) {
+	object, err := newS3Object(ctx, u, opts)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create an uploader with the session and custom options
-	uploader := manager.NewUploader(s3Client, func(u *manager.Uploader) {
-		u.PartSize = partSize
+	uploader := manager.NewUploader(object.client, func(u *manager.Uploader) {
+		u.PartSize = partSize(opts.size)
 		u.Concurrency = concurrency
 
+		// The uploader would abort using the upload's context, which is already
+		// cancelled if the capture was interrupted. Parts are instead aborted below
+		u.LeavePartsOnError = true
+
 		// A buffer provider could be used to allow for larger buffers (64 KiB?) in memory
 		// u.BufferProvider = manager.NewBufferedReadSeekerWriteToPool(64 * 1024)
 	})
 
-	var s3Reader io.Reader = reader
-	if compress {
-		var wPipe *io.PipeWriter
-		s3Reader, wPipe = io.Pipe()
-
-		go func() {
-			writer := snappy.NewBufferedWriter(wPipe)
-			defer func() {
-				cErr := reader.Close()
-				if cErr != nil {
-					log.Fatalf("failed to close reader: %s", cErr)
-				}
-				cErr = writer.Close()
-				if cErr != nil {
-					log.Fatalf("failed to close writer: %T; %s", writer, cErr)
-				}
-				cErr = wPipe.Close()
-				if cErr != nil {
-					log.Fatalf("failed to close pipe writer: %s", cErr)
-				}
-			}()
-
-			if _, err := io.Copy(writer, reader); err != nil {
-				log.Fatalf("compressor failed: %s", err)
-			}
-		}()
-	} else {
-		defer reader.Close()
-	}
-
-	// Upload the file to S3
-	result, err := uploader.Upload(context.TODO(),
-		&s3.PutObjectInput{
-			ACL:    types.ObjectCannedACLBucketOwnerFullControl,
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
-			Body:   s3Reader,
-		},
-	)
+	body, pipe := io.Pipe()
+	w := &S3Writer{s3Object: object, pipe: pipe, done: make(chan struct{}), location: u.String()}
+
+	// Any failure writing the output is propagated to the uploader
+	// through the pipe, which in turn aborts the upload
+	go func() {
+		defer close(w.done)
+		upload := object.input
+		upload.Body = body
+		result, err := uploader.Upload(ctx, &upload)
+
+		if err != nil {
+			abortUpload(object.client, *upload.Bucket, *upload.Key, err)
+			w.err = fmt.Errorf("failed to upload to s3: %w", err)
+			body.CloseWithError(w.err) // fail any further writes
+			return
+		}
+
+		w.location = result.Location
+		body.CloseWithError(io.ErrClosedPipe)
+	}()
+
+	return w, nil
+}
+
+func (w *S3Writer) Write(p []byte) (int, error) {
+	return w.count(w.pipe.Write(p))
+}
+
+// Close completes the upload once all data is written
+func (w *S3Writer) Close() error {
+	w.pipe.Close()
+	<-w.done
+	return w.err
+}
+
+func (w *S3Writer) Abort(err error) {
+	w.pipe.CloseWithError(err)
+	<-w.done
+}
+
+func (w *S3Writer) Location() string {
+	return w.location
+}
+
+// UpdateMetadata adds the metadata to the uploaded object, by copying the object in place
+// (see updateMetadata)
+func (w *S3Writer) UpdateMetadata(ctx context.Context, metadata map[string]string) error {
+	return w.updateMetadata(ctx, metadata, w.Written())
+}
+
+// updateMetadata adds the metadata to the object of size bytes, by copying the object in
+// place. Since CopyObject is limited to 5 GiB, larger objects are copied in parts of
+// copyPartSize bytes using a multipart upload (see copyMultipart).
+func (o *s3Object) updateMetadata(ctx context.Context, metadata map[string]string, size int64) error {
+	in := o.input
+	merged := make(map[string]string, len(in.Metadata)+len(metadata))
+	for k, v := range in.Metadata {
+		merged[k] = v
+	}
+	for k, v := range metadata {
+		merged[k] = v
+	}
+
+	if size > maxCopySize {
+		if err := o.copyMultipart(ctx, merged, size, copyPartSize); err != nil {
+			return err
+		}
+		o.input.Metadata = merged
+		return nil
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:                         in.Bucket,
+		Key:                            in.Key,
+		CopySource:                     aws.String(o.copySource()),
+		ACL:                            in.ACL,
+		MetadataDirective:              types.MetadataDirectiveReplace,
+		Metadata:                       merged,
+		TaggingDirective:               types.TaggingDirectiveCopy,
+		ServerSideEncryption:           in.ServerSideEncryption,
+		SSEKMSKeyId:                    in.SSEKMSKeyId,
+		SSECustomerAlgorithm:           in.SSECustomerAlgorithm,
+		SSECustomerKey:                 in.SSECustomerKey,
+		SSECustomerKeyMD5:              in.SSECustomerKeyMD5,
+		CopySourceSSECustomerAlgorithm: in.SSECustomerAlgorithm,
+		CopySourceSSECustomerKey:       in.SSECustomerKey,
+		CopySourceSSECustomerKeyMD5:    in.SSECustomerKeyMD5,
+		StorageClass:                   in.StorageClass,
+		ChecksumAlgorithm:              in.ChecksumAlgorithm,
+	}
+	if _, err := o.client.CopyObject(ctx, input); err != nil {
+		return err
+	}
+
+	o.input.Metadata = merged
+	return nil
+}
+
+// copyMultipart replaces the object of size bytes with a copy of itself with the metadata,
+// using a multipart upload of parts of partSize bytes, each copied from the object using
+// UploadPartCopy. The object's tags are those it was uploaded with. The object is left
+// unchanged if any part fails, and the upload is aborted.
+func (o *s3Object) copyMultipart(ctx context.Context, metadata map[string]string, size, partSize int64) error {
+	in := o.input
+	created, err := o.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               in.Bucket,
+		Key:                  in.Key,
+		ACL:                  in.ACL,
+		Metadata:             metadata,
+		Tagging:              in.Tagging,
+		ServerSideEncryption: in.ServerSideEncryption,
+		SSEKMSKeyId:          in.SSEKMSKeyId,
+		SSECustomerAlgorithm: in.SSECustomerAlgorithm,
+		SSECustomerKey:       in.SSECustomerKey,
+		SSECustomerKeyMD5:    in.SSECustomerKeyMD5,
+		StorageClass:         in.StorageClass,
+		ChecksumAlgorithm:    in.ChecksumAlgorithm,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	uploadID := created.UploadId
+
+	// The start and end of each part are offsets within the object
+	completed := make([]types.CompletedPart, (size+partSize-1)/partSize)
+	uploader := newPartUploader(ctx, 1, func(ctx context.Context, part *pendingPart) error {
+		result, err := o.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:                         in.Bucket,
+			Key:                            in.Key,
+			UploadId:                       uploadID,
+			PartNumber:                     part.Number,
+			CopySource:                     aws.String(o.copySource()),
+			CopySourceRange:                aws.String(fmt.Sprintf("bytes=%d-%d", part.Start, part.End-1)),
+			SSECustomerAlgorithm:           in.SSECustomerAlgorithm,
+			SSECustomerKey:                 in.SSECustomerKey,
+			SSECustomerKeyMD5:              in.SSECustomerKeyMD5,
+			CopySourceSSECustomerAlgorithm: in.SSECustomerAlgorithm,
+			CopySourceSSECustomerKey:       in.SSECustomerKey,
+			CopySourceSSECustomerKeyMD5:    in.SSECustomerKeyMD5,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy part %d: %w", part.Number, err)
+		}
+
+		copied := result.CopyPartResult
+		if copied == nil {
+			return fmt.Errorf("failed to copy part %d: no result", part.Number)
+		}
+		completed[part.Number-1] = types.CompletedPart{
+			PartNumber:     part.Number,
+			ETag:           copied.ETag,
+			ChecksumCRC32:  copied.ChecksumCRC32,
+			ChecksumCRC32C: copied.ChecksumCRC32C,
+			ChecksumSHA1:   copied.ChecksumSHA1,
+			ChecksumSHA256: copied.ChecksumSHA256,
+		}
+		return nil
+	})
 
+	for start := int64(0); start < size && err == nil; start += partSize {
+		end := start + partSize
+		if end > size {
+			end = size
+		}
+		err = uploader.send(&pendingPart{uploadedPart: uploadedPart{Start: uint64(start), End: uint64(end)}})
+	}
+	if fErr := uploader.wait(); fErr != nil {
+		err = fErr
+	}
+
+	if err == nil {
+		_, err = o.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:               in.Bucket,
+			Key:                  in.Key,
+			UploadId:             uploadID,
+			MultipartUpload:      &types.CompletedMultipartUpload{Parts: completed},
+			SSECustomerAlgorithm: in.SSECustomerAlgorithm,
+			SSECustomerKey:       in.SSECustomerKey,
+			SSECustomerKeyMD5:    in.SSECustomerKeyMD5,
+		})
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("failed to complete multipart upload %s: %w", aws.ToString(uploadID), err)
+	}
+
+	abortMultipartUpload(o.client, aws.ToString(in.Bucket), aws.ToString(in.Key), aws.ToString(uploadID))
+	return err
+}
+
+// copySource is the source of a copy of the object, in the form bucket/key
+func (o *s3Object) copySource() string {
+	return *o.input.Bucket + "/" + (&url.URL{Path: *o.input.Key}).EscapedPath()
+}
+
+// abortUpload aborts the multipart upload that failed with err, if any, so
+// that an interrupted capture does not leave orphaned parts in the bucket
+func abortUpload(s3Client *s3.Client, bucket, key string, err error) {
+	var mErr manager.MultiUploadFailure
+	if !errors.As(err, &mErr) {
+		return
+	}
+
+	abortMultipartUpload(s3Client, bucket, key, mErr.UploadID())
+}
+
+// abortMultipartUpload aborts the multipart upload with the ID
+func abortMultipartUpload(s3Client *s3.Client, bucket, key, uploadID string) {
+	// The context used for the upload may have been cancelled, so use a new one
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+
+	log.Printf("[INFO] aborting multipart upload: %s", uploadID)
+	_, err := s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to upload to s3: %s", err)
+		log.Printf("[WARN] failed to abort multipart upload %s: %s", uploadID, err)
 	}
+}
 
-	return result, nil
+func init() {
+	registerSink("s3", newS3Writer)
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// putObject stores the data as the object at bucket/key in the fakeS3, returning an
+// s3Object for it with the metadata it was uploaded with
+func putObject(t *testing.T, s3 *fakeS3, path string, data []byte, metadata map[string]string) *s3Object {
+	t.Helper()
+
+	s3.use(t)
+	object, err := newS3Object(context.Background(), &url.URL{Scheme: "s3", Host: "bkt", Path: "/" + strings.TrimPrefix(path, "bkt/")}, sinkOptions{metadata: metadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3.mu.Lock()
+	s3.objects[path] = &fakeObject{data: data, metadata: metadata}
+	s3.mu.Unlock()
+
+	return object
+}
+
+// cancelOnCreate is an HTTP client that cancels a context once a multipart
+// upload is created, after reading the response
+type cancelOnCreate struct {
+	cancel context.CancelFunc
+}
+
+func (c cancelOnCreate) Do(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if _, ok := req.URL.Query()["uploads"]; !ok || err != nil {
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	c.cancel()
+	return resp, err
+}
+
+func TestUpdateMetadata(t *testing.T) {
+	s3 := newFakeS3(t)
+	data := randomData(1000)
+	object := putObject(t, s3, "bkt/capture.lime", data, map[string]string{"memr-host": "web-01"})
+
+	if err := object.updateMetadata(context.Background(), map[string]string{"memr-image-sha256": "abcd"}, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := s3.object("bkt/capture.lime")
+	want := map[string]string{"memr-host": "web-01", "memr-image-sha256": "abcd"}
+	if !reflect.DeepEqual(updated.metadata, want) {
+		t.Errorf("metadata: got %v; want %v", updated.metadata, want)
+	}
+	if !bytes.Equal(updated.data, data) || updated.parts != nil {
+		t.Error("expected the object to be copied in place using a single copy")
+	}
+}
+
+func TestCopyMultipart(t *testing.T) {
+	s3 := newFakeS3(t)
+	data := randomData(1000)
+	object := putObject(t, s3, "bkt/capture.lime", data, map[string]string{"memr-host": "web-01"})
+
+	metadata := map[string]string{"memr-host": "web-01", "memr-output-sha256": "abcd"}
+	if err := object.copyMultipart(context.Background(), metadata, int64(len(data)), 300); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each part is copied from a range of the object, the last being smaller
+	updated := s3.object("bkt/capture.lime")
+	if !bytes.Equal(updated.data, data) {
+		t.Error("object does not match after being copied in parts")
+	}
+	if !reflect.DeepEqual(updated.parts, []int{1, 2, 3, 4}) {
+		t.Errorf("unexpected parts: %v", updated.parts)
+	}
+	if !reflect.DeepEqual(updated.metadata, metadata) {
+		t.Errorf("metadata: got %v; want %v", updated.metadata, metadata)
+	}
+
+	// A failure leaves the object unchanged, and aborts the copy
+	s3.setOnPart(func(_ string, number int) int {
+		if number == 3 {
+			return 403
+		}
+		return 0
+	})
+	err := object.copyMultipart(context.Background(), map[string]string{"memr-output-sha256": "ef01"}, int64(len(data)), 300)
+	if err == nil || !strings.Contains(err.Error(), "failed to copy part 3") {
+		t.Fatalf("expected part 3 to fail: %v", err)
+	}
+	if got := s3.object("bkt/capture.lime").metadata; !reflect.DeepEqual(got, metadata) {
+		t.Errorf("expected the object to be unchanged: %v", got)
+	}
+	if pending := s3.pending(); len(pending) != 0 {
+		t.Errorf("expected the copy to be aborted: %v", pending)
+	}
+
+	// Cancelling before the first part is handed off also aborts the copy
+	s3.setOnPart(func(_ string, number int) int {
+		t.Errorf("unexpected part %d copied after cancelling", number)
+		return 0
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	object.client = newTestS3Client(object, cancelOnCreate{cancel: cancel})
+	err = object.copyMultipart(ctx, map[string]string{"memr-output-sha256": "ef01"}, int64(len(data)), 300)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the copy to be cancelled: %v", err)
+	}
+	if pending := s3.pending(); len(pending) != 0 {
+		t.Errorf("expected the copy to be aborted: %v", pending)
+	}
+}
+
+// newTestS3Client returns a client for the object, like that of newS3Object, using the HTTP client
+func newTestS3Client(object *s3Object, client s3.HTTPClient) *s3.Client {
+	return s3.NewFromConfig(object.config, func(o *s3.Options) {
+		o.UsePathStyle = s3Opts.pathStyle
+		o.EndpointResolver = s3.EndpointResolverFromURL(s3Opts.endpoint)
+		o.HTTPClient = client
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// pendingPart is a part that is ready to be uploaded
+type pendingPart struct {
+	uploadedPart
+	data []byte
+}
+
+// partUploader uploads the parts of a multipart upload using concurrent goroutines, as
+// they are cut from the output by a sink (see resumableS3Writer and presignedSink). The
+// first failure stops any other uploads, and any parts handed off after it are dropped.
+type partUploader struct {
+	upload  func(ctx context.Context, part *pendingPart) error
+	number  int32 // number of the next part
+	parts   chan *pendingPart
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	err     error
+	stopped bool
+}
+
+// newPartUploader starts uploading parts using upload, starting at part number
+func newPartUploader(ctx context.Context, number int32, upload func(ctx context.Context, part *pendingPart) error) *partUploader {
+	u := &partUploader{upload: upload, number: number, parts: make(chan *pendingPart)}
+	u.ctx, u.cancel = context.WithCancel(ctx)
+	for i := 0; i < concurrency; i++ {
+		u.wg.Add(1)
+		go u.uploadParts()
+	}
+	return u
+}
+
+// send hands the part off to be uploaded, numbering it as the next part. The part
+// is dropped once the uploads are stopped by a failure or cancellation.
+func (u *partUploader) send(part *pendingPart) error {
+	part.Number = u.number
+	if u.ctx.Err() == nil {
+		select {
+		case u.parts <- part:
+			u.number++
+			return nil
+		case <-u.ctx.Done():
+		}
+	}
+
+	if err := u.failure(); err != nil {
+		return err
+	}
+	return u.ctx.Err()
+}
+
+// uploadParts uploads each of the parts, until a part fails
+func (u *partUploader) uploadParts() {
+	defer u.wg.Done()
+	for part := range u.parts {
+		if u.ctx.Err() != nil {
+			continue // drain any parts after a failure
+		}
+		if err := u.upload(u.ctx, part); err != nil {
+			u.fail(err)
+		}
+	}
+}
+
+// fail records the first failure, stopping any other uploads
+func (u *partUploader) fail(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err == nil {
+		u.err = err
+	}
+	u.cancel()
+}
+
+func (u *partUploader) failure() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err
+}
+
+// finish hands off the last part using flush, if pending, then waits for all parts to
+// be uploaded. The last part may be smaller than the part size, and at least one part
+// is required.
+func (u *partUploader) finish(pending bool, flush func() error) error {
+	if u.stopped {
+		return u.failure()
+	}
+
+	if pending || u.number == 1 {
+		if err := flush(); err != nil {
+			u.fail(err)
+		}
+	}
+
+	return u.wait()
+}
+
+// wait waits for all parts to be uploaded, for callers without a last part to hand
+// off using finish (eg: when every part is handed off using send)
+func (u *partUploader) wait() error {
+	u.stop()
+	return u.failure()
+}
+
+// stop waits for any parts being uploaded, after which no more parts are uploaded
+func (u *partUploader) stop() {
+	if u.stopped {
+		return
+	}
+	u.stopped = true
+	close(u.parts)
+	u.wg.Wait()
+	u.cancel()
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// maxPresignExpiry is the longest validity of a SigV4 presigned URL
+	maxPresignExpiry = 7 * 24 * time.Hour
+
+	// presignedRetries is the number of times a request to a presigned URL is retried
+	presignedRetries = 3
+)
+
+var (
+	presignBucket, presignKey string
+	presignSize               string
+	presignExpires            = 24 * time.Hour
+	presignOutput             = "-"
+)
+
+// presignCmd creates a multipart upload and presigns the requests to complete it,
+// for use by the presigned sink on a host without credentials
+var presignCmd = &cobra.Command{
+	Use:   "presign",
+	Short: "Generate presigned URLs for uploading to S3 without credentials",
+	Long: `Generate a bundle of presigned URLs for uploading to S3 from a host without
+AWS credentials, using: memr --output presigned:<BUNDLE>
+
+This creates a multipart upload, and presigns a request to upload each part,
+along with requests to complete and abort the upload. Parts are sized for the
+expected --size of the output (eg: the memory of the target host), in the same
+way as uploads using credentials. The URLs allow anyone holding the bundle to
+upload to the key until they expire, so the bundle should be treated as a secret.
+
+Options of the upload (eg: --sse and --tags) are set when the upload is created.
+Customer-provided keys (--sse c) and checksums are not supported, since they
+require headers to be sent with each part.`,
+	Example: `
+Generating a bundle for a host with 64 GiB of memory, valid for 12 hours:
+memr presign --bucket <BUCKET> --key <KEY> --size 64G --expires 12h --output bundle.json
+
+Uploading from the target host using the bundle:
+memr --output presigned:bundle.json`,
+	Args: cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := s3Opts.validate(); err != nil {
+			return err
+		}
+		if s3Opts.sse == "c" {
+			return fmt.Errorf("server-side encryption \"c\" is not supported with presigned URLs")
+		}
+		if presignExpires <= 0 || presignExpires > maxPresignExpiry {
+			return fmt.Errorf("\"--expires\" must be greater than 0 and at most %s", maxPresignExpiry)
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		size, err := parseSize(presignSize)
+		if err != nil || size == 0 {
+			return fmt.Errorf("invalid size: %s", presignSize)
+		}
+
+		u := &url.URL{Scheme: "s3", Host: presignBucket, Path: "/" + presignKey}
+		bundle, err := presignUpload(cmd.Context(), u, size, presignExpires)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.MarshalIndent(bundle, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+
+		if presignOutput == "-" {
+			_, err = os.Stdout.Write(data)
+		} else {
+			err = os.WriteFile(presignOutput, data, 0600)
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Printf("presigned %d part(s) of %d bytes for upload %s to %s, expiring at %s",
+			len(bundle.Parts), bundle.PartSize, bundle.UploadID, u, bundle.Expires.Format(time.RFC3339))
+
+		return nil
+	},
+}
+
+// presignedBundle describes a multipart upload to S3 using presigned URLs, written by
+// memr presign and used by the presigned sink. Any unused parts are ignored.
+type presignedBundle struct {
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key"`
+	UploadID    string    `json:"upload_id"`
+	PartSize    int64     `json:"part_size"`
+	Expires     time.Time `json:"expires"`
+	Parts       []string  `json:"parts"` // URL for uploading each part, in order of part number
+	CompleteURL string    `json:"complete_url"`
+	AbortURL    string    `json:"abort_url"`
+}
+
+// presignUpload creates a multipart upload to the s3://bucket/key URL for size bytes,
+// and presigns the requests to upload each part, and to complete or abort the upload
+func presignUpload(ctx context.Context, u *url.URL, size uint64, expires time.Duration) (*presignedBundle, error) {
+	object, err := newS3Object(ctx, u, sinkOptions{size: size})
+	if err != nil {
+		return nil, err
+	}
+
+	// Allow for the output exceeding the size, such as headers or incompressible data
+	partSize := partSize(size)
+	numParts := int((size+size/100)/uint64(partSize)) + 2
+	if numParts > int(manager.MaxUploadParts) {
+		numParts = int(manager.MaxUploadParts)
+	}
+
+	in := object.input
+	result, err := object.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               in.Bucket,
+		Key:                  in.Key,
+		ACL:                  in.ACL,
+		Metadata:             in.Metadata,
+		Tagging:              in.Tagging,
+		ServerSideEncryption: in.ServerSideEncryption,
+		SSEKMSKeyId:          in.SSEKMSKeyId,
+		StorageClass:         in.StorageClass,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+
+	bundle := &presignedBundle{
+		Bucket:   *in.Bucket,
+		Key:      *in.Key,
+		UploadID: aws.ToString(result.UploadId),
+		PartSize: partSize,
+		Expires:  time.Now().Add(expires).UTC().Truncate(time.Second),
+	}
+
+	presigner := s3.NewPresignClient(object.client, s3.WithPresignExpires(expires))
+	for number := 1; number <= numParts; number++ {
+		req, err := presigner.PresignUploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     in.Bucket,
+			Key:        in.Key,
+			UploadId:   result.UploadId,
+			PartNumber: int32(number),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to presign part %d: %w", number, err)
+		}
+		bundle.Parts = append(bundle.Parts, req.URL)
+	}
+
+	// The SDK cannot presign completing or aborting an upload, so these are signed
+	// directly, using the object's URL (as resolved for the parts)
+	objectURL, err := url.Parse(bundle.Parts[0])
+	if err != nil {
+		return nil, err
+	}
+	objectURL.RawQuery = ""
+
+	if bundle.CompleteURL, err = presignURL(ctx, object.config, http.MethodPost, objectURL, bundle.UploadID, expires); err != nil {
+		return nil, err
+	}
+	if bundle.AbortURL, err = presignURL(ctx, object.config, http.MethodDelete, objectURL, bundle.UploadID, expires); err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+// presignURL presigns a request to the object's URL for the multipart upload,
+// using SigV4 with an unsigned payload
+func presignURL(ctx context.Context, cfg aws.Config, method string, u *url.URL, uploadID string, expires time.Duration) (string, error) {
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	signed := *u
+	signed.RawQuery = url.Values{
+		"uploadId":      {uploadID},
+		"X-Amz-Expires": {strconv.Itoa(int(expires.Seconds()))},
+	}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, signed.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	signer := v4.NewSigner(func(o *v4.SignerOptions) {
+		o.DisableURIPathEscaping = true // S3 paths are escaped once
+	})
+	presigned, _, err := signer.PresignHTTP(ctx, creds, req, "UNSIGNED-PAYLOAD", "s3", cfg.Region, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("failed to presign %s request: %w", method, err)
+	}
+
+	return presigned, nil
+}
+
+// presignedSink is a Sink uploading the output to S3 using the presigned URLs of a bundle
+// written by memr presign, with a presigned:<BUNDLE> URL. This requires no credentials,
+// so is suitable for hosts on which credentials should not be placed. Parts are uploaded
+// using plain HTTP(S) PUT requests, and any failure aborts the upload.
+type presignedSink struct {
+	ctx      context.Context
+	bundle   *presignedBundle
+	buf      *bytes.Buffer
+	uploader *partUploader
+	etags    []string // ETag of each part uploaded
+	mu       sync.Mutex
+	location string
+	counter
+}
+
+func newPresignedSink(ctx context.Context, u *url.URL, opts sinkOptions) (Sink, error) {
+	path := u.Opaque // eg: presigned:bundle.json
+	if path == "" {
+		path = u.Host + u.Path
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var bundle presignedBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("invalid presigned bundle %s: %w", path, err)
+	}
+	if len(bundle.Parts) == 0 || bundle.PartSize <= 0 || bundle.CompleteURL == "" {
+		return nil, fmt.Errorf("presigned bundle %s is incomplete", path)
+	}
+	if time.Now().After(bundle.Expires) {
+		return nil, fmt.Errorf("presigned bundle %s expired at %s", path, bundle.Expires.Format(time.RFC3339))
+	}
+	if capacity := uint64(bundle.PartSize) * uint64(len(bundle.Parts)); opts.size > capacity {
+		log.Printf("[WARN] presigned bundle %s allows for %d bytes, but %d are expected before any compression", path, capacity, opts.size)
+	}
+
+	s := &presignedSink{
+		ctx:      ctx,
+		bundle:   &bundle,
+		buf:      new(bytes.Buffer),
+		etags:    make([]string, len(bundle.Parts)),
+		location: (&url.URL{Scheme: "s3", Host: bundle.Bucket, Path: "/" + bundle.Key}).String(),
+	}
+	s.uploader = newPartUploader(ctx, 1, s.upload)
+
+	return s, nil
+}
+
+func (s *presignedSink) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if err := s.uploader.failure(); err != nil {
+			return n, err
+		}
+
+		chunk := p
+		if room := s.bundle.PartSize - int64(s.buf.Len()); int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		s.buf.Write(chunk)
+		n += len(chunk)
+		p = p[len(chunk):]
+
+		if int64(s.buf.Len()) == s.bundle.PartSize {
+			if err := s.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// flush hands the current part off to be uploaded, and starts the next part
+func (s *presignedSink) flush() error {
+	if int(s.uploader.number) > len(s.bundle.Parts) {
+		return fmt.Errorf("output exceeds the %d part(s) of the presigned bundle", len(s.bundle.Parts))
+	}
+
+	data := s.buf.Bytes()
+	if err := s.uploader.send(&pendingPart{uploadedPart: uploadedPart{Size: int64(len(data))}, data: data}); err != nil {
+		return err
+	}
+	s.count(len(data), nil)
+
+	s.buf = new(bytes.Buffer)
+
+	return nil
+}
+
+// upload uploads the part using its presigned URL, recording its ETag
+func (s *presignedSink) upload(ctx context.Context, part *pendingPart) error {
+	resp, err := presignedRequest(ctx, http.MethodPut, s.bundle.Parts[part.Number-1], part.data)
+	if err != nil {
+		return fmt.Errorf("failed to upload part %d: %w", part.Number, err)
+	}
+
+	s.mu.Lock()
+	s.etags[part.Number-1] = resp.Header.Get("ETag")
+	s.mu.Unlock()
+	log.Printf("[DEBUG] uploaded part %d: size=%d", part.Number, part.Size)
+
+	return nil
+}
+
+// presignedRequest sends the body to the presigned URL, retrying any failures
+func presignedRequest(ctx context.Context, method, presigned string, body []byte) (*http.Response, error) {
+	var err error
+	for attempt := 0; attempt < presignedRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, method, presigned, bytes.NewReader(body)); err != nil {
+			return nil, err
+		}
+
+		var resp *http.Response
+		if resp, err = http.DefaultClient.Do(req); err != nil {
+			continue
+		}
+		respBody, rErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		// S3 may report a failure to complete an upload in the body of a 200 response
+		switch {
+		case rErr != nil:
+			err = rErr
+		case resp.StatusCode/100 != 2:
+			err = fmt.Errorf("unexpected response: %s: %s", resp.Status, bytes.TrimSpace(respBody))
+			if resp.StatusCode/100 == 4 {
+				return nil, err // eg: the URL has expired
+			}
+		case bytes.Contains(respBody, []byte("<Error>")):
+			err = fmt.Errorf("unexpected response: %s", bytes.TrimSpace(respBody))
+		default:
+			resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+			return resp, nil
+		}
+	}
+
+	return nil, err
+}
+
+// completedUpload is the body of a request to complete a multipart upload
+type completedUpload struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+// Close uploads the last part, and completes the upload once all parts are uploaded
+func (s *presignedSink) Close() error {
+	if err := s.uploader.finish(s.buf.Len() > 0, s.flush); err != nil {
+		s.abort(err)
+		return err
+	}
+
+	var body completedUpload
+	for i := 0; i < int(s.uploader.number)-1; i++ {
+		body.Parts = append(body.Parts, struct {
+			PartNumber int
+			ETag       string
+		}{i + 1, s.etags[i]})
+	}
+	data, err := xml.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := presignedRequest(s.ctx, http.MethodPost, s.bundle.CompleteURL, data)
+	if err != nil {
+		err = fmt.Errorf("failed to complete upload: %w", err)
+		s.abort(err)
+		return err
+	}
+
+	var result struct {
+		Location string
+	}
+	if xml.NewDecoder(resp.Body).Decode(&result) == nil && result.Location != "" {
+		s.location = result.Location
+	}
+
+	return nil
+}
+
+// Abort abandons the upload after the failure err, removing its parts
+func (s *presignedSink) Abort(err error) {
+	s.uploader.fail(err)
+	s.uploader.stop()
+	s.abort(err)
+}
+
+// abort aborts the multipart upload that failed with err, so that
+// an interrupted capture does not leave orphaned parts in the bucket
+func (s *presignedSink) abort(err error) {
+	// The context used for the upload may have been cancelled, so use a new one
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+
+	log.Printf("[INFO] aborting multipart upload %s after: %s", s.bundle.UploadID, err)
+	if _, aErr := presignedRequest(ctx, http.MethodDelete, s.bundle.AbortURL, nil); aErr != nil {
+		log.Printf("[WARN] failed to abort multipart upload %s: %s", s.bundle.UploadID, aErr)
+	}
+}
+
+func (s *presignedSink) Location() string {
+	return s.location
+}
+
+func init() {
+	presignCmd.Flags().StringVarP(&presignBucket, "bucket", "b", presignBucket, "S3 bucket to which the output will be uploaded")
+	presignCmd.Flags().StringVarP(&presignKey, "key", "k", presignKey, "key to which the output will be uploaded")
+	presignCmd.Flags().StringVar(&presignSize, "size", presignSize, "expected size of the output before compression, such as the memory of the target host (eg: 64G)")
+	presignCmd.Flags().DurationVar(&presignExpires, "expires", presignExpires, "time for which the URLs are valid (at most 168h)")
+	presignCmd.Flags().StringVarP(&presignOutput, "output", "o", presignOutput, "file to which the bundle of URLs should be written, or - for stdout")
+	presignCmd.Flags().StringVarP(&region, "region", "r", region, "AWS region to use with S3 client")
+	presignCmd.Flags().BoolVarP(&useAccelerate, "accelerate", "a", false, "use S3 Transfer Acceleration")
+	presignCmd.Flags().StringVar(&s3Opts.endpoint, "endpoint-url", s3Opts.endpoint, "custom S3 endpoint URL, for S3-compatible stores (eg: MinIO or Ceph RGW)")
+	presignCmd.Flags().BoolVar(&s3Opts.pathStyle, "path-style", s3Opts.pathStyle, "use path-style addressing for S3 (eg: https://<HOST>/<BUCKET>/<KEY>), typically with --endpoint-url")
+	presignCmd.Flags().StringVar(&s3Opts.acl, "acl", s3Opts.acl, "canned ACL for the S3 object, or none")
+	presignCmd.Flags().StringVar(&s3Opts.sse, "sse", s3Opts.sse, "server-side encryption for the S3 object (one of: none, s3, kms)")
+	presignCmd.Flags().StringVar(&s3Opts.kmsKeyID, "sse-kms-key-id", s3Opts.kmsKeyID, "KMS key ID for --sse kms (default is the AWS managed key)")
+	presignCmd.Flags().StringToStringVar(&s3Opts.tags, "tags", s3Opts.tags, "tags for the S3 object (eg: retention=90d,case=1234)")
+	presignCmd.Flags().StringToStringVar(&s3Opts.metadata, "metadata", s3Opts.metadata, "user metadata for the S3 object")
+	presignCmd.Flags().StringVar(&s3Opts.storageClass, "storage-class", s3Opts.storageClass, "storage class for the S3 object (eg: STANDARD_IA)")
+	_ = presignCmd.MarkFlagRequired("bucket")
+	_ = presignCmd.MarkFlagRequired("key")
+	_ = presignCmd.MarkFlagRequired("size")
+
+	registerSink("presigned", newPresignedSink)
+	rootCmd.AddCommand(presignCmd)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// openPresignedSink opens a presignedSink using a bundle of numParts parts of partSize
+// bytes, for an upload to the fakeS3 (which does not check the signatures of requests)
+func openPresignedSink(t *testing.T, s3 *fakeS3, numParts int, partSize int64) (*presignedSink, string) {
+	t.Helper()
+
+	id := s3.create("bkt/capture.lime")
+	objectURL := s3.URL + "/bkt/capture.lime?uploadId=" + id
+	bundle := presignedBundle{
+		Bucket:      "bkt",
+		Key:         "capture.lime",
+		UploadID:    id,
+		PartSize:    partSize,
+		Expires:     time.Now().Add(time.Hour),
+		CompleteURL: objectURL,
+		AbortURL:    objectURL,
+	}
+	for number := 1; number <= numParts; number++ {
+		bundle.Parts = append(bundle.Parts, fmt.Sprintf("%s&partNumber=%d", objectURL, number))
+	}
+
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err := newPresignedSink(context.Background(), &url.URL{Scheme: "presigned", Opaque: path}, sinkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink.(*presignedSink), id
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data) //nolint:gosec
+	return data
+}
+
+func TestPresignedSink(t *testing.T) {
+	s3 := newFakeS3(t)
+	sink, _ := openPresignedSink(t, s3, 5, 1024)
+
+	data := randomData(3*1024 + 100)
+	for _, chunk := range [][]byte{data[:700], data[700:2500], data[2500:]} {
+		if _, err := sink.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	object := s3.object("bkt/capture.lime")
+	if object == nil {
+		t.Fatal("object was not uploaded")
+	}
+	if !bytes.Equal(object.data, data) {
+		t.Error("object does not match the output")
+	}
+	if sink.Written() != int64(len(data)) {
+		t.Errorf("written: got %d; want %d", sink.Written(), len(data))
+	}
+	if want := s3.URL + "/bkt/capture.lime"; sink.Location() != want {
+		t.Errorf("location: got %s; want %s", sink.Location(), want)
+	}
+
+	// Each part's ETag is included in the body, in order of part number
+	var body completedUpload
+	if err := xml.Unmarshal(object.complete, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.XMLName.Local != "CompleteMultipartUpload" || body.XMLName.Space != "http://s3.amazonaws.com/doc/2006-03-01/" {
+		t.Errorf("unexpected element completing the upload: %v", body.XMLName)
+	}
+	if len(body.Parts) != 4 {
+		t.Fatalf("parts completing the upload: got %d; want 4", len(body.Parts))
+	}
+	for i, part := range body.Parts {
+		end := (i + 1) * 1024
+		if end > len(data) {
+			end = len(data)
+		}
+		if part.PartNumber != i+1 || part.ETag != fakeETag(data[i*1024:end]) {
+			t.Errorf("part %d: got number=%d; etag=%s", i+1, part.PartNumber, part.ETag)
+		}
+	}
+}
+
+func TestPresignedSinkEmpty(t *testing.T) {
+	s3 := newFakeS3(t)
+	sink, _ := openPresignedSink(t, s3, 2, 1024)
+
+	// At least one part is required to complete the upload
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if object := s3.object("bkt/capture.lime"); object == nil || !reflect.DeepEqual(object.parts, []int{1}) {
+		t.Errorf("expected an empty part to be uploaded: %v", object)
+	}
+}
+
+func TestPresignedSinkFailure(t *testing.T) {
+	s3 := newFakeS3(t)
+	s3.setOnPart(func(_ string, number int) int {
+		if number == 2 {
+			return 403
+		}
+		return 0
+	})
+	sink, id := openPresignedSink(t, s3, 5, 1024)
+
+	// The failure is reported by a later write, or once closed
+	var err error
+	data := randomData(1024)
+	for i := 0; i < 5 && err == nil; i++ {
+		_, err = sink.Write(data)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err == nil {
+		err = sink.Close()
+	} else {
+		sink.Abort(err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "failed to upload part 2") {
+		t.Fatalf("expected part 2 to fail: %v", err)
+	}
+	if upload := s3.upload(id); upload == nil || !upload.aborted {
+		t.Error("expected the upload to be aborted")
+	}
+}
+
+func TestPresignedSinkExceedsParts(t *testing.T) {
+	s3 := newFakeS3(t)
+	sink, id := openPresignedSink(t, s3, 2, 1024)
+
+	if _, err := sink.Write(randomData(2*1024 + 1)); err != nil {
+		t.Fatal(err)
+	}
+	err := sink.Close()
+	if err == nil || !strings.Contains(err.Error(), "output exceeds the 2 part(s)") {
+		t.Fatalf("expected output to exceed the parts: %v", err)
+	}
+	if upload := s3.upload(id); upload == nil || !upload.aborted {
+		t.Error("expected the upload to be aborted")
+	}
+}
+
+func TestPresignedSinkCompleteError(t *testing.T) {
+	s3 := newFakeS3(t)
+	s3.setCompleteError("InternalError")
+	sink, id := openPresignedSink(t, s3, 2, 1024)
+
+	if _, err := sink.Write(randomData(100)); err != nil {
+		t.Fatal(err)
+	}
+	err := sink.Close()
+	if err == nil || !strings.Contains(err.Error(), "InternalError") {
+		t.Fatalf("expected an error in the body of the response: %v", err)
+	}
+	if s3.object("bkt/capture.lime") != nil {
+		t.Error("expected the upload not to be completed")
+	}
+	if upload := s3.upload(id); upload == nil || !upload.aborted {
+		t.Error("expected the upload to be aborted")
+	}
+}
+
+func TestPresignURL(t *testing.T) {
+	cfg := aws.Config{
+		Region: "us-west-2",
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+		}),
+	}
+	objectURL, _ := url.Parse("https://bkt.s3.us-west-2.amazonaws.com/path/to/capture.lime")
+
+	presigned, err := presignURL(context.Background(), cfg, "POST", objectURL, "upload-1", 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(presigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != objectURL.Host || u.Path != objectURL.Path {
+		t.Errorf("unexpected URL: %s", presigned)
+	}
+
+	query := u.Query()
+	if got := query.Get("uploadId"); got != "upload-1" {
+		t.Errorf("uploadId: got %q; want upload-1", got)
+	}
+	if got := query.Get("X-Amz-Expires"); got != "7200" {
+		t.Errorf("X-Amz-Expires: got %q; want 7200", got)
+	}
+	if got := query.Get("X-Amz-Signature"); len(got) != 64 {
+		t.Errorf("X-Amz-Signature: got %q", got)
+	}
+	if got := query.Get("X-Amz-Credential"); !strings.HasPrefix(got, "AKIDEXAMPLE/") || !strings.Contains(got, "/us-west-2/s3/") {
+		t.Errorf("X-Amz-Credential: got %q", got)
+	}
+}
+
+func TestPresignedUpload(t *testing.T) {
+	s3 := newFakeS3(t)
+	image, data := writeTestLiME(t, 4, testRange{0x1000, 6 << 20}, testRange{0x1000000, 1 << 20})
+	bundle := filepath.Join(t.TempDir(), "bundle.json")
+
+	out, err := runMemr(t, "presign", "--bucket", "bkt", "--key", "capture.lime", "--size", "7M",
+		"--endpoint-url", s3.URL, "--path-style", "--output", bundle)
+	if err != nil {
+		t.Fatalf("failed to presign: %v; output:\n%s", err, out)
+	}
+
+	out, err = runMemr(t, "--image", image, "--output", "presigned:"+bundle, "--compress=false", "--progress=false")
+	if err != nil {
+		t.Fatalf("failed to upload: %v; output:\n%s", err, out)
+	}
+
+	object := s3.object("bkt/capture.lime")
+	if object == nil {
+		t.Fatal("object was not uploaded")
+	}
+	if !bytes.Equal(object.data, data) {
+		t.Error("object does not match the image")
+	}
+	if !reflect.DeepEqual(object.parts, []int{1, 2}) {
+		t.Errorf("unexpected parts: %v", object.parts)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/ryandeivert/memr"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// receiveTimeout is the longest time the collector waits to read from a client
+	receiveTimeout = 5 * time.Minute
+
+	// maxAcceptDelay is the longest time waited before accepting connections again after a failure
+	maxAcceptDelay = time.Second
+)
+
+var (
+	receiveListen   = ":9443"
+	receiveOutput   = "."
+	receiveCert     string
+	receiveKey      string
+	receiveClientCA string
+	receiveInsecure = false
+
+	// receiving are the names of the captures being received, which are not reused
+	// for captures from the same client received within the same second
+	receiving   = make(map[string]bool)
+	receivingMu sync.Mutex
+)
+
+// receiveCmd runs a collector, storing the captures streamed to it using tls:// (or memr+tcp://) outputs
+var receiveCmd = &cobra.Command{
+	Use:   "receive",
+	Short: "Receive captures streamed from other hosts using tls:// outputs",
+	Long: `Receive captures streamed from other hosts using: memr --output tls://<HOST>:<PORT>
+
+This runs a collector (eg: on a jump box), which authenticates each client using
+mutual TLS, requiring a certificate issued by the --client-ca. Each capture is
+written to the --output directory, or S3 prefix (eg: s3://bucket/prefix), named
+by the common name of the client's certificate and the time it was received (eg:
+host1-20260102T150405Z.lime.sz). A receipt describing the client, the capture
+and the verification of its data is written alongside it (eg: ....lime.sz.json).
+
+The size and hashes of the data sent by the client are verified before the capture
+is completed, and the client is told of any failure. Captures that fail, or whose
+clients disconnect, are aborted (partial local files are left in place).
+
+Using --insecure, plain memr+tcp:// outputs are accepted without authentication, and
+captures are named by the client's address. This should only be used on trusted
+networks.`,
+	Example: `
+Receiving captures into a local directory:
+memr receive --listen :9443 --cert server.pem --key server-key.pem --client-ca ca.pem --output /data/captures
+
+Receiving captures and uploading them to S3:
+memr receive --cert server.pem --key server-key.pem --client-ca ca.pem --output s3://<BUCKET>/<PREFIX>
+
+Streaming a capture to the collector from the target host:
+memr --output tls://<HOST>:9443 --tls-cert client.pem --tls-key client-key.pem --tls-ca ca.pem`,
+	Args: cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := s3Opts.validate(); err != nil {
+			return err
+		}
+		if s3Opts.sse == "c" {
+			return fmt.Errorf("server-side encryption \"c\" is not supported when receiving captures")
+		}
+		if receiveInsecure {
+			if receiveCert+receiveKey+receiveClientCA != "" {
+				return fmt.Errorf("\"--insecure\" flag cannot be used with the \"--cert\", \"--key\" or \"--client-ca\" flags")
+			}
+			return nil
+		}
+		if receiveCert == "" || receiveKey == "" || receiveClientCA == "" {
+			return fmt.Errorf("\"--cert\", \"--key\" and \"--client-ca\" flags must be supplied, unless using the \"--insecure\" flag")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		// Local paths are reported to clients, so are made absolute
+		if u, err := url.Parse(receiveOutput); err != nil || u.Scheme == "" {
+			if receiveOutput, err = filepath.Abs(receiveOutput); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(receiveOutput, 0700); err != nil {
+				return fmt.Errorf("failed to create output directory: %s", err)
+			}
+		}
+
+		listener, err := net.Listen("tcp", receiveListen)
+		if err != nil {
+			return err
+		}
+
+		if !receiveInsecure {
+			config, err := serverTLSConfig()
+			if err != nil {
+				listener.Close()
+				return err
+			}
+			listener = tls.NewListener(listener, config)
+		}
+
+		log.Printf("receiving captures on %s, writing to %s", listener.Addr(), receiveOutput)
+
+		// The listener is closed once the context is cancelled (on SIGINT/SIGTERM),
+		// which also cancels any captures in progress
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+		}()
+
+		var wg sync.WaitGroup
+		defer wg.Wait()
+
+		var delay time.Duration
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				if errors.Is(err, net.ErrClosed) {
+					return err
+				}
+
+				// Failures may be temporary (eg: running out of file descriptors),
+				// so accepting is retried after a delay, doubling until successful
+				delay *= 2
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				log.Printf("[WARN] failed to accept connection: %s; retrying in %s", err, delay)
+
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return nil
+				}
+				continue
+			}
+			delay = 0
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				receiveCapture(ctx, conn)
+			}()
+		}
+	},
+}
+
+// receipt describes a capture received by the collector, and is written alongside it as JSON
+type receipt struct {
+	Client     string         `json:"client"` // common name of the client's certificate, or its address
+	RemoteAddr string         `json:"remote_addr"`
+	Location   string         `json:"location"`
+	Received   time.Time      `json:"received"`
+	Completed  time.Time      `json:"completed"`
+	Header     *streamHeader  `json:"header"`
+	Trailer    *streamTrailer `json:"trailer"`
+	Verified   bool           `json:"verified"`
+}
+
+// receiveCapture reads a capture from the client, stores it, and replies with the outcome
+func receiveCapture(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// Reads from the connection are not cancelled by the context, so it is closed instead
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	client, err := clientName(conn)
+	if err != nil {
+		log.Printf("[WARN] rejected client %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	rcpt := &receipt{Client: client, RemoteAddr: conn.RemoteAddr().String(), Received: time.Now().UTC()}
+	r := bufio.NewReader(&deadlineReader{conn: conn})
+
+	location, err := storeCapture(ctx, r, rcpt)
+	if err != nil {
+		log.Printf("[ERROR] failed to receive capture from %s (%s): %s", client, rcpt.RemoteAddr, err)
+		if err := writeMessage(conn, streamReply{Error: err.Error()}); err != nil {
+			log.Printf("[DEBUG] failed to reply to %s: %s", client, err)
+		}
+		return
+	}
+
+	log.Printf("received capture from %s (%s) to %s (%d bytes)", client, rcpt.RemoteAddr, location, rcpt.Trailer.Size)
+
+	if err := writeMessage(conn, streamReply{Location: location}); err != nil {
+		log.Printf("[WARN] failed to reply to %s, though its capture was stored: %s", client, err)
+	}
+}
+
+// storeCapture reads the header, data and trailer of a capture from r, writing the
+// data to a sink named for the client, and returning its location once verified
+func storeCapture(ctx context.Context, r io.Reader, rcpt *receipt) (string, error) {
+	magic := make([]byte, len(streamMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return "", fmt.Errorf("failed to read magic: %s", err)
+	}
+	if string(magic) != streamMagic {
+		return "", fmt.Errorf("unsupported protocol: %q", magic)
+	}
+
+	rcpt.Header = &streamHeader{}
+	if err := readMessage(r, rcpt.Header); err != nil {
+		return "", fmt.Errorf("failed to read header: %s", unexpectedEOF(err))
+	}
+
+	hasher, err := memr.NewHasher(rcpt.Header.Hashes...)
+	if err != nil {
+		return "", err
+	}
+
+	metadata := make(map[string]string)
+	for key, value := range rcpt.Header.Metadata {
+		metadata[key] = value
+	}
+	metadata["memr-client"] = rcpt.Client // as authenticated, rather than sent by the client
+
+	name, release := reserveName(ctx, rcpt.Client, rcpt.Header, rcpt.Received)
+	defer release()
+
+	sink, err := openSink(ctx, receiveURL(name), sinkOptions{
+		size:        rcpt.Header.Size,
+		metadata:    metadata,
+		compression: rcpt.Header.Compression,
+		encryption:  rcpt.Header.Encryption,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to open output: %s", err)
+	}
+
+	if _, err := io.Copy(io.MultiWriter(sink, hasher), &frameReader{r: r}); err != nil {
+		sink.Abort(err)
+		return "", fmt.Errorf("failed to read data: %s", err)
+	}
+
+	rcpt.Trailer = &streamTrailer{}
+	if err := readMessage(r, rcpt.Trailer); err != nil {
+		err = unexpectedEOF(err)
+		sink.Abort(err)
+		return "", fmt.Errorf("failed to read trailer: %s", err)
+	}
+
+	if err := verifyTrailer(rcpt.Trailer, hasher); err != nil {
+		sink.Abort(err)
+		return "", err
+	}
+	rcpt.Verified = true
+
+	if err := sink.Close(); err != nil {
+		return "", fmt.Errorf("failed to complete output to %s: %s", sink.Location(), err)
+	}
+	rcpt.Location = sink.Location()
+	rcpt.Completed = time.Now().UTC()
+
+	if err := writeReceipt(ctx, name+".json", rcpt); err != nil {
+		log.Printf("[WARN] failed to write receipt for %s: %s", rcpt.Location, err)
+	}
+
+	return rcpt.Location, nil
+}
+
+// verifyTrailer compares the size and hashes of the data received to those sent
+func verifyTrailer(trailer *streamTrailer, hasher *memr.Hasher) error {
+	if uint64(trailer.Size) != hasher.Size() {
+		return fmt.Errorf("size of the data received does not match the trailer: %d != %d", hasher.Size(), trailer.Size)
+	}
+
+	sums := hasher.Sums()
+	for name, sum := range sums {
+		if trailer.Hashes[name] != sum {
+			return fmt.Errorf("%s of the data received does not match the trailer: %s != %s", name, sum, trailer.Hashes[name])
+		}
+	}
+	if len(sums) == 0 {
+		return fmt.Errorf("no hashes of the data in the header")
+	}
+
+	return nil
+}
+
+// writeReceipt writes the receipt as JSON to a sink with the name
+func writeReceipt(ctx context.Context, name string, rcpt *receipt) error {
+	data, err := json.MarshalIndent(rcpt, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	sink, err := openSink(ctx, receiveURL(name), sinkOptions{size: uint64(len(data))})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(sink, bytes.NewReader(data)); err != nil {
+		sink.Abort(err)
+		return err
+	}
+	return sink.Close()
+}
+
+// clientName returns the common name (or first DNS name) of the client's certificate,
+// or the client's address when using --insecure, for use in the names of its captures
+func clientName(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		return sanitizeName(host), err
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(receiveTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no client certificate")
+	}
+
+	name := certs[0].Subject.CommonName
+	if name == "" && len(certs[0].DNSNames) > 0 {
+		name = certs[0].DNSNames[0]
+	}
+	if name == "" {
+		return "", fmt.Errorf("no common name or DNS name in client certificate")
+	}
+
+	return sanitizeName(name), nil
+}
+
+// sanitizeName replaces characters in the name that are not safe in paths or keys
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, strings.Trim(name, "."))
+}
+
+// captureName names the capture for the client and the time it was received, with an
+// extension for its format and any compression or encryption. Names that are taken are
+// numbered instead (eg: host1-20260102T150405Z-1.lime.sz), for captures from the same
+// client received within the same second.
+func captureName(client string, header *streamHeader, received time.Time, taken func(name string) bool) string {
+	base := client + "-" + received.Format("20060102T150405Z")
+
+	var ext string
+	if format := sanitizeName(header.Format); format != "" {
+		ext += "." + format
+	}
+	if header.Compression == "snappy" {
+		ext += ".sz"
+	} else if header.Compression != "" {
+		ext += "." + sanitizeName(header.Compression)
+	}
+	if header.Encryption != "" {
+		ext += "." + sanitizeName(header.Encryption)
+	}
+
+	name := base + ext
+	for n := 1; taken(name); n++ {
+		name = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+	return name
+}
+
+// reserveName names the capture (see captureName), taking neither the name of a capture
+// being received, nor of one that was stored. The name is released once the capture is
+// stored or abandoned, by calling release.
+func reserveName(ctx context.Context, client string, header *streamHeader, received time.Time) (name string, release func()) {
+	receivingMu.Lock()
+	defer receivingMu.Unlock()
+
+	name = captureName(client, header, received, func(name string) bool {
+		return receiving[name] || captureExists(ctx, name)
+	})
+	receiving[name] = true
+
+	return name, func() {
+		receivingMu.Lock()
+		defer receivingMu.Unlock()
+		delete(receiving, name)
+	}
+}
+
+// captureExists returns true if a file or object with the name exists within the
+// --output. Any failure to check (eg: lacking permission to read objects) is treated
+// as it not existing.
+func captureExists(ctx context.Context, name string) bool {
+	u, err := url.Parse(receiveURL(name))
+	if err != nil || u.Scheme == "" {
+		_, err := os.Lstat(receiveURL(name))
+		return err == nil
+	}
+	if u.Scheme != "s3" {
+		return false
+	}
+
+	object, err := newS3Object(ctx, u, sinkOptions{})
+	if err != nil {
+		return false
+	}
+	_, err = object.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: object.input.Bucket, Key: object.input.Key})
+	return err == nil
+}
+
+// receiveURL returns the URL (or local path) of the name within the --output
+func receiveURL(name string) string {
+	if u, err := url.Parse(receiveOutput); err == nil && u.Scheme != "" {
+		u.Path = path.Join("/", u.Path, name)
+		return u.String()
+	}
+	return filepath.Join(receiveOutput, name)
+}
+
+// serverTLSConfig returns the TLS configuration of the collector, requiring
+// clients to present a certificate issued by the --client-ca
+func serverTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(receiveCert, receiveKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %s", err)
+	}
+
+	pool, err := loadCertPool(receiveClientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// deadlineReader extends the read deadline of the connection before each read,
+// so that clients that stop sending are disconnected after the receiveTimeout
+type deadlineReader struct {
+	conn net.Conn
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(receiveTimeout))
+	return d.conn.Read(p)
+}
+
+func init() {
+	receiveCmd.Flags().StringVarP(&receiveListen, "listen", "l", receiveListen, "address on which to listen for clients")
+	receiveCmd.Flags().StringVarP(&receiveOutput, "output", "o", receiveOutput, "directory, or S3 prefix (eg: s3://bucket/prefix), to which captures should be written")
+	receiveCmd.Flags().StringVar(&receiveCert, "cert", receiveCert, "PEM encoded certificate of the collector")
+	receiveCmd.Flags().StringVar(&receiveKey, "key", receiveKey, "PEM encoded private key of the --cert")
+	receiveCmd.Flags().StringVar(&receiveClientCA, "client-ca", receiveClientCA, "PEM encoded CA certificates with which to verify client certificates")
+	receiveCmd.Flags().BoolVar(&receiveInsecure, "insecure", receiveInsecure, "accept memr+tcp:// outputs without TLS or authenticating clients")
+	receiveCmd.Flags().StringVarP(&region, "region", "r", region, "AWS region to use with S3 client")
+	receiveCmd.Flags().StringVar(&s3Opts.endpoint, "endpoint-url", s3Opts.endpoint, "custom S3 endpoint URL, for S3-compatible stores (eg: MinIO or Ceph RGW)")
+	receiveCmd.Flags().BoolVar(&s3Opts.pathStyle, "path-style", s3Opts.pathStyle, "use path-style addressing for S3 (eg: https://<HOST>/<BUCKET>/<KEY>), typically with --endpoint-url")
+	receiveCmd.Flags().StringVar(&s3Opts.sse, "sse", s3Opts.sse, "server-side encryption for the S3 objects (one of: none, s3, kms)")
+	receiveCmd.Flags().StringVar(&s3Opts.kmsKeyID, "sse-kms-key-id", s3Opts.kmsKeyID, "KMS key ID for --sse kms (default is the AWS managed key)")
+	receiveCmd.Flags().StringToStringVar(&s3Opts.tags, "tags", s3Opts.tags, "tags for the S3 objects (eg: retention=90d,case=1234)")
+	receiveCmd.Flags().StringVar(&s3Opts.storageClass, "storage-class", s3Opts.storageClass, "storage class for the S3 objects (eg: STANDARD_IA)")
+
+	rootCmd.AddCommand(receiveCmd)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryandeivert/memr"
+)
+
+// setReceiveOutput sets the --output of the collector for the test
+func setReceiveOutput(t *testing.T, output string) {
+	previous := receiveOutput
+	receiveOutput = output
+	t.Cleanup(func() { receiveOutput = previous })
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := map[string]string{
+		"web-01":                 "web-01",
+		"web-01.example.com":     "web-01.example.com",
+		"../../etc/passwd":       "_.._etc_passwd",
+		"host name/with\\slashs": "host_name_with_slashs",
+		"..":                     "",
+		"2001:db8::1":            "2001_db8__1",
+	}
+	for name, want := range tests {
+		if got := sanitizeName(name); got != want {
+			t.Errorf("sanitizeName(%q): got %q; want %q", name, got, want)
+		}
+	}
+}
+
+func TestCaptureName(t *testing.T) {
+	received := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	none := func(string) bool { return false }
+
+	tests := []struct {
+		header streamHeader
+		want   string
+	}{
+		{streamHeader{Format: "lime", Compression: "snappy"}, "web-01-20260102T150405Z.lime.sz"},
+		{streamHeader{Format: "elf"}, "web-01-20260102T150405Z.elf"},
+		{streamHeader{Format: "lime", Compression: "snappy", Encryption: memr.EncryptionAge}, "web-01-20260102T150405Z.lime.sz.age"},
+		{streamHeader{Format: "../lime", Compression: "zstd/x"}, "web-01-20260102T150405Z._lime.zstd_x"},
+		{streamHeader{}, "web-01-20260102T150405Z"},
+	}
+	for _, test := range tests {
+		if got := captureName("web-01", &test.header, received, none); got != test.want {
+			t.Errorf("captureName(%+v): got %q; want %q", test.header, got, test.want)
+		}
+	}
+
+	// Names that are taken are numbered
+	taken := map[string]bool{
+		"web-01-20260102T150405Z.lime.sz":   true,
+		"web-01-20260102T150405Z-1.lime.sz": true,
+	}
+	header := &streamHeader{Format: "lime", Compression: "snappy"}
+	name := captureName("web-01", header, received, func(name string) bool { return taken[name] })
+	if name != "web-01-20260102T150405Z-2.lime.sz" {
+		t.Errorf("unexpected name when taken: %s", name)
+	}
+}
+
+func TestReserveName(t *testing.T) {
+	dir := t.TempDir()
+	setReceiveOutput(t, dir)
+
+	received := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	header := &streamHeader{Format: "lime"}
+
+	// Captures being received, or already stored, are not overwritten
+	first, releaseFirst := reserveName(context.Background(), "web-01", header, received)
+	second, releaseSecond := reserveName(context.Background(), "web-01", header, received)
+	if first == second {
+		t.Fatalf("name reserved twice: %s", first)
+	}
+	if err := os.WriteFile(filepath.Join(dir, first), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	releaseFirst()
+	releaseSecond()
+
+	if name, release := reserveName(context.Background(), "web-01", header, received); name != second {
+		t.Errorf("expected released name %s to be reused: got %s", second, name)
+	} else {
+		release()
+	}
+	if len(receiving) != 0 {
+		t.Errorf("names were not released: %v", receiving)
+	}
+}
+
+func TestCaptureExistsS3(t *testing.T) {
+	s3 := newFakeS3(t)
+	s3.use(t)
+	setReceiveOutput(t, "s3://bkt/captures")
+
+	sink, err := openSink(context.Background(), receiveURL("web-01-20260102T150405Z.lime"), sinkOptions{size: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sink.Write([]byte("lime")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !captureExists(context.Background(), "web-01-20260102T150405Z.lime") {
+		t.Error("expected the uploaded capture to exist")
+	}
+	if captureExists(context.Background(), "web-01-20260102T150405Z-1.lime") {
+		t.Error("expected a capture that was not uploaded not to exist")
+	}
+}
+
+// receiveStream sends the data to storeCapture through a net.Pipe using the stream sink,
+// returning the error from closing the sink (which waits for the reply)
+func receiveStream(t *testing.T, opts sinkOptions, data []byte) (*receipt, Sink, error) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	rcpt := &receipt{Client: "web-01", RemoteAddr: "pipe", Received: time.Now().UTC()}
+	go func() {
+		defer server.Close()
+		location, err := storeCapture(context.Background(), server, rcpt)
+		reply := streamReply{Location: location}
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		writeMessage(server, reply) //nolint:errcheck
+	}()
+
+	sink, err := startStream(client, "memr+tcp://collector:9443", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > 100000 {
+			n = 100000
+		}
+		if _, err := sink.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+
+	return rcpt, sink, sink.Close()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	setReceiveOutput(t, dir)
+
+	data := randomData(3*maxFrameSize + 12345)
+	opts := sinkOptions{
+		size:        uint64(len(data)),
+		format:      "lime",
+		compression: "snappy",
+		metadata:    map[string]string{"memr-host": "web-01", "memr-client": "spoofed"},
+		ranges:      []memr.OutputRange{{Start: 0x1000, End: 0x2000, Offset: 32}},
+	}
+	rcpt, sink, err := receiveStream(t, opts, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(sink.Location(), dir+string(filepath.Separator)+"web-01-") || !strings.HasSuffix(sink.Location(), ".lime.sz") {
+		t.Errorf("unexpected location reported by the collector: %s", sink.Location())
+	}
+	stored, err := ioutil.ReadFile(sink.Location())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Error("stored capture does not match the data sent")
+	}
+
+	if !rcpt.Verified || rcpt.Trailer.Size != int64(len(data)) {
+		t.Errorf("unexpected receipt: verified=%v; trailer=%+v", rcpt.Verified, rcpt.Trailer)
+	}
+	header := rcpt.Header
+	if header.Size != uint64(len(data)) || header.Format != "lime" || header.Compression != "snappy" ||
+		len(header.Ranges) != 1 || header.Ranges[0] != (streamRange{Start: 0x1000, End: 0x2000, Offset: 32}) {
+		t.Errorf("unexpected header: %+v", header)
+	}
+
+	var written receipt
+	if err := json.Unmarshal(mustReadFile(t, sink.Location()+".json"), &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Location != sink.Location() || !written.Verified || written.Header.Metadata["memr-client"] != "spoofed" {
+		t.Errorf("unexpected receipt written: %+v", written)
+	}
+}
+
+func TestStoreCaptureTrailerMismatch(t *testing.T) {
+	setReceiveOutput(t, t.TempDir())
+	data := []byte("captured data")
+
+	var buf bytes.Buffer
+	buf.WriteString(streamMagic)
+	writeMessage(&buf, streamHeader{Format: "raw", Hashes: []memr.Hash{streamHash}}) //nolint:errcheck
+	buf.Write(frames(data, maxFrameSize))
+	stream := buf.Len()
+
+	hasher, _ := memr.NewHasher(streamHash)
+	hasher.Write(data)
+	for _, test := range []struct {
+		trailer streamTrailer
+		err     string
+	}{
+		{streamTrailer{Size: int64(len(data)) - 1, Hashes: hasher.Sums()}, "size of the data received does not match"},
+		{streamTrailer{Size: int64(len(data)), Hashes: map[memr.Hash]string{streamHash: "tampered"}}, "sha256 of the data received does not match"},
+	} {
+		buf.Truncate(stream)
+		writeMessage(&buf, test.trailer) //nolint:errcheck
+
+		rcpt := &receipt{Client: "web-01", Received: time.Now().UTC()}
+		_, err := storeCapture(context.Background(), bytes.NewReader(buf.Bytes()), rcpt)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("expected error %q: %v", test.err, err)
+		}
+		if rcpt.Verified {
+			t.Error("expected the capture not to be verified")
+		}
+	}
+
+	// Truncated data, and another protocol entirely
+	truncated := buf.Bytes()[:stream-6]
+	if _, err := storeCapture(context.Background(), bytes.NewReader(truncated), &receipt{Client: "web-01"}); err == nil || !strings.Contains(err.Error(), "unexpected EOF") {
+		t.Errorf("expected truncated data to fail: %v", err)
+	}
+	if _, err := storeCapture(context.Background(), strings.NewReader("GET / HTTP/1.1\r\n"), &receipt{Client: "web-01"}); err == nil || !strings.Contains(err.Error(), "unsupported protocol") {
+		t.Errorf("expected another protocol to be rejected: %v", err)
+	}
+}
+
+// testPKI is a CA, along with certificates it issued to a server and client
+type testPKI struct {
+	caFile, serverCert, serverKey, clientCert, clientKey string
+}
+
+// newTestPKI writes a CA, and the certificates of a server (localhost) and client (web-01)
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "memr test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writePEM := func(name, kind string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage, dnsNames ...string) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     dnsNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return writePEM(name+".pem", "CERTIFICATE", der), writePEM(name+"-key.pem", "PRIVATE KEY", keyDER)
+	}
+
+	pki := &testPKI{caFile: writePEM("ca.pem", "CERTIFICATE", caDER)}
+	pki.serverCert, pki.serverKey = issue("localhost", 2, x509.ExtKeyUsageServerAuth, "localhost")
+	pki.clientCert, pki.clientKey = issue("web-01", 3, x509.ExtKeyUsageClientAuth)
+	return pki
+}
+
+// acceptClient accepts a connection using the collector's TLS configuration,
+// returning the name of the client or the error authenticating it
+func acceptClient(t *testing.T, pki *testPKI, clientCert, clientKey string) (string, error) {
+	t.Helper()
+
+	receiveCert, receiveKey, receiveClientCA = pki.serverCert, pki.serverKey, pki.caFile
+	tlsCertFile, tlsKeyFile, tlsCAFile = clientCert, clientKey, pki.caFile
+	t.Cleanup(func() {
+		receiveCert, receiveKey, receiveClientCA = "", "", ""
+		tlsCertFile, tlsKeyFile, tlsCAFile = "", "", ""
+	})
+
+	config, err := serverTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The client's half of the handshake completes before the server verifies its certificate
+	go func() {
+		clientConfig, err := clientTLSConfig("localhost")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err == nil {
+			ioutil.ReadAll(conn) //nolint:errcheck
+			conn.Close()
+		}
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return clientName(conn)
+}
+
+func TestClientName(t *testing.T) {
+	pki := newTestPKI(t)
+
+	name, err := acceptClient(t, pki, pki.clientCert, pki.clientKey)
+	if err != nil || name != "web-01" {
+		t.Errorf("expected client web-01 to be authenticated: name=%q; err=%v", name, err)
+	}
+
+	// A client without a certificate is rejected during the handshake
+	if name, err := acceptClient(t, pki, "", ""); err == nil {
+		t.Errorf("expected client without a certificate to be rejected: name=%q", name)
+	}
+
+	// As is a client whose certificate was not issued by the --client-ca
+	other := newTestPKI(t)
+	if name, err := acceptClient(t, pki, other.clientCert, other.clientKey); err == nil {
+		t.Errorf("expected client with an untrusted certificate to be rejected: name=%q", name)
+	}
+}
+
+func TestClientNameInsecure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		if conn, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+			binary.Write(conn, binary.BigEndian, uint32(0)) //nolint:errcheck
+			conn.Close()
+		}
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Without TLS, clients are named by their address
+	if name, err := clientName(conn); err != nil || name != "127.0.0.1" {
+		t.Errorf("unexpected name of client: name=%q; err=%v", name, err)
+	}
+}
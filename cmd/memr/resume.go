@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/golang/snappy"
+	"github.com/ryandeivert/memr"
+)
+
+// maxResumeDelay is the longest time waited before resuming a failed upload
+const maxResumeDelay = time.Minute
+
+// resumeState is the state of a resumable upload to S3, which is saved to the file
+// given by --resume-state as each part is uploaded. If the upload is interrupted,
+// running memr again with the same file continues the same multipart upload.
+type resumeState struct {
+	Output      string         `json:"output"`
+	UploadID    string         `json:"upload_id"`
+	Source      string         `json:"source"`
+	Format      string         `json:"format"`
+	Compression string         `json:"compression,omitempty"`
+	Size        uint64         `json:"size"` // expected size of the image
+	PartSize    int64          `json:"part_size"`
+	Started     time.Time      `json:"started"`
+	Updated     time.Time      `json:"updated"` // when the last part was uploaded
+	Parts       []uploadedPart `json:"parts"`
+	Resumes     []resumeReport `json:"resumes"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// uploadedPart is a part of the upload, along with the portion of the image it contains
+type uploadedPart struct {
+	Number   int32  `json:"number"`
+	ETag     string `json:"etag"`
+	Checksum string `json:"checksum,omitempty"` // using the --checksum-algorithm, if any
+	Start    uint64 `json:"start"`              // offset in the image
+	End      uint64 `json:"end"`                // exclusive
+	Size     int64  `json:"size"`               // bytes uploaded, after any compression
+}
+
+// loadResumeState loads the state of the upload to output from the file at path,
+// or returns a new state if the file does not exist
+func loadResumeState(path, output string) (*resumeState, error) {
+	state := &resumeState{Output: output, path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid resume state in %s: %w", path, err)
+	}
+	if state.Output != output {
+		return nil, fmt.Errorf("resume state in %s is for a different output: %s", path, state.Output)
+	}
+
+	return state, nil
+}
+
+// check checks that a resumed upload is for the same capture as the reader, or
+// otherwise records the capture for a new upload
+func (s *resumeState) check(reader *memr.Reader, compression string) error {
+	source, format := reader.Source().String(), reader.Format.String()
+	if s.UploadID == "" {
+		s.Source, s.Format, s.Compression, s.Size = source, format, compression, reader.Size()
+		return nil
+	}
+
+	if s.Source != source || s.Format != format || s.Compression != compression || s.Size != reader.Size() {
+		return fmt.Errorf(
+			"resume state in %s is for a different capture (source=%s; format=%s; compression=%q; size=%d)",
+			s.path, s.Source, s.Format, s.Compression, s.Size,
+		)
+	}
+
+	return nil
+}
+
+// offset returns the offset in the image at which the upload resumes, which
+// is the end of the parts uploaded without any gaps in their numbers
+func (s *resumeState) offset() uint64 {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := s.contiguous()
+	if len(parts) == 0 {
+		return 0
+	}
+	return parts[len(parts)-1].End
+}
+
+// contiguous returns the parts uploaded without any gaps in their numbers.
+// Any parts after a gap are uploaded again once resumed, since their content may differ.
+func (s *resumeState) contiguous() []uploadedPart {
+	for i, part := range s.Parts {
+		if part.Number != int32(i+1) {
+			return s.Parts[:i]
+		}
+	}
+	return s.Parts
+}
+
+// trim discards any parts after a gap in their numbers, saving the state
+func (s *resumeState) trim() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Parts = s.contiguous()
+	return s.save()
+}
+
+// addPart records the part as uploaded
+func (s *resumeState) addPart(part uploadedPart) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Parts = append(s.Parts, part)
+	sort.Slice(s.Parts, func(i, j int) bool { return s.Parts[i].Number < s.Parts[j].Number })
+	s.Updated = time.Now()
+
+	return s.save()
+}
+
+// resumed records that the upload was resumed at the offset, after being interrupted
+func (s *resumeState) resumed(offset uint64, interrupted time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.Resumes = append(s.Resumes, resumeReport{
+		Offset:      offset,
+		Interrupted: interrupted,
+		Resumed:     now,
+		Gap:         now.Sub(interrupted).Seconds(),
+	})
+
+	return s.save()
+}
+
+// save writes the state to its file, replacing it only once written in full
+func (s *resumeState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// uploadError is a failure uploading part of a resumable upload, after which the upload can be resumed
+type uploadError struct {
+	number int32
+	err    error
+}
+
+func (e *uploadError) Error() string {
+	return fmt.Sprintf("failed to upload part %d: %s", e.number, e.err)
+}
+
+func (e *uploadError) Unwrap() error {
+	return e.err
+}
+
+// resumableS3Writer is a Sink uploading the output to S3 using a multipart upload, whose
+// state is saved as each part is uploaded (see resumeState). Unlike the S3Writer, each
+// part contains a known portion of the image, so that reading can be resumed at the end of
+// the last part. When compressing, each part is compressed separately as its own snappy
+// stream, and the resulting streams are decompressed as one. On failure, the upload is
+// left in place to be resumed.
+type resumableS3Writer struct {
+	*s3Object
+	state    *resumeState
+	compress bool
+	hasher   *memr.Hasher // hashes the data uploaded, if not nil
+	partSize int64
+	parent   context.Context
+	location string
+	counter
+
+	// state of the current session, from begin until the uploader is stopped
+	buf      *bytes.Buffer
+	snappy   *snappy.Writer
+	start    uint64 // offset in the image of the current part
+	offset   uint64 // offset in the image of the next byte written
+	uploader *partUploader
+}
+
+// newResumableS3Writer opens a resumable upload to the s3://bucket/key URL, either
+// continuing the upload in the state, or creating a new multipart upload
+func newResumableS3Writer(ctx context.Context, output string, opts sinkOptions, state *resumeState, compress bool, hasher *memr.Hasher) (*resumableS3Writer, error) {
+	u, err := url.Parse(output)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := newS3Object(ctx, u, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &resumableS3Writer{
+		s3Object: object,
+		state:    state,
+		compress: compress,
+		hasher:   hasher,
+		parent:   ctx,
+		location: u.String(),
+	}
+
+	if state.UploadID != "" {
+		offset := state.offset()
+		log.Printf("[INFO] resuming multipart upload %s at offset %d", state.UploadID, offset)
+		if err := state.resumed(offset, state.Updated); err != nil {
+			return nil, fmt.Errorf("failed to save resume state: %w", err)
+		}
+	} else if err := w.create(); err != nil {
+		return nil, err
+	}
+
+	w.partSize = state.PartSize
+	w.begin()
+
+	return w, nil
+}
+
+// create creates the multipart upload, saving its state
+func (w *resumableS3Writer) create() error {
+	in := w.input
+	result, err := w.client.CreateMultipartUpload(w.parent, &s3.CreateMultipartUploadInput{
+		Bucket:               in.Bucket,
+		Key:                  in.Key,
+		ACL:                  in.ACL,
+		Metadata:             in.Metadata,
+		Tagging:              in.Tagging,
+		ServerSideEncryption: in.ServerSideEncryption,
+		SSEKMSKeyId:          in.SSEKMSKeyId,
+		SSECustomerAlgorithm: in.SSECustomerAlgorithm,
+		SSECustomerKey:       in.SSECustomerKey,
+		SSECustomerKeyMD5:    in.SSECustomerKeyMD5,
+		StorageClass:         in.StorageClass,
+		ChecksumAlgorithm:    in.ChecksumAlgorithm,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+
+	w.state.UploadID = aws.ToString(result.UploadId)
+	w.state.PartSize = partSize(w.state.Size)
+	w.state.Started = time.Now()
+	w.state.Updated = w.state.Started
+	log.Printf("[INFO] created multipart upload %s, with state in %s", w.state.UploadID, w.state.path)
+
+	if err := w.state.save(); err != nil {
+		return fmt.Errorf("failed to save resume state: %w", err)
+	}
+
+	return nil
+}
+
+// begin starts writing at the offset at which the upload resumes, starting
+// the uploader of each part
+func (w *resumableS3Writer) begin() {
+	w.state.Parts = w.state.contiguous()
+	w.start = w.state.offset()
+	w.offset = w.start
+
+	w.written = 0
+	for _, part := range w.state.Parts {
+		w.written += part.Size
+	}
+
+	w.buf = new(bytes.Buffer)
+	if w.compress {
+		w.snappy = snappy.NewBufferedWriter(w.buf)
+	}
+
+	w.uploader = newPartUploader(w.parent, int32(len(w.state.Parts))+1, w.upload)
+}
+
+func (w *resumableS3Writer) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if err := w.uploader.failure(); err != nil {
+			return n, err
+		}
+
+		// Parts are compressed as they are written, so are only cut once large enough
+		chunk := p
+		if room := w.partSize - int64(w.buf.Len()); !w.compress && int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		if w.compress {
+			_, err = w.snappy.Write(chunk)
+		} else {
+			_, err = w.buf.Write(chunk)
+		}
+		if err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		w.offset += uint64(len(chunk))
+		p = p[len(chunk):]
+
+		if int64(w.buf.Len()) >= w.partSize {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// flush hands the current part off to be uploaded, and starts the next part
+func (w *resumableS3Writer) flush() error {
+	if w.compress {
+		if err := w.snappy.Close(); err != nil {
+			return err
+		}
+	}
+
+	if w.uploader.number > manager.MaxUploadParts {
+		return fmt.Errorf("upload exceeds the maximum of %d parts", manager.MaxUploadParts)
+	}
+
+	data := w.buf.Bytes()
+	part := &pendingPart{
+		uploadedPart: uploadedPart{Start: w.start, End: w.offset, Size: int64(len(data))},
+		data:         data,
+	}
+	if w.hasher != nil {
+		w.hasher.Write(data)
+	}
+
+	if err := w.uploader.send(part); err != nil {
+		return err
+	}
+	w.count(len(data), nil)
+
+	w.start = w.offset
+	w.buf = new(bytes.Buffer)
+	if w.compress {
+		w.snappy.Reset(w.buf)
+	}
+
+	return nil
+}
+
+// upload uploads the part, and records it in the state
+func (w *resumableS3Writer) upload(ctx context.Context, part *pendingPart) error {
+	in := w.input
+	result, err := w.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:               in.Bucket,
+		Key:                  in.Key,
+		UploadId:             aws.String(w.state.UploadID),
+		PartNumber:           part.Number,
+		Body:                 bytes.NewReader(part.data),
+		ContentLength:        int64(len(part.data)),
+		ChecksumAlgorithm:    in.ChecksumAlgorithm,
+		SSECustomerAlgorithm: in.SSECustomerAlgorithm,
+		SSECustomerKey:       in.SSECustomerKey,
+		SSECustomerKeyMD5:    in.SSECustomerKeyMD5,
+	})
+	if err != nil {
+		return &uploadError{number: part.Number, err: err}
+	}
+
+	part.ETag = aws.ToString(result.ETag)
+	part.Checksum = aws.ToString(partChecksum(in.ChecksumAlgorithm, result))
+	log.Printf("[DEBUG] uploaded part %d: offset=%d; end=%d; size=%d", part.Number, part.Start, part.End, part.Size)
+
+	if err := w.state.addPart(part.uploadedPart); err != nil {
+		return &uploadError{number: part.Number, err: fmt.Errorf("failed to save resume state: %w", err)}
+	}
+
+	return nil
+}
+
+// finish uploads the last part once all data is written, and waits for all parts to be uploaded
+func (w *resumableS3Writer) finish() error {
+	return w.uploader.finish(w.offset > w.start, w.flush)
+}
+
+// Close completes the upload once all parts are uploaded, removing the state file
+func (w *resumableS3Writer) Close() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+
+	var completed []types.CompletedPart
+	for _, part := range w.state.Parts {
+		completedPart := types.CompletedPart{PartNumber: part.Number, ETag: aws.String(part.ETag)}
+		setPartChecksum(&completedPart, w.input.ChecksumAlgorithm, part.Checksum)
+		completed = append(completed, completedPart)
+	}
+
+	result, err := w.client.CompleteMultipartUpload(w.parent, &s3.CompleteMultipartUploadInput{
+		Bucket:               w.input.Bucket,
+		Key:                  w.input.Key,
+		UploadId:             aws.String(w.state.UploadID),
+		MultipartUpload:      &types.CompletedMultipartUpload{Parts: completed},
+		SSECustomerAlgorithm: w.input.SSECustomerAlgorithm,
+		SSECustomerKey:       w.input.SSECustomerKey,
+		SSECustomerKeyMD5:    w.input.SSECustomerKeyMD5,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload %s: %w", w.state.UploadID, err)
+	}
+
+	w.location = aws.ToString(result.Location)
+	if err := os.Remove(w.state.path); err != nil {
+		log.Printf("[WARN] failed to remove resume state %s: %s", w.state.path, err)
+	}
+
+	return nil
+}
+
+// Abort stops uploading after the failure err, once any parts being uploaded are complete.
+// The upload is left in place, so that it can be resumed using the state file, which only
+// keeps the parts up to the first that failed.
+func (w *resumableS3Writer) Abort(err error) {
+	w.uploader.fail(err)
+	w.uploader.stop()
+	if err := w.state.trim(); err != nil {
+		log.Printf("[WARN] failed to save resume state %s: %s", w.state.path, err)
+	}
+	log.Printf("[INFO] multipart upload %s can be resumed at offset %d using: --resume-state %s", w.state.UploadID, w.state.offset(), w.state.path)
+}
+
+func (w *resumableS3Writer) Location() string {
+	return w.location
+}
+
+// UpdateMetadata adds the metadata to the uploaded object, by copying the object in place
+// (see updateMetadata)
+func (w *resumableS3Writer) UpdateMetadata(ctx context.Context, metadata map[string]string) error {
+	return w.updateMetadata(ctx, metadata, w.Written())
+}
+
+// copyResumable copies the output of the reader to the sink. If uploading a part fails, the
+// upload is resumed up to resumeRetries times, reopening the reader (using reopen) at the end
+// of the parts uploaded so far. The reader from which the output was last read is returned.
+func copyResumable(ctx context.Context, reader *memr.Reader, sink *resumableS3Writer, reopen func(offset uint64) (*memr.Reader, error)) (*memr.Reader, error) {
+	for attempt := 1; ; attempt++ {
+		_, err := io.Copy(sink, reader)
+		if err == nil {
+			err = sink.finish()
+		}
+		if err == nil {
+			return reader, nil
+		}
+		sink.Abort(err)
+
+		var uErr *uploadError
+		if !errors.As(err, &uErr) || ctx.Err() != nil || attempt > resumeRetries {
+			return reader, err
+		}
+
+		interrupted := time.Now()
+		delay := time.Duration(1<<uint(attempt-1)) * time.Second
+		if delay > maxResumeDelay {
+			delay = maxResumeDelay
+		}
+		log.Printf("[WARN] %s; resuming in %s (attempt %d of %d)", err, delay, attempt, resumeRetries)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return reader, ctx.Err()
+		}
+
+		offset := sink.state.offset()
+		reader.Close()
+		resumed, err := reopen(offset)
+		if err != nil {
+			return reader, fmt.Errorf("failed to reopen memory reader at offset %d: %w", offset, err)
+		}
+		reader = resumed
+
+		if err := sink.state.resumed(offset, interrupted); err != nil {
+			return reader, fmt.Errorf("failed to save resume state: %w", err)
+		}
+		log.Printf("[INFO] resuming multipart upload %s at offset %d", sink.state.UploadID, offset)
+		sink.begin()
+	}
+}
+
+// partChecksum returns the checksum of an uploaded part using the algorithm, if any
+func partChecksum(algorithm types.ChecksumAlgorithm, result *s3.UploadPartOutput) *string {
+	switch algorithm {
+	case types.ChecksumAlgorithmCrc32:
+		return result.ChecksumCRC32
+	case types.ChecksumAlgorithmCrc32c:
+		return result.ChecksumCRC32C
+	case types.ChecksumAlgorithmSha1:
+		return result.ChecksumSHA1
+	case types.ChecksumAlgorithmSha256:
+		return result.ChecksumSHA256
+	}
+	return nil
+}
+
+// setPartChecksum sets the checksum of a part using the algorithm, if any
+func setPartChecksum(part *types.CompletedPart, algorithm types.ChecksumAlgorithm, checksum string) {
+	if checksum == "" {
+		return
+	}
+	switch algorithm {
+	case types.ChecksumAlgorithmCrc32:
+		part.ChecksumCRC32 = aws.String(checksum)
+	case types.ChecksumAlgorithmCrc32c:
+		part.ChecksumCRC32C = aws.String(checksum)
+	case types.ChecksumAlgorithmSha1:
+		part.ChecksumSHA1 = aws.String(checksum)
+	case types.ChecksumAlgorithmSha256:
+		part.ChecksumSHA256 = aws.String(checksum)
+	}
+}
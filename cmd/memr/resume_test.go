@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResumeStateContiguous(t *testing.T) {
+	state := &resumeState{path: filepath.Join(t.TempDir(), "state.json")}
+	if offset := (*resumeState)(nil).offset(); offset != 0 {
+		t.Errorf("offset of nil state: got %d; want 0", offset)
+	}
+
+	for _, part := range []uploadedPart{
+		{Number: 4, Start: 300, End: 400},
+		{Number: 1, Start: 0, End: 100},
+		{Number: 2, Start: 100, End: 200},
+	} {
+		if err := state.addPart(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if offset := state.offset(); offset != 200 {
+		t.Errorf("offset: got %d; want 200", offset)
+	}
+
+	if err := state.trim(); err != nil {
+		t.Fatal(err)
+	}
+	saved := readResumeState(t, state.path)
+	if got := partNumbers(saved.Parts); !reflect.DeepEqual(got, []int32{1, 2}) {
+		t.Errorf("saved parts: got %v; want [1 2]", got)
+	}
+}
+
+// readResumeState reads the state saved to the file at path
+func readResumeState(t *testing.T, path string) *resumeState {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state resumeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	return &state
+}
+
+func partNumbers(parts []uploadedPart) []int32 {
+	var numbers []int32
+	for _, part := range parts {
+		numbers = append(numbers, part.Number)
+	}
+	return numbers
+}
+
+// failPartOnce fails the first upload of part n of an upload with the state file, only
+// once part n+1 is recorded in the state, so that parts after n are in flight when it fails
+func failPartOnce(t *testing.T, s3 *fakeS3, statePath string, n int) {
+	var once sync.Once
+	s3.setOnPart(func(_ string, number int) int {
+		status := 0
+		if number != n {
+			return status
+		}
+		once.Do(func() {
+			deadline := time.Now().Add(30 * time.Second)
+			for time.Now().Before(deadline) {
+				if data, err := ioutil.ReadFile(statePath); err == nil {
+					var state resumeState
+					if json.Unmarshal(data, &state) == nil {
+						for _, part := range state.Parts {
+							if int(part.Number) == n+1 {
+								status = 403
+								return
+							}
+						}
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			t.Errorf("part %d was not uploaded while part %d was in flight", n+1, n)
+			status = 403
+		})
+		return status
+	})
+}
+
+func resumeArgs(s3 *fakeS3, image, state, manifest string, retries int) []string {
+	return []string{
+		"--image", image,
+		"--output", "s3://bkt/capture.lime.sz",
+		"--endpoint-url", s3.URL,
+		"--path-style",
+		"--resume-state", state,
+		"--resume-retries", strconv.Itoa(retries),
+		"--manifest", manifest,
+		"--concurrency", "3",
+		"--progress=false",
+	}
+}
+
+// checkResumedUpload checks the object uploaded by a resumed upload, and its manifest
+func checkResumedUpload(t *testing.T, s3 *fakeS3, image []byte, manifestPath string) *manifest {
+	t.Helper()
+
+	object := s3.object("bkt/capture.lime.sz")
+	if object == nil {
+		t.Fatal("object was not uploaded")
+	}
+	if len(object.parts) < 4 {
+		t.Errorf("expected at least 4 parts: got %v", object.parts)
+	}
+	for i, number := range object.parts {
+		if number != i+1 {
+			t.Errorf("unexpected parts: %v", object.parts)
+			break
+		}
+	}
+	if !bytes.Equal(decompress(t, object.data), image) {
+		t.Error("decompressed object does not match the image")
+	}
+
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Resumes) != 1 {
+		t.Errorf("resumes in manifest: got %d; want 1", len(m.Resumes))
+	}
+	if m.Image != nil || m.OutputStream != nil {
+		t.Errorf("expected no digests of a resumed image: image=%v; output_stream=%v", m.Image, m.OutputStream)
+	}
+	if m.OutputSize != int64(len(object.data)) {
+		t.Errorf("output size in manifest: got %d; want %d", m.OutputSize, len(object.data))
+	}
+
+	return &m
+}
+
+func TestResumeFromStateFile(t *testing.T) {
+	s3 := newFakeS3(t)
+	image, data := writeTestLiME(t, 1, testRange{0x1000, 12 << 20}, testRange{0x1000000, 12 << 20})
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "state.json")
+	manifestPath := filepath.Join(dir, "manifest.json")
+
+	failPartOnce(t, s3, statePath, 2)
+	out, err := runMemr(t, resumeArgs(s3, image, statePath, manifestPath, 0)...)
+	if err == nil || !strings.Contains(out, "failed to upload part 2") {
+		t.Fatalf("expected part 2 to fail: err=%v; output:\n%s", err, out)
+	}
+
+	// Part 3 was uploaded, but only the parts before the failure are kept
+	state := readResumeState(t, statePath)
+	if got := partNumbers(state.Parts); !reflect.DeepEqual(got, []int32{1}) {
+		t.Fatalf("saved parts: got %v; want [1]", got)
+	}
+	if pending := s3.pending(); !reflect.DeepEqual(pending, []string{state.UploadID}) {
+		t.Fatalf("expected the upload to be left in place: got %v", pending)
+	}
+
+	// A state file for a different capture is rejected, even if it is smaller than the offset
+	other, _ := writeTestLiME(t, 2, testRange{0x1000, 1 << 20})
+	otherState := filepath.Join(dir, "other.json")
+	if err := os.WriteFile(otherState, mustReadFile(t, statePath), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runMemr(t, resumeArgs(s3, other, otherState, manifestPath, 0)...)
+	if err == nil || !strings.Contains(out, "is for a different capture") {
+		t.Fatalf("expected a different capture to be rejected: err=%v; output:\n%s", err, out)
+	}
+
+	if out, err := runMemr(t, resumeArgs(s3, image, statePath, manifestPath, 0)...); err != nil {
+		t.Fatalf("failed to resume upload: %v; output:\n%s", err, out)
+	}
+
+	m := checkResumedUpload(t, s3, data, manifestPath)
+	if len(m.Resumes) == 1 && m.Resumes[0].Offset != state.Parts[0].End {
+		t.Errorf("resumed at offset %d; want %d", m.Resumes[0].Offset, state.Parts[0].End)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("expected state file to be removed: %v", err)
+	}
+}
+
+func TestResumeInProcess(t *testing.T) {
+	s3 := newFakeS3(t)
+	image, data := writeTestLiME(t, 3, testRange{0x1000, 12 << 20}, testRange{0x1000000, 12 << 20})
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "state.json")
+	manifestPath := filepath.Join(dir, "manifest.json")
+
+	failPartOnce(t, s3, statePath, 2)
+	out, err := runMemr(t, resumeArgs(s3, image, statePath, manifestPath, 1)...)
+	if err != nil {
+		t.Fatalf("failed to upload: %v; output:\n%s", err, out)
+	}
+	if !strings.Contains(out, "resuming in") {
+		t.Errorf("expected the upload to be resumed; output:\n%s", out)
+	}
+
+	m := checkResumedUpload(t, s3, data, manifestPath)
+	if len(m.Resumes) == 1 && (m.Resumes[0].Offset == 0 || m.Resumes[0].Offset >= uint64(len(data))) {
+		t.Errorf("unexpected offset at which the upload resumed: %d", m.Resumes[0].Offset)
+	}
+}
+
+func TestResumeSSEC(t *testing.T) {
+	s3 := newFakeS3(t)
+	image, data := writeTestLiME(t, 4, testRange{0x1000, 12 << 20}, testRange{0x1000000, 12 << 20})
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "state.json")
+	manifestPath := filepath.Join(dir, "manifest.json")
+	keyPath := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyPath, bytes.Repeat([]byte{0x5a}, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every request of the upload, including completing it, must use the customer key
+	failPartOnce(t, s3, statePath, 2)
+	args := append(resumeArgs(s3, image, statePath, manifestPath, 1), "--sse", "c", "--sse-c-key", keyPath, "--checksum-algorithm", "SHA256")
+	out, err := runMemr(t, args...)
+	if err != nil {
+		t.Fatalf("failed to upload: %v; output:\n%s", err, out)
+	}
+
+	checkResumedUpload(t, s3, data, manifestPath)
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
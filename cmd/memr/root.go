@@ -2,21 +2,28 @@ package main
 
 /*
 
-This CLI demonstrates using memr both for writing to a file and copying
-to S3 using manager.Uploader. However, this could be extended to do
-things like copying to os.Stdout, using io.Copy(os.Stdout, reader), or
-uploading to other cloud providers.
+This CLI demonstrates using memr for writing to a file, stdout, a TCP or
+HTTP endpoint, or copying to S3 using manager.Uploader. Each destination
+is a Sink, selected by the scheme of the --output URL (see sink.go), so
+this can be extended to upload to other cloud providers by registering
+additional sinks.
 
 */
 
 import (
+	"context"
+	"crypto/ed25519"
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"filippo.io/age"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/golang/snappy"
 	"github.com/ryandeivert/memr"
 	"github.com/spf13/cobra"
 )
@@ -27,10 +34,23 @@ var (
 	compress              = true
 	useAccelerate         = false
 	progress              = true
-	allDevices            = []string{"/proc/kcore", "/dev/crash", "/dev/mem"}
 	region                = "us-east-1"
 	s3Bucket, s3ObjectKey string
 	localFile             string
+	output                string
+	skipBadPages          = false
+	pageRetries           = 3
+	manifestFile          string
+	hashNames             = []string{string(memr.HashSHA256)}
+	signKeyFile           string
+	encryptTo             []string
+	imageFile             string
+	rangeMapFile          string
+	outputFormatName      = "lime"
+	resumeStateFile       string
+	resumeRetries         = 5
+	splitSizeValue        string
+	splitSize             uint64
 )
 
 // rootCmd is the entry point command for the CLI
@@ -43,6 +63,13 @@ var rootCmd = &cobra.Command{
 Writing to local file:
 memr --local-file <FILE>
 
+Writing to stdout, and piping to another tool:
+memr --output - | <COMMAND>
+
+Streaming to a collector (see: memr receive) authenticating with a client certificate, or to an HTTP endpoint accepting PUT requests:
+memr --output tls://<HOST>:<PORT> --tls-cert <CERT_FILE> --tls-key <KEY_FILE> --tls-ca <CA_FILE>
+memr --output https://<HOST>/<PATH>
+
 Streaming directly to S3 bucket:
 memr --bucket <BUCKET> --key <KEY>
 
@@ -52,82 +79,341 @@ memr --accelerate --bucket <BUCKET> --key <KEY>
 Targeting a specific device:
 memr /dev/mem --local-file <FILE>
 
+Uploading to MinIO with path-style addressing, SSE-S3 and retention tags:
+memr --output s3://<BUCKET>/<KEY> --endpoint-url https://minio.example.com:9000 --path-style --sse s3 --tags retention=90d
+
+Uploading with SSE-KMS, an infrequent access storage class and SHA-256 checksums of each part:
+memr --bucket <BUCKET> --key <KEY> --sse kms --sse-kms-key-id <KEY_ID> --storage-class STANDARD_IA --checksum-algorithm SHA256
+
+Uploading to S3 resumably, continuing the same upload (if interrupted) by running the same command again:
+memr --bucket <BUCKET> --key <KEY> --resume-state <STATE_FILE>
+
+Uploading to S3 without credentials, using a bundle of presigned URLs generated by: memr presign
+memr --output presigned:<BUNDLE_FILE>
+
+Splitting the output across files of at most 4000 MiB (eg: for a FAT formatted drive), reassembled using <FILE>.index:
+memr --split-size 4000M --local-file <FILE>
+
+Streaming a crashed kernel's memory to S3 from a kdump capture kernel:
+memr /proc/vmcore --bucket <BUCKET> --key <KEY>
+
 Skipping compression:
-memr --compress=false --local-file <FILE>`,
-	ValidArgs: allDevices,
+memr --compress=false --local-file <FILE>
+
+Writing an ELF core file, which can be opened by Volatility 3, crash or gdb:
+memr --format elf --compress=false --local-file <FILE>
+
+Writing a padded raw image, where file offsets equal physical addresses (gaps are sparse):
+memr --format padded --compress=false --local-file <FILE>
+
+Writing an AVML (version 2) image, which can be converted by avml-convert:
+memr --format avml --local-file <FILE>
+
+Converting an existing raw image to LiME and uploading it to S3:
+memr --image <RAW_FILE> --range-map <IOMEM_FILE> --bucket <BUCKET> --key <KEY>
+
+Zero-filling unreadable pages and reporting them:
+memr --skip-bad-pages --manifest <MANIFEST_FILE> --local-file <FILE>
+
+Encrypting the output to an age recipient, so that it can only be decrypted using the recipient's identity:
+memr --encrypt-to age1... --bucket <BUCKET> --key <KEY>
+
+Writing a signed manifest including SHA-256 and BLAKE3 hashes of the image and each range:
+memr --manifest <MANIFEST_FILE> --hash sha256,blake3 --sign-key <KEY_FILE> --local-file <FILE>`,
+	ValidArgs: allDevices(),
 	Args:      cobra.OnlyValidArgs,
 	RunE: func(cmd *cobra.Command, devices []string) (err error) {
 
+		formatOpt, err := formatOption(outputFormatName)
+		if err != nil {
+			return err
+		}
+
+		// Hashes are only computed when they are included in a manifest
+		var hashes []memr.Hash
+		var signKey ed25519.PrivateKey
+		if manifestFile != "" {
+			for _, name := range hashNames {
+				hashes = append(hashes, memr.Hash(name))
+			}
+			if signKeyFile != "" {
+				if signKey, err = loadSigningKey(signKeyFile); err != nil {
+					return fmt.Errorf("failed to load signing key: %s", err)
+				}
+			}
+		}
+
+		var recipients []age.Recipient
+		if len(encryptTo) > 0 {
+			if recipients, err = loadRecipients(encryptTo); err != nil {
+				return fmt.Errorf("failed to load encryption recipients: %s", err)
+			}
+		}
+
 		options := func(m *memr.Reader) {
 			m.WithProgress = progress
+			m.SkipBadPages = skipBadPages
+			m.PageRetries = pageRetries
+			m.Hashes = hashes
+			formatOpt(m)
 		}
 
-		var reader *memr.Reader
-		if len(devices) == 0 {
-			reader, err = memr.Probe(options)
-		} else {
-			for _, t := range devices {
-				reader, err = memr.NewReader(memr.MemSource(t), options)
+		// The context is cancelled on SIGINT/SIGTERM, stopping the acquisition
+		ctx := cmd.Context()
+
+		// Resumable uploads continue reading from the offset at which they were interrupted
+		var state *resumeState
+		if resumeStateFile != "" {
+			if state, err = loadResumeState(resumeStateFile, outputURL()); err != nil {
+				return fmt.Errorf("failed to load resume state: %s", err)
+			}
+		}
+
+		openReader := func(offset uint64) (reader *memr.Reader, err error) {
+			offsetOpt := func(m *memr.Reader) { m.StartOffset = offset }
+			if imageFile != "" {
+				var source memr.MemSource
+				source, err = imageSource()
 				if err == nil {
-					break
+					reader, err = memr.NewReaderContext(ctx, source, options, offsetOpt)
+				}
+			} else if len(devices) == 0 {
+				reader, err = memr.ProbeContext(ctx, options, offsetOpt)
+			} else {
+				for _, t := range devices {
+					reader, err = memr.NewReaderContext(ctx, memr.LookupSource(t), options, offsetOpt)
+					if err == nil {
+						break
+					}
 				}
 			}
+			return reader, err
 		}
+
+		reader, err := openReader(0)
 		if err != nil {
 			return fmt.Errorf("failed to load memory reader: %s", err)
 		}
-		defer reader.Close()
+		defer func() { reader.Close() }() // the reader is reopened when resuming
 
-		// Using local file
-		if localFile != "" {
-			var writer io.WriteCloser
-			writer, err = os.Create(localFile)
-			if err != nil {
-				return fmt.Errorf("failed to open local file for writing %s", err)
-			}
-			defer writer.Close()
+		if provider := reader.RangeProvider(); provider != "" {
+			log.Printf("using memory ranges from %s", provider)
+		}
 
-			if compress {
-				writer = snappy.NewBufferedWriter(writer)
-			}
+		// Formats that are already compressed (eg: AVML) should not be compressed again
+		compressOutput := compress
+		if compress && reader.Format.Compressed() {
+			log.Printf("[DEBUG] %s format is already compressed, skipping compression", reader.Format)
+			compressOutput = false
+		}
+
+		var compression string
+		if compressOutput {
+			compression = "snappy"
+		}
 
-			read, err := io.Copy(writer, reader)
-			if err != nil {
-				return fmt.Errorf("failed to copy memory to local file %s", err)
+		// A resumed upload is checked against the capture before reading from the offset at
+		// which it resumes, which may otherwise be beyond the end of a different capture
+		if state != nil {
+			if err := state.check(reader, compression); err != nil {
+				return err
+			}
+			if offset := state.offset(); offset > 0 {
+				reader.Close()
+				if reader, err = openReader(offset); err != nil {
+					return fmt.Errorf("failed to load memory reader at offset %d: %s", offset, err)
+				}
 			}
+		}
 
-			reader.Close()
+		stages := outputStages{compress: compressOutput, recipients: recipients}
 
-			if reader.Size() != uint64(read) {
-				return fmt.Errorf("failed to read all data. expected=%d; read=%d ", reader.Size(), read)
+		// The output of any stages is hashed separately, since it differs from the image
+		var outputHasher *memr.Hasher
+		if !stages.empty() && len(hashes) > 0 {
+			if outputHasher, err = memr.NewHasher(hashes...); err != nil {
+				return err
 			}
+		}
 
-			log.Printf("acquired memory using %q to file: %s", reader.Source(), localFile)
+		started := time.Now()
+
+		var sink Sink
+		sinkOpts := sinkOptions{
+			size:        reader.Size(),
+			metadata:    outputMetadata(reader),
+			splitSize:   splitSize,
+			format:      outputFormatName,
+			compression: compression,
+			ranges:      reader.OutputRanges(),
+		}
+		if len(recipients) > 0 {
+			sinkOpts.encryption = memr.EncryptionAge
+		}
+		if state != nil {
+			// Each part is compressed (and hashed) separately by the sink,
+			// so that the upload can be resumed at the end of any part
+			sink, err = newResumableS3Writer(ctx, outputURL(), sinkOpts, state, stages.compress, outputHasher)
+			stages = outputStages{}
 		} else {
+			sink, err = openSink(ctx, outputURL(), sinkOpts)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open output: %s", err)
+		}
 
-			// Not using a local file, so assume s3
-			res, err := S3Writer(reader, compress, useAccelerate, region, s3Bucket, s3ObjectKey, concurrency, reader.Size())
-			if err != nil {
+		var dst io.Writer = sink
+		if outputHasher != nil && state == nil {
+			dst = io.MultiWriter(sink, outputHasher)
+		}
+
+		var writer io.Writer = dst
+		var staged io.WriteCloser
+		if !stages.empty() {
+			if staged, err = stages.wrap(dst); err != nil {
+				sink.Abort(err)
 				return err
 			}
+			writer = staged
+		} else if file, ok := sink.(fileBacked); ok {
+			writer = file.File() // written directly, allowing sparse output
+		}
+
+		if state != nil {
+			reader, err = copyResumable(ctx, reader, sink.(*resumableS3Writer), openReader)
+		} else if _, err = io.Copy(writer, reader); err == nil && staged != nil {
+			err = staged.Close()
+		}
+		if err != nil {
+			sink.Abort(err)
+			return fmt.Errorf("failed to write output to %s: %s", sink.Location(), err)
+		}
+
+		reader.Close()
+
+		// The location of memory within a split output is only known without compression or encryption
+		if split, ok := sink.(*splitSink); ok && stages.empty() {
+			split.layout = reader.OutputRanges()
+		}
+
+		if err := sink.Close(); err != nil {
+			return fmt.Errorf("failed to complete output to %s: %s", sink.Location(), err)
+		}
+
+		if !reader.Format.Compressed() && reader.Size() != reader.BytesRead() {
+			return fmt.Errorf("failed to read all data. expected=%d; read=%d ", reader.Size(), reader.BytesRead())
+		}
+
+		log.Printf("acquired memory using %q to %s (%d bytes written)", reader.Source(), sink.Location(), sink.Written())
+
+		completed := time.Now()
+
+		// Memory is likely to have changed while a resumed upload was interrupted,
+		// so the hashes of the image (or its output) as a whole are meaningless
+		var resumes []resumeReport
+		if state != nil {
+			started, resumes = state.Started, state.Resumes
+		}
+		if len(resumes) > 0 {
+			log.Printf("[WARN] upload was resumed %d time(s), so the output is not a consistent image", len(resumes))
+		}
+
+		// Hashes are only known once complete, so are added to any metadata afterwards
+		if updater, ok := sink.(metadataUpdater); ok && len(hashes) > 0 && len(resumes) == 0 {
+			metadata := make(map[string]string)
+			for name, sum := range reader.ImageHashes() {
+				metadata["memr-image-"+string(name)] = sum
+			}
+			if outputHasher != nil {
+				for name, sum := range outputHasher.Sums() {
+					metadata["memr-output-"+string(name)] = sum
+				}
+			}
+			if err := updater.UpdateMetadata(ctx, metadata); err != nil {
+				log.Printf("[WARN] failed to add hashes to the metadata of %s (they are only in the manifest): %s", sink.Location(), err)
+			}
+		}
+
+		if missing := reader.MissingRanges(); len(missing) > 0 {
+			log.Printf("[WARN] %d memory range(s) were not available from %q and were omitted", len(missing), reader.Source())
+		}
+		if pages := reader.BadPages(); len(pages) > 0 {
+			log.Printf("[WARN] %d unreadable page(s) were zero-filled in the output", len(pages))
+		}
+
+		if manifestFile != "" {
+			m := newManifest(reader, sink.Location())
+			m.OutputSize = sink.Written()
+			m.Timings = timings{Started: started, Completed: completed, Duration: completed.Sub(started).Seconds()}
+			m.Resumes = resumes
+			m.Compression = compression
+			if len(recipients) > 0 {
+				m.Encryption = memr.EncryptionAge
+				m.Recipients = recipientNames(recipients)
+			}
+			m.OutputStream = m.Image
+			if outputHasher != nil {
+				m.OutputStream = &digest{Size: outputHasher.Size(), Hashes: outputHasher.Sums()}
+			}
+			if len(resumes) > 0 {
+				m.Image, m.OutputStream = nil, nil
+			}
+
+			if signKey != nil {
+				if err := m.sign(signKey); err != nil {
+					return fmt.Errorf("failed to sign manifest: %s", err)
+				}
+			}
 
-			log.Printf("acquired memory using %q and uploaded to S3: %s", reader.Source(), res.Location)
+			if err := m.write(manifestFile); err != nil {
+				return fmt.Errorf("failed to write manifest: %s", err)
+			}
 		}
 
 		return nil
 	},
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-		flags := cmd.Flags()
-		verbosity, err := flags.GetCount("verbose")
+		verbosity, err := cmd.Flags().GetCount("verbose")
 		if err != nil {
 			return err
 		}
 		memr.SetLogLevel(memr.LogLvl(verbosity))
-
-		if localFile+s3Bucket+s3ObjectKey == "" {
-			return fmt.Errorf("either \"--local-file\" flag, or \"--bucket\" and \"--key\" flags, must be supplied")
+		return nil
+	},
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if (signKeyFile != "" || cmd.Flags().Changed("hash")) && manifestFile == "" {
+			return fmt.Errorf("\"--sign-key\" and \"--hash\" flags require the \"--manifest\" flag")
+		}
+		if err := s3Opts.validate(); err != nil {
+			return err
+		}
+		if rangeMapFile != "" && imageFile == "" {
+			return fmt.Errorf("\"--range-map\" flag requires the \"--image\" flag")
+		}
+		if localFile+s3Bucket+s3ObjectKey+output == "" {
+			return fmt.Errorf("either \"--output\" flag, \"--local-file\" flag, or \"--bucket\" and \"--key\" flags, must be supplied")
 		}
-		if localFile != "" {
+		if output != "" && localFile+s3Bucket+s3ObjectKey != "" {
+			return fmt.Errorf("\"--output\" flag cannot be used with \"--local-file\", \"--bucket\" or \"--key\" flags")
+		}
+		if resumeStateFile != "" {
+			if u, err := url.Parse(outputURL()); err != nil || u.Scheme != "s3" {
+				return fmt.Errorf("\"--resume-state\" flag requires output to S3")
+			}
+			if len(encryptTo) > 0 || outputFormatName == "avml" {
+				return fmt.Errorf("\"--resume-state\" flag cannot be used with the \"--encrypt-to\" flag or the avml format")
+			}
+		}
+		if splitSizeValue != "" {
+			var err error
+			if splitSize, err = parseSize(splitSizeValue); err != nil || splitSize == 0 {
+				return fmt.Errorf("invalid split size %q", splitSizeValue)
+			}
+			if outputURL() == "-" || resumeStateFile != "" {
+				return fmt.Errorf("\"--split-size\" flag cannot be used with output to stdout or the \"--resume-state\" flag")
+			}
+		}
+		if output != "" || localFile != "" {
 			return nil
 		}
 		if s3Bucket != "" && s3ObjectKey == "" {
@@ -140,23 +426,123 @@ memr --compress=false --local-file <FILE>`,
 	},
 }
 
+// outputMetadata describes the output, for sinks that store metadata alongside it
+func outputMetadata(reader *memr.Reader) map[string]string {
+	host := currentHost()
+	metadata := map[string]string{
+		"memr-version": version,
+		"memr-source":  reader.Source().String(),
+		"memr-format":  reader.Format.String(),
+		"memr-host":    host.Hostname,
+		"memr-kernel":  host.KernelRelease,
+	}
+	if release := reader.KernelInfo().OSRelease(); release != "" {
+		metadata["memr-kernel"] = release // the captured kernel, which differs for images
+	}
+	return metadata
+}
+
+// outputURL returns the URL of the output, from either the --output
+// flag, or the equivalent --local-file or --bucket and --key flags
+func outputURL() string {
+	switch {
+	case output != "":
+		return output
+	case localFile != "":
+		return localFile
+	}
+	return (&url.URL{Scheme: "s3", Host: s3Bucket, Path: "/" + s3ObjectKey}).String()
+}
+
+// imageSource returns the source for reading an existing image, which
+// is a raw image if a range map is supplied, and one whose format is detected otherwise
+func imageSource() (memr.MemSource, error) {
+	if rangeMapFile == "" {
+		return memr.NewImageSource(imageFile), nil
+	}
+
+	memRanges, err := readRangeMap(rangeMapFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return memr.NewRawImageSource(imageFile, memRanges), nil
+}
+
+// readRangeMap reads the ranges from a copy of the captured host's /proc/iomem
+func readRangeMap(path string) (memr.MemRanges, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	memRanges, err := memr.ParseMemRanges(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse range map %s: %s", path, err)
+	}
+
+	return memRanges, nil
+}
+
+// allDevices returns the names of all registered memory sources
+func allDevices() []string {
+	var devices []string
+	for _, source := range memr.Sources() {
+		devices = append(devices, source.String())
+	}
+	return devices
+}
+
 func init() {
 	// Global (persistent) flags
 	_ = rootCmd.PersistentFlags().CountP("verbose", "v", "enable verbose logging")
 
-	rootCmd.PersistentFlags().BoolVarP(&compress, "compress", "c", true, "compress the output with snappy")
 	rootCmd.PersistentFlags().BoolVarP(&progress, "progress", "p", true, "show progress")
-	rootCmd.PersistentFlags().IntVarP(&concurrency, "concurrency", "t", concurrency, "number of threads to use for S3 upload")
-	rootCmd.PersistentFlags().StringVarP(&region, "region", "r", region, "AWS region to use with S3 client")
-	rootCmd.PersistentFlags().StringVarP(&s3Bucket, "bucket", "b", s3Bucket, "S3 bucket to which output should be sent")
-	rootCmd.PersistentFlags().StringVarP(&s3ObjectKey, "key", "k", s3ObjectKey, "key to use for uploading to S3 bucket")
-	rootCmd.PersistentFlags().BoolVarP(&useAccelerate, "accelerate", "a", false, "use S3 Transfer Acceleration")
-	rootCmd.PersistentFlags().StringVarP(&localFile, "local-file", "f", localFile, "local file to write to, instead of S3")
+
+	// Flags for acquisition
+	rootCmd.Flags().BoolVarP(&compress, "compress", "c", true, "compress the output with snappy")
+	rootCmd.Flags().IntVarP(&concurrency, "concurrency", "t", concurrency, "number of threads to use for S3 upload")
+	rootCmd.Flags().StringVarP(&region, "region", "r", region, "AWS region to use with S3 client")
+	rootCmd.Flags().StringVarP(&s3Bucket, "bucket", "b", s3Bucket, "S3 bucket to which output should be sent (equivalent to --output s3://<BUCKET>/<KEY>)")
+	rootCmd.Flags().StringVarP(&s3ObjectKey, "key", "k", s3ObjectKey, "key to use for uploading to S3 bucket")
+	rootCmd.Flags().BoolVarP(&useAccelerate, "accelerate", "a", false, "use S3 Transfer Acceleration")
+	rootCmd.Flags().StringVarP(&output, "output", "o", output, "destination of the output: a local file path or file:// URL, - for stdout, s3://bucket/key, presigned:<BUNDLE> (see presign), tcp://host:port, tls:// or memr+tcp://host:port (see receive) or http(s):// URL (using PUT)")
+	rootCmd.Flags().StringVar(&s3Opts.endpoint, "endpoint-url", s3Opts.endpoint, "custom S3 endpoint URL, for S3-compatible stores (eg: MinIO or Ceph RGW)")
+	rootCmd.Flags().BoolVar(&s3Opts.pathStyle, "path-style", s3Opts.pathStyle, "use path-style addressing for S3 (eg: https://<HOST>/<BUCKET>/<KEY>), typically with --endpoint-url")
+	rootCmd.Flags().StringVar(&s3Opts.acl, "acl", s3Opts.acl, "canned ACL for the S3 object, or none")
+	rootCmd.Flags().StringVar(&s3Opts.sse, "sse", s3Opts.sse, "server-side encryption for the S3 object (one of: none, s3, kms, c)")
+	rootCmd.Flags().StringVar(&s3Opts.kmsKeyID, "sse-kms-key-id", s3Opts.kmsKeyID, "KMS key ID for --sse kms (default is the AWS managed key)")
+	rootCmd.Flags().StringVar(&s3Opts.sseCKeyFile, "sse-c-key", s3Opts.sseCKeyFile, "file containing the 256-bit key (raw or base64 encoded) for --sse c")
+	rootCmd.Flags().StringToStringVar(&s3Opts.tags, "tags", s3Opts.tags, "tags for the S3 object (eg: retention=90d,case=1234)")
+	rootCmd.Flags().StringToStringVar(&s3Opts.metadata, "metadata", s3Opts.metadata, "user metadata for the S3 object, in addition to the host, kernel, source and hashes (when using --manifest)")
+	rootCmd.Flags().StringVar(&s3Opts.storageClass, "storage-class", s3Opts.storageClass, "storage class for the S3 object (eg: STANDARD_IA)")
+	rootCmd.Flags().StringVar(&s3Opts.checksum, "checksum-algorithm", s3Opts.checksum, "algorithm for checksums of each part uploaded to S3 (eg: SHA256)")
+	rootCmd.Flags().StringVar(&resumeStateFile, "resume-state", resumeStateFile, "file in which the state of a resumable S3 upload is kept, continuing the upload if it exists")
+	rootCmd.Flags().IntVar(&resumeRetries, "resume-retries", resumeRetries, "number of times a failed resumable S3 upload is resumed before giving up (see --resume-state)")
+	rootCmd.Flags().StringVar(&tlsCertFile, "tls-cert", tlsCertFile, "PEM encoded client certificate with which to authenticate to a collector, using a tls:// output")
+	rootCmd.Flags().StringVar(&tlsKeyFile, "tls-key", tlsKeyFile, "PEM encoded private key of the --tls-cert")
+	rootCmd.Flags().StringVar(&tlsCAFile, "tls-ca", tlsCAFile, "PEM encoded CA certificates with which to verify a collector, using a tls:// output (default is the system's roots)")
+	rootCmd.Flags().StringVar(&splitSizeValue, "split-size", splitSizeValue, "split the output across files or S3 objects of at most this size (eg: 4000M), named <OUTPUT>.000, <OUTPUT>.001 and so on, with an index named <OUTPUT>.index")
+	rootCmd.Flags().StringVarP(&localFile, "local-file", "f", localFile, "local file to write to, instead of S3 (equivalent to --output <FILE>)")
+	rootCmd.Flags().BoolVar(&skipBadPages, "skip-bad-pages", skipBadPages, "zero-fill pages that cannot be read, instead of failing")
+	rootCmd.Flags().IntVar(&pageRetries, "page-retries", pageRetries, "number of times to retry an unreadable page when using --skip-bad-pages")
+	rootCmd.Flags().StringVar(&outputFormatName, "format", outputFormatName, fmt.Sprintf("output format (one of: %s)", formatNames()))
+	rootCmd.Flags().StringVar(&imageFile, "image", imageFile, "existing LiME, AVML or ELF (or raw, with --range-map) image to read from, instead of a memory source")
+	rootCmd.Flags().StringVar(&rangeMapFile, "range-map", rangeMapFile, "copy of /proc/iomem from the captured host, describing the ranges of a raw --image")
+	rootCmd.Flags().StringVar(&manifestFile, "manifest", manifestFile, "file to which a JSON manifest of the acquisition, including hashes, should be written")
+	rootCmd.Flags().StringSliceVar(&hashNames, "hash", hashNames, "hashes to include in the manifest (any of: sha256, blake3, md5)")
+	rootCmd.Flags().StringSliceVar(&encryptTo, "encrypt-to", encryptTo, "age recipient (age1...), or file of age recipients or PEM encoded X25519 public key, to which the output should be encrypted (may be repeated)")
+	rootCmd.Flags().StringVar(&signKeyFile, "sign-key", signKeyFile, "PEM encoded ed25519 private key (PKCS #8) with which to sign the manifest")
 }
 
 func main() {
 	rootCmd.Version = version
-	if err := rootCmd.Execute(); err != nil {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	if err != nil {
 		os.Exit(1)
 	}
 }
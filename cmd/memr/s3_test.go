@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5" //nolint:gosec
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+// sseCKeyMD5Header is the header with the MD5 of the SSE-C key used by a request
+const sseCKeyMD5Header = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+
+// fakeS3 is an S3 endpoint supporting the requests made by memr using path-style addressing
+// (eg: http://<HOST>/<BUCKET>/<KEY>), holding objects and multipart uploads in memory
+type fakeS3 struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	onPart        func(uploadID string, number int) int // see setOnPart
+	completeError string                                // see setCompleteError
+	objects       map[string]*fakeObject                // by bucket/key
+	uploads       map[string]*fakeUpload                // by upload ID
+	uploadIDs     int
+}
+
+type fakeObject struct {
+	data     []byte
+	metadata map[string]string
+	parts    []int  // numbers of the parts that completed a multipart upload, in order
+	complete []byte // body of the request that completed a multipart upload
+}
+
+type fakeUpload struct {
+	path       string
+	metadata   map[string]string
+	parts      map[int][]byte
+	aborted    bool
+	sseCKeyMD5 string // MD5 of the SSE-C key of the upload, required by each later request
+}
+
+// newFakeS3 starts a fakeS3, which is closed at the end of the test
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{objects: make(map[string]*fakeObject), uploads: make(map[string]*fakeUpload)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// use configures S3 clients created by the test (using newS3Object) to use the fakeS3
+func (f *fakeS3) use(t *testing.T) {
+	previous := s3Opts
+	s3Opts.endpoint, s3Opts.pathStyle = f.URL, true
+	t.Cleanup(func() { s3Opts = previous })
+
+	for key, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":           "test",
+		"AWS_SECRET_ACCESS_KEY":       "test",
+		"AWS_EC2_METADATA_DISABLED":   "true",
+		"AWS_CONFIG_FILE":             filepath.Join(t.TempDir(), "config"),
+		"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(t.TempDir(), "credentials"),
+	} {
+		key := key
+		previous, ok := os.LookupEnv(key)
+		os.Setenv(key, value)
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(key, previous)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+// setOnPart sets a function called before storing a part of an upload, which returns
+// the status with which the request fails, or 0 if it succeeds
+func (f *fakeS3) setOnPart(onPart func(uploadID string, number int) int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onPart = onPart
+}
+
+// setCompleteError reports an error with the code in the body of 200
+// responses to completing an upload, as S3 may do
+func (f *fakeS3) setCompleteError(code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.completeError = code
+}
+
+// create creates a multipart upload to bucket/key, returning its ID
+func (f *fakeS3) create(path string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploadIDs++
+	id := fmt.Sprintf("upload-%d", f.uploadIDs)
+	f.uploads[id] = &fakeUpload{path: path, metadata: make(map[string]string), parts: make(map[int][]byte)}
+	return id
+}
+
+// object returns the object at bucket/key, or nil if it does not exist
+func (f *fakeS3) object(path string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[path]
+}
+
+// upload returns the upload with the ID, or nil if it does not exist
+func (f *fakeS3) upload(id string) *fakeUpload {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.uploads[id]
+}
+
+// pending returns the IDs of the uploads that were neither completed nor aborted
+func (f *fakeS3) pending() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []string
+	for id, upload := range f.uploads {
+		if !upload.aborted {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+	_, isCreate := query["uploads"]
+	id := query.Get("uploadId")
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && isCreate:
+		id = f.create(path)
+		f.mu.Lock()
+		f.uploads[id].metadata = fakeMetadata(r.Header)
+		f.uploads[id].sseCKeyMD5 = r.Header.Get(sseCKeyMD5Header)
+		f.mu.Unlock()
+		fakeResult(w, "InitiateMultipartUploadResult", "<UploadId>"+id+"</UploadId>")
+
+	case r.Method == http.MethodPut && id != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.mu.Lock()
+		onPart := f.onPart
+		f.mu.Unlock()
+		if onPart != nil {
+			if status := onPart(id, number); status != 0 {
+				fakeError(w, status, "InjectedFailure")
+				return
+			}
+		}
+		f.mu.Lock()
+		upload := f.uploads[id]
+		if upload == nil || upload.aborted {
+			f.mu.Unlock()
+			fakeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if r.Header.Get(sseCKeyMD5Header) != upload.sseCKeyMD5 {
+			f.mu.Unlock()
+			fakeError(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			data, ok := f.copySource(source, r.Header.Get("X-Amz-Copy-Source-Range"))
+			if !ok {
+				f.mu.Unlock()
+				fakeError(w, http.StatusBadRequest, "InvalidRange")
+				return
+			}
+			upload.parts[number] = data
+			f.mu.Unlock()
+			fakeResult(w, "CopyPartResult", "<ETag>"+html.EscapeString(fakeETag(data))+"</ETag>")
+			return
+		}
+		upload.parts[number] = body
+		f.mu.Unlock()
+		w.Header().Set("ETag", fakeETag(body))
+
+	case r.Method == http.MethodPost && id != "":
+		var complete struct {
+			Parts []struct {
+				ETag       string
+				PartNumber int
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			fakeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		upload := f.uploads[id]
+		if upload == nil || upload.aborted {
+			fakeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if r.Header.Get(sseCKeyMD5Header) != upload.sseCKeyMD5 {
+			fakeError(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		if f.completeError != "" {
+			fakeResult(w, "Error", "<Code>"+f.completeError+"</Code>")
+			return
+		}
+		object := &fakeObject{metadata: upload.metadata, complete: body}
+		for i, part := range complete.Parts {
+			data, ok := upload.parts[part.PartNumber]
+			if !ok || part.ETag != fakeETag(data) || (i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber) {
+				fakeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object.data = append(object.data, data...)
+			object.parts = append(object.parts, part.PartNumber)
+		}
+		f.objects[path] = object
+		delete(f.uploads, id)
+		fakeResult(w, "CompleteMultipartUploadResult", "<Location>"+f.URL+"/"+path+"</Location>")
+
+	case r.Method == http.MethodDelete && id != "":
+		f.mu.Lock()
+		if upload := f.uploads[id]; upload != nil {
+			upload.aborted = true
+		}
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodHead:
+		if f.object(path) == nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.mu.Lock()
+		data, ok := f.copySource(r.Header.Get("X-Amz-Copy-Source"), "")
+		if ok {
+			f.objects[path] = &fakeObject{data: data, metadata: fakeMetadata(r.Header)}
+		}
+		f.mu.Unlock()
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		fakeResult(w, "CopyObjectResult", "<ETag>"+html.EscapeString(fakeETag(data))+"</ETag>")
+
+	case r.Method == http.MethodPut:
+		f.mu.Lock()
+		f.objects[path] = &fakeObject{data: body, metadata: fakeMetadata(r.Header)}
+		f.mu.Unlock()
+		w.Header().Set("ETag", fakeETag(body))
+
+	default:
+		fakeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// copySource returns the data of the object copied by a request, limited to the range
+// (eg: bytes=0-99), if any. The mutex must be held.
+func (f *fakeS3) copySource(source, rng string) ([]byte, bool) {
+	path, err := url.PathUnescape(strings.TrimPrefix(source, "/"))
+	if err != nil || f.objects[path] == nil {
+		return nil, false
+	}
+	data := f.objects[path].data
+	if rng == "" {
+		return data, true
+	}
+
+	var start, end int
+	if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || start > end || end >= len(data) {
+		return nil, false
+	}
+	return data[start : end+1], true
+}
+
+// fakeMetadata returns the user metadata in the headers of a request
+func fakeMetadata(header http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for name := range header {
+		if key := strings.ToLower(name); strings.HasPrefix(key, "x-amz-meta-") {
+			metadata[strings.TrimPrefix(key, "x-amz-meta-")] = header.Get(name)
+		}
+	}
+	return metadata
+}
+
+func fakeETag(data []byte) string {
+	sum := md5.Sum(data) //nolint:gosec
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func fakeResult(w http.ResponseWriter, name, content string) {
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<%s>%s</%s>", name, content, name)
+}
+
+func fakeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// decompress decompresses data written by memr using snappy, which
+// may be the concatenation of separately compressed streams
+func decompress(t *testing.T, data []byte) []byte {
+	t.Helper()
+	out, err := ioutil.ReadAll(snappy.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("failed to decompress output: %v", err)
+	}
+	return out
+}
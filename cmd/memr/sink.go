@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ryandeivert/memr"
+)
+
+// Sink is a destination for the output of an acquisition, selected
+// by the scheme of the --output URL (see registerSink)
+type Sink interface {
+	io.Writer
+
+	// Close completes the output once all data is written, returning any failure
+	Close() error
+
+	// Abort abandons the output after the failure err, cleaning up where possible
+	// (eg: aborting a multipart upload). Partial local files are left in place.
+	Abort(err error)
+
+	// Written returns the number of bytes written to the destination
+	Written() int64
+
+	// Location describes where the output was written (eg: s3://bucket/key)
+	Location() string
+}
+
+// fileBacked can optionally be implemented by a Sink writing to a local file,
+// allowing output to be written to the file directly (eg: as sparse regions)
+type fileBacked interface {
+	File() *os.File
+}
+
+// metadataUpdater can optionally be implemented by a Sink that stores metadata alongside
+// the output (eg: S3 object metadata), allowing metadata that is only known once the
+// output is complete (eg: hashes) to be added after the sink is closed
+type metadataUpdater interface {
+	UpdateMetadata(ctx context.Context, metadata map[string]string) error
+}
+
+// sinkOptions are supplied to each sinkFactory
+type sinkOptions struct {
+	size        uint64             // expected size of the output, before any compression or encryption
+	metadata    map[string]string  // describes the output, for sinks that store metadata (eg: source)
+	splitSize   uint64             // size at which the output is split across chunks, or 0 (see splitSink)
+	format      string             // name of the output format (eg: lime)
+	compression string             // compression of the output (eg: snappy), if any
+	encryption  string             // encryption of the output (eg: age), if any
+	ranges      []memr.OutputRange // location of memory within the image, if known
+}
+
+// sinkFactory opens a Sink for the URL
+type sinkFactory func(ctx context.Context, u *url.URL, opts sinkOptions) (Sink, error)
+
+var sinkFactories = make(map[string]sinkFactory)
+
+// registerSink registers the factory for the URL scheme (eg: s3). This should be called
+// from an init function, allowing additional sinks to be added in their own files.
+func registerSink(scheme string, factory sinkFactory) {
+	sinkFactories[scheme] = factory
+}
+
+// sinkSchemes returns the registered URL schemes, sorted
+func sinkSchemes() []string {
+	schemes := make([]string, 0, len(sinkFactories))
+	for scheme := range sinkFactories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// openSink opens the sink for the output, which is either - for stdout, a
+// URL using a registered scheme, or a local file path (without a scheme).
+// The output is split across chunks if a splitSize is supplied.
+func openSink(ctx context.Context, output string, opts sinkOptions) (Sink, error) {
+	if output == "-" {
+		return &stdoutSink{}, nil
+	}
+
+	u, err := url.Parse(output)
+	if err != nil || u.Scheme == "" {
+		u = &url.URL{Scheme: "file", Path: output}
+	}
+
+	factory, ok := sinkFactories[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported output scheme %q; must be one of: %s", u.Scheme, strings.Join(sinkSchemes(), ", "))
+	}
+
+	if opts.splitSize > 0 {
+		return newSplitSink(ctx, u, factory, opts)
+	}
+
+	return factory(ctx, u, opts)
+}
+
+// counter counts the bytes written by a Sink
+type counter struct {
+	written int64
+}
+
+func (c *counter) count(n int, err error) (int, error) {
+	c.written += int64(n)
+	return n, err
+}
+
+func (c *counter) Written() int64 {
+	return c.written
+}
+
+// fileSink writes to a local file, using either a path or a file:// URL
+type fileSink struct {
+	file *os.File
+	counter
+}
+
+func newFileSink(_ context.Context, u *url.URL, _ sinkOptions) (Sink, error) {
+	path := u.Host + u.Path // allow relative paths, eg: file://capture.lime
+	if path == "" {
+		return nil, fmt.Errorf("no path in output URL: %s", u)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local file for writing %s", err)
+	}
+
+	return &fileSink{file: file}, nil
+}
+
+func (f *fileSink) Write(p []byte) (int, error) {
+	return f.count(f.file.Write(p))
+}
+
+func (f *fileSink) File() *os.File {
+	return f.file
+}
+
+// Close closes the file, using its size as the number of bytes written,
+// since it may have been written directly (see fileBacked)
+func (f *fileSink) Close() error {
+	if info, err := f.file.Stat(); err == nil {
+		f.written = info.Size()
+	}
+	return f.file.Close()
+}
+
+func (f *fileSink) Abort(error) {
+	f.file.Close()
+}
+
+func (f *fileSink) Location() string {
+	return f.file.Name()
+}
+
+// stdoutSink writes to stdout, allowing the output to be piped to other tools
+type stdoutSink struct {
+	counter
+}
+
+func (s *stdoutSink) Write(p []byte) (int, error) {
+	return s.count(os.Stdout.Write(p))
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
+
+func (s *stdoutSink) Abort(error) {}
+
+func (s *stdoutSink) Location() string {
+	return "stdout"
+}
+
+// tcpSink writes to a TCP connection, using a tcp://host:port URL
+type tcpSink struct {
+	conn     net.Conn
+	location string
+	counter
+}
+
+func newTCPSink(ctx context.Context, u *url.URL, _ sinkOptions) (Sink, error) {
+	if u.Port() == "" {
+		return nil, fmt.Errorf("no port in output URL: %s", u)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tcpSink{conn: conn, location: u.String()}, nil
+}
+
+func (t *tcpSink) Write(p []byte) (int, error) {
+	return t.count(t.conn.Write(p))
+}
+
+func (t *tcpSink) Close() error {
+	return t.conn.Close()
+}
+
+func (t *tcpSink) Abort(error) {
+	t.conn.Close()
+}
+
+func (t *tcpSink) Location() string {
+	return t.location
+}
+
+// httpSink streams the output as the body of a PUT request to an http(s):// URL,
+// using chunked transfer encoding since the size of the output is not known up front
+type httpSink struct {
+	pipe     *io.PipeWriter
+	done     chan struct{}
+	err      error
+	location string
+	counter
+}
+
+func newHTTPSink(ctx context.Context, u *url.URL, _ sinkOptions) (Sink, error) {
+	body, pipe := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	h := &httpSink{pipe: pipe, done: make(chan struct{}), location: u.Redacted()}
+	go func() {
+		defer close(h.done)
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("unexpected response: %s", resp.Status)
+			}
+		}
+		h.err = err
+
+		// Fail any further writes if the request ended early
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		body.CloseWithError(err)
+	}()
+
+	return h, nil
+}
+
+func (h *httpSink) Write(p []byte) (int, error) {
+	return h.count(h.pipe.Write(p))
+}
+
+func (h *httpSink) Close() error {
+	h.pipe.Close()
+	<-h.done
+	return h.err
+}
+
+func (h *httpSink) Abort(err error) {
+	h.pipe.CloseWithError(err)
+	<-h.done
+}
+
+func (h *httpSink) Location() string {
+	return h.location
+}
+
+func init() {
+	registerSink("file", newFileSink)
+	registerSink("tcp", newTCPSink)
+	registerSink("http", newHTTPSink)
+	registerSink("https", newHTTPSink)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestTCPSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+
+	// The output is written as is, without the stream protocol used for collectors
+	sink, err := openSink(context.Background(), "tcp://"+listener.Addr().String(), sinkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sink.(*tcpSink); !ok {
+		t.Fatalf("unexpected sink for tcp:// output: %T", sink)
+	}
+
+	data := randomData(100 << 10)
+	if _, err := sink.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes not matching the %d written", len(got), len(data))
+	}
+	if sink.Written() != int64(len(data)) {
+		t.Errorf("written: got %d; want %d", sink.Written(), len(data))
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strconv"
+
+	"github.com/ryandeivert/memr"
+	"github.com/ryandeivert/memr/image"
+)
+
+// splittable lists the schemes of outputs that can be split, since
+// each chunk is named by appending a suffix to the path of the URL
+var splittable = map[string]bool{"file": true, "s3": true}
+
+// splitSink splits the output across chunks of at most chunkSize bytes, each written
+// to its own sink (eg: capture.lime.000, capture.lime.001 and so on), for destinations
+// that limit the size of a file or object. Once complete, an index describing the
+// chunks is written alongside them (eg: capture.lime.index), allowing them to be
+// reassembled when read (see image.OpenFile).
+type splitSink struct {
+	ctx      context.Context
+	url      *url.URL
+	factory  sinkFactory
+	opts     sinkOptions
+	index    image.SplitIndex
+	chunk    Sink               // sink of the last chunk, or nil if it is complete
+	layout   []memr.OutputRange // location of memory within the output, if known
+	location string
+	counter
+}
+
+func newSplitSink(ctx context.Context, u *url.URL, factory sinkFactory, opts sinkOptions) (Sink, error) {
+	if !splittable[u.Scheme] {
+		return nil, fmt.Errorf("output using the %s scheme cannot be split", u.Scheme)
+	}
+
+	// Local paths may be relative, eg: file://capture.lime
+	if u.Scheme == "file" {
+		u = &url.URL{Scheme: u.Scheme, Path: u.Host + u.Path}
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return nil, fmt.Errorf("no path in output URL: %s", u)
+	}
+
+	location := *u
+	location.Path += image.IndexSuffix
+	s := &splitSink{
+		ctx:      ctx,
+		url:      u,
+		factory:  factory,
+		opts:     opts,
+		index:    image.SplitIndex{Name: name, ChunkSize: int64(opts.splitSize)},
+		location: location.String(),
+	}
+	if u.Scheme == "file" {
+		s.location = location.Path
+	}
+
+	return s, nil
+}
+
+// sinkURL returns the URL of the output, with the suffix appended to its path
+func (s *splitSink) sinkURL(suffix string) *url.URL {
+	u := *s.url
+	u.Path += suffix
+	return &u
+}
+
+// next opens the sink for the next chunk
+func (s *splitSink) next() error {
+	n := len(s.index.Chunks)
+	name := image.ChunkName(s.index.Name, n)
+
+	// The expected size of the output is used to size the chunk (eg: its upload parts)
+	opts := sinkOptions{size: s.opts.splitSize, metadata: map[string]string{"memr-split-chunk": strconv.Itoa(n)}}
+	if remaining := s.opts.size - uint64(s.index.Size); s.opts.size > uint64(s.index.Size) && remaining < opts.size {
+		opts.size = remaining
+	}
+	for key, value := range s.opts.metadata {
+		opts.metadata[key] = value
+	}
+
+	chunk, err := s.factory(s.ctx, s.sinkURL(name[len(s.index.Name):]), opts)
+	if err != nil {
+		return fmt.Errorf("failed to open chunk %s: %s", name, err)
+	}
+
+	s.chunk = chunk
+	s.index.Chunks = append(s.index.Chunks, image.SplitChunk{Name: name, Start: s.index.Size, End: s.index.Size})
+
+	return nil
+}
+
+// complete closes the sink of the last chunk
+func (s *splitSink) complete() error {
+	chunk := s.chunk
+	s.chunk = nil
+	if err := chunk.Close(); err != nil {
+		return fmt.Errorf("failed to complete chunk %s: %s", chunk.Location(), err)
+	}
+	log.Printf("[DEBUG] completed chunk %s (%d bytes written)", chunk.Location(), chunk.Written())
+	return nil
+}
+
+func (s *splitSink) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if s.chunk == nil {
+			if err := s.next(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := &s.index.Chunks[len(s.index.Chunks)-1]
+		size := len(p)
+		if room := s.index.ChunkSize - chunk.Size(); int64(size) > room {
+			size = int(room)
+		}
+
+		n, err := s.chunk.Write(p[:size])
+		written += n
+		chunk.End += int64(n)
+		s.index.Size += int64(n)
+		p = p[n:]
+		if err != nil {
+			return s.count(written, err)
+		}
+
+		if chunk.Size() == s.index.ChunkSize {
+			if err := s.complete(); err != nil {
+				return s.count(written, err)
+			}
+		}
+	}
+
+	return s.count(written, nil)
+}
+
+// Close completes the last chunk and writes the index, describing the memory
+// held by each chunk if the location of memory within the output is known
+func (s *splitSink) Close() error {
+	if s.chunk != nil {
+		if err := s.complete(); err != nil {
+			return err
+		}
+	}
+
+	for i := range s.index.Chunks {
+		s.index.Chunks[i].Ranges = chunkRanges(s.index.Chunks[i], s.layout)
+	}
+
+	var data bytes.Buffer
+	if err := s.index.Write(&data); err != nil {
+		return err
+	}
+
+	index, err := s.factory(s.ctx, s.sinkURL(image.IndexSuffix), sinkOptions{size: uint64(data.Len()), metadata: s.opts.metadata})
+	if err != nil {
+		return fmt.Errorf("failed to open index: %s", err)
+	}
+	if _, err := index.Write(data.Bytes()); err != nil {
+		index.Abort(err)
+		return fmt.Errorf("failed to write index: %s", err)
+	}
+	if err := index.Close(); err != nil {
+		return fmt.Errorf("failed to complete index: %s", err)
+	}
+	s.location = index.Location()
+
+	log.Printf("[INFO] split output into %d chunk(s), described by the index %s", len(s.index.Chunks), s.location)
+
+	return nil
+}
+
+// Abort abandons the last chunk. Any completed chunks are left in place.
+func (s *splitSink) Abort(err error) {
+	completed := len(s.index.Chunks)
+	if s.chunk != nil {
+		s.chunk.Abort(err)
+		completed--
+	}
+	if completed > 0 {
+		log.Printf("[WARN] %d completed chunk(s) of the split output were left in place", completed)
+	}
+}
+
+// Location returns the location of the index, which is opened to reassemble the chunks
+func (s *splitSink) Location() string {
+	return s.location
+}
+
+// chunkRanges returns the portions of the layout held by the chunk
+func chunkRanges(chunk image.SplitChunk, layout []memr.OutputRange) []image.SplitRange {
+	var rngs []image.SplitRange
+	for _, rng := range layout {
+		start, end := int64(rng.Offset), int64(rng.Offset+rng.End-rng.Start)
+		if start < chunk.Start {
+			start = chunk.Start
+		}
+		if end > chunk.End {
+			end = chunk.End
+		}
+		if start >= end {
+			continue
+		}
+		rngs = append(rngs, image.SplitRange{
+			Start:  rng.Start + uint64(start-int64(rng.Offset)),
+			End:    rng.Start + uint64(end-int64(rng.Offset)),
+			Offset: start - chunk.Start,
+		})
+	}
+	return rngs
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ryandeivert/memr"
+	"github.com/ryandeivert/memr/image"
+)
+
+func TestChunkRanges(t *testing.T) {
+	// Ranges at offsets 0x20-0x1820 and 0x1840-0x2840 of the output
+	layout := []memr.OutputRange{
+		{Start: 0x1000, End: 0x2800, Offset: 0x20},
+		{Start: 0x10000, End: 0x11000, Offset: 0x1840},
+	}
+
+	cases := []struct {
+		name       string
+		start, end int64
+		layout     []memr.OutputRange
+		expected   []image.SplitRange
+	}{
+		{
+			name: "start of range", start: 0, end: 0x1000, layout: layout,
+			expected: []image.SplitRange{{Start: 0x1000, End: 0x1fe0, Offset: 0x20}},
+		},
+		{
+			name: "across ranges", start: 0x1000, end: 0x2000, layout: layout,
+			expected: []image.SplitRange{
+				{Start: 0x1fe0, End: 0x2800, Offset: 0},
+				{Start: 0x10000, End: 0x107c0, Offset: 0x840},
+			},
+		},
+		{
+			name: "end of range", start: 0x2000, end: 0x2840, layout: layout,
+			expected: []image.SplitRange{{Start: 0x107c0, End: 0x11000, Offset: 0}},
+		},
+		{
+			name: "within range", start: 0x100, end: 0x200, layout: layout,
+			expected: []image.SplitRange{{Start: 0x10e0, End: 0x11e0, Offset: 0}},
+		},
+		{name: "between ranges", start: 0x1820, end: 0x1840, layout: layout},
+		{name: "unknown layout", start: 0, end: 0x1000},
+	}
+	for _, tc := range cases {
+		got := chunkRanges(image.SplitChunk{Start: tc.start, End: tc.end}, tc.layout)
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("[%s] got %+v; want %+v", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestSplitSink(t *testing.T) {
+	_, data := writeTestLiME(t, 9, testRange{0x1000, 0x1800}, testRange{0x10000, 0x1000})
+	path := filepath.Join(t.TempDir(), "capture.lime")
+
+	sink, err := openSink(context.Background(), path, sinkOptions{size: uint64(len(data)), splitSize: 0x1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	split, ok := sink.(*splitSink)
+	if !ok {
+		t.Fatalf("unexpected sink for split output: %T", sink)
+	}
+	split.layout = []memr.OutputRange{
+		{Start: 0x1000, End: 0x2800, Offset: 0x20},
+		{Start: 0x10000, End: 0x11000, Offset: 0x1840},
+	}
+
+	// Writes that span chunks, and end exactly at the end of a chunk
+	for _, size := range []int{700, 0x1000 - 700, 0x1234, 1} {
+		if _, err := sink.Write(data[sink.Written() : sink.Written()+int64(size)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sink.Write(data[sink.Written():]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sink.Written() != int64(len(data)) || sink.Location() != path+image.IndexSuffix {
+		t.Errorf("unexpected sink: written=%d; location=%s", sink.Written(), sink.Location())
+	}
+
+	file, err := os.Open(path + image.IndexSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := image.ReadSplitIndex(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []image.SplitChunk{
+		{Name: "capture.lime.000", Start: 0, End: 0x1000, Ranges: []image.SplitRange{
+			{Start: 0x1000, End: 0x1fe0, Offset: 0x20},
+		}},
+		{Name: "capture.lime.001", Start: 0x1000, End: 0x2000, Ranges: []image.SplitRange{
+			{Start: 0x1fe0, End: 0x2800, Offset: 0},
+			{Start: 0x10000, End: 0x107c0, Offset: 0x840},
+		}},
+		{Name: "capture.lime.002", Start: 0x2000, End: 0x2840, Ranges: []image.SplitRange{
+			{Start: 0x107c0, End: 0x11000, Offset: 0},
+		}},
+	}
+	if index.Name != "capture.lime" || index.Size != int64(len(data)) || index.ChunkSize != 0x1000 {
+		t.Errorf("unexpected index: %+v", index)
+	}
+	if !reflect.DeepEqual(index.Chunks, expected) {
+		t.Errorf("chunks: got %+v; want %+v", index.Chunks, expected)
+	}
+	for _, chunk := range expected {
+		got := mustReadFile(t, filepath.Join(filepath.Dir(path), chunk.Name))
+		if !bytes.Equal(got, data[chunk.Start:chunk.End]) {
+			t.Errorf("chunk %s does not match the output", chunk.Name)
+		}
+	}
+
+	// The chunks are reassembled using the index
+	reassembled, err := image.OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(reassembled)
+	reassembled.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("reassembled chunks do not match the output")
+	}
+
+	img, err := image.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	p := make([]byte, 0x100)
+	if _, err := img.ReadAt(p, 0x107c0-0x80); err != nil || !bytes.Equal(p, data[0x1840+0x7c0-0x80:0x1840+0x7c0+0x80]) {
+		t.Errorf("unexpected data read across chunks: %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+
+	"github.com/ryandeivert/memr"
+)
+
+// The stream protocol carries a capture from the stream sink (using a tls:// or memr+tcp://
+// output) to a collector (memr receive). After the streamMagic, the sender writes a
+// streamHeader message, then the data as frames, each prefixed by its length, with a
+// zero length frame marking the end. This is followed by a streamTrailer message used
+// to verify the data, after which the collector replies with a streamReply message
+// once the capture is stored. Messages are JSON, prefixed by their length.
+const (
+	streamMagic = "MEMRSTR1" // includes the version of the protocol
+
+	// maxFrameSize is the largest frame of data written by the stream sink
+	maxFrameSize = 1 << 20
+
+	// maxMessageSize is the largest message accepted by either side
+	maxMessageSize = 16 << 20
+
+	// streamHash is the hash of the data included in the trailer
+	streamHash = memr.HashSHA256
+
+	// insecureScheme is the scheme of outputs using the stream protocol without TLS,
+	// distinct from tcp:// outputs, which write the raw output to any listener
+	insecureScheme = "memr+tcp"
+)
+
+var (
+	tlsCertFile string
+	tlsKeyFile  string
+	tlsCAFile   string
+)
+
+// streamHeader describes the capture, and is sent before its data
+type streamHeader struct {
+	MemrVersion string            `json:"memr_version"`
+	Format      string            `json:"format"` // name of the output format (eg: lime)
+	Size        uint64            `json:"size"`   // expected size of the image, before any compression or encryption
+	Compression string            `json:"compression,omitempty"`
+	Encryption  string            `json:"encryption,omitempty"`
+	Ranges      []streamRange     `json:"ranges,omitempty"` // location of memory within the image, if known
+	Hashes      []memr.Hash       `json:"hashes"`           // hashes of the data included in the trailer
+	Metadata    map[string]string `json:"metadata"`         // describes the source and host (eg: memr-host)
+}
+
+type streamRange struct {
+	Start  uint64 `json:"start"`
+	End    uint64 `json:"end"`    // exclusive
+	Offset uint64 `json:"offset"` // offset within the image at which Start is written
+}
+
+// streamTrailer follows the data, allowing the collector to verify it
+type streamTrailer struct {
+	Size   int64                `json:"size"` // bytes of data sent
+	Hashes map[memr.Hash]string `json:"hashes"`
+}
+
+// streamReply is sent by the collector once the capture is stored, or failed
+type streamReply struct {
+	Location string `json:"location,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// writeMessage writes v as JSON, prefixed by its length
+func writeMessage(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// readMessage reads a message written by writeMessage into v
+func readMessage(r io.Reader, v interface{}) error {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size > maxMessageSize {
+		return fmt.Errorf("message exceeds %d bytes: %d", maxMessageSize, size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// frameReader reads the data from frames, returning io.EOF at the zero length frame
+type frameReader struct {
+	r         io.Reader
+	remaining uint32 // bytes remaining in the current frame
+	done      bool
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	if f.done {
+		return 0, io.EOF
+	}
+
+	if f.remaining == 0 {
+		if err := binary.Read(f.r, binary.BigEndian, &f.remaining); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if f.remaining > maxFrameSize {
+			return 0, fmt.Errorf("frame exceeds %d bytes: %d", maxFrameSize, f.remaining)
+		}
+		if f.remaining == 0 {
+			f.done = true
+			return 0, io.EOF
+		}
+	}
+
+	if uint32(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.r.Read(p)
+	f.remaining -= uint32(n)
+	return n, unexpectedEOF(err)
+}
+
+// unexpectedEOF treats the end of the connection within the data as a failure
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// streamSink sends the output to a collector (see memr receive), using either a
+// tls://host:port or memr+tcp://host:port URL. Using tls, the client's certificate is
+// supplied with --tls-cert and --tls-key, and the collector's is verified using
+// either --tls-ca or the system's roots.
+type streamSink struct {
+	conn     net.Conn
+	buf      *bufio.Writer
+	hasher   *memr.Hasher
+	location string
+	counter
+}
+
+func newStreamSink(ctx context.Context, u *url.URL, opts sinkOptions) (Sink, error) {
+	if u.Port() == "" {
+		return nil, fmt.Errorf("no port in output URL: %s", u)
+	}
+
+	var conn net.Conn
+	var err error
+	if u.Scheme == "tls" {
+		var config *tls.Config
+		if config, err = clientTLSConfig(u.Hostname()); err != nil {
+			return nil, err
+		}
+		dialer := &tls.Dialer{Config: config}
+		conn, err = dialer.DialContext(ctx, "tcp", u.Host)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", u.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := startStream(conn, u.String(), opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// startStream sends the streamMagic and header describing the output to the collector
+// at the other end of the connection, returning a streamSink to send its data
+func startStream(conn net.Conn, location string, opts sinkOptions) (*streamSink, error) {
+	header := streamHeader{
+		MemrVersion: version,
+		Format:      opts.format,
+		Size:        opts.size,
+		Compression: opts.compression,
+		Encryption:  opts.encryption,
+		Hashes:      []memr.Hash{streamHash},
+		Metadata:    opts.metadata,
+	}
+	for _, rng := range opts.ranges {
+		header.Ranges = append(header.Ranges, streamRange{Start: rng.Start, End: rng.End, Offset: rng.Offset})
+	}
+
+	s := &streamSink{conn: conn, buf: bufio.NewWriterSize(conn, maxFrameSize/4), location: location}
+	s.hasher, _ = memr.NewHasher(streamHash)
+
+	_, err := s.buf.WriteString(streamMagic)
+	if err == nil {
+		err = writeMessage(s.buf, header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to send header: %s", err)
+	}
+
+	return s, nil
+}
+
+func (s *streamSink) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		size := len(p)
+		if size > maxFrameSize {
+			size = maxFrameSize
+		}
+
+		if err := binary.Write(s.buf, binary.BigEndian, uint32(size)); err != nil {
+			return s.count(written, err)
+		}
+		n, err := s.buf.Write(p[:size])
+		s.hasher.Write(p[:n])
+		written += n
+		p = p[n:]
+		if err != nil {
+			return s.count(written, err)
+		}
+	}
+	return s.count(written, nil)
+}
+
+// Close ends the data and sends the trailer, then waits for the collector to store the
+// capture. The location is then that reported by the collector (eg: s3://bucket/key).
+func (s *streamSink) Close() error {
+	defer s.conn.Close()
+
+	err := binary.Write(s.buf, binary.BigEndian, uint32(0))
+	if err == nil {
+		err = writeMessage(s.buf, streamTrailer{Size: s.written, Hashes: s.hasher.Sums()})
+	}
+	if err == nil {
+		err = s.buf.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send trailer: %s", err)
+	}
+
+	var reply streamReply
+	if err := readMessage(s.conn, &reply); err != nil {
+		return fmt.Errorf("failed to read reply from collector: %s", unexpectedEOF(err))
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("collector failed to store the capture: %s", reply.Error)
+	}
+	if reply.Location != "" {
+		s.location = reply.Location
+	}
+
+	return nil
+}
+
+// Abort closes the connection without a trailer, so the collector abandons the capture
+func (s *streamSink) Abort(error) {
+	s.conn.Close()
+}
+
+func (s *streamSink) Location() string {
+	return s.location
+}
+
+// clientTLSConfig returns the TLS configuration for connecting to the collector at host
+func clientTLSConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+
+	if tlsCertFile != "" || tlsKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsCAFile != "" {
+		pool, err := loadCertPool(tlsCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// loadCertPool loads the PEM encoded certificates in the file at path
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM encoded certificates in %s", path)
+	}
+
+	return pool, nil
+}
+
+func init() {
+	registerSink("tls", newStreamSink)
+	registerSink(insecureScheme, newStreamSink)
+}
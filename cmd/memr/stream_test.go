@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/ryandeivert/memr"
+)
+
+// frames encodes the data as frames of at most size bytes, followed by the zero length frame
+func frames(data []byte, size int) []byte {
+	var buf bytes.Buffer
+	for len(data) > 0 {
+		n := len(data)
+		if n > size {
+			n = size
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(n)) //nolint:errcheck
+		buf.Write(data[:n])
+		data = data[n:]
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(0)) //nolint:errcheck
+	return buf.Bytes()
+}
+
+func TestMessages(t *testing.T) {
+	var buf bytes.Buffer
+	sent := streamTrailer{Size: 1234, Hashes: map[memr.Hash]string{memr.HashSHA256: "abcd"}}
+	if err := writeMessage(&buf, sent); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	var received streamTrailer
+	if err := readMessage(bytes.NewReader(data), &received); err != nil {
+		t.Fatal(err)
+	}
+	if received.Size != sent.Size || received.Hashes[memr.HashSHA256] != "abcd" {
+		t.Errorf("unexpected message: %+v", received)
+	}
+
+	// Truncated within the length, or the message itself
+	for _, size := range []int{2, len(data) - 1} {
+		err := readMessage(bytes.NewReader(data[:size]), &received)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("truncated to %d bytes: expected an unexpected EOF: %v", size, err)
+		}
+	}
+
+	var oversized bytes.Buffer
+	binary.Write(&oversized, binary.BigEndian, uint32(maxMessageSize+1)) //nolint:errcheck
+	err := readMessage(&oversized, &received)
+	if err == nil || !strings.Contains(err.Error(), "message exceeds") {
+		t.Errorf("expected an oversized message to be rejected: %v", err)
+	}
+}
+
+func TestFrameReader(t *testing.T) {
+	data := randomData(2*maxFrameSize + 100)
+	encoded := append(frames(data, maxFrameSize), []byte("trailer")...)
+
+	r := bytes.NewReader(encoded)
+	got, err := ioutil.ReadAll(&frameReader{r: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data read from frames does not match")
+	}
+
+	// Reading stops at the zero length frame, before the trailer
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "trailer" {
+		t.Errorf("unexpected data after frames: %q", rest)
+	}
+
+	// Truncated within a length, within a frame, or before the zero length frame
+	end := len(encoded) - len("trailer")
+	for _, size := range []int{2, 100, end - 4} {
+		_, err := ioutil.ReadAll(&frameReader{r: bytes.NewReader(encoded[:size])})
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("truncated to %d bytes: expected an unexpected EOF: %v", size, err)
+		}
+	}
+
+	var oversized bytes.Buffer
+	binary.Write(&oversized, binary.BigEndian, uint32(maxFrameSize+1)) //nolint:errcheck
+	_, err = ioutil.ReadAll(&frameReader{r: &oversized})
+	if err == nil || !strings.Contains(err.Error(), "frame exceeds") {
+		t.Errorf("expected an oversized frame to be rejected: %v", err)
+	}
+}
+
+func TestVerifyTrailer(t *testing.T) {
+	data := []byte("some data")
+	hasher, _ := memr.NewHasher(streamHash)
+	hasher.Write(data)
+	sums := hasher.Sums()
+
+	tests := []struct {
+		name    string
+		trailer streamTrailer
+		err     string
+	}{
+		{"match", streamTrailer{Size: int64(len(data)), Hashes: sums}, ""},
+		{"size", streamTrailer{Size: int64(len(data)) + 1, Hashes: sums}, "size of the data received does not match"},
+		{"hash", streamTrailer{Size: int64(len(data)), Hashes: map[memr.Hash]string{streamHash: strings.Repeat("0", 64)}}, "sha256 of the data received does not match"},
+		{"missing hash", streamTrailer{Size: int64(len(data))}, "sha256 of the data received does not match"},
+	}
+	for _, test := range tests {
+		err := verifyTrailer(&test.trailer, hasher)
+		if test.err == "" && err != nil {
+			t.Errorf("[%s] unexpected error: %v", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("[%s] expected error %q: %v", test.name, test.err, err)
+		}
+	}
+
+	// Data must be hashed, which requires hashes in the header
+	empty, _ := memr.NewHasher()
+	if err := verifyTrailer(&streamTrailer{}, empty); err == nil {
+		t.Error("expected data without hashes to be rejected")
+	}
+}
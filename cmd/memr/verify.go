@@ -0,0 +1,561 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ryandeivert/memr"
+	"github.com/ryandeivert/memr/image"
+	"github.com/spf13/cobra"
+)
+
+var (
+	verifyManifest    string
+	verifyKeyFile     string
+	verifyIdentities  []string
+	verifyInputFormat = "auto"
+	verifyRangeMap    string
+	verifyTempDir     string
+	verifyJSON        bool
+)
+
+const (
+	checkOK      = "ok"
+	checkFailed  = "failed"
+	checkSkipped = "skipped"
+)
+
+// manifestFormats maps the formats recorded in manifests to the image formats they produce
+var manifestFormats = map[string][]image.Format{
+	memr.FormatDefault.String(): {image.FormatLiME, image.FormatRaw},
+	memr.FormatELF.String():     {image.FormatELF},
+	memr.FormatPadded.String():  {image.FormatPadded},
+	memr.FormatAVML.String():    {image.FormatAVML},
+}
+
+// verifyCmd checks an existing image against the manifest written when it was acquired
+var verifyCmd = &cobra.Command{
+	Use:   "verify <IMAGE>",
+	Short: "Verify an existing image against its manifest",
+	Long: `Verify an existing image against the manifest written when it was acquired
+(using --manifest), by re-reading the image and recomputing the hashes of the
+output stream, the entire image and each of its ranges.
+
+The signature of the manifest is verified if it is signed. Supplying --verify-key
+additionally requires the manifest to be signed by that key, since the public key
+embedded in the manifest only proves it has not been modified since signing.
+
+The structure of the image is also checked: its format, the number of headers
+and ranges it contains, and that its ranges match the memory ranges recorded in
+the manifest (every range of system RAM is either captured or recorded as missing).
+
+Images encrypted using --encrypt-to are decrypted first, using --identity.
+
+Raw and padded images use the ranges from the manifest, unless --range-map is
+supplied. Any stream compression of the image (snappy, lz4, gzip or zstd) is
+detected and stripped first, using temporary files in --temp-dir.`,
+	Example: `
+Verifying a LiME image against its manifest:
+memr verify capture.lime --manifest capture.json
+
+Verifying a compressed image, requiring the manifest to be signed by a known key:
+memr verify capture.lime.sz --manifest capture.json --verify-key public.pem
+
+Verifying an encrypted image:
+memr verify capture.lime.sz.age --manifest capture.json --identity key.txt
+
+Verifying a raw image, using the ranges from the manifest:
+memr verify capture.raw --manifest capture.json --input-format raw`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		data, err := ioutil.ReadFile(verifyManifest)
+		if err != nil {
+			return fmt.Errorf("failed to read manifest: %s", err)
+		}
+
+		var m manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("invalid manifest %s: %s", verifyManifest, err)
+		}
+
+		var trusted ed25519.PublicKey
+		if verifyKeyFile != "" {
+			if trusted, err = loadVerifyKey(verifyKeyFile); err != nil {
+				return fmt.Errorf("failed to load verification key: %s", err)
+			}
+		}
+
+		rpt := &verifyReport{Image: args[0], Manifest: verifyManifest, Checks: []verifyCheck{}, Ranges: []rangeCheck{}}
+		rpt.add("signature", verifySignature(data, trusted))
+
+		// Encrypted output is decrypted first, which also authenticates it
+		decrypted := args[0]
+		if m.Encryption != "" {
+			if len(verifyIdentities) == 0 {
+				return fmt.Errorf("image is encrypted, \"--identity\" flag must be supplied")
+			}
+			identities, err := loadIdentities(verifyIdentities)
+			if err != nil {
+				return fmt.Errorf("failed to load identities: %s", err)
+			}
+			if decrypted, _, err = decryptTemp(args[0], verifyTempDir, identities); err != nil {
+				return err
+			}
+			defer os.Remove(decrypted)
+		}
+
+		input, layers, cleanup, err := stripCompression(decrypted, verifyTempDir)
+		defer cleanup()
+		if err != nil {
+			return fmt.Errorf("failed to decompress input: %s", err)
+		}
+
+		if err := rpt.verifyDigests(&m, args[0], input, layers); err != nil {
+			return err
+		}
+
+		// Raw and padded images are described by the captured ranges, by default
+		var rngs []image.Range
+		if verifyRangeMap == "" && verifyInputFormat != "auto" {
+			rngs = make([]image.Range, 0, len(m.Ranges))
+			for _, rng := range m.Ranges {
+				rngs = append(rngs, image.Range{Start: rng.Start, End: rng.End})
+			}
+		}
+
+		var img *image.Image
+		if rngs != nil {
+			img, err = openImageRanges(input, verifyInputFormat, rngs, true)
+		} else {
+			img, err = openImage(input, verifyInputFormat, verifyRangeMap, true)
+		}
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+
+		rpt.verifyStructure(&m, img)
+		if err := rpt.verifyRanges(&m, img); err != nil {
+			return err
+		}
+
+		if verifyJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(rpt); err != nil {
+				return err
+			}
+		} else if err := rpt.print(os.Stdout); err != nil {
+			return err
+		}
+
+		if rpt.Problems > 0 {
+			return fmt.Errorf("verification of %s failed with %d problem(s)", args[0], rpt.Problems)
+		}
+
+		log.Printf("verified %s against %s", args[0], verifyManifest)
+
+		return nil
+	},
+}
+
+// verifyReport describes the result of verifying an image, and is written as
+// JSON when using --json. The end addresses of ranges are exclusive.
+type verifyReport struct {
+	Image    string        `json:"image"`
+	Manifest string        `json:"manifest"`
+	Checks   []verifyCheck `json:"checks"`
+	Ranges   []rangeCheck  `json:"ranges"`
+	Problems int           `json:"problems"`
+}
+
+type verifyCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // one of: ok, failed or skipped
+	Detail string `json:"detail,omitempty"`
+}
+
+type rangeCheck struct {
+	Start  uint64 `json:"start"`
+	End    uint64 `json:"end"`
+	Size   uint64 `json:"size"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (v *verifyReport) add(name string, check verifyCheck) {
+	check.Name = name
+	if check.Status == checkFailed {
+		v.Problems++
+	}
+	v.Checks = append(v.Checks, check)
+}
+
+// verifySignature verifies the signature of the manifest in data, requiring it
+// to be signed by the trusted key, if supplied
+func verifySignature(data []byte, trusted ed25519.PublicKey) verifyCheck {
+	payload, sig, err := canonicalManifest(data)
+	if err != nil {
+		return verifyCheck{Status: checkFailed, Detail: err.Error()}
+	}
+
+	if sig == nil {
+		if trusted != nil {
+			return verifyCheck{Status: checkFailed, Detail: "manifest is not signed"}
+		}
+		return verifyCheck{Status: checkSkipped, Detail: "manifest is not signed"}
+	}
+
+	if sig.Algorithm != signatureAlgorithm {
+		return verifyCheck{Status: checkFailed, Detail: fmt.Sprintf("unsupported signature algorithm: %s", sig.Algorithm)}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(sig.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return verifyCheck{Status: checkFailed, Detail: "invalid public key in signature"}
+	}
+	value, err := base64.StdEncoding.DecodeString(sig.Value)
+	if err != nil {
+		return verifyCheck{Status: checkFailed, Detail: "invalid signature value"}
+	}
+
+	if trusted != nil && !trusted.Equal(ed25519.PublicKey(key)) {
+		return verifyCheck{Status: checkFailed, Detail: fmt.Sprintf("signed by an untrusted key: %s", sig.PublicKey)}
+	}
+
+	if !ed25519.Verify(key, payload, value) {
+		return verifyCheck{Status: checkFailed, Detail: "signature does not match the manifest"}
+	}
+
+	if trusted == nil {
+		return verifyCheck{Status: checkOK, Detail: fmt.Sprintf("signed by embedded key %s, which is untrusted (use --verify-key to require a known key)", sig.PublicKey)}
+	}
+	return verifyCheck{Status: checkOK, Detail: fmt.Sprintf("signed by trusted key %s", sig.PublicKey)}
+}
+
+// verifyDigests checks the hashes of the output stream (path, as written) and the
+// entire image (input, decrypted and with the compression layers removed) against the manifest
+func (v *verifyReport) verifyDigests(m *manifest, path, input string, layers []string) error {
+	var expected []string
+	if m.Compression != "" {
+		expected = []string{m.Compression}
+	}
+
+	// Any compression is beneath encryption, so is only compared for unencrypted output
+	var streamDigest *digest
+	switch {
+	case m.OutputStream == nil:
+		v.add("output stream", verifyCheck{Status: checkSkipped, Detail: "no hashes in manifest"})
+	case m.Encryption == "" && strings.Join(layers, ",") != strings.Join(expected, ","):
+		v.add("output stream", verifyCheck{
+			Status: checkSkipped,
+			Detail: fmt.Sprintf("compression of image (%s) differs from manifest (%s)", layerNames(layers), layerNames(expected)),
+		})
+	default:
+		var err error
+		if streamDigest, err = hashFile(path, m.OutputStream.Hashes); err != nil {
+			return err
+		}
+		v.add("output stream", compareDigests(m.OutputStream, streamDigest))
+	}
+
+	if m.Image == nil {
+		detail := "no hashes in manifest"
+		if len(m.Resumes) > 0 {
+			detail = fmt.Sprintf("no hashes in manifest (upload was resumed %d time(s), so the image is not consistent)", len(m.Resumes))
+		}
+		v.add("image", verifyCheck{Status: checkSkipped, Detail: detail})
+		return nil
+	}
+
+	// Without compression, the output stream is the image
+	imageDigest := streamDigest
+	if input != path || streamDigest == nil || !sameHashes(m.Image, m.OutputStream) {
+		var err error
+		if imageDigest, err = hashFile(input, m.Image.Hashes); err != nil {
+			return err
+		}
+	}
+	v.add("image", compareDigests(m.Image, imageDigest))
+
+	return nil
+}
+
+// verifyStructure checks the format, headers and ranges of the image against the manifest
+func (v *verifyReport) verifyStructure(m *manifest, img *image.Image) {
+	formats, ok := manifestFormats[m.Format]
+	switch {
+	case !ok:
+		v.add("format", verifyCheck{Status: checkSkipped, Detail: fmt.Sprintf("unknown format in manifest: %s", m.Format)})
+	case !containsFormat(formats, img.Format):
+		v.add("format", verifyCheck{Status: checkFailed, Detail: fmt.Sprintf("image is %s, manifest is %s", img.Format, m.Format)})
+	default:
+		v.add("format", verifyCheck{Status: checkOK, Detail: img.Format.String()})
+	}
+
+	if len(img.Anomalies) > 0 {
+		v.add("anomalies", verifyCheck{Status: checkFailed, Detail: strings.Join(img.Anomalies, "; ")})
+	} else {
+		v.add("anomalies", verifyCheck{Status: checkOK})
+	}
+
+	switch {
+	case img.Format == image.FormatRaw || img.Format == image.FormatPadded:
+		v.add("headers", verifyCheck{Status: checkSkipped, Detail: fmt.Sprintf("%s images have no headers", img.Format)})
+	case len(img.Ranges) != len(m.Ranges):
+		v.add("headers", verifyCheck{Status: checkFailed, Detail: fmt.Sprintf("image has %d header(s), manifest has %d range(s)", len(img.Ranges), len(m.Ranges))})
+	default:
+		v.add("headers", verifyCheck{Status: checkOK, Detail: fmt.Sprintf("%d header(s)", len(img.Ranges))})
+	}
+
+	captured := make(map[[2]uint64]bool, len(m.Ranges))
+	for _, rng := range m.Ranges {
+		captured[[2]uint64{rng.Start, rng.End}] = true
+	}
+	var unexpected []string
+	for _, rng := range img.Ranges {
+		if !captured[[2]uint64{rng.Start, rng.End}] {
+			unexpected = append(unexpected, fmt.Sprintf("%#x-%#x", rng.Start, rng.End-1))
+		}
+	}
+	if len(unexpected) > 0 {
+		v.add("ranges", verifyCheck{Status: checkFailed, Detail: fmt.Sprintf("range(s) not in manifest: %s", strings.Join(unexpected, ", "))})
+	} else {
+		v.add("ranges", verifyCheck{Status: checkOK, Detail: fmt.Sprintf("%d range(s)", len(img.Ranges))})
+	}
+
+	if len(m.MemoryRanges) == 0 {
+		v.add("memory layout", verifyCheck{Status: checkSkipped, Detail: "no memory ranges in manifest"})
+	} else if problems := layoutProblems(img.Ranges, m.MemoryRanges, m.MissingRanges); len(problems) > 0 {
+		v.add("memory layout", verifyCheck{Status: checkFailed, Detail: strings.Join(problems, "; ")})
+	} else {
+		v.add("memory layout", verifyCheck{Status: checkOK, Detail: fmt.Sprintf("%d memory range(s)", len(m.MemoryRanges))})
+	}
+}
+
+// verifyRanges checks the hashes of each range recorded in the manifest
+func (v *verifyReport) verifyRanges(m *manifest, img *image.Image) error {
+	for _, rng := range m.Ranges {
+		check := rangeCheck{Start: rng.Start, End: rng.End, Size: rng.Size}
+
+		if len(rng.Hashes) == 0 {
+			check.Status, check.Detail = checkSkipped, "no hashes in manifest (read before the upload was resumed)"
+			v.Ranges = append(v.Ranges, check)
+			continue
+		}
+
+		hasher, err := newHasher(rng.Hashes)
+		if err != nil {
+			return err
+		}
+
+		if _, err := img.Extract(hasher, rng.Start, rng.End-rng.Start, false); err != nil {
+			check.Status, check.Detail = checkFailed, err.Error()
+		} else {
+			result := compareDigests(&digest{Size: rng.Size, Hashes: rng.Hashes}, &digest{Size: hasher.Size(), Hashes: hasher.Sums()})
+			check.Status, check.Detail = result.Status, result.Detail
+		}
+
+		if check.Status == checkFailed {
+			v.Problems++
+		}
+		v.Ranges = append(v.Ranges, check)
+	}
+
+	return nil
+}
+
+func (v *verifyReport) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Image:\t%s\n", v.Image)
+	fmt.Fprintf(tw, "Manifest:\t%s\n", v.Manifest)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nChecks (%d):\n", len(v.Checks))
+	for _, check := range v.Checks {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", check.Name, check.Status, check.Detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nRanges (%d):\n", len(v.Ranges))
+	fmt.Fprintln(tw, "  START\tEND\tSIZE\tSTATUS\tDETAIL")
+	for _, rng := range v.Ranges {
+		fmt.Fprintf(tw, "  %#016x\t%#016x\t%d (%s)\t%s\t%s\n", rng.Start, rng.End-1, rng.Size, humanSize(rng.Size), rng.Status, rng.Detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nProblems: %d\n", v.Problems)
+
+	return nil
+}
+
+// layoutProblems checks that every range of the image is within the memory ranges,
+// and that every memory range is either captured by the image or recorded as missing.
+// Memory and missing ranges are inclusive, while those of the image are exclusive.
+func layoutProblems(rngs []image.Range, memory, missing []rangeReport) []string {
+	var problems []string
+	for _, rng := range rngs {
+		var inside bool
+		for _, mem := range memory {
+			if rng.Start >= mem.Start && rng.End-1 <= mem.End {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			problems = append(problems, fmt.Sprintf("range %#x-%#x is outside the memory ranges", rng.Start, rng.End-1))
+		}
+	}
+
+	for _, mem := range memory {
+		var covered uint64
+		for _, rng := range rngs {
+			covered += overlap(mem.Start, mem.End+1, rng.Start, rng.End)
+		}
+		for _, rng := range missing {
+			covered += overlap(mem.Start, mem.End+1, rng.Start, rng.End+1)
+		}
+		if size := mem.End + 1 - mem.Start; covered != size {
+			problems = append(problems, fmt.Sprintf("memory range %#x-%#x has %d byte(s) neither captured nor missing", mem.Start, mem.End, int64(size)-int64(covered)))
+		}
+	}
+
+	return problems
+}
+
+// overlap returns the number of bytes in both [start1, end1) and [start2, end2)
+func overlap(start1, end1, start2, end2 uint64) uint64 {
+	if start2 > start1 {
+		start1 = start2
+	}
+	if end2 < end1 {
+		end1 = end2
+	}
+	if start1 >= end1 {
+		return 0
+	}
+	return end1 - start1
+}
+
+// compareDigests compares the actual digest to the expected one, from the manifest
+func compareDigests(expected, actual *digest) verifyCheck {
+	var problems []string
+	if expected.Size != actual.Size {
+		problems = append(problems, fmt.Sprintf("size %d != %d", actual.Size, expected.Size))
+	}
+
+	names := hashNamesOf(expected.Hashes)
+	for _, name := range names {
+		if actual.Hashes[name] != expected.Hashes[name] {
+			problems = append(problems, fmt.Sprintf("%s %s != %s", name, actual.Hashes[name], expected.Hashes[name]))
+		}
+	}
+
+	if len(problems) > 0 {
+		return verifyCheck{Status: checkFailed, Detail: strings.Join(problems, "; ")}
+	}
+
+	var strs []string
+	for _, name := range names {
+		strs = append(strs, string(name))
+	}
+	return verifyCheck{Status: checkOK, Detail: strings.Join(strs, ", ")}
+}
+
+// hashFile computes the digest of the file at path, using the hashes in sums
+func hashFile(path string, sums map[memr.Hash]string) (*digest, error) {
+	hasher, err := newHasher(sums)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := image.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+
+	return &digest{Size: hasher.Size(), Hashes: hasher.Sums()}, nil
+}
+
+// newHasher returns a memr.Hasher computing the hashes in sums
+func newHasher(sums map[memr.Hash]string) (*memr.Hasher, error) {
+	hasher, err := memr.NewHasher(hashNamesOf(sums)...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest: %s", err)
+	}
+	return hasher, nil
+}
+
+// hashNamesOf returns the names of the hashes in sums, sorted
+func hashNamesOf(sums map[memr.Hash]string) []memr.Hash {
+	names := make([]memr.Hash, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// sameHashes returns true if both digests use the same hashes
+func sameHashes(a, b *digest) bool {
+	if a == nil || b == nil || len(a.Hashes) != len(b.Hashes) {
+		return false
+	}
+	for name := range a.Hashes {
+		if _, ok := b.Hashes[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFormat(formats []image.Format, format image.Format) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func layerNames(layers []string) string {
+	if len(layers) == 0 {
+		return "none"
+	}
+	return strings.Join(layers, ", ")
+}
+
+func init() {
+	verifyCmd.Flags().StringVarP(&verifyManifest, "manifest", "m", verifyManifest, "manifest written when the image was acquired (using --manifest)")
+	verifyCmd.Flags().StringVar(&verifyKeyFile, "verify-key", verifyKeyFile, "PEM encoded ed25519 public key by which the manifest must be signed")
+	verifyCmd.Flags().StringSliceVarP(&verifyIdentities, "identity", "i", verifyIdentities, "file of age identities or PEM encoded X25519 private key with which to decrypt an encrypted image (may be repeated)")
+	verifyCmd.Flags().StringVar(&verifyInputFormat, "input-format", verifyInputFormat, fmt.Sprintf("input format (one of: %s)", strings.Join(inputFormats, ", ")))
+	verifyCmd.Flags().StringVar(&verifyRangeMap, "range-map", verifyRangeMap, "copy of /proc/iomem from the captured host, describing the ranges of a raw or padded image (default is the ranges from the manifest)")
+	verifyCmd.Flags().StringVar(&verifyTempDir, "temp-dir", verifyTempDir, "directory for temporary files used to decompress the image (default is the system temporary directory)")
+	verifyCmd.Flags().BoolVar(&verifyJSON, "json", verifyJSON, "write the result as JSON")
+	_ = verifyCmd.MarkFlagRequired("manifest")
+
+	rootCmd.AddCommand(verifyCmd)
+}
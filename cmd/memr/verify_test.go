@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ryandeivert/memr"
+	"github.com/ryandeivert/memr/image"
+)
+
+// writeKeys writes a new ed25519 private key and its public key as PEM
+// encoded files, returning their paths and the keys
+func writeKeys(t *testing.T) (string, string, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	privatePath, publicPath := filepath.Join(dir, "key.pem"), filepath.Join(dir, "public.pem")
+	if err := os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return privatePath, publicPath, private
+}
+
+// sums returns the sha256 digest of the data
+func sums(data []byte) *digest {
+	hasher, _ := memr.NewHasher(memr.HashSHA256)
+	hasher.Write(data) //nolint:errcheck
+	return &digest{Size: uint64(len(data)), Hashes: hasher.Sums()}
+}
+
+func TestVerifySignature(t *testing.T) {
+	privatePath, publicPath, key := writeKeys(t)
+
+	m := &manifest{Source: "/dev/crash", Format: "lime", Size: 0x2000, Ranges: []rangeDigest{{Start: 0x1000, End: 0x3000, Size: 0x2000}}}
+	if err := m.sign(key); err != nil {
+		t.Fatal(err)
+	}
+	compact, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same manifest as written, indented and with its fields in another order
+	indented, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(compact, &fields); err != nil {
+		t.Fatal(err)
+	}
+	reordered, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The signed payload is unaffected by the signature itself
+	payload, sig, err := canonicalManifest(compact)
+	if err != nil || sig == nil || strings.Contains(string(payload), "signature") {
+		t.Fatalf("unexpected canonical manifest: %s; %v", payload, err)
+	}
+
+	trusted, err := loadVerifyKey(publicPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSigningKey(privatePath); err != nil {
+		t.Fatal(err)
+	}
+	_, _, other := writeKeys(t)
+	untrusted := other.Public().(ed25519.PublicKey)
+
+	unsigned := *m
+	unsigned.Signature = nil
+	unsignedData, _ := json.Marshal(&unsigned)
+
+	tampered := strings.Replace(string(compact), `"size":8192`, `"size":8193`, 1)
+	if tampered == string(compact) {
+		t.Fatal("failed to tamper with the manifest")
+	}
+
+	cases := []struct {
+		name    string
+		data    []byte
+		trusted ed25519.PublicKey
+		status  string
+		detail  string
+	}{
+		{"trusted", compact, trusted, checkOK, "signed by trusted key"},
+		{"indented", indented, trusted, checkOK, "signed by trusted key"},
+		{"reordered", reordered, trusted, checkOK, "signed by trusted key"},
+		{"embedded key", compact, nil, checkOK, "which is untrusted (use --verify-key"},
+		{"tampered", []byte(tampered), nil, checkFailed, "signature does not match"},
+		{"untrusted key", compact, untrusted, checkFailed, "signed by an untrusted key"},
+		{"unsigned", unsignedData, nil, checkSkipped, "not signed"},
+		{"unsigned with key", unsignedData, trusted, checkFailed, "not signed"},
+		{"invalid", []byte("{"), nil, checkFailed, "invalid manifest"},
+	}
+	for _, tc := range cases {
+		check := verifySignature(tc.data, tc.trusted)
+		if check.Status != tc.status || !strings.Contains(check.Detail, tc.detail) {
+			t.Errorf("[%s] got %s (%s); want %s (%s)", tc.name, check.Status, check.Detail, tc.status, tc.detail)
+		}
+	}
+}
+
+func TestVerifyDigests(t *testing.T) {
+	path, data := writeTestLiME(t, 6, testRange{0x1000, 0x2000})
+
+	m := &manifest{Image: sums(data), OutputStream: sums(data)}
+	rpt := &verifyReport{}
+	if err := rpt.verifyDigests(m, path, path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rpt.Problems != 0 || len(rpt.Checks) != 2 || rpt.Checks[0].Status != checkOK || rpt.Checks[1].Status != checkOK {
+		t.Errorf("expected the digests to match: %+v", rpt.Checks)
+	}
+
+	// A different image, of the same size
+	modified := append([]byte(nil), data...)
+	modified[100] ^= 0xff
+	if err := os.WriteFile(path, modified, 0600); err != nil {
+		t.Fatal(err)
+	}
+	rpt = &verifyReport{}
+	if err := rpt.verifyDigests(m, path, path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rpt.Problems != 2 || !strings.HasPrefix(rpt.Checks[1].Detail, "sha256 ") {
+		t.Errorf("expected the digests not to match: %+v", rpt.Checks)
+	}
+
+	// Compression that differs from the manifest skips the output stream
+	rpt = &verifyReport{}
+	if err := rpt.verifyDigests(m, path, path, []string{"gzip"}); err != nil {
+		t.Fatal(err)
+	}
+	if rpt.Checks[0].Status != checkSkipped || !strings.Contains(rpt.Checks[0].Detail, "compression of image (gzip) differs from manifest (none)") {
+		t.Errorf("expected the output stream to be skipped: %+v", rpt.Checks[0])
+	}
+}
+
+func TestVerifyRanges(t *testing.T) {
+	path, data := writeTestLiME(t, 7, testRange{0x1000, 0x2000}, testRange{0x10000, 0x1000})
+	img, err := image.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	first := data[32 : 32+0x2000]
+	second := append([]byte(nil), data[32+0x2000+32:]...)
+	second[0] ^= 0xff
+
+	m := &manifest{
+		Format: memr.FormatDefault.String(),
+		Ranges: []rangeDigest{
+			{Start: 0x1000, End: 0x3000, Size: 0x2000, Hashes: sums(first).Hashes},
+			{Start: 0x10000, End: 0x11000, Size: 0x1000, Hashes: sums(second).Hashes}, // hash mismatch
+			{Start: 0x20000, End: 0x21000, Size: 0x1000, Hashes: sums(second).Hashes}, // not in the image
+			{Start: 0x30000, End: 0x31000, Size: 0x1000},                              // read before a resume
+		},
+		MemoryRanges: []rangeReport{{Start: 0x1000, End: 0x2fff}, {Start: 0x10000, End: 0x10fff}},
+	}
+
+	rpt := &verifyReport{}
+	if err := rpt.verifyRanges(m, img); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ status, detail string }{
+		{checkOK, "sha256"},
+		{checkFailed, "sha256 "},
+		{checkFailed, "not within any range"},
+		{checkSkipped, "no hashes in manifest"},
+	}
+	if len(rpt.Ranges) != len(want) {
+		t.Fatalf("unexpected ranges: %+v", rpt.Ranges)
+	}
+	for i, check := range rpt.Ranges {
+		if check.Status != want[i].status || !strings.Contains(check.Detail, want[i].detail) {
+			t.Errorf("range %#x: got %s (%s); want %s (%s)", check.Start, check.Status, check.Detail, want[i].status, want[i].detail)
+		}
+	}
+	if rpt.Problems != 2 {
+		t.Errorf("problems: got %d; want 2", rpt.Problems)
+	}
+
+	// The image has fewer headers than the manifest has ranges
+	rpt = &verifyReport{}
+	rpt.verifyStructure(m, img)
+	statuses := make(map[string]string)
+	for _, check := range rpt.Checks {
+		statuses[check.Name] = check.Status
+	}
+	for name, status := range map[string]string{"format": checkOK, "anomalies": checkOK, "headers": checkFailed, "ranges": checkOK, "memory layout": checkOK} {
+		if statuses[name] != status {
+			t.Errorf("%s: got %s; want %s (%+v)", name, statuses[name], status, rpt.Checks)
+		}
+	}
+}
+
+func TestVerifyImage(t *testing.T) {
+	lime, _ := writeTestLiME(t, 8, testRange{0x1000, 0x3000}, testRange{0x10000, 0x2000})
+	privatePath, publicPath, _ := writeKeys(t)
+	dir := t.TempDir()
+	output, manifestPath := filepath.Join(dir, "capture.lime"), filepath.Join(dir, "capture.json")
+
+	out, err := runMemr(t, "--image", lime, "--output", output, "--manifest", manifestPath, "--sign-key", privatePath, "--compress=false", "--progress=false")
+	if err != nil {
+		t.Fatalf("failed to acquire: %v; output:\n%s", err, out)
+	}
+
+	out, err = runMemr(t, "verify", output, "--manifest", manifestPath, "--verify-key", publicPath)
+	if err != nil {
+		t.Fatalf("failed to verify: %v; output:\n%s", err, out)
+	}
+	if !strings.Contains(out, "signed by trusted key") || !strings.Contains(out, "Problems: 0") {
+		t.Errorf("unexpected verification:\n%s", out)
+	}
+
+	// Modify the data of the second range, after its header
+	data := mustReadFile(t, output)
+	data[32+0x3000+32+10] ^= 0xff
+	if err := os.WriteFile(output, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runMemr(t, "verify", output, "--manifest", manifestPath, "--verify-key", publicPath, "--json")
+	if err == nil {
+		t.Fatalf("expected verification to fail:\n%s", out)
+	}
+	var rpt verifyReport
+	if err := json.Unmarshal([]byte(out[:strings.LastIndex(out, "}")+1]), &rpt); err != nil {
+		t.Fatalf("invalid report: %v\n%s", err, out)
+	}
+	if len(rpt.Ranges) != 2 || rpt.Ranges[0].Status != checkOK || rpt.Ranges[1].Status != checkFailed {
+		t.Errorf("expected only the second range to fail: %+v", rpt.Ranges)
+	}
+	// The output stream, the image and the second range
+	if rpt.Problems != 3 {
+		t.Errorf("problems: got %d; want 3", rpt.Problems)
+	}
+}
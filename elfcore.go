@@ -0,0 +1,117 @@
+package memr
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"log"
+	"runtime"
+)
+
+// elfMachines maps GOARCH values to the ELF machine, used when
+// the memory source does not describe the kernel's machine
+var elfMachines = map[string]elf.Machine{
+	"386":     elf.EM_386,
+	"amd64":   elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"ppc64":   elf.EM_PPC64,
+	"ppc64le": elf.EM_PPC64,
+	"riscv64": elf.EM_RISCV,
+	"s390x":   elf.EM_S390,
+}
+
+// elfPrologue returns the ELF header, program header table and notes to be written before
+// the blocks of an ELF core file. Since the size of each block is known up front, the
+// offset of each block's data within the file can be computed before any are read.
+func (r *Reader) elfPrologue(blks blocks) []byte {
+	var notes bytes.Buffer
+	if note, ok := r.kernelInfo.VMCoreInfoNote(); ok {
+		writeNote(&notes, note, r.ByteOrder)
+	}
+
+	phnum := len(blks)
+	if notes.Len() > 0 {
+		phnum++
+	}
+
+	ehsize := binary.Size(elf.Header64{})
+	phentsize := binary.Size(elf.Prog64{})
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_CORE),
+		Machine:   uint16(r.elfMachine()),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     uint64(ehsize),
+		Ehsize:    uint16(ehsize),
+		Phentsize: uint16(phentsize),
+		Phnum:     uint16(phnum),
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	if r.ByteOrder == binary.BigEndian {
+		hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	}
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	offset := uint64(ehsize + phnum*phentsize)
+
+	var progs []elf.Prog64
+	if notes.Len() > 0 {
+		progs = append(progs, elf.Prog64{
+			Type:   uint32(elf.PT_NOTE),
+			Off:    offset,
+			Filesz: uint64(notes.Len()),
+		})
+		offset += uint64(notes.Len())
+	}
+
+	// Virtual addresses are in the direct mapping of physical
+	// memory, if its start (PAGE_OFFSET) is known
+	pageOffset, havePageOffset := r.kernelInfo.Number("PAGE_OFFSET")
+
+	for _, blk := range blks {
+		prog := elf.Prog64{
+			Type:   uint32(elf.PT_LOAD),
+			Flags:  uint32(elf.PF_R | elf.PF_W | elf.PF_X),
+			Off:    offset,
+			Paddr:  blk.start,
+			Filesz: blk.size(),
+			Memsz:  blk.size(),
+		}
+		if havePageOffset {
+			prog.Vaddr = pageOffset + blk.start
+		}
+		progs = append(progs, prog)
+		offset += blk.size()
+	}
+
+	var prologue bytes.Buffer
+	_ = binary.Write(&prologue, r.ByteOrder, hdr) // writes to a bytes.Buffer cannot fail
+	_ = binary.Write(&prologue, r.ByteOrder, progs)
+	prologue.Write(notes.Bytes())
+
+	log.Printf("[DEBUG] ELF prologue size: %d (program headers: %d)", prologue.Len(), phnum)
+
+	return prologue.Bytes()
+}
+
+// elfMachine returns the machine of the kernel from the memory
+// source if known, falling back to that of the current host
+func (r *Reader) elfMachine() elf.Machine {
+	if r.kernelInfo != nil && r.kernelInfo.Machine != elf.EM_NONE {
+		return r.kernelInfo.Machine
+	}
+	return elfMachines[runtime.GOARCH]
+}
+
+// writeNote serializes the note, padding the name and description to a 4 byte alignment
+func writeNote(buf *bytes.Buffer, note Note, ord binary.ByteOrder) {
+	name := append([]byte(note.Name), 0)
+	_ = binary.Write(buf, ord, []uint32{uint32(len(name)), uint32(len(note.Desc)), uint32(note.Type)})
+	buf.Write(name)
+	buf.Write(make([]byte, align4(uint64(len(name)))-uint64(len(name))))
+	buf.Write(note.Desc)
+	buf.Write(make([]byte, align4(uint64(len(note.Desc)))-uint64(len(note.Desc))))
+}
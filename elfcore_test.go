@@ -0,0 +1,97 @@
+package memr
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormatELF(t *testing.T) {
+	source := &fakeSource{ReaderAt: patternReaderAt{}}
+
+	raw, err := ioutil.ReadAll(newTestReader(context.Background(), t, source, func(r *Reader) {
+		r.PageHeaderProvider = nil
+	}))
+	if err != nil {
+		t.Fatalf("failed to read source: %v", err)
+	}
+
+	reader := newTestReader(context.Background(), t, source, func(r *Reader) {
+		r.Format = FormatELF
+	})
+	vmcoreinfo := []byte("OSRELEASE=5.15.0\nNUMBER(PAGE_OFFSET)=0xffff000000000000\n")
+	reader.kernelInfo = &KernelInfo{
+		Machine:    elf.EM_AARCH64,
+		Notes:      []Note{{Name: noteNameVmcoreinfo, Desc: vmcoreinfo}},
+		VMCoreInfo: parseVmcoreinfo(vmcoreinfo),
+	}
+	reader.reader, reader.size = reader.initBlockReaders(reader.sourceBlocks(source, mustRanges(t, source)))
+
+	core, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read ELF core: %v", err)
+	}
+	if uint64(len(core)) != reader.Size() {
+		t.Errorf("size does not match: %d != %d", len(core), reader.Size())
+	}
+
+	file, err := elf.NewFile(bytes.NewReader(core))
+	if err != nil {
+		t.Fatalf("failed to parse ELF core: %v", err)
+	}
+	if file.Type != elf.ET_CORE || file.Machine != elf.EM_AARCH64 {
+		t.Errorf("invalid ELF header: type=%s; machine=%s", file.Type, file.Machine)
+	}
+
+	info, err := elfKernelInfo(file)
+	if err != nil {
+		t.Fatalf("failed to read notes: %v", err)
+	}
+	if info.OSRelease() != "5.15.0" {
+		t.Errorf("invalid VMCOREINFO: %v", info.VMCoreInfo)
+	}
+
+	var loads []*elf.Prog
+	for _, prog := range file.Progs {
+		if prog.Type == elf.PT_LOAD {
+			loads = append(loads, prog)
+		}
+	}
+	if len(loads) != len(testRanges) {
+		t.Fatalf("unexpected number of PT_LOAD segments: %d", len(loads))
+	}
+	for i, prog := range loads {
+		if prog.Paddr != testRanges[i].Start || prog.Filesz != testRanges[i].End+1-testRanges[i].Start {
+			t.Errorf("[%d] invalid segment: paddr=%d; size=%d", i, prog.Paddr, prog.Filesz)
+		}
+		if prog.Vaddr != 0xffff000000000000+prog.Paddr {
+			t.Errorf("[%d] invalid segment vaddr: %x", i, prog.Vaddr)
+		}
+	}
+
+	// Reading the core as a vmcore should produce the same raw output
+	path := filepath.Join(t.TempDir(), "vmcore")
+	if err := ioutil.WriteFile(path, core, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fromCore, err := ioutil.ReadAll(newTestReader(context.Background(), t, &vmcoreSource{path: path}, func(r *Reader) {
+		r.PageHeaderProvider = nil
+	}))
+	if err != nil {
+		t.Fatalf("failed to read ELF core as vmcore: %v", err)
+	}
+	if !bytes.Equal(fromCore, raw) {
+		t.Error("raw output from ELF core does not match")
+	}
+}
+
+func mustRanges(t *testing.T, source MemSource) []SourceRange {
+	rngs, err := source.Ranges(nil, testRanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rngs
+}
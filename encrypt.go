@@ -0,0 +1,179 @@
+package memr
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// EncryptionAge is the name of the encryption applied by NewEncryptWriter, which
+// produces files in the age format (https://age-encryption.org/v1)
+const EncryptionAge = "age"
+
+// oidX25519 is the algorithm identifier of X25519 keys (RFC 8410)
+var oidX25519 = asn1.ObjectIdentifier{1, 3, 101, 110}
+
+// NewEncryptWriter returns an io.WriteCloser that encrypts the data written to it for each
+// of the recipients, writing the result to w in the age format. A random data key is
+// generated for each writer and wrapped to each recipient, and the data is sealed in
+// 64 KiB chunks using ChaCha20-Poly1305, so only the holder of an identity for one of
+// the recipients can decrypt (or undetectably modify) the output. This includes the
+// host doing the capture, which only needs the recipients' public keys. Passphrase
+// (scrypt) recipients are rejected for this reason. Close must be called to seal and
+// write the final chunk, and does not close w.
+func NewEncryptWriter(w io.Writer, recipients ...age.Recipient) (io.WriteCloser, error) {
+	for _, recipient := range recipients {
+		if _, ok := recipient.(*age.ScryptRecipient); ok {
+			return nil, errors.New("passphrase recipients are not supported, use a public key")
+		}
+	}
+	return age.Encrypt(w, recipients...)
+}
+
+// NewDecryptReader returns an io.Reader that decrypts the output of a NewEncryptWriter,
+// read from r, using any of the identities. Reads fail if the data has been modified.
+func NewDecryptReader(r io.Reader, identities ...age.Identity) (io.Reader, error) {
+	return age.Decrypt(r, identities...)
+}
+
+// ParseRecipients parses the recipients in data, which is either a PEM encoded X25519
+// public key (eg: as written by: openssl pkey -in key.pem -pubout), or age recipients
+// (eg: age1...), one per line, where empty lines and lines starting with # are ignored.
+func ParseRecipients(data []byte) ([]age.Recipient, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return age.ParseRecipients(bytes.NewReader(data))
+	}
+
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("unexpected PEM type for recipient: %s", block.Type)
+	}
+
+	var key struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(block.Bytes, &key); err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if !key.Algorithm.Algorithm.Equal(oidX25519) {
+		return nil, fmt.Errorf("public key is not an X25519 key: %s", key.Algorithm.Algorithm)
+	}
+
+	recipient, err := age.ParseX25519Recipient(bech32Encode("age", key.PublicKey.Bytes))
+	if err != nil {
+		return nil, err
+	}
+
+	return []age.Recipient{recipient}, nil
+}
+
+// ParseIdentities parses the identities in data, which is either a PEM encoded X25519
+// private key in PKCS #8 form (eg: as written by: openssl genpkey -algorithm x25519), or
+// age identities (eg: AGE-SECRET-KEY-1...), one per line, where empty lines and lines
+// starting with # are ignored.
+func ParseIdentities(data []byte) ([]age.Identity, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return age.ParseIdentities(bytes.NewReader(data))
+	}
+
+	if block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("unexpected PEM type for identity: %s", block.Type)
+	}
+
+	var key struct {
+		Version    int
+		Algorithm  pkix.AlgorithmIdentifier
+		PrivateKey []byte
+		Attributes asn1.RawValue `asn1:"optional,tag:0"`
+		PublicKey  asn1.RawValue `asn1:"optional,tag:1"`
+	}
+	if _, err := asn1.Unmarshal(block.Bytes, &key); err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	if !key.Algorithm.Algorithm.Equal(oidX25519) {
+		return nil, fmt.Errorf("private key is not an X25519 key: %s", key.Algorithm.Algorithm)
+	}
+
+	// The private key is itself an encoded OCTET STRING
+	var scalar []byte
+	if _, err := asn1.Unmarshal(key.PrivateKey, &scalar); err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	identity, err := age.ParseX25519Identity(strings.ToUpper(bech32Encode("age-secret-key-", scalar)))
+	if err != nil {
+		return nil, err
+	}
+
+	return []age.Identity{identity}, nil
+}
+
+// bech32Charset is the alphabet used by Bech32 (BIP 173)
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32Encode encodes the data using Bech32 with the lower case hrp, which
+// is the encoding used by age for X25519 recipients and identities
+func bech32Encode(hrp string, data []byte) string {
+	// Regroup the data from 8 bit bytes to 5 bit values, zero padding the last
+	var values []byte
+	var acc uint32
+	var bits uint
+	for _, b := range data {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			values = append(values, byte(acc>>bits)&31)
+		}
+	}
+	if bits > 0 {
+		values = append(values, byte(acc<<(5-bits))&31)
+	}
+
+	// The checksum covers the expanded hrp and the values
+	var expanded []byte
+	for _, c := range []byte(hrp) {
+		expanded = append(expanded, c>>5)
+	}
+	expanded = append(expanded, 0)
+	for _, c := range []byte(hrp) {
+		expanded = append(expanded, c&31)
+	}
+	mod := bech32Polymod(append(append(expanded, values...), 0, 0, 0, 0, 0, 0)) ^ 1
+
+	var result strings.Builder
+	result.WriteString(hrp)
+	result.WriteByte('1')
+	for _, v := range values {
+		result.WriteByte(bech32Charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		result.WriteByte(bech32Charset[(mod>>(5*(5-uint(i))))&31])
+	}
+
+	return result.String()
+}
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
@@ -0,0 +1,43 @@
+package memr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ReadError is the error returned by Reader.Read when reading of
+// a block of memory fails. The underlying error can be obtained
+// using errors.Unwrap, errors.Is or errors.As.
+type ReadError struct {
+	Source     MemSource // source from which the block was being read
+	Start, End uint64    // physical address range of the block
+	Offset     uint64    // offset within the block at which the failure occurred
+	Err        error     // underlying error
+}
+
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("failed to read %s block (start=%d; end=%d) at offset %d: %s", e.Source, e.Start, e.End, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// wrapError wraps err in a *ReadError for the block,
+// unless it is already a *ReadError
+func (b *block) wrapError(err error) error {
+	var rErr *ReadError
+	if err == nil || err == io.EOF || errors.As(err, &rErr) || err == b.ctx.Err() {
+		return err
+	}
+
+	return &ReadError{
+		Source: b.source,
+		Start:  b.start,
+		End:    b.end,
+		Offset: b.offset,
+		Err:    err,
+	}
+}
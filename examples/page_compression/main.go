@@ -21,7 +21,8 @@ func main() {
 
 	options := func(m *memr.Reader) {
 		// A custom header should be used when page-level compression is performed
-		// This matches what AVML defines as their header for "version 2" using snappy
+		// This resembles what AVML defines as their header for "version 2" using snappy,
+		// but the result is not compatible with AVML (use memr.FormatAVML for that)
 		m.PageHeaderProvider = func(start, end uint64) interface{} {
 			return &memr.DefaultHeader{
 				Magic:     binary.LittleEndian.Uint32([]byte("AVML")), // custom "AVML" magic
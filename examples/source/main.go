@@ -18,14 +18,14 @@ func main() {
 	flag.Parse()
 
 	outputFile := *outputFileFlag
-	source := memr.MemSource(*sourceFlag)
-
-	switch source {
-	case "":
+	if *sourceFlag == "" {
 		log.Fatal("source flag must be specified")
-	case memr.SourceKcore, memr.SourceCrash, memr.SourceMem:
-	default:
-		log.Fatalf("unknown source specified: %s", source)
+	}
+
+	// Use memr.LookupSource(name) to find a registered source by name
+	source := memr.LookupSource(*sourceFlag)
+	if source == nil {
+		log.Fatalf("unknown source specified: %s", *sourceFlag)
 	}
 
 	// Use memr.NewReader(source) to open a reader for this source
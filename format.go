@@ -0,0 +1,73 @@
+package memr
+
+import (
+	"fmt"
+)
+
+// Format determines the overall layout of the output produced by a Reader
+type Format int
+
+const (
+	// FormatDefault writes each block of memory preceded by the header returned by the
+	// Reader's PageHeaderProvider (LiME by default), or without headers if it is nil (raw)
+	FormatDefault Format = iota
+
+	// FormatELF writes an ELF64 core file (vmcore-style), with one PT_LOAD program
+	// header per block of memory and a PT_NOTE containing VMCOREINFO when it is
+	// available. These can be opened directly by tools such as Volatility 3, crash,
+	// and gdb. The PageHeaderProvider is not used with this format.
+	FormatELF
+
+	// FormatPadded writes each block of memory at the offset equal to its start address,
+	// with the gaps between blocks (including before the first) filled with zeros, so the
+	// byte at physical address X is at offset X of the output (LiME's "padded" format).
+	// When copied to a regular *os.File using io.Copy (see Reader.WriteTo), the gaps are
+	// left as sparse holes. The PageHeaderProvider is not used with this format.
+	FormatPadded
+
+	// FormatAVML writes an image in the AVML version 2 format, which can be converted
+	// by avml-convert. Each block is split into ranges of at most avml.MaxBlockSize bytes,
+	// each written with an AVML header, followed by its data compressed with snappy and
+	// the size of the compressed data. Since the output is compressed, its size is not
+	// known in advance. The PageHeaderProvider and ByteOrder are not used with this format.
+	FormatAVML
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatDefault:
+		return "default"
+	case FormatELF:
+		return "elf"
+	case FormatPadded:
+		return "padded"
+	case FormatAVML:
+		return "avml"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// validate ensures the format can be used with the Reader's other options
+func (f Format) validate(r *Reader) error {
+	if r.StartOffset > 0 && (f.Compressed() || r.PageHandler != nil) {
+		return fmt.Errorf("a start offset is not supported by the %s format or with a PageHandler", f)
+	}
+
+	switch f {
+	case FormatDefault:
+		return nil
+	case FormatELF, FormatPadded, FormatAVML:
+		// Offsets to each block must be known up front, so page handling is not supported
+		if r.PageHandler != nil {
+			return fmt.Errorf("the %s format does not support a PageHandler", f)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported format: %s", f)
+}
+
+// Compressed returns true if the format compresses the memory that is read,
+// in which case Reader.Size is the size of the uncompressed memory
+func (f Format) Compressed() bool {
+	return f == FormatAVML
+}
@@ -3,16 +3,19 @@ module github.com/ryandeivert/memr
 go 1.16
 
 require (
+	filippo.io/age v1.0.0
 	github.com/VividCortex/ewma v1.2.0 // indirect
-	github.com/aws/aws-sdk-go-v2 v1.13.0
-	github.com/aws/aws-sdk-go-v2/config v1.13.1
-	github.com/aws/aws-sdk-go-v2/feature/s3/manager v1.9.1
-	github.com/aws/aws-sdk-go-v2/service/s3 v1.24.1
+	github.com/aws/aws-sdk-go-v2 v1.16.2
+	github.com/aws/aws-sdk-go-v2/config v1.15.3
+	github.com/aws/aws-sdk-go-v2/feature/s3/manager v1.11.3
+	github.com/aws/aws-sdk-go-v2/service/s3 v1.26.3
 	github.com/cheggaaa/pb/v3 v3.0.8
 	github.com/golang/snappy v0.0.4
 	github.com/hashicorp/logutils v1.0.0
+	github.com/klauspost/compress v1.15.1
 	github.com/mattn/go-runewidth v0.0.13 // indirect
 	github.com/pierrec/lz4/v4 v4.1.14
 	github.com/spf13/cobra v1.3.0
+	github.com/zeebo/blake3 v0.2.3
 	golang.org/x/sys v0.0.0-20220209214540-3681064d5158 // indirect
 )
@@ -0,0 +1,78 @@
+package memr
+
+import (
+	"crypto/md5" //nolint:gosec
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"github.com/zeebo/blake3"
+)
+
+// Hash is an algorithm used to hash the memory read by a Reader
+type Hash string
+
+const (
+	HashSHA256 Hash = "sha256"
+	HashBLAKE3 Hash = "blake3"
+	HashMD5    Hash = "md5" // for compatibility with older tooling only
+)
+
+var hashFuncs = map[Hash]func() hash.Hash{
+	HashSHA256: sha256.New,
+	HashBLAKE3: func() hash.Hash { return blake3.New() },
+	HashMD5:    md5.New,
+}
+
+// Hasher computes several hashes at once over the data written
+// to it, and counts the number of bytes written
+type Hasher struct {
+	hashes []Hash
+	funcs  []hash.Hash
+	size   uint64
+}
+
+// NewHasher returns a Hasher computing each of the hashes
+func NewHasher(hashes ...Hash) (*Hasher, error) {
+	h := &Hasher{}
+	for _, name := range hashes {
+		newFunc, ok := hashFuncs[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash: %s", name)
+		}
+		h.hashes = append(h.hashes, name)
+		h.funcs = append(h.funcs, newFunc())
+	}
+
+	return h, nil
+}
+
+// Write satisfies the io.Writer interface, and never fails
+func (h *Hasher) Write(p []byte) (int, error) {
+	for _, f := range h.funcs {
+		f.Write(p)
+	}
+	h.size += uint64(len(p))
+	return len(p), nil
+}
+
+// Size returns the number of bytes written to the Hasher
+func (h *Hasher) Size() uint64 {
+	return h.size
+}
+
+// Sums returns the hex encoded sum of each hash, keyed by hash
+func (h *Hasher) Sums() map[Hash]string {
+	sums := make(map[Hash]string, len(h.hashes))
+	for i, name := range h.hashes {
+		sums[name] = hex.EncodeToString(h.funcs[i].Sum(nil))
+	}
+	return sums
+}
+
+// RangeHashes holds the hashes of the memory in a block read by a Reader
+type RangeHashes struct {
+	Start, End uint64          // physical address range of the block (End is exclusive)
+	Sums       map[Hash]string // hex encoded sum of each hash, or nil if the block was only partially read
+}
@@ -2,8 +2,10 @@ package memr
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
-	"log"
+
+	"github.com/ryandeivert/memr/internal/ranges"
 )
 
 /*
@@ -17,21 +19,25 @@ typedef struct {
     unsigned char reserved[8];    // Currently all zeros
 }
 */
-const (
-	limeMagic uint32 = 0x4C694D45
-)
 
 // PageHeaderProviderFunc should be used to provide a page header
 type PageHeaderProviderFunc func(start, end uint64) interface{}
 
-func newHeaderReader(h interface{}, ord binary.ByteOrder) io.Reader {
-	rPipe, wPipe := io.Pipe()
+// newHeaderReader serializes the header for the block using the specified byte order.
+// Any failure to serialize the header is returned as a *ReadError for the block
+func newHeaderReader(blk *block, h interface{}, ord binary.ByteOrder) io.Reader {
+	rPipe, wPipe := newPipe(blk.ctx)
 	go func() {
-		defer wPipe.Close()
 		err := binary.Write(wPipe, ord, h)
 		if err != nil {
-			log.Fatalf("failed to serialize page header: %s", err)
+			err = &ReadError{
+				Source: blk.source,
+				Start:  blk.start,
+				End:    blk.end,
+				Err:    fmt.Errorf("failed to serialize page header: %w", err),
+			}
 		}
+		wPipe.CloseWithError(err)
 	}()
 
 	return rPipe
@@ -41,7 +47,7 @@ func newHeaderReader(h interface{}, ord binary.ByteOrder) io.Reader {
 // returns a DefaultHeader struct
 func HeaderLime(start, end uint64) interface{} {
 	return &DefaultHeader{
-		Magic:     limeMagic,
+		Magic:     ranges.LiMEMagic,
 		Version:   1,
 		StartAddr: start,
 		EndAddr:   end - 1,
@@ -0,0 +1,92 @@
+package memr
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ryandeivert/memr/image"
+	"github.com/ryandeivert/memr/internal/iomem"
+)
+
+// imageSource reads from an existing image file, allowing previous captures
+// to be re-processed (eg: re-headered, compressed or uploaded) by a Reader.
+// The image is decoded using the image package, and is either one whose format
+// can be detected (LiME, AVML or ELF core), a raw image consisting of the contents
+// of memRanges back to back, or a padded raw image. The opened SourceFile is the decoded
+// *image.Image, which is read by physical address.
+type imageSource struct {
+	path      string
+	memRanges MemRanges // ranges of a raw or padded image; nil for other images
+	padded    bool      // the image is a padded raw image
+}
+
+// NewImageSource returns a MemSource that reads from an existing image file, such
+// as one written by a Reader. LiME (of either byte order), AVML and ELF core images
+// are detected, and decoded using the image package.
+func NewImageSource(path string) MemSource {
+	return &imageSource{path: path}
+}
+
+// NewRawImageSource returns a MemSource that reads from an existing raw image
+// file (written without headers), containing the memRanges back to back. The
+// memRanges are typically read from a copy of the captured host's /proc/iomem,
+// using ParseMemRanges.
+func NewRawImageSource(path string, memRanges MemRanges) MemSource {
+	return &imageSource{path: path, memRanges: memRanges}
+}
+
+// NewPaddedImageSource returns a MemSource that reads from an existing padded raw image
+// file, where the byte at each physical address is at the same offset (eg: as written
+// using FormatPadded). If memRanges is nil, the entire image is read as a single range.
+func NewPaddedImageSource(path string, memRanges MemRanges) MemSource {
+	return &imageSource{path: path, memRanges: memRanges, padded: true}
+}
+
+// ParseMemRanges parses the ranges of system RAM from data in the /proc/iomem format
+func ParseMemRanges(r io.Reader) (MemRanges, error) {
+	return iomem.ParseRanges(r)
+}
+
+func (i *imageSource) String() string {
+	return i.path
+}
+
+// Standalone satisfies the StandaloneSource interface, since the image
+// describes the captured host's memory, not that of the current host
+func (i *imageSource) Standalone() bool {
+	return true
+}
+
+func (i *imageSource) Open() (SourceFile, error) {
+	if i.padded {
+		return image.OpenPadded(i.path, imageRanges(i.memRanges))
+	}
+	if i.memRanges != nil {
+		return image.OpenRaw(i.path, imageRanges(i.memRanges))
+	}
+	return image.Open(i.path)
+}
+
+func (i *imageSource) Ranges(file SourceFile, _ MemRanges) ([]SourceRange, error) {
+	img, ok := file.(*image.Image)
+	if !ok {
+		return nil, fmt.Errorf("unexpected file for image %s: %T", i, file)
+	}
+
+	// The image is read by physical address, so offsets equal addresses
+	rngs := make([]SourceRange, 0, len(img.Ranges))
+	for _, rng := range img.Ranges {
+		rngs = append(rngs, SourceRange{Start: rng.Start, End: rng.End, Offset: int64(rng.Start)})
+	}
+
+	return rngs, nil
+}
+
+// imageRanges converts the memRanges (with inclusive end addresses) to image ranges
+func imageRanges(memRanges MemRanges) []image.Range {
+	rngs := make([]image.Range, 0, len(memRanges))
+	for _, rng := range memRanges {
+		rngs = append(rngs, image.Range{Start: rng.Start, End: rng.End + 1})
+	}
+	return rngs
+}
@@ -0,0 +1,138 @@
+package image
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ryandeivert/memr/avml"
+	"github.com/ryandeivert/memr/internal/ranges"
+)
+
+// limeRanges walks the headers of a LiME image, where the data for each range
+// immediately follows its header. If lenient, headers whose end address is exclusive
+// (so the next header is found one byte earlier than expected) are tolerated, and
+// are listed in the returned anomalies.
+func limeRanges(r io.ReaderAt, size int64, ord binary.ByteOrder, lenient bool) ([]Range, []string, error) {
+	raw := make([]byte, avml.HeaderSize) // LiME and AVML headers share the same layout
+
+	var rngs []Range
+	var anomalies []string
+	var offset int64
+	for offset < size {
+		if _, err := r.ReadAt(raw, offset); err != nil {
+			return nil, nil, fmt.Errorf("failed to read header at offset %d: %w", offset, err)
+		}
+
+		magic := ord.Uint32(raw[0:])
+		if magic != ranges.LiMEMagic && lenient && len(rngs) > 0 && offByOne(r, offset, ord) {
+			anomalies = append(anomalies, offByOneAnomaly(&rngs[len(rngs)-1]))
+			offset--
+			continue
+		}
+
+		version := ord.Uint32(raw[4:])
+		start := ord.Uint64(raw[8:])
+		end := ord.Uint64(raw[16:])
+
+		if magic != ranges.LiMEMagic {
+			return nil, nil, fmt.Errorf("invalid header magic at offset %d: %#x", offset, magic)
+		}
+		if version != 1 {
+			return nil, nil, fmt.Errorf("unsupported header version at offset %d: %d", offset, version)
+		}
+		if end < start {
+			return nil, nil, fmt.Errorf("invalid header range at offset %d: start=%d; end=%d", offset, start, end)
+		}
+
+		rng := Range{
+			Start:   start,
+			End:     end + 1, // header end addresses are inclusive
+			Offset:  offset + int64(len(raw)),
+			Version: version,
+		}
+		rngs = append(rngs, rng)
+		offset = rng.Offset + int64(rng.Size())
+	}
+
+	// The final range is one byte short if its end address is exclusive
+	if offset == size+1 && lenient && len(rngs) > 0 {
+		anomalies = append(anomalies, offByOneAnomaly(&rngs[len(rngs)-1]))
+		offset--
+	}
+
+	// Ensure the data for the final range is not truncated
+	if offset > size {
+		return nil, nil, fmt.Errorf("image is truncated, expected %d bytes: %w", offset, io.ErrUnexpectedEOF)
+	}
+
+	return rngs, anomalies, nil
+}
+
+// offByOne returns true if a LiME header is found one byte before the offset
+func offByOne(r io.ReaderAt, offset int64, ord binary.ByteOrder) bool {
+	var magic [4]byte
+	_, err := r.ReadAt(magic[:], offset-1)
+	return err == nil && ord.Uint32(magic[:]) == ranges.LiMEMagic
+}
+
+// offByOneAnomaly shortens the range, whose header's end address is exclusive
+func offByOneAnomaly(rng *Range) string {
+	rng.End--
+	return fmt.Sprintf("header end address is exclusive, rather than inclusive (off by one): %s", rng)
+}
+
+// avmlRanges locates the blocks of an AVML image
+func avmlRanges(r io.ReaderAt, size int64) ([]Range, error) {
+	blocks, err := avml.Index(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	rngs := make([]Range, 0, len(blocks))
+	for _, block := range blocks {
+		rngs = append(rngs, Range{
+			Start:      block.StartAddr,
+			End:        block.EndAddr + 1, // header end addresses are inclusive
+			Offset:     block.Offset,
+			Version:    block.Version,
+			Compressed: block.CompressedSize,
+		})
+	}
+
+	return rngs, nil
+}
+
+// elfRanges reads the ranges from the PT_LOAD segments of an ELF core file, ordered
+// by physical address. Segments that overlap others, such as the one mapping the
+// kernel's text in /proc/vmcore, are clipped to avoid duplicate data.
+func elfRanges(r io.ReaderAt) (binary.ByteOrder, []Range, error) {
+	file, err := elf.NewFile(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if file.Type != elf.ET_CORE {
+		return nil, nil, fmt.Errorf("not a core file: %s", file.Type)
+	}
+
+	var segments []ranges.Range
+	for _, prog := range file.Progs {
+		// Segments without a physical address (eg: vmalloc) use -1
+		if prog.Type != elf.PT_LOAD || prog.Filesz == 0 || prog.Paddr == ^uint64(0) {
+			continue
+		}
+		segments = append(segments, ranges.Range{
+			Start:  prog.Paddr,
+			End:    prog.Paddr + prog.Filesz,
+			Offset: int64(prog.Off),
+		})
+	}
+
+	var rngs []Range
+	for _, segment := range ranges.Clip(segments) {
+		rngs = append(rngs, Range{Start: segment.Start, End: segment.End, Offset: segment.Offset})
+	}
+
+	return file.ByteOrder, rngs, nil
+}
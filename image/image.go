@@ -0,0 +1,484 @@
+// Package image decodes memory images, such as those written by memr, LiME or AVML,
+// providing access to their ranges of physical memory. Supported formats are LiME
+// (including uncompressed AVML images, which use LiME headers), AVML version 2,
+// ELF64 core files (eg: a copy of /proc/vmcore), padded raw images (where file offsets
+// equal physical addresses) and raw images (containing ranges back to back, described
+// by a separate range map).
+package image
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/ryandeivert/memr/avml"
+	"github.com/ryandeivert/memr/internal/ranges"
+)
+
+// ErrUnmapped is returned by ReadAt when an address is not within any range of the image
+var ErrUnmapped = errors.New("address is not within any range of the image")
+
+// Format is the format of an image
+type Format int
+
+const (
+	FormatLiME   Format = iota + 1 // LiME, with a header preceding each range
+	FormatAVML                     // AVML version 2, with a header preceding each compressed range
+	FormatELF                      // ELF64 core file, with a PT_LOAD segment for each range
+	FormatPadded                   // padded raw image, where file offsets equal physical addresses
+	FormatRaw                      // raw image, containing ranges back to back
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatLiME:
+		return "lime"
+	case FormatAVML:
+		return "avml"
+	case FormatELF:
+		return "elf"
+	case FormatPadded:
+		return "padded"
+	case FormatRaw:
+		return "raw"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Range is a range of physical memory within an image
+type Range struct {
+	Start, End uint64 // physical address range (End is exclusive)
+	Offset     int64  // offset within the image of the range's data
+	Version    uint32 // version of the range's header, or 0 if it has none
+	Compressed uint64 // size of the compressed data, for compressed (AVML version 2) ranges
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("start=%d; end=%d; offset=%d", r.Start, r.End, r.Offset)
+}
+
+// Size returns the size of the memory in the range
+func (r Range) Size() uint64 {
+	return r.End - r.Start
+}
+
+// DataSize returns the size of the range's data within the image
+func (r Range) DataSize() uint64 {
+	if r.Compressed > 0 {
+		return r.Compressed
+	}
+	return r.Size()
+}
+
+// Image is a decoded memory image. Its ReadAt method reads by physical address.
+type Image struct {
+	Format    Format
+	ByteOrder binary.ByteOrder // byte order of the headers, or nil if the format has none
+	Ranges    []Range          // ranges of physical memory, ordered by address (unless Inspected)
+	Anomalies []string         // problems found in the image that did not prevent decoding it
+
+	r         io.ReaderAt
+	size      int64
+	closer    io.Closer
+	unordered bool // the ranges are not ordered by address, see Inspect
+
+	mu    sync.Mutex
+	cache struct {
+		rng  int    // index of the cached range
+		data []byte // decompressed data of the cached range
+	}
+}
+
+// Open opens the image file at path, detecting its format. Padded and raw images
+// cannot be detected, so must be opened using OpenPadded or OpenRaw instead. Images
+// split into chunks are reassembled using their index (see OpenFile).
+func Open(path string) (*Image, error) {
+	return openFile(path, New)
+}
+
+// OpenPadded opens the padded raw image file at path. See NewPadded.
+func OpenPadded(path string, rngs []Range) (*Image, error) {
+	return openFile(path, func(r io.ReaderAt, size int64) (*Image, error) {
+		return NewPadded(r, size, rngs)
+	})
+}
+
+// OpenRaw opens the raw image file at path. See NewRaw.
+func OpenRaw(path string, rngs []Range) (*Image, error) {
+	return openFile(path, func(r io.ReaderAt, size int64) (*Image, error) {
+		return NewRaw(r, size, rngs)
+	})
+}
+
+func openFile(path string, decode func(io.ReaderAt, int64) (*Image, error)) (*Image, error) {
+	file, err := OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := decode(file, file.Size())
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open image %s: %w", path, err)
+	}
+	img.closer = file
+
+	return img, nil
+}
+
+// InspectFile opens the image file at path, detecting its format. See Inspect.
+func InspectFile(path string) (*Image, error) {
+	return openFile(path, Inspect)
+}
+
+// New decodes the image of the given size from r, detecting its format
+// (LiME, AVML or ELF) from its magic. All headers are validated.
+func New(r io.ReaderAt, size int64) (*Image, error) {
+	return decode(r, size, false)
+}
+
+// Inspect is like New, but tolerates problems that New would reject, so the image
+// can be inspected. These are ranges that are out of order or overlap, and LiME
+// headers whose end address is exclusive, rather than inclusive (off by one).
+// Any problems found are listed in the Anomalies of the image.
+func Inspect(r io.ReaderAt, size int64) (*Image, error) {
+	return decode(r, size, true)
+}
+
+func decode(r io.ReaderAt, size int64, lenient bool) (*Image, error) {
+	var magic [4]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil {
+		return nil, fmt.Errorf("failed to read magic: %w", err)
+	}
+
+	img := &Image{r: r, size: size}
+	img.cache.rng = -1
+
+	var err error
+	switch {
+	case binary.LittleEndian.Uint32(magic[:]) == ranges.LiMEMagic:
+		img.Format, img.ByteOrder = FormatLiME, binary.LittleEndian
+		img.Ranges, img.Anomalies, err = limeRanges(r, size, binary.LittleEndian, lenient)
+	case binary.BigEndian.Uint32(magic[:]) == ranges.LiMEMagic:
+		img.Format, img.ByteOrder = FormatLiME, binary.BigEndian
+		img.Ranges, img.Anomalies, err = limeRanges(r, size, binary.BigEndian, lenient)
+	case binary.LittleEndian.Uint32(magic[:]) == avml.Magic:
+		img.Format, img.ByteOrder = FormatAVML, binary.LittleEndian
+		img.Ranges, err = avmlRanges(r, size)
+	case bytes.Equal(magic[:], []byte(elf.ELFMAG)):
+		img.Format = FormatELF
+		img.ByteOrder, img.Ranges, err = elfRanges(r)
+	default:
+		return nil, fmt.Errorf("unknown image magic: %#x", binary.LittleEndian.Uint32(magic[:]))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s image: %w", img.Format, err)
+	}
+
+	if img.Format != FormatELF {
+		img.Anomalies = append(img.Anomalies, endAnomalies(img.Ranges)...)
+	}
+
+	if lenient {
+		order := orderAnomalies(img.Ranges)
+		img.unordered = len(order) > 0
+		img.Anomalies = append(img.Anomalies, order...)
+		return img, nil
+	}
+
+	if err := validateOrder(img.Ranges); err != nil {
+		return nil, fmt.Errorf("invalid %s image: %w", img.Format, err)
+	}
+
+	return img, nil
+}
+
+// NewPadded returns the padded raw image of the given size read from r, where the
+// byte at each physical address is at the same offset. If rngs is empty, the entire
+// image is treated as a single range. Otherwise, only rngs (typically from the
+// captured host's /proc/iomem) are treated as memory, and their offsets are ignored.
+func NewPadded(r io.ReaderAt, size int64, rngs []Range) (*Image, error) {
+	if len(rngs) == 0 {
+		rngs = []Range{{Start: 0, End: uint64(size)}}
+	}
+
+	padded := make([]Range, 0, len(rngs))
+	for _, rng := range rngs {
+		if rng.End > uint64(size) {
+			return nil, fmt.Errorf("range exceeds the padded image size %d: %s", size, rng)
+		}
+		padded = append(padded, Range{Start: rng.Start, End: rng.End, Offset: int64(rng.Start)})
+	}
+
+	return newImage(FormatPadded, r, size, padded)
+}
+
+// NewRaw returns the raw image of the given size read from r, which contains the
+// rngs (typically from the captured host's /proc/iomem) back to back. The offsets
+// of rngs are ignored, and the size of the image must match the ranges.
+func NewRaw(r io.ReaderAt, size int64, rngs []Range) (*Image, error) {
+	var offset int64
+	raw := make([]Range, 0, len(rngs))
+	for _, rng := range rngs {
+		raw = append(raw, Range{Start: rng.Start, End: rng.End, Offset: offset})
+		offset += int64(rng.Size())
+	}
+	if offset != size {
+		return nil, fmt.Errorf("raw image size does not match the ranges: %d != %d", size, offset)
+	}
+
+	return newImage(FormatRaw, r, size, raw)
+}
+
+func newImage(format Format, r io.ReaderAt, size int64, rngs []Range) (*Image, error) {
+	if err := validateOrder(rngs); err != nil {
+		return nil, fmt.Errorf("invalid %s image: %w", format, err)
+	}
+
+	img := &Image{Format: format, Ranges: rngs, r: r, size: size}
+	img.cache.rng = -1
+
+	return img, nil
+}
+
+// Close closes the underlying file, if the image was opened using Open
+func (i *Image) Close() error {
+	if i.closer == nil {
+		return nil
+	}
+	return i.closer.Close()
+}
+
+// Size returns the total size of the memory in all ranges of the image
+func (i *Image) Size() uint64 {
+	var total uint64
+	for _, rng := range i.Ranges {
+		total += rng.Size()
+	}
+	return total
+}
+
+// FileSize returns the size of the image itself
+func (i *Image) FileSize() int64 {
+	return i.size
+}
+
+// Gaps returns the portions of the address space between the first and
+// last ranges of the image that are not within any range
+func (i *Image) Gaps() []Range {
+	rngs := i.Ranges
+	if i.unordered {
+		rngs = append([]Range(nil), rngs...)
+		sort.SliceStable(rngs, func(a, b int) bool { return rngs[a].Start < rngs[b].Start })
+	}
+
+	var gaps []Range
+	var end uint64
+	for idx, rng := range rngs {
+		if idx > 0 && rng.Start > end {
+			gaps = append(gaps, Range{Start: end, End: rng.Start})
+		}
+		if rng.End > end {
+			end = rng.End
+		}
+	}
+
+	return gaps
+}
+
+// Find returns the index of the range containing the physical address
+func (i *Image) Find(addr uint64) (int, bool) {
+	if i.unordered {
+		for idx, rng := range i.Ranges {
+			if rng.Start <= addr && addr < rng.End {
+				return idx, true
+			}
+		}
+		return len(i.Ranges), false
+	}
+
+	idx := sort.Search(len(i.Ranges), func(j int) bool { return i.Ranges[j].End > addr })
+	if idx < len(i.Ranges) && i.Ranges[idx].Start <= addr {
+		return idx, true
+	}
+	return idx, false
+}
+
+// Open returns an io.Reader of the (uncompressed) contents of the range
+func (i *Image) Open(rng Range) io.Reader {
+	if rng.Compressed > 0 {
+		block := &avml.Block{
+			Header:         avml.Header{Version: 2, StartAddr: rng.Start, EndAddr: rng.End - 1},
+			Offset:         rng.Offset,
+			CompressedSize: rng.Compressed,
+		}
+		return block.Open(i.r)
+	}
+	return io.NewSectionReader(i.r, rng.Offset, int64(rng.Size()))
+}
+
+// ReadAt reads len(p) bytes of memory starting at the physical address addr, satisfying
+// the io.ReaderAt interface. If any of the addresses are not within a range of the image,
+// the bytes up to the first such address are read and an error wrapping ErrUnmapped is
+// returned. Compressed ranges are decompressed in full, and the most recent one is cached.
+func (i *Image) ReadAt(p []byte, addr int64) (n int, err error) {
+	for n < len(p) {
+		cur := uint64(addr) + uint64(n)
+		idx, ok := i.Find(cur)
+		if !ok {
+			return n, fmt.Errorf("%w: %d", ErrUnmapped, cur)
+		}
+
+		rng := i.Ranges[idx]
+		want := p[n:]
+		if remaining := rng.End - cur; uint64(len(want)) > remaining {
+			want = want[:remaining]
+		}
+
+		var read int
+		if rng.Compressed > 0 {
+			read, err = i.readCompressed(idx, want, cur-rng.Start)
+		} else {
+			read, err = i.r.ReadAt(want, rng.Offset+int64(cur-rng.Start))
+			if err == io.EOF && read == len(want) {
+				err = nil
+			}
+		}
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (i *Image) readCompressed(idx int, p []byte, off uint64) (int, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.cache.rng != idx {
+		data, err := ioutil.ReadAll(i.Open(i.Ranges[idx]))
+		if err != nil {
+			return 0, fmt.Errorf("failed to decompress range (%s): %w", i.Ranges[idx], err)
+		}
+		if uint64(len(data)) != i.Ranges[idx].Size() {
+			return 0, fmt.Errorf("failed to decompress range (%s): %w", i.Ranges[idx], io.ErrUnexpectedEOF)
+		}
+		i.cache.rng, i.cache.data = idx, data
+	}
+
+	return copy(p, i.cache.data[off:]), nil
+}
+
+// validateOrder ensures the ranges are in ascending order and do not overlap
+func validateOrder(rngs []Range) error {
+	if len(rngs) == 0 {
+		return errors.New("no ranges found")
+	}
+
+	for idx, rng := range rngs {
+		if rng.End <= rng.Start {
+			return fmt.Errorf("empty or inverted range: %s", rng)
+		}
+		if idx > 0 && rng.Start < rngs[idx-1].End {
+			return fmt.Errorf("ranges are out of order or overlap: %s follows %s", rng, rngs[idx-1])
+		}
+	}
+
+	return nil
+}
+
+// orderAnomalies lists any ranges that are empty, out of order or overlap
+func orderAnomalies(rngs []Range) []string {
+	var anomalies []string
+	for idx, rng := range rngs {
+		if rng.End <= rng.Start {
+			anomalies = append(anomalies, fmt.Sprintf("empty or inverted range: %s", rng))
+		}
+		if idx == 0 {
+			continue
+		}
+		prev := rngs[idx-1]
+		if rng.Start < prev.Start {
+			anomalies = append(anomalies, fmt.Sprintf("range is out of order: %s follows %s", rng, prev))
+		} else if rng.Start < prev.End {
+			anomalies = append(anomalies, fmt.Sprintf("range overlaps the previous range: %s overlaps %s", rng, prev))
+		}
+	}
+
+	return anomalies
+}
+
+// pageSize is the smallest page size, used to detect suspicious header end addresses
+const pageSize = 0x1000
+
+// endAnomalies lists any ranges that start on a page boundary, but end one byte after
+// a page boundary, suggesting the header's end address is exclusive (off by one)
+func endAnomalies(rngs []Range) []string {
+	var anomalies []string
+	for _, rng := range rngs {
+		if rng.Start%pageSize == 0 && rng.End%pageSize == 1 {
+			anomalies = append(anomalies, fmt.Sprintf("end address appears to be exclusive, rather than inclusive (off by one): %s", rng))
+		}
+	}
+
+	return anomalies
+}
+
+// extractChunkSize is the size of the reads used by Extract
+const extractChunkSize = 1 << 20
+
+// Extract writes length bytes of memory starting at the physical address addr to w.
+// If zeroFill is true, any addresses that are not within a range of the image are
+// written as zeros. Otherwise, an error wrapping ErrUnmapped is returned for the
+// first such address. The number of bytes written is returned.
+func (i *Image) Extract(w io.Writer, addr, length uint64, zeroFill bool) (int64, error) {
+	if addr+length < addr {
+		return 0, fmt.Errorf("range overflows the address space: addr=%d; length=%d", addr, length)
+	}
+
+	buf := make([]byte, extractChunkSize)
+	var written int64
+	for cur, end := addr, addr+length; cur < end; {
+		want := buf
+		if remaining := end - cur; uint64(len(want)) > remaining {
+			want = want[:remaining]
+		}
+
+		n, err := i.ReadAt(want, int64(cur))
+		if errors.Is(err, ErrUnmapped) && zeroFill {
+			// Zero-fill up to the start of the next range, if any
+			gap := end - (cur + uint64(n))
+			if idx, _ := i.Find(cur + uint64(n)); idx < len(i.Ranges) && i.Ranges[idx].Start-(cur+uint64(n)) < gap {
+				gap = i.Ranges[idx].Start - (cur + uint64(n))
+			}
+			if uint64(len(want)-n) > gap {
+				want = want[:uint64(n)+gap]
+			}
+			for j := n; j < len(want); j++ {
+				want[j] = 0
+			}
+			n, err = len(want), nil
+		}
+
+		wn, wErr := w.Write(want[:n])
+		written += int64(wn)
+		if err != nil {
+			return written, err
+		}
+		if wErr != nil {
+			return written, wErr
+		}
+
+		cur += uint64(n)
+	}
+
+	return written, nil
+}
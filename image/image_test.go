@@ -0,0 +1,409 @@
+package image_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/ryandeivert/memr"
+	"github.com/ryandeivert/memr/image"
+)
+
+var testRanges = memr.MemRanges{
+	{Start: 0x1000, End: 0x4fff},
+	{Start: 0x10000, End: 0x13fff},
+}
+
+// pattern returns the expected byte at the physical address
+func pattern(addr uint64) byte {
+	return byte(addr % 251)
+}
+
+// writeImages writes a raw image of testRanges, and converts it to other formats using memr
+func writeImages(t *testing.T) map[string]string {
+	var raw []byte
+	for _, rng := range testRanges {
+		for addr := rng.Start; addr <= rng.End; addr++ {
+			raw = append(raw, pattern(addr))
+		}
+	}
+
+	dir := t.TempDir()
+	paths := map[string]string{"raw": filepath.Join(dir, "raw")}
+	if err := ioutil.WriteFile(paths["raw"], raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	options := map[string]func(*memr.Reader){
+		"lime-le": func(r *memr.Reader) {},
+		"lime-be": func(r *memr.Reader) { r.ByteOrder = binary.BigEndian },
+		"avml":    func(r *memr.Reader) { r.Format = memr.FormatAVML },
+		"elf":     func(r *memr.Reader) { r.Format = memr.FormatELF },
+		"padded":  func(r *memr.Reader) { r.Format = memr.FormatPadded },
+	}
+	for name, option := range options {
+		reader, err := memr.NewReader(memr.NewRawImageSource(paths["raw"], testRanges), option, func(r *memr.Reader) {
+			r.WithProgress = false
+		})
+		if err != nil {
+			t.Fatalf("[%s] failed to create reader: %v", name, err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("[%s] failed to read image: %v", name, err)
+		}
+
+		paths[name] = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(paths[name], data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return paths
+}
+
+func TestOpen(t *testing.T) {
+	paths := writeImages(t)
+
+	rngs := []image.Range{
+		{Start: testRanges[0].Start, End: testRanges[0].End + 1},
+		{Start: testRanges[1].Start, End: testRanges[1].End + 1},
+	}
+
+	cases := []struct {
+		name   string
+		open   func() (*image.Image, error)
+		format image.Format
+		order  binary.ByteOrder
+	}{
+		{"lime-le", func() (*image.Image, error) { return image.Open(paths["lime-le"]) }, image.FormatLiME, binary.LittleEndian},
+		{"lime-be", func() (*image.Image, error) { return image.Open(paths["lime-be"]) }, image.FormatLiME, binary.BigEndian},
+		{"avml", func() (*image.Image, error) { return image.Open(paths["avml"]) }, image.FormatAVML, binary.LittleEndian},
+		{"elf", func() (*image.Image, error) { return image.Open(paths["elf"]) }, image.FormatELF, binary.LittleEndian},
+		{"padded", func() (*image.Image, error) { return image.OpenPadded(paths["padded"], rngs) }, image.FormatPadded, nil},
+		{"raw", func() (*image.Image, error) { return image.OpenRaw(paths["raw"], rngs) }, image.FormatRaw, nil},
+	}
+
+	for _, tc := range cases {
+		img, err := tc.open()
+		if err != nil {
+			t.Fatalf("[%s] failed to open image: %v", tc.name, err)
+		}
+		defer img.Close()
+
+		if img.Format != tc.format || img.ByteOrder != tc.order {
+			t.Errorf("[%s] unexpected format: %s (%v)", tc.name, img.Format, img.ByteOrder)
+		}
+		if len(img.Ranges) != len(rngs) {
+			t.Fatalf("[%s] unexpected ranges: %v", tc.name, img.Ranges)
+		}
+		for i, rng := range img.Ranges {
+			if rng.Start != rngs[i].Start || rng.End != rngs[i].End {
+				t.Errorf("[%s] unexpected range: %s", tc.name, rng)
+			}
+
+			data, err := ioutil.ReadAll(img.Open(rng))
+			if err != nil {
+				t.Fatalf("[%s] failed to read range: %v", tc.name, err)
+			}
+			if uint64(len(data)) != rng.Size() || data[0] != pattern(rng.Start) || data[len(data)-1] != pattern(rng.End-1) {
+				t.Errorf("[%s] unexpected data for range: %s", tc.name, rng)
+			}
+		}
+
+		// Read across the end of the first range into the gap
+		p := make([]byte, 0x10)
+		n, err := img.ReadAt(p, 0x4ff8)
+		if n != 8 || !errors.Is(err, image.ErrUnmapped) {
+			t.Errorf("[%s] expected unmapped address after %d byte(s): %v", tc.name, n, err)
+		}
+		if p[0] != pattern(0x4ff8) || p[7] != pattern(0x4fff) {
+			t.Errorf("[%s] unexpected data read by address", tc.name)
+		}
+
+		n, err = img.ReadAt(p, 0x12000)
+		if err != nil || n != len(p) || p[0] != pattern(0x12000) {
+			t.Errorf("[%s] failed to read by address: %v", tc.name, err)
+		}
+	}
+}
+
+func TestInvalidImages(t *testing.T) {
+	paths := writeImages(t)
+
+	lime, err := ioutil.ReadFile(paths["lime-le"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap the order of the two ranges
+	first := 32 + int(testRanges[0].End-testRanges[0].Start+1)
+	swapped := append(append([]byte(nil), lime[first:]...), lime[:first]...)
+
+	badVersion := append([]byte(nil), lime...)
+	badVersion[4] = 3
+
+	cases := map[string][]byte{
+		"truncated": lime[:len(lime)-1],
+		"order":     swapped,
+		"version":   badVersion,
+		"magic":     bytes.Repeat([]byte{0xff}, 64),
+	}
+	for name, data := range cases {
+		if _, err := image.New(bytes.NewReader(data), int64(len(data))); err == nil {
+			t.Errorf("[%s] expected invalid image", name)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	// LiME headers with exclusive end addresses, with the second range out of order
+	header := func(start, end uint64) []byte {
+		raw := make([]byte, 32)
+		binary.LittleEndian.PutUint32(raw[0:], 0x4C694D45)
+		binary.LittleEndian.PutUint32(raw[4:], 1)
+		binary.LittleEndian.PutUint64(raw[8:], start)
+		binary.LittleEndian.PutUint64(raw[16:], end)
+		return raw
+	}
+	var data []byte
+	data = append(data, header(0x2000, 0x3000)...)
+	data = append(data, make([]byte, 0x1000)...)
+	data = append(data, header(0x1000, 0x2000)...)
+	data = append(data, make([]byte, 0x1000)...)
+
+	if _, err := image.New(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Error("expected invalid image")
+	}
+
+	img, err := image.Inspect(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("failed to inspect image: %v", err)
+	}
+	if len(img.Ranges) != 2 || img.Ranges[0].End != 0x3000 || img.Ranges[1].Start != 0x1000 {
+		t.Errorf("unexpected ranges: %v", img.Ranges)
+	}
+	// Two off by one headers and one out of order range
+	if len(img.Anomalies) != 3 {
+		t.Errorf("unexpected anomalies: %q", img.Anomalies)
+	}
+	if _, ok := img.Find(0x1800); !ok {
+		t.Error("expected address to be found in unordered ranges")
+	}
+}
+
+func TestExtract(t *testing.T) {
+	paths := writeImages(t)
+
+	img, err := image.Open(paths["avml"])
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer img.Close()
+
+	// Extract across the gap between the ranges
+	var buf bytes.Buffer
+	n, err := img.Extract(&buf, 0x4000, 0xd000, true)
+	if err != nil || n != 0xd000 {
+		t.Fatalf("failed to extract range: %d; %v", n, err)
+	}
+	data := buf.Bytes()
+	for _, addr := range []uint64{0x4000, 0x4fff, 0x10000, 0x10fff} {
+		if data[addr-0x4000] != pattern(addr) {
+			t.Errorf("unexpected data at address %#x", addr)
+		}
+	}
+	if !bytes.Equal(data[0x1000:0xc000], make([]byte, 0xb000)) {
+		t.Error("expected gap to be zero-filled")
+	}
+
+	// Strict extraction stops at the gap
+	buf.Reset()
+	n, err = img.Extract(&buf, 0x4000, 0xd000, false)
+	if !errors.Is(err, image.ErrUnmapped) || n != 0x1000 {
+		t.Errorf("expected unmapped address after %d byte(s): %v", n, err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	paths := writeImages(t)
+
+	rngs := []image.Range{
+		{Start: testRanges[0].Start, End: testRanges[0].End + 1},
+		{Start: testRanges[1].Start, End: testRanges[1].End + 1},
+	}
+	open := map[string]func(io.Reader) (*image.Stream, error){
+		"lime-le":   image.NewStream,
+		"lime-be":   image.NewStream,
+		"padded":    func(r io.Reader) (*image.Stream, error) { return image.NewPaddedStream(r, rngs) },
+		"padded-no": func(r io.Reader) (*image.Stream, error) { return image.NewPaddedStream(r, nil) },
+		"raw":       func(r io.Reader) (*image.Stream, error) { return image.NewRawStream(r, rngs) },
+	}
+	paths["padded-no"] = paths["padded"]
+
+	// Extract across the gap between the ranges, and beyond the end of the image
+	extracts := []struct{ addr, length uint64 }{
+		{0x4000, 0xd000},
+		{0x1000, 0x10},
+		{0x12000, 0x4000},
+	}
+
+	// Streams only support reading each image once
+	stream := func(name string) *image.Stream {
+		data, err := ioutil.ReadFile(paths[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := open[name](iotest.HalfReader(bytes.NewReader(data)))
+		if err != nil {
+			t.Fatalf("[%s] failed to open stream: %v", name, err)
+		}
+		return s
+	}
+
+	for name := range open {
+		for _, extract := range extracts {
+			var buf bytes.Buffer
+			n, err := stream(name).Extract(&buf, extract.addr, extract.length, true)
+			if err != nil || uint64(n) != extract.length {
+				t.Fatalf("[%s] failed to extract %#x: %d; %v", name, extract.addr, n, err)
+			}
+
+			data := buf.Bytes()
+			for i := range data {
+				addr := extract.addr + uint64(i)
+				want := byte(0)
+				if (addr >= rngs[0].Start && addr < rngs[0].End) || (addr >= rngs[1].Start && addr < rngs[1].End) {
+					want = pattern(addr)
+				}
+				if data[i] != want {
+					t.Errorf("[%s] unexpected data at address %#x", name, addr)
+					break
+				}
+			}
+		}
+
+		// Strict extraction stops at the gap, unless padded without ranges (so without gaps)
+		if name == "padded-no" {
+			continue
+		}
+		n, err := stream(name).Extract(ioutil.Discard, 0x4000, 0xd000, false)
+		if !errors.Is(err, image.ErrUnmapped) || n != 0x1000 {
+			t.Errorf("[%s] expected unmapped address after %d byte(s): %v", name, n, err)
+		}
+	}
+
+	// AVML and ELF images must be read at random
+	for _, name := range []string{"avml", "elf"} {
+		file, err := os.Open(paths[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = image.NewStream(file)
+		file.Close()
+		if !errors.Is(err, image.ErrRandomAccess) {
+			t.Errorf("[%s] expected the image to require random access: %v", name, err)
+		}
+	}
+
+	// Ranges out of order, and truncated data, are detected as they are read
+	lime, err := ioutil.ReadFile(paths["lime-le"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := 32 + int(testRanges[0].End-testRanges[0].Start+1)
+	swapped := append(append([]byte(nil), lime[first:]...), lime[:first]...)
+
+	cases := map[string]struct {
+		data []byte
+		err  string
+	}{
+		"order":     {swapped, "out of order"},
+		"truncated": {lime[:len(lime)-1], "truncated"},
+	}
+	for name, tc := range cases {
+		s, err := image.NewStream(bytes.NewReader(tc.data))
+		if err != nil {
+			t.Fatalf("[%s] failed to open stream: %v", name, err)
+		}
+		if _, err := s.Extract(ioutil.Discard, 0, 0x20000, true); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("[%s] expected error %q: %v", name, tc.err, err)
+		}
+	}
+}
+
+func TestOpenSplit(t *testing.T) {
+	paths := writeImages(t)
+	expected, err := ioutil.ReadFile(paths["elf"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Split the image into chunks, named relative to the index
+	dir := t.TempDir()
+	name := filepath.Join(dir, "split.elf")
+	index := &image.SplitIndex{Name: "split.elf", Size: int64(len(expected)), ChunkSize: 0x1234}
+	for start := int64(0); start < index.Size; start += index.ChunkSize {
+		end := start + index.ChunkSize
+		if end > index.Size {
+			end = index.Size
+		}
+		chunk := image.SplitChunk{Name: image.ChunkName("split.elf", len(index.Chunks)), Start: start, End: end}
+		if err := ioutil.WriteFile(filepath.Join(dir, chunk.Name), expected[start:end], 0600); err != nil {
+			t.Fatal(err)
+		}
+		index.Chunks = append(index.Chunks, chunk)
+	}
+	var buf bytes.Buffer
+	if err := index.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name+image.IndexSuffix, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Either the name of the output or its index can be opened
+	for _, path := range []string{name, name + image.IndexSuffix} {
+		file, err := image.OpenFile(path)
+		if err != nil {
+			t.Fatalf("[%s] failed to open split file: %v", path, err)
+		}
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("[%s] failed to read split file: %v", path, err)
+		}
+		if !bytes.Equal(data, expected) || file.Index == nil || len(file.Index.Chunks) != len(index.Chunks) {
+			t.Errorf("[%s] split file does not match the image", path)
+		}
+
+		img, err := image.Open(path)
+		if err != nil {
+			t.Fatalf("[%s] failed to open split image: %v", path, err)
+		}
+		p := make([]byte, 0x10)
+		if _, err := img.ReadAt(p, 0x10000); err != nil || p[0] != pattern(0x10000) {
+			t.Errorf("[%s] unexpected data read from split image: %v", path, err)
+		}
+		img.Close()
+	}
+
+	// Truncated chunks, and chunks outside the index's directory, are rejected
+	if err := ioutil.WriteFile(filepath.Join(dir, index.Chunks[1].Name), expected[:10], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := image.Open(name); err == nil {
+		t.Error("expected truncated chunk to be rejected")
+	}
+	if _, err := image.ReadSplitIndex(bytes.NewBufferString(`{"size":1,"chunks":[{"name":"../x","start":0,"end":1}]}`)); err == nil {
+		t.Error("expected chunk outside the directory to be rejected")
+	}
+}
@@ -0,0 +1,203 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// IndexSuffix is appended to the name of a split output to name its index (eg: capture.lime.index)
+const IndexSuffix = ".index"
+
+// SplitIndex describes an output that was split into chunks of at most ChunkSize
+// bytes (eg: capture.lime.000, capture.lime.001 and so on), such as those written by
+// memr using --split-size. The chunks hold the output back to back.
+type SplitIndex struct {
+	Name      string       `json:"name"`       // name of the output as a whole
+	Size      int64        `json:"size"`       // size of the output as a whole
+	ChunkSize int64        `json:"chunk_size"` // maximum size of each chunk
+	Chunks    []SplitChunk `json:"chunks"`
+}
+
+// SplitChunk is a chunk of a split output
+type SplitChunk struct {
+	Name   string       `json:"name"`             // file name of the chunk, relative to the index
+	Start  int64        `json:"start"`            // offset within the output of the chunk's first byte
+	End    int64        `json:"end"`              // offset within the output of the chunk's end (exclusive)
+	Ranges []SplitRange `json:"ranges,omitempty"` // memory held by the chunk, if known (eg: not compressed)
+}
+
+// Size returns the size of the chunk
+func (c SplitChunk) Size() int64 {
+	return c.End - c.Start
+}
+
+// SplitRange is a range of physical memory (or part of one) held by a chunk
+type SplitRange struct {
+	Start  uint64 `json:"start"`
+	End    uint64 `json:"end"`    // exclusive
+	Offset int64  `json:"offset"` // offset within the chunk of the byte at Start
+}
+
+// ChunkName returns the name of the nth chunk of the output name (eg: capture.lime.000)
+func ChunkName(name string, n int) string {
+	return fmt.Sprintf("%s.%03d", name, n)
+}
+
+// ReadSplitIndex reads the index of a split output from r, validating that
+// its chunks are named within the index's directory and hold the entire output
+func ReadSplitIndex(r io.Reader) (*SplitIndex, error) {
+	var index SplitIndex
+	if err := json.NewDecoder(r).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to decode split index: %w", err)
+	}
+
+	var offset int64
+	for _, chunk := range index.Chunks {
+		if chunk.Name == "" || chunk.Name != filepath.Base(chunk.Name) || chunk.Name == ".." {
+			return nil, fmt.Errorf("invalid chunk name in split index: %q", chunk.Name)
+		}
+		if chunk.Start != offset || chunk.End < chunk.Start {
+			return nil, fmt.Errorf("chunk %s does not follow the previous chunk: start=%d; end=%d; expected start=%d", chunk.Name, chunk.Start, chunk.End, offset)
+		}
+		offset = chunk.End
+	}
+	if offset != index.Size {
+		return nil, fmt.Errorf("chunks do not match the size of the split output: %d != %d", offset, index.Size)
+	}
+
+	return &index, nil
+}
+
+// Write writes the index as JSON to w
+func (s *SplitIndex) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// File is an input file opened using OpenFile. This is either a single file, or
+// the chunks of a split output, reassembled so they are read as a single file.
+type File struct {
+	*io.SectionReader
+	Index *SplitIndex // index of a split output, or nil for a single file
+
+	name  string
+	files []*os.File
+}
+
+// OpenFile opens the file at path for reading. If path is the index of a split
+// output (ending with IndexSuffix), or does not exist but such an index does, the
+// chunks listed by the index are opened and reassembled.
+func OpenFile(path string) (*File, error) {
+	if strings.HasSuffix(path, IndexSuffix) {
+		return openSplit(path)
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(path + IndexSuffix); statErr == nil {
+			return openSplit(path + IndexSuffix)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &File{SectionReader: io.NewSectionReader(file, 0, info.Size()), name: path, files: []*os.File{file}}, nil
+}
+
+func openSplit(path string) (*File, error) {
+	data, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	index, err := ReadSplitIndex(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	f := &File{Index: index, name: path}
+	for _, chunk := range index.Chunks {
+		file, err := os.Open(filepath.Join(filepath.Dir(path), chunk.Name))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to open chunk of split output: %w", err)
+		}
+		f.files = append(f.files, file)
+
+		info, err := file.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if info.Size() != chunk.Size() {
+			f.Close()
+			return nil, fmt.Errorf("chunk %s does not match the split index: size=%d; expected=%d", file.Name(), info.Size(), chunk.Size())
+		}
+	}
+	f.SectionReader = io.NewSectionReader(&chunkReader{index: index, files: f.files}, 0, index.Size)
+
+	return f, nil
+}
+
+// Name returns the path used to open the file
+func (f *File) Name() string {
+	return f.name
+}
+
+// Close closes the file, or each chunk of a split output
+func (f *File) Close() error {
+	var err error
+	for _, file := range f.files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// chunkReader reads the chunks of a split output as a single io.ReaderAt
+type chunkReader struct {
+	index *SplitIndex
+	files []*os.File
+}
+
+func (c *chunkReader) ReadAt(p []byte, off int64) (int, error) {
+	chunks := c.index.Chunks
+	i := sort.Search(len(chunks), func(i int) bool { return chunks[i].End > off })
+
+	var read int
+	for ; read < len(p) && i < len(chunks); i++ {
+		chunk := chunks[i]
+		want := len(p) - read
+		if remaining := chunk.End - off; int64(want) > remaining {
+			want = int(remaining)
+		}
+		n, err := c.files[i].ReadAt(p[read:read+want], off-chunk.Start)
+		read += n
+		off += int64(n)
+		if n < want {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF // already validated as complete, so it was truncated since
+			}
+			return read, err
+		}
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
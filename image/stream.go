@@ -0,0 +1,267 @@
+package image
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/ryandeivert/memr/avml"
+	"github.com/ryandeivert/memr/internal/ranges"
+)
+
+// ErrRandomAccess is returned by NewStream for images that cannot be read sequentially
+var ErrRandomAccess = errors.New("image must be read at random, rather than sequentially")
+
+// Stream is an image that is read sequentially, such as the output of a decompressor,
+// without seeking. Only formats whose ranges can be located as they are read are
+// supported: LiME, padded and raw images. The ranges must be in ascending order.
+type Stream struct {
+	Format    Format
+	ByteOrder binary.ByteOrder // byte order of the headers, or nil if the format has none
+
+	r      io.Reader
+	offset int64   // offset within the image of the next byte read from r
+	next   int64   // offset of the next LiME header
+	rngs   []Range // remaining ranges of padded and raw images
+	prev   *Range  // previous range, to ensure the ranges are in order
+	open   bool    // the image is padded without ranges, so ends with r
+}
+
+// NewStream returns the image read sequentially from r, detecting its format from its
+// magic. An error wrapping ErrRandomAccess is returned for AVML and ELF images.
+func NewStream(r io.Reader) (*Stream, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, fmt.Errorf("failed to read magic: %w", err)
+	}
+
+	s := &Stream{Format: FormatLiME, r: io.MultiReader(bytes.NewReader(magic[:]), r)}
+	switch {
+	case binary.LittleEndian.Uint32(magic[:]) == ranges.LiMEMagic:
+		s.ByteOrder = binary.LittleEndian
+	case binary.BigEndian.Uint32(magic[:]) == ranges.LiMEMagic:
+		s.ByteOrder = binary.BigEndian
+	case binary.LittleEndian.Uint32(magic[:]) == avml.Magic:
+		return nil, fmt.Errorf("%w: %s", ErrRandomAccess, FormatAVML)
+	case bytes.Equal(magic[:], []byte(elf.ELFMAG)):
+		return nil, fmt.Errorf("%w: %s", ErrRandomAccess, FormatELF)
+	default:
+		return nil, fmt.Errorf("unknown image magic: %#x", binary.LittleEndian.Uint32(magic[:]))
+	}
+
+	return s, nil
+}
+
+// NewPaddedStream returns the padded raw image read sequentially from r. See NewPadded.
+func NewPaddedStream(r io.Reader, rngs []Range) (*Stream, error) {
+	s := &Stream{Format: FormatPadded, r: r}
+	if len(rngs) == 0 {
+		s.rngs, s.open = []Range{{Start: 0, End: math.MaxUint64}}, true
+		return s, nil
+	}
+
+	for _, rng := range rngs {
+		s.rngs = append(s.rngs, Range{Start: rng.Start, End: rng.End, Offset: int64(rng.Start)})
+	}
+	if err := validateOrder(s.rngs); err != nil {
+		return nil, fmt.Errorf("invalid %s image: %w", s.Format, err)
+	}
+
+	return s, nil
+}
+
+// NewRawStream returns the raw image read sequentially from r. See NewRaw.
+func NewRawStream(r io.Reader, rngs []Range) (*Stream, error) {
+	s := &Stream{Format: FormatRaw, r: r}
+
+	var offset int64
+	for _, rng := range rngs {
+		s.rngs = append(s.rngs, Range{Start: rng.Start, End: rng.End, Offset: offset})
+		offset += int64(rng.Size())
+	}
+	if err := validateOrder(s.rngs); err != nil {
+		return nil, fmt.Errorf("invalid %s image: %w", s.Format, err)
+	}
+
+	return s, nil
+}
+
+// Extract writes length bytes of memory starting at the physical address addr to w,
+// reading the image up to the end of the range. See Image.Extract. The stream cannot
+// be read again, so Extract may only be called once.
+func (s *Stream) Extract(w io.Writer, addr, length uint64, zeroFill bool) (int64, error) {
+	if addr+length < addr {
+		return 0, fmt.Errorf("range overflows the address space: addr=%d; length=%d", addr, length)
+	}
+
+	var written int64
+	cur, end := addr, addr+length
+	fill := func(to uint64) error {
+		if !zeroFill {
+			return fmt.Errorf("%w: %d", ErrUnmapped, cur)
+		}
+		n, err := writeZeros(w, to-cur)
+		written += n
+		cur += uint64(n)
+		return err
+	}
+
+	for cur < end {
+		rng, err := s.nextRange()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+		if rng.End <= cur {
+			continue
+		}
+
+		if rng.Start > cur {
+			if err := fill(min(rng.Start, end)); err != nil {
+				return written, err
+			}
+			if cur == end {
+				break
+			}
+		}
+
+		if err := s.skip(rng.Offset + int64(cur-rng.Start)); err != nil {
+			return written, err
+		}
+		n, err := io.CopyN(w, s.r, int64(min(rng.End, end)-cur))
+		written += n
+		cur += uint64(n)
+		s.offset += n
+		if err == io.EOF && s.open {
+			break // the end of a padded image without ranges
+		}
+		if err == io.EOF {
+			return written, fmt.Errorf("image is truncated at offset %d: %w", s.offset, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if cur < end {
+		if err := fill(end); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// nextRange returns the next range of the image, or io.EOF after the final range
+func (s *Stream) nextRange() (Range, error) {
+	var rng Range
+	if s.Format == FormatLiME {
+		var err error
+		if rng, err = s.nextHeader(); err != nil {
+			return Range{}, err
+		}
+	} else {
+		if len(s.rngs) == 0 {
+			return Range{}, io.EOF
+		}
+		rng, s.rngs = s.rngs[0], s.rngs[1:]
+	}
+
+	if s.prev != nil && rng.Start < s.prev.End {
+		return Range{}, fmt.Errorf("ranges are out of order or overlap: %s follows %s", rng, s.prev)
+	}
+	s.prev = &rng
+
+	return rng, nil
+}
+
+// nextHeader reads the LiME header following the data of the previous range
+func (s *Stream) nextHeader() (Range, error) {
+	if err := s.skip(s.next); err != nil {
+		return Range{}, err
+	}
+
+	raw := make([]byte, avml.HeaderSize)
+	n, err := io.ReadFull(s.r, raw)
+	s.offset += int64(n)
+	if err == io.EOF {
+		return Range{}, io.EOF
+	}
+	if err != nil {
+		return Range{}, fmt.Errorf("failed to read header at offset %d: %w", s.next, err)
+	}
+
+	magic := s.ByteOrder.Uint32(raw[0:])
+	version := s.ByteOrder.Uint32(raw[4:])
+	start := s.ByteOrder.Uint64(raw[8:])
+	end := s.ByteOrder.Uint64(raw[16:])
+
+	if magic != ranges.LiMEMagic {
+		return Range{}, fmt.Errorf("invalid header magic at offset %d: %#x", s.next, magic)
+	}
+	if version != 1 {
+		return Range{}, fmt.Errorf("unsupported header version at offset %d: %d", s.next, version)
+	}
+	if end < start || end == math.MaxUint64 {
+		return Range{}, fmt.Errorf("invalid header range at offset %d: start=%d; end=%d", s.next, start, end)
+	}
+
+	rng := Range{
+		Start:   start,
+		End:     end + 1, // header end addresses are inclusive
+		Offset:  s.offset,
+		Version: version,
+	}
+	s.next = rng.Offset + int64(rng.Size())
+
+	return rng, nil
+}
+
+// skip discards the data read from r up to the offset within the image
+func (s *Stream) skip(offset int64) error {
+	if offset <= s.offset {
+		return nil
+	}
+
+	n, err := io.CopyN(ioutil.Discard, s.r, offset-s.offset)
+	s.offset += n
+	if err == io.EOF {
+		return fmt.Errorf("image is truncated, expected %d bytes: %w", offset, io.ErrUnexpectedEOF)
+	}
+
+	return err
+}
+
+// writeZeros writes n zeros to w
+func writeZeros(w io.Writer, n uint64) (int64, error) {
+	zeros := make([]byte, extractChunkSize)
+
+	var written int64
+	for uint64(written) < n {
+		chunk := zeros
+		if remaining := n - uint64(written); uint64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		wn, err := w.Write(chunk)
+		written += int64(wn)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+func min(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,80 @@
+package memr
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// patternReaderAt returns a repeating pattern derived from the offset
+type patternReaderAt struct{}
+
+func (patternReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = byte((off + int64(i)) % 251)
+	}
+	return len(p), nil
+}
+
+func TestImageSource(t *testing.T) {
+	for _, ord := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		source := &fakeSource{ReaderAt: patternReaderAt{}}
+
+		// Write a LiME image to be used as the source
+		lime, err := ioutil.ReadAll(newTestReader(context.Background(), t, source, func(r *Reader) {
+			r.ByteOrder = ord
+		}))
+		if err != nil {
+			t.Fatalf("[%s] failed to read source: %v", ord, err)
+		}
+
+		raw, err := ioutil.ReadAll(newTestReader(context.Background(), t, source, func(r *Reader) {
+			r.PageHeaderProvider = nil
+		}))
+		if err != nil {
+			t.Fatalf("[%s] failed to read source: %v", ord, err)
+		}
+
+		limePath := filepath.Join(t.TempDir(), "image.lime")
+		rawPath := filepath.Join(t.TempDir(), "image.raw")
+		if err := ioutil.WriteFile(limePath, lime, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(rawPath, raw, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// LiME -> raw, and raw -> LiME (little endian)
+		fromLime, err := ioutil.ReadAll(newTestReader(context.Background(), t, NewImageSource(limePath), func(r *Reader) {
+			r.PageHeaderProvider = nil
+		}))
+		if err != nil {
+			t.Fatalf("[%s] failed to read LiME image: %v", ord, err)
+		}
+		if !bytes.Equal(fromLime, raw) {
+			t.Errorf("[%s] raw output from LiME image does not match", ord)
+		}
+
+		fromRaw, err := ioutil.ReadAll(newTestReader(context.Background(), t, NewRawImageSource(rawPath, testRanges), func(r *Reader) {
+			r.ByteOrder = ord
+		}))
+		if err != nil {
+			t.Fatalf("[%s] failed to read raw image: %v", ord, err)
+		}
+		if !bytes.Equal(fromRaw, lime) {
+			t.Errorf("[%s] LiME output from raw image does not match", ord)
+		}
+
+		// Truncated images should fail
+		truncPath := filepath.Join(t.TempDir(), "trunc.lime")
+		if err := ioutil.WriteFile(truncPath, lime[:len(lime)-1], 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewReader(NewImageSource(truncPath)); err == nil {
+			t.Errorf("[%s] expected error for truncated image", ord)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"strconv"
 	"strings"
 )
@@ -20,17 +19,15 @@ func (m MemRange) String() string {
 	return fmt.Sprintf("start=%d; end=%d", m.Start, m.End)
 }
 
-// ReadRanges reads from /proc/iomem
+// ReadRanges reads the ranges of system RAM, typically from /proc/iomem.
+// Fallback providers are used if /proc/iomem is unavailable or masked (see Detect)
 func ReadRanges() (MemRanges, error) {
-	file, err := os.Open("/proc/iomem")
-	if err != nil {
-		return nil, err
-	}
-
-	return ranges(file)
+	ranges, _, err := Detect()
+	return ranges, err
 }
 
-func ranges(file io.Reader) (MemRanges, error) {
+// ParseRanges parses the ranges of system RAM from data in the /proc/iomem format
+func ParseRanges(file io.Reader) (MemRanges, error) {
 	// Valid lines look like:
 	// 00100000-07ffffff : System RAM
 	scanner := bufio.NewScanner(file)
@@ -69,19 +66,20 @@ func ranges(file io.Reader) (MemRanges, error) {
 	}
 
 	if len(ranges) == 0 {
-		return nil, fmt.Errorf("no valid ranges in /proc/iomem")
+		return nil, fmt.Errorf("no valid ranges in iomem")
 	}
 
-	log.Printf("[DEBUG] loaded ranges:\n%+v", ranges)
 	return ranges, nil
 }
 
-func (m MemRanges) ToMap() map[uint64]interface{} {
-	rangeMap := make(map[uint64]interface{})
+// Contains returns true if the address falls within any of the ranges
+func (m MemRanges) Contains(addr uint64) bool {
 	for _, rng := range m {
-		rangeMap[rng.Start] = nil // ignore end, unused
+		if addr >= rng.Start && addr <= rng.End {
+			return true
+		}
 	}
-	return rangeMap
+	return false
 }
 
 func (m MemRanges) String() string {
@@ -2,6 +2,9 @@ package iomem
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -27,7 +30,7 @@ func TestReadRanges(t *testing.T) {
 6c692000-6de34fff : System RAM
 6de35000-793fefff : reserved
 `)
-	ranges, err := ranges(&buffer)
+	ranges, err := ParseRanges(&buffer)
 	if err != nil {
 		t.Error("Failed to read ranges", err)
 	}
@@ -49,3 +52,119 @@ func TestReadRanges(t *testing.T) {
 		}
 	}
 }
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkRanges(t *testing.T, ranges MemRanges, expectedRanges []*MemRange) {
+	if len(ranges) != len(expectedRanges) {
+		t.Fatalf("invalid number of ranges: %d != %d", len(ranges), len(expectedRanges))
+	}
+	for i, rng := range ranges {
+		if *rng != *expectedRanges[i] {
+			t.Errorf("[%d] invalid range: %s != %s", i, rng, expectedRanges[i])
+		}
+	}
+}
+
+func TestMaskedRanges(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"iomem": `00000000-00000000 : Reserved
+00000000-00000000 : System RAM
+00000000-00000000 : Reserved
+00000000-00000000 : System RAM`,
+	})
+
+	_, err := (&procIomem{path: filepath.Join(dir, "iomem")}).Ranges()
+	if err != ErrMasked {
+		t.Errorf("expected masked error, got: %v", err)
+	}
+}
+
+func TestFirmwareMemmapRanges(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"0/start": "0x0", "0/end": "0x9fbff", "0/type": "System RAM",
+		"1/start": "0x9fc00", "1/end": "0xfffff", "1/type": "Reserved",
+		"10/start": "0x100000000", "10/end": "0x1bfffffff", "10/type": "System RAM",
+		"2/start": "0x100000", "2/end": "0xbfffffff", "2/type": "System RAM",
+	})
+
+	ranges, err := (&firmwareMemmap{dir: dir}).Ranges()
+	if err != nil {
+		t.Fatal("Failed to read ranges", err)
+	}
+
+	checkRanges(t, ranges, []*MemRange{
+		{0x0, 0x9fbff},
+		{0x100000, 0xbfffffff},
+		{0x100000000, 0x1bfffffff},
+	})
+}
+
+func TestMemoryBlockRanges(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"block_size_bytes":    "8000000",
+		"memory0/phys_index":  "00000000",
+		"memory0/state":       "online",
+		"memory1/phys_index":  "00000001",
+		"memory1/state":       "online",
+		"memory2/phys_index":  "00000002",
+		"memory2/state":       "offline",
+		"memory32/phys_index": "00000020",
+		"memory32/state":      "online",
+	})
+
+	ranges, err := (&memoryBlocks{dir: dir}).Ranges()
+	if err != nil {
+		t.Fatal("Failed to read ranges", err)
+	}
+
+	checkRanges(t, ranges, []*MemRange{
+		{0x0, 0xfffffff},
+		{0x100000000, 0x107ffffff},
+	})
+}
+
+func TestDetect(t *testing.T) {
+	defer func(providers []Provider) {
+		Providers = providers
+	}(Providers)
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"iomem":                   "00000000-00000000 : System RAM",
+		"memmap/0/start":          "0x1000",
+		"memmap/0/end":            "0x9fbff",
+		"memmap/0/type":           "System RAM",
+		"memory/block_size_bytes": "8000000",
+	})
+
+	Providers = []Provider{
+		&procIomem{path: filepath.Join(dir, "iomem")},
+		&kcoreSegments{path: filepath.Join(dir, "kcore")}, // missing
+		&firmwareMemmap{dir: filepath.Join(dir, "memmap")},
+		&memoryBlocks{dir: filepath.Join(dir, "memory")},
+	}
+
+	ranges, provider, err := Detect()
+	if err != nil {
+		t.Fatal("Failed to detect ranges", err)
+	}
+	if provider != Providers[2] {
+		t.Errorf("unexpected provider used: %s", provider.Name())
+	}
+
+	checkRanges(t, ranges, []*MemRange{{0x1000, 0x9fbff}})
+}
@@ -0,0 +1,273 @@
+package iomem
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrMasked is returned when the addresses in /proc/iomem are masked, which
+// occurs under kptr restrictions or when read by a non-root user, resulting
+// in every address appearing as 00000000-00000000
+var ErrMasked = errors.New("addresses are masked")
+
+// Provider reads the ranges of system RAM from a particular source
+type Provider interface {
+	// Name describes the provider, typically using its path (eg: /proc/iomem)
+	Name() string
+
+	// Ranges reads the ranges of system RAM, sorted by start address
+	Ranges() (MemRanges, error)
+}
+
+// Providers lists the providers used by Detect, in order of preference
+var Providers = []Provider{
+	&procIomem{path: "/proc/iomem"},
+	&firmwareMemmap{dir: "/sys/firmware/memmap"},
+	&kcoreSegments{path: "/proc/kcore"},
+	&memoryBlocks{dir: "/sys/devices/system/memory"},
+}
+
+// Detect reads the ranges of system RAM using the first of the Providers to
+// return valid ranges, and returns the ranges along with the provider used
+func Detect() (MemRanges, Provider, error) {
+	var errs []string
+	for _, provider := range Providers {
+		ranges, err := provider.Ranges()
+		if err != nil {
+			log.Printf("[DEBUG] failed to read memory ranges using %s: %s", provider.Name(), err)
+			errs = append(errs, fmt.Sprintf("%s: %s", provider.Name(), err))
+			continue
+		}
+
+		log.Printf("[DEBUG] loaded ranges using %s:\n%+v", provider.Name(), ranges)
+		return ranges, provider, nil
+	}
+
+	return nil, nil, fmt.Errorf("failed to read memory ranges from any provider (%s)", strings.Join(errs, "; "))
+}
+
+// procIomem reads ranges from /proc/iomem
+type procIomem struct {
+	path string
+}
+
+func (p *procIomem) Name() string {
+	return p.path
+}
+
+func (p *procIomem) Ranges() (MemRanges, error) {
+	file, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ranges, err := ParseRanges(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if ranges.masked() {
+		return nil, ErrMasked
+	}
+
+	return ranges, nil
+}
+
+// firmwareMemmap reads ranges from /sys/firmware/memmap, where each entry
+// is a directory containing start, end and type files. For example:
+//
+//	/sys/firmware/memmap/2/start: 0x100000
+//	/sys/firmware/memmap/2/end:   0xbfffffff
+//	/sys/firmware/memmap/2/type:  System RAM
+type firmwareMemmap struct {
+	dir string
+}
+
+func (f *firmwareMemmap) Name() string {
+	return f.dir
+}
+
+func (f *firmwareMemmap) Ranges() (MemRanges, error) {
+	entries, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges MemRanges
+	for _, entry := range entries {
+		entryDir := filepath.Join(f.dir, entry.Name())
+		typ, err := readValue(entryDir, "type")
+		if err != nil {
+			return nil, err
+		}
+		if typ != "System RAM" {
+			continue
+		}
+
+		curRange := new(MemRange)
+		if curRange.Start, err = readHex(entryDir, "start"); err != nil {
+			return nil, err
+		}
+		if curRange.End, err = readHex(entryDir, "end"); err != nil {
+			return nil, err
+		}
+
+		ranges = append(ranges, curRange)
+	}
+
+	return ranges.validate()
+}
+
+// kcoreSegments reads ranges from the physical addresses of the
+// PT_LOAD program segments of /proc/kcore
+type kcoreSegments struct {
+	path string
+}
+
+func (k *kcoreSegments) Name() string {
+	return k.path
+}
+
+func (k *kcoreSegments) Ranges() (MemRanges, error) {
+	file, err := elf.Open(k.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var ranges MemRanges
+	for _, prog := range file.Progs {
+		// Segments without a physical address (eg: vmalloc) use 0 or -1
+		if prog.Type != elf.PT_LOAD || prog.Paddr == 0 || prog.Paddr == ^uint64(0) || prog.Filesz == 0 {
+			continue
+		}
+
+		ranges = append(ranges, &MemRange{Start: prog.Paddr, End: prog.Paddr + prog.Filesz - 1})
+	}
+
+	// The segment for the kernel text overlaps those for RAM, so merge any overlaps
+	return ranges.merge(false).validate()
+}
+
+// memoryBlocks reads ranges from the online memory blocks
+// in /sys/devices/system/memory, where each memoryN directory
+// describes a block of block_size_bytes starting at phys_index
+type memoryBlocks struct {
+	dir string
+}
+
+func (m *memoryBlocks) Name() string {
+	return m.dir
+}
+
+func (m *memoryBlocks) Ranges() (MemRanges, error) {
+	blockSize, err := readHex(m.dir, "block_size_bytes")
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := filepath.Glob(filepath.Join(m.dir, "memory[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges MemRanges
+	for _, entryDir := range entries {
+		state, err := readValue(entryDir, "state")
+		if err != nil {
+			return nil, err
+		}
+		if state != "online" {
+			continue
+		}
+
+		index, err := readHex(entryDir, "phys_index")
+		if err != nil {
+			return nil, err
+		}
+
+		start := index * blockSize
+		ranges = append(ranges, &MemRange{Start: start, End: start + blockSize - 1})
+	}
+
+	// Blocks are typically large (eg: 128 MiB), so merge adjacent blocks
+	return ranges.merge(true).validate()
+}
+
+func readValue(dir, name string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readHex reads a hex value, which may or may not be prefixed with 0x
+func readHex(dir, name string) (uint64, error) {
+	value, err := readValue(dir, name)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value in %s: %s", filepath.Join(dir, name), err)
+	}
+
+	return result, nil
+}
+
+// masked returns true if every range has a zero start and end address
+func (m MemRanges) masked() bool {
+	for _, rng := range m {
+		if rng.Start != 0 || rng.End != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validate sorts the ranges, ensuring at least one exists and none are masked
+func (m MemRanges) validate() (MemRanges, error) {
+	if len(m) == 0 {
+		return nil, fmt.Errorf("no valid ranges")
+	}
+	if m.masked() {
+		return nil, ErrMasked
+	}
+
+	sort.SliceStable(m, func(i, j int) bool { return m[i].Start < m[j].Start })
+
+	return m, nil
+}
+
+// merge combines overlapping ranges, and optionally adjacent ones
+func (m MemRanges) merge(adjacent bool) MemRanges {
+	sort.SliceStable(m, func(i, j int) bool { return m[i].Start < m[j].Start })
+
+	var merged MemRanges
+	for _, rng := range m {
+		if len(merged) > 0 {
+			prev := merged[len(merged)-1]
+			if rng.Start <= prev.End || (adjacent && rng.Start == prev.End+1) {
+				if rng.End > prev.End {
+					prev.End = rng.End
+				}
+				continue
+			}
+		}
+		curRange := *rng
+		merged = append(merged, &curRange)
+	}
+
+	return merged
+}
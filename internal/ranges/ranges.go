@@ -0,0 +1,50 @@
+// Package ranges holds the handling of ranges of physical memory shared by the
+// memr and image packages: the LiME magic preceding each range of LiME images,
+// and the clipping of ranges that overlap, such as the PT_LOAD segments of ELF cores.
+package ranges
+
+import (
+	"log"
+	"sort"
+)
+
+// LiMEMagic is the value of the magic for each LiME header (LiME), which is
+// also used for version 1 (uncompressed) AVML headers
+const LiMEMagic uint32 = 0x4C694D45
+
+// Range is a range of physical memory, and the offset of its data
+type Range struct {
+	Start, End uint64 // physical address range (End is exclusive)
+	Offset     int64  // offset at which Start can be read
+}
+
+// Clip orders the ranges by physical address, clipping (or dropping)
+// any range that overlaps a preceding one so that no data is duplicated.
+// When ranges share a start address, the larger is preferred
+func Clip(rngs []Range) []Range {
+	sort.SliceStable(rngs, func(i, j int) bool {
+		if rngs[i].Start == rngs[j].Start {
+			return rngs[i].End > rngs[j].End
+		}
+		return rngs[i].Start < rngs[j].Start
+	})
+
+	var clipped []Range
+	var prevEnd uint64
+	for _, rng := range rngs {
+		if rng.End <= prevEnd {
+			log.Printf("[DEBUG] range overlaps previous range, skipping: start=%d; end=%d", rng.Start, rng.End)
+			continue
+		}
+		if rng.Start < prevEnd {
+			log.Printf("[DEBUG] range partially overlaps previous range, clipping: start=%d; end=%d", rng.Start, rng.End)
+			rng.Offset += int64(prevEnd - rng.Start)
+			rng.Start = prevEnd
+		}
+
+		clipped = append(clipped, rng)
+		prevEnd = rng.End
+	}
+
+	return clipped
+}
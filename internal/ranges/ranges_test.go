@@ -0,0 +1,31 @@
+package ranges
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClip(t *testing.T) {
+	rngs := []Range{
+		{Start: 0x10000, End: 0x14000, Offset: 0x1000},
+		{Start: 0x12000, End: 0x16000, Offset: 0x5000}, // partially overlapping
+		{Start: 0x1000, End: 0x2000, Offset: 0xc000},   // sharing the start of a larger range
+		{Start: 0x11000, End: 0x12000, Offset: 0xb000}, // within a range
+		{Start: 0x1000, End: 0x3000, Offset: 0x9000},
+		{Start: 0x16000, End: 0x17000, Offset: 0xd000}, // adjacent
+	}
+
+	expected := []Range{
+		{Start: 0x1000, End: 0x3000, Offset: 0x9000},
+		{Start: 0x10000, End: 0x14000, Offset: 0x1000},
+		{Start: 0x14000, End: 0x16000, Offset: 0x7000},
+		{Start: 0x16000, End: 0x17000, Offset: 0xd000},
+	}
+	if clipped := Clip(rngs); !reflect.DeepEqual(clipped, expected) {
+		t.Errorf("got %+v; want %+v", clipped, expected)
+	}
+
+	if clipped := Clip(nil); clipped != nil {
+		t.Errorf("expected no ranges: %+v", clipped)
+	}
+}
@@ -6,23 +6,82 @@ import (
 	"log"
 	"os"
 	"sort"
-
-	"github.com/ryandeivert/memr/internal/iomem"
 )
 
 const minSourceSize = 4096
 
-// kcoreBlocks reads logical blocks from the *elf.File as elf.Progs
-func kcoreBlocks(file *elf.File, memRanges iomem.MemRanges) blocks {
+// kcoreSource reads from the /proc/kcore ELF file, where
+// physical memory is available as PT_LOAD program segments
+type kcoreSource struct {
+	path string
+}
+
+func (k *kcoreSource) String() string {
+	return k.path
+}
+
+func (k *kcoreSource) Open() (SourceFile, error) {
+	if err := verifySource(k.path); err != nil {
+		return nil, err
+	}
+	return os.Open(k.path)
+}
+
+func (k *kcoreSource) KernelInfo(file SourceFile) (*KernelInfo, error) {
+	elfFile, err := elf.NewFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return elfKernelInfo(elfFile)
+}
+
+func (k *kcoreSource) Ranges(file SourceFile, memRanges MemRanges) ([]SourceRange, error) {
+	if len(memRanges) == 0 {
+		return nil, fmt.Errorf("no memory ranges available for %s", k)
+	}
+
+	elfFile, err := elf.NewFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// Kernel info is only used to improve the mapping of virtual addresses, if needed
+	info, err := elfKernelInfo(elfFile)
+	if err != nil {
+		log.Printf("[DEBUG] failed to read kernel info from %s: %s", k, err)
+	}
+
+	rngs := kcoreRanges(elfFile, memRanges, info)
+	if len(rngs) == 0 {
+		return nil, fmt.Errorf("no kcore segments overlap the memory ranges for %s", k)
+	}
+
+	return rngs, nil
+}
+
+// kcoreRanges maps the logical ranges from the *elf.File (as elf.Progs) onto the
+// memory ranges by their intersection. Segments that only partially overlap a memory
+// range are clipped to it, and segments may be split across multiple memory ranges.
+// If the kernel info includes the PAGE_OFFSET (start of the direct mapping of physical
+// memory), this is used to map virtual addresses to physical addresses when needed.
+func kcoreRanges(file *elf.File, memRanges MemRanges, info *KernelInfo) []SourceRange {
 
-	rangeMap := memRanges.ToMap()
 	sort.SliceStable(file.Progs, func(i, j int) bool { return file.Progs[i].Vaddr < file.Progs[j].Vaddr })
 
-	var blks blocks
-	var firstVaddr uint64
+	var rngs []SourceRange
+	firstVaddr, havePageOffset := info.Number("PAGE_OFFSET")
+	if havePageOffset {
+		log.Printf("[DEBUG] kcore vaddr from VMCOREINFO PAGE_OFFSET: %d", firstVaddr)
+	}
 	for _, progHeader := range file.Progs {
 		// Only care about PT_LOAD program header types
-		if progHeader.Type != elf.PT_LOAD {
+		if progHeader.Type != elf.PT_LOAD || progHeader.Filesz == 0 {
+			continue
+		}
+
+		// Segments without a physical address (eg: vmalloc) use -1 on newer kernels
+		if progHeader.Paddr == ^uint64(0) {
+			log.Printf("[DEBUG] kcore segment has no physical address, skipping: %d", progHeader.Vaddr)
 			continue
 		}
 
@@ -35,23 +94,36 @@ func kcoreBlocks(file *elf.File, memRanges iomem.MemRanges) blocks {
 		if startValue == 0 {
 			log.Printf("[DEBUG] kcore physical address unavailable, resorting to virtual address: %d", progHeader.Vaddr)
 			startValue = progHeader.Vaddr - firstVaddr
+
+			// The derived address is a guess without PAGE_OFFSET, so only
+			// trust it if it begins within one of the memory ranges
+			if !havePageOffset && !memRanges.Contains(startValue) {
+				log.Printf("[DEBUG] kcore address not found in memory ranges: %d", startValue)
+				continue
+			}
 		}
 
-		// Skip if address is not in the iomem start values
-		_, ok := rangeMap[startValue]
-		if !ok {
-			log.Printf("[DEBUG] kcore address not found in memory ranges: %d", startValue)
-			continue
+		segment := SourceRange{
+			Start:  startValue,
+			End:    startValue + progHeader.Filesz,
+			Offset: int64(progHeader.Off),
+		}
+
+		var found bool
+		for _, rng := range memRanges {
+			if clipped, ok := segment.intersect(rng.Start, rng.End+1); ok { // iomem ranges are inclusive
+				rngs = append(rngs, clipped)
+				found = true
+			}
 		}
 
-		blks = append(blks, &block{
-			Reader: progHeader.Open(),
-			start:  progHeader.Paddr,
-			end:    (progHeader.Paddr + progHeader.Filesz),
-		})
+		if !found {
+			log.Printf("[DEBUG] kcore segment does not overlap any memory range: start=%d; end=%d", segment.Start, segment.End)
+		}
 	}
 
-	return blks
+	// The segment for the kernel's text overlaps those for RAM, so clip any overlaps
+	return clipOverlaps(rngs)
 }
 
 // verifySource checks if a source can be read
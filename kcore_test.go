@@ -0,0 +1,113 @@
+package memr
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+)
+
+// testELF builds a minimal ELF64 core file containing only the program headers
+func testELF(t *testing.T, progs []elf.Prog64) *elf.File {
+	var buf bytes.Buffer
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_CORE),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     uint64(binary.Size(elf.Header64{})),
+		Ehsize:    uint16(binary.Size(elf.Header64{})),
+		Phentsize: uint16(binary.Size(elf.Prog64{})),
+		Phnum:     uint16(len(progs)),
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	if err := binary.Write(&buf, binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, progs); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestKcoreRanges(t *testing.T) {
+	const pageOffset = 0xffff888000000000
+	load := uint32(elf.PT_LOAD)
+
+	file := testELF(t, []elf.Prog64{
+		// vmalloc, without a physical address
+		{Type: load, Vaddr: 0xffffc90000000000, Paddr: ^uint64(0), Off: 0x10000, Filesz: 0x100000},
+		// kernel text, overlapping RAM
+		{Type: load, Vaddr: 0xffffffff81000000, Paddr: 0x1000000, Off: 0x20000, Filesz: 0x200000},
+		// RAM, matching the first iomem range exactly
+		{Type: load, Vaddr: pageOffset + 0x1000, Paddr: 0x1000, Off: 0x40000, Filesz: 0x9f000},
+		// RAM, spanning the second and third iomem ranges
+		{Type: load, Vaddr: pageOffset + 0x100000, Paddr: 0x100000, Off: 0x100000, Filesz: 0x7ff00000},
+	})
+
+	memRanges := MemRanges{
+		{Start: 0x1000, End: 0x9ffff},
+		{Start: 0x100000, End: 0x3fffffff},
+		{Start: 0x40000000, End: 0x7fffffff},
+		{Start: 0x100000000, End: 0x13fffffff}, // not in kcore
+	}
+
+	rngs := kcoreRanges(file, memRanges, nil)
+
+	expected := []SourceRange{
+		{Start: 0x1000, End: 0xa0000, Offset: 0x40000},
+		{Start: 0x100000, End: 0x40000000, Offset: 0x100000},
+		{Start: 0x40000000, End: 0x80000000, Offset: 0x40000000},
+	}
+
+	if len(rngs) != len(expected) {
+		t.Fatalf("unexpected number of ranges: %d != %d (%+v)", len(rngs), len(expected), rngs)
+	}
+	for i, rng := range rngs {
+		if rng != expected[i] {
+			t.Errorf("[%d] invalid range: %+v != %+v", i, rng, expected[i])
+		}
+	}
+
+	uncovered := uncoveredRanges(memRanges, rngs)
+	if len(uncovered) != 1 || *uncovered[0] != *memRanges[3] {
+		t.Errorf("invalid uncovered ranges: %s", uncovered)
+	}
+}
+
+func TestUncoveredRanges(t *testing.T) {
+	memRanges := MemRanges{
+		{Start: 0x1000, End: 0x9ffff},
+		{Start: 0x100000, End: 0x3fffffff},
+	}
+
+	rngs := []SourceRange{
+		{Start: 0x1000, End: 0x50000},
+		{Start: 0x200000, End: 0x300000},
+		{Start: 0x300000, End: 0x3ffff000},
+	}
+
+	expected := MemRanges{
+		{Start: 0x50000, End: 0x9ffff},
+		{Start: 0x100000, End: 0x1fffff},
+		{Start: 0x3ffff000, End: 0x3fffffff},
+	}
+
+	uncovered := uncoveredRanges(memRanges, rngs)
+	if len(uncovered) != len(expected) {
+		t.Fatalf("unexpected number of ranges: %d != %d (%s)", len(uncovered), len(expected), uncovered)
+	}
+	for i, rng := range uncovered {
+		if *rng != *expected[i] {
+			t.Errorf("[%d] invalid range: %s != %s", i, rng, expected[i])
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package memr
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// noteNameVmcoreinfo is the name of the ELF note containing VMCOREINFO
+const noteNameVmcoreinfo = "VMCOREINFO"
+
+// Note is an ELF note read from the PT_NOTE segment(s) of
+// a memory source, such as /proc/kcore or /proc/vmcore
+type Note struct {
+	Name string    // eg: CORE or VMCOREINFO
+	Type elf.NType // eg: NT_PRSTATUS, NT_PRPSINFO or NT_TASKSTRUCT
+	Desc []byte    // the raw content of the note
+}
+
+func (n Note) String() string {
+	return fmt.Sprintf("name=%s; type=%s; size=%d", n.Name, n.Type, len(n.Desc))
+}
+
+// KernelInfo describes the kernel whose memory is being read, as parsed from the
+// ELF notes of the memory source. On newer kernels, this includes the VMCOREINFO
+// note, containing values such as OSRELEASE, PAGESIZE, KERNELOFFSET,
+// SYMBOL(swapper_pg_dir) and NUMBER(phys_base).
+type KernelInfo struct {
+	Machine    elf.Machine       // the machine from the ELF header (eg: EM_X86_64)
+	Notes      []Note            // all notes, in the order they were read
+	VMCoreInfo map[string]string // key/value pairs from the VMCOREINFO note, if available
+}
+
+// KernelInfoSource can optionally be implemented by a MemSource
+// that is able to describe the kernel (eg: using ELF notes)
+type KernelInfoSource interface {
+	KernelInfo(file SourceFile) (*KernelInfo, error)
+}
+
+// Value returns the raw value for the VMCOREINFO key (eg: OSRELEASE)
+func (k *KernelInfo) Value(key string) (string, bool) {
+	if k == nil {
+		return "", false
+	}
+	value, ok := k.VMCoreInfo[key]
+	return value, ok
+}
+
+// OSRelease returns the kernel release (eg: 5.15.0-1019-aws)
+func (k *KernelInfo) OSRelease() string {
+	value, _ := k.Value("OSRELEASE")
+	return value
+}
+
+// PageSize returns the kernel's page size
+func (k *KernelInfo) PageSize() (uint64, bool) {
+	return k.parse("PAGESIZE", 10)
+}
+
+// KernelOffset returns the KASLR offset of the kernel
+func (k *KernelInfo) KernelOffset() (uint64, bool) {
+	return k.parse("KERNELOFFSET", 16)
+}
+
+// Symbol returns the address of the symbol (eg: swapper_pg_dir)
+func (k *KernelInfo) Symbol(name string) (uint64, bool) {
+	return k.parse("SYMBOL("+name+")", 16)
+}
+
+// Number returns the value of the number (eg: phys_base)
+func (k *KernelInfo) Number(name string) (uint64, bool) {
+	return k.parse("NUMBER("+name+")", 0)
+}
+
+func (k *KernelInfo) parse(key string, base int) (uint64, bool) {
+	value, ok := k.Value(key)
+	if !ok {
+		return 0, false
+	}
+
+	result, err := strconv.ParseUint(value, base, 64)
+	if err != nil {
+		// Numbers are formatted as signed values by the kernel
+		signed, sErr := strconv.ParseInt(value, base, 64)
+		if sErr != nil {
+			log.Printf("[DEBUG] invalid VMCOREINFO value for %s: %s", key, err)
+			return 0, false
+		}
+		result = uint64(signed)
+	}
+
+	return result, true
+}
+
+// VMCoreInfoNote returns the raw VMCOREINFO note, if available
+func (k *KernelInfo) VMCoreInfoNote() (Note, bool) {
+	if k != nil {
+		for _, note := range k.Notes {
+			if note.Name == noteNameVmcoreinfo {
+				return note, true
+			}
+		}
+	}
+	return Note{}, false
+}
+
+// elfKernelInfo reads all notes from the PT_NOTE segments of the *elf.File
+func elfKernelInfo(file *elf.File) (*KernelInfo, error) {
+	info := &KernelInfo{Machine: file.Machine, VMCoreInfo: make(map[string]string)}
+	for _, progHeader := range file.Progs {
+		if progHeader.Type != elf.PT_NOTE {
+			continue
+		}
+
+		notes, err := readNotes(progHeader.Open(), file.ByteOrder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read notes: %w", err)
+		}
+		info.Notes = append(info.Notes, notes...)
+	}
+
+	if note, ok := info.VMCoreInfoNote(); ok {
+		info.VMCoreInfo = parseVmcoreinfo(note.Desc)
+	}
+
+	log.Printf("[DEBUG] loaded %d note(s) and %d VMCOREINFO value(s)", len(info.Notes), len(info.VMCoreInfo))
+
+	return info, nil
+}
+
+// readNotes reads the notes from a PT_NOTE segment, where each note is a header
+// (name size, description size and type), followed by the name and description,
+// each padded to a 4 byte alignment
+func readNotes(r io.Reader, ord binary.ByteOrder) ([]Note, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var notes []Note
+	for len(data) >= 12 {
+		nameSize := uint64(ord.Uint32(data[0:]))
+		descSize := uint64(ord.Uint32(data[4:]))
+		typ := elf.NType(ord.Uint32(data[8:]))
+		data = data[12:]
+
+		if nameSize == 0 && descSize == 0 && typ == 0 {
+			break // padding at the end of the segment
+		}
+
+		nameEnd := align4(nameSize)
+		descEnd := nameEnd + align4(descSize)
+		if nameEnd > uint64(len(data)) || nameEnd+descSize > uint64(len(data)) {
+			return nil, fmt.Errorf("note exceeds segment: name size=%d; desc size=%d", nameSize, descSize)
+		}
+
+		notes = append(notes, Note{
+			Name: string(bytes.TrimRight(data[:nameSize], "\x00")),
+			Type: typ,
+			Desc: append([]byte(nil), data[nameEnd:nameEnd+descSize]...),
+		})
+
+		if descEnd > uint64(len(data)) {
+			break
+		}
+		data = data[descEnd:]
+	}
+
+	return notes, nil
+}
+
+// parseVmcoreinfo parses the KEY=VALUE lines of the VMCOREINFO note
+func parseVmcoreinfo(desc []byte) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(desc, "\x00")))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		values[parts[0]] = parts[1]
+	}
+
+	return values
+}
+
+func align4(size uint64) uint64 {
+	return (size + 3) &^ 3
+}
@@ -0,0 +1,69 @@
+package memr
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadNotes(t *testing.T) {
+	vmcoreinfo := `OSRELEASE=5.15.0-1019-aws
+PAGESIZE=4096
+SYMBOL(swapper_pg_dir)=ffffffff8340a000
+NUMBER(phys_base)=-1073741824
+NUMBER(PAGE_OFFSET)=0xffff000000000000
+KERNELOFFSET=1e00000
+`
+	var buf bytes.Buffer
+	writeNote(&buf, Note{Name: "CORE", Type: elf.NT_PRSTATUS, Desc: make([]byte, 336)}, binary.LittleEndian)
+	writeNote(&buf, Note{Name: "CORE", Type: elf.NT_PRPSINFO, Desc: make([]byte, 136)}, binary.LittleEndian)
+	writeNote(&buf, Note{Name: "CORE", Type: 4, Desc: make([]byte, 13)}, binary.LittleEndian) // NT_TASKSTRUCT, unaligned
+	writeNote(&buf, Note{Name: noteNameVmcoreinfo, Desc: []byte(vmcoreinfo)}, binary.LittleEndian)
+	buf.Write(make([]byte, 16)) // trailing padding
+
+	notes, err := readNotes(&buf, binary.LittleEndian)
+	if err != nil {
+		t.Fatalf("failed to read notes: %v", err)
+	}
+	if len(notes) != 4 {
+		t.Fatalf("unexpected number of notes: %d", len(notes))
+	}
+	if notes[2].Type != 4 || len(notes[2].Desc) != 13 {
+		t.Errorf("invalid note: %s", notes[2])
+	}
+
+	info := &KernelInfo{Notes: notes}
+	note, ok := info.VMCoreInfoNote()
+	if !ok {
+		t.Fatal("VMCOREINFO note not found")
+	}
+	info.VMCoreInfo = parseVmcoreinfo(note.Desc)
+
+	if info.OSRelease() != "5.15.0-1019-aws" {
+		t.Errorf("invalid os release: %s", info.OSRelease())
+	}
+	if v, ok := info.PageSize(); !ok || v != 4096 {
+		t.Errorf("invalid page size: %d", v)
+	}
+	if v, ok := info.KernelOffset(); !ok || v != 0x1e00000 {
+		t.Errorf("invalid kernel offset: %x", v)
+	}
+	if v, ok := info.Symbol("swapper_pg_dir"); !ok || v != 0xffffffff8340a000 {
+		t.Errorf("invalid symbol: %x", v)
+	}
+	if v, ok := info.Number("phys_base"); !ok || int64(v) != -1073741824 {
+		t.Errorf("invalid number: %d", int64(v))
+	}
+	if v, ok := info.Number("PAGE_OFFSET"); !ok || v != 0xffff000000000000 {
+		t.Errorf("invalid number: %x", v)
+	}
+	if _, ok := info.Symbol("missing"); ok {
+		t.Error("expected missing symbol")
+	}
+
+	var nilInfo *KernelInfo
+	if _, ok := nilInfo.PageSize(); ok {
+		t.Error("expected no value from nil info")
+	}
+}
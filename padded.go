@@ -0,0 +1,154 @@
+package memr
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// hole is a portion of the output (end-exclusive) that does not correspond to
+// any block of memory, and is zero-filled when using FormatPadded
+type hole struct {
+	start, end uint64
+}
+
+func (h hole) size() uint64 {
+	return h.end - h.start
+}
+
+// paddedHoles returns the holes preceding each of the blocks, when each block is
+// written at the offset equal to its start address. Blocks must be in ascending
+// order and must not overlap, otherwise the layout is not possible.
+func paddedHoles(blks blocks) ([]hole, error) {
+	var holes []hole
+	var offset uint64
+	for _, blk := range blks {
+		if blk.start < offset {
+			return nil, fmt.Errorf("blocks are out of order or overlap at address %d", blk.start)
+		}
+		if blk.start > offset {
+			holes = append(holes, hole{start: offset, end: blk.start})
+		}
+		offset = blk.end
+	}
+
+	return holes, nil
+}
+
+// zeroReader reads n zero bytes
+type zeroReader struct {
+	n uint64
+}
+
+func (z *zeroReader) Read(p []byte) (int, error) {
+	if z.n == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > z.n {
+		p = p[:z.n]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	z.n -= uint64(len(p))
+	return len(p), nil
+}
+
+// WriteTo satisfies the io.WriterTo interface, and so is used by io.Copy.
+// When using FormatPadded and writing to a regular *os.File, the holes between
+// blocks are skipped by seeking past them instead of writing zeros, leaving
+// sparse holes in the file. Otherwise, this is equivalent to copying using Read.
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	file, ok := w.(*os.File)
+	if !ok || r.Format != FormatPadded || !regularFile(file) {
+		return io.Copy(w, struct{ io.Reader }{r}) // hide WriteTo from io.Copy
+	}
+
+	log.Printf("[DEBUG] writing %d hole(s) as sparse regions of %s", len(r.holes), file.Name())
+
+	sparse := &sparseWriter{file: file, holes: r.holes, offset: r.offset}
+	n, err := io.Copy(sparse, struct{ io.Reader }{r})
+	if err != nil {
+		return n, err
+	}
+
+	return n, sparse.flush()
+}
+
+// regularFile returns true if the file is a regular file, and so supports seeking
+func regularFile(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode().IsRegular()
+}
+
+// sparseWriter writes to a file, seeking over the data for any holes instead of writing
+// it. The offset is that of the output, which may differ from the offset in the file.
+type sparseWriter struct {
+	file   *os.File
+	holes  []hole
+	offset uint64 // offset in the output of the next byte to be written
+	skip   int64  // number of bytes skipped since the last write
+}
+
+func (s *sparseWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		for len(s.holes) > 0 && s.holes[0].end <= s.offset {
+			s.holes = s.holes[1:]
+		}
+
+		n := len(p)
+		if len(s.holes) > 0 && s.holes[0].start <= s.offset {
+			// Within a hole, so skip over the data
+			if remaining := s.holes[0].end - s.offset; uint64(n) > remaining {
+				n = int(remaining)
+			}
+			s.skip += int64(n)
+		} else {
+			// Only write up to the next hole, if any
+			if len(s.holes) > 0 {
+				if remaining := s.holes[0].start - s.offset; uint64(n) > remaining {
+					n = int(remaining)
+				}
+			}
+			if err = s.seek(); err != nil {
+				return written, err
+			}
+			if n, err = s.file.Write(p[:n]); err != nil {
+				return written + n, err
+			}
+		}
+
+		p = p[n:]
+		written += n
+		s.offset += uint64(n)
+	}
+
+	return written, nil
+}
+
+// seek moves past any skipped data before the next write
+func (s *sparseWriter) seek() error {
+	if s.skip == 0 {
+		return nil
+	}
+	if _, err := s.file.Seek(s.skip, io.SeekCurrent); err != nil {
+		return fmt.Errorf("failed to seek over hole: %w", err)
+	}
+	s.skip = 0
+	return nil
+}
+
+// flush extends the file over any trailing skipped data, since seeking
+// alone does not change the size of the file
+func (s *sparseWriter) flush() error {
+	if s.skip == 0 {
+		return nil
+	}
+	s.skip--
+	if err := s.seek(); err != nil {
+		return err
+	}
+	_, err := s.file.Write([]byte{0})
+	return err
+}
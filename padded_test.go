@@ -0,0 +1,81 @@
+package memr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormatPadded(t *testing.T) {
+	source := &fakeSource{ReaderAt: patternReaderAt{}}
+	padded := func(r *Reader) { r.Format = FormatPadded }
+
+	// The byte at each address should be at the same offset, with zeros elsewhere
+	expected := make([]byte, testRanges[len(testRanges)-1].End+1)
+	for _, rng := range testRanges {
+		patternReaderAt{}.ReadAt(expected[rng.Start:rng.End+1], int64(rng.Start))
+	}
+
+	reader := newTestReader(context.Background(), t, source, padded)
+	if reader.Size() != uint64(len(expected)) {
+		t.Errorf("unexpected size: %d != %d", reader.Size(), len(expected))
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read source: %v", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Error("padded output does not match")
+	}
+
+	// Copying to a file should produce the same output, using holes for the gaps
+	path := filepath.Join(t.TempDir(), "padded")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	n, err := io.Copy(file, newTestReader(context.Background(), t, source, padded))
+	if err != nil {
+		t.Fatalf("failed to copy to file: %v", err)
+	}
+	if n != int64(len(expected)) {
+		t.Errorf("unexpected number of bytes copied: %d", n)
+	}
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Error("padded file does not match")
+	}
+}
+
+func TestSparseWriterTrailingHole(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	sparse := &sparseWriter{file: file, holes: []hole{{start: 4, end: 8}, {start: 12, end: 16}}}
+	if _, err := sparse.Write([]byte("abcd\x00\x00\x00\x00efgh\x00\x00\x00\x00")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := sparse.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "abcd\x00\x00\x00\x00efgh\x00\x00\x00\x00" {
+		t.Errorf("unexpected file content: %q", data)
+	}
+}
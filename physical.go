@@ -2,51 +2,71 @@ package memr
 
 import (
 	"bufio"
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
-
-	"github.com/ryandeivert/memr/internal/iomem"
 )
 
-// physicalBlocks reads sections directly from an *os.File
-// Certain character devices (eg: /dev/crash) require reads
-// to be block-aligned, so allow reading on exact OS page size
-func physicalBlocks(file io.ReaderAt, memRanges iomem.MemRanges, strictPages bool) (blks blocks) {
-	pgsz := os.Getpagesize()
-	for _, rng := range memRanges {
-		end := rng.End
-		if strictPages {
-			end = end - (end % uint64(pgsz))
-		}
+// physicalSource reads directly from a character device (eg: /dev/crash
+// or /dev/mem) where offsets within the device are physical addresses
+type physicalSource struct {
+	path        string
+	pageAligned bool
+}
 
-		var blkRdr io.Reader = io.NewSectionReader(file, int64(rng.Start), int64(end-rng.Start))
-		if strictPages {
-			blkRdr = blockReader(blkRdr, pgsz)
-		}
-		blks = append(blks, &block{Reader: blkRdr, start: rng.Start, end: end})
+// NewPhysicalSource returns a MemSource that reads from the device at the specified path,
+// where offsets within the device are physical addresses (eg: /dev/mem, or fmem-style
+// devices). If pageAligned is true, reads are performed on exact OS page boundaries.
+func NewPhysicalSource(path string, pageAligned bool) MemSource {
+	return &physicalSource{path: path, pageAligned: pageAligned}
+}
+
+func (p *physicalSource) String() string {
+	return p.path
+}
+
+func (p *physicalSource) PageAligned() bool {
+	return p.pageAligned
+}
+
+func (p *physicalSource) Open() (SourceFile, error) {
+	return os.Open(p.path)
+}
+
+// Ranges returns the iomem ranges as-is, since offsets within
+// the device correspond directly to physical addresses
+func (p *physicalSource) Ranges(_ SourceFile, memRanges MemRanges) ([]SourceRange, error) {
+	if len(memRanges) == 0 {
+		return nil, fmt.Errorf("no memory ranges available for %s", p)
+	}
+
+	rngs := make([]SourceRange, 0, len(memRanges))
+	for _, rng := range memRanges {
+		rngs = append(rngs, SourceRange{
+			Start:  rng.Start,
+			End:    rng.End + 1, // iomem ranges are inclusive
+			Offset: int64(rng.Start),
+		})
 	}
 
-	return blks
+	return rngs, nil
 }
 
 // blockReader forces buffered reads on exact page sizes, typically 4096
 // Note: wrapping the io.Reader with bufio.Reader directly (without the Pipe)
 // does not work because io.Copy will always default to 32 KiB page sizes
-func blockReader(r io.Reader, pgsz int) io.Reader {
-	rPipe, wPipe := io.Pipe()
-	buffer := bufio.NewReaderSize(r, pgsz)
+// Any read failure is propagated to the returned io.Reader
+func blockReader(ctx context.Context, r io.Reader, pgsz int) io.Reader {
+	rPipe, wPipe := newPipe(ctx)
+	buffer := bufio.NewReaderSize(&contextReader{ctx: ctx, Reader: r}, pgsz)
 	go func() {
-		defer func() {
-			pErr := wPipe.Close()
-			if pErr != nil {
-				log.Fatalf("failed to close block writer: %s", pErr)
-			}
-		}()
 		c, err := io.Copy(wPipe, buffer)
 		if err != nil {
-			log.Fatalf("block read failed: %s (read=%d)", err, c)
+			log.Printf("[DEBUG] block read failed: %s (read=%d)", err, c)
 		}
+		wPipe.CloseWithError(err)
 	}()
 
 	return rPipe
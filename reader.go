@@ -1,12 +1,11 @@
 package memr
 
 import (
-	"debug/elf"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
-	"os"
 
 	"github.com/cheggaaa/pb/v3"
 	"github.com/ryandeivert/memr/internal/iomem"
@@ -25,6 +24,10 @@ type Reader struct {
 	// tools. In most cases, the returned io.Reader should be used for compression instead
 	PageHandler PageWriterFunc
 
+	// Format determines the overall layout of the output. The default, FormatDefault, writes
+	// each block preceded by the header from PageHeaderProvider. See Format for other options.
+	Format Format
+
 	// WithProgress should be set to false if progress should not be reported during
 	// the reading of memory. The default when calling NewReader is true.
 	WithProgress bool
@@ -34,35 +37,166 @@ type Reader struct {
 	// when calling NewReader is binary.LittleEndian.
 	ByteOrder binary.ByteOrder
 
+	// SkipBadPages should be set to true if pages that cannot be read from the memory
+	// source (eg: due to EIO or EFAULT) should be zero-filled in the output instead of
+	// failing the read. Each failing page is first retried PageRetries times. Pages that
+	// are zero-filled can be retrieved with BadPages(). The default when calling NewReader is false.
+	SkipBadPages bool
+
+	// PageRetries is the number of times a failing page is retried before it is
+	// zero-filled, when SkipBadPages is true. The default when calling NewReader is 3.
+	PageRetries int
+
+	// Hashes lists the hashes computed as memory is read, both over the entire output of
+	// the reader and the memory of each block. These are available once reading is complete
+	// using ImageHashes() and RangeHashes(). The default when calling NewReader is none.
+	Hashes []Hash
+
+	// StartOffset is the offset in the output at which reading starts, allowing an
+	// interrupted read to be resumed (eg: to continue an upload). The portions of the
+	// output before it, including any headers, are skipped without being read from the
+	// memory source. Since memory is likely to have changed in the meantime, the result
+	// is not a consistent image. This is not supported by compressed formats (eg:
+	// FormatAVML) or with a PageHandler, since their offsets are not known up front.
+	// The default when calling NewReader is 0.
+	StartOffset uint64
+
 	// unexported items
-	source    MemSource
-	memRanges iomem.MemRanges
-	input     io.Closer
-	reader    io.Reader
-	size      uint64
-	bar       *pb.ProgressBar
+	source        MemSource
+	memRanges     iomem.MemRanges
+	rangeProvider string
+	missingRanges iomem.MemRanges
+	kernelInfo    *KernelInfo
+	input         io.Closer
+	reader        io.Reader
+	size          uint64
+	offset        uint64 // offset in the output of the next byte to be read
+	holes         []hole // zero-filled portions of the output, when using FormatPadded
+	blocks        blocks
+	hasher        *Hasher // hashes the entire output, if Hashes are specified
+	bar           *pb.ProgressBar
+	badPages      *badPages
+	parent        context.Context    // context supplied by the caller
+	ctx           context.Context    // context derived from parent, cancelled on Close or Reset
+	cancel        context.CancelFunc // cancels ctx, tearing down any in-flight reads
 }
 
-// Source returns the MemSource for this reader (one of: /proc/kcore, /dev/crash, /dev/mem)
+// Source returns the MemSource for this reader (eg: /proc/vmcore, /proc/kcore, /dev/crash, /dev/mem)
 func (r *Reader) Source() MemSource {
 	return r.source
 }
 
+// RangeProvider describes the provider from which the ranges of system RAM were
+// read (eg: /proc/iomem, or a fallback such as /sys/firmware/memmap if addresses
+// in /proc/iomem are masked). This is empty for sources that describe their own
+// ranges (eg: /proc/vmcore).
+func (r *Reader) RangeProvider() string {
+	if standalone(r.source) {
+		return ""
+	}
+	return r.rangeProvider
+}
+
+// KernelInfo returns information about the kernel, parsed from the ELF notes of the
+// memory source (eg: /proc/kcore or /proc/vmcore). This includes VMCOREINFO values
+// on newer kernels, such as the KASLR offset and page table root. The result is
+// nil if the source cannot describe the kernel.
+func (r *Reader) KernelInfo() *KernelInfo {
+	return r.kernelInfo
+}
+
+// MemRanges returns the ranges of system RAM from which memory is read, as described
+// by the RangeProvider. This is nil for sources that describe their own ranges.
+func (r *Reader) MemRanges() MemRanges {
+	if standalone(r.source) {
+		return nil
+	}
+	return r.memRanges
+}
+
+// MissingRanges returns the portions of the ranges of system RAM that are not available
+// from the memory source, and so are omitted from the output. For example, /proc/kcore may
+// not describe all of system RAM on some kernels (eg: arm64, or with memory hotplug).
+func (r *Reader) MissingRanges() MemRanges {
+	return r.missingRanges
+}
+
+// BadPages returns the pages that could not be read from the memory source
+// and were zero-filled instead. This is only applicable if SkipBadPages is true,
+// and should be called once reading is complete.
+func (r *Reader) BadPages() []BadPage {
+	return r.badPages.list()
+}
+
+// BytesRead returns the number of bytes read from the reader so far, including any
+// skipped before the StartOffset. Once reading is complete, this is the size of the
+// output, which differs from Size for compressed formats.
+func (r *Reader) BytesRead() uint64 {
+	return r.offset
+}
+
+// ImageHashes returns the sums of the Hashes over the entire output of the reader,
+// keyed by hash. This should be called once reading is complete, and is nil if no
+// Hashes were specified. If a StartOffset is used, these only cover the output
+// from the StartOffset onward.
+func (r *Reader) ImageHashes() map[Hash]string {
+	if r.hasher == nil {
+		return nil
+	}
+	return r.hasher.Sums()
+}
+
+// RangeHashes returns the sums of the Hashes over the memory of each block, excluding
+// any headers, in the order the blocks were read. Blocks that were not read in their
+// entirety, due to the StartOffset, have no Sums. This should be called once reading
+// is complete, and is nil if no Hashes were specified.
+func (r *Reader) RangeHashes() []RangeHashes {
+	if r.hasher == nil {
+		return nil
+	}
+
+	rngs := make([]RangeHashes, 0, len(r.blocks))
+	for _, blk := range r.blocks {
+		rng := RangeHashes{Start: blk.start, End: blk.end}
+		if blk.hasher != nil {
+			rng.Sums = blk.hasher.Sums()
+		}
+		rngs = append(rngs, rng)
+	}
+	return rngs
+}
+
 // Close satisfies the io.Closer interface.
 // This should be called after all reading is complete to close the underlying
 // input file. It also signals the progress bar to flush its output. Without calling
 // this, you will likely see incorrect progress output upon completion.
+// Closing the reader also stops any in-flight reads.
 func (r *Reader) Close() error {
+	r.cancel()
 	r.bar.Finish()
 	return r.input.Close()
 }
 
 // Read satisfies the io.Reader interface.
+// Failures reading from the memory source are returned as a *ReadError.
+// If the reader's context is cancelled or its deadline passes, ctx.Err() is returned.
 func (r *Reader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
 	if r.WithProgress && !r.bar.IsStarted() {
 		r.bar.Start()
 	}
-	return r.reader.Read(p)
+	n, err := r.reader.Read(p)
+	r.offset += uint64(n)
+	if r.hasher != nil {
+		r.hasher.Write(p[:n])
+	}
+	if err != nil && r.ctx.Err() != nil {
+		// surface the cancellation instead of the resulting pipe failures
+		return n, r.ctx.Err()
+	}
+	return n, err
 }
 
 // PageWriterFunc can be used to add special handling of page contents,
@@ -70,21 +204,32 @@ func (r *Reader) Read(p []byte) (int, error) {
 // data is read. Note: use of this should nearly always be avoided.
 type PageWriterFunc func(io.Writer) io.WriteCloser
 
-// Probe enumerates all available memory sources and returns the first valid
-// reader. Current sources are: /proc/kcore, /dev/crash, /dev/mem.
+// Probe enumerates all registered memory sources and returns the first valid
+// reader. Built-in sources are: /proc/vmcore, /proc/kcore, /dev/crash, /dev/mem.
+// Additional sources can be registered using RegisterSource.
 // Optional options can be provided for the resulting Reader.
 // See NewReader for usage of custom options.
 func Probe(options ...func(*Reader)) (*Reader, error) {
+	return ProbeContext(context.Background(), options...)
+}
+
+// ProbeContext is like Probe, but the provided context controls
+// the lifecycle of the resulting Reader. See NewReaderContext.
+func ProbeContext(ctx context.Context, options ...func(*Reader)) (*Reader, error) {
 
-	memRanges, err := iomem.ReadRanges()
+	// Ranges are read once and shared by all sources. If they cannot be
+	// read, sources that require them will fail with the resulting error
+	memRanges, provider, err := iomem.Detect()
 	if err != nil {
-		return nil, err
+		log.Printf("[DEBUG] failed to read memory ranges: %v", err)
+	} else {
+		options = append(options, func(r *Reader) {
+			r.memRanges = memRanges
+			r.rangeProvider = provider.Name()
+		})
 	}
-	options = append(options, func(r *Reader) {
-		r.memRanges = memRanges
-	})
 	for _, source := range allMemSources() {
-		reader, err := NewReader(source, options...)
+		reader, err := NewReaderContext(ctx, source, options...)
 		if err != nil {
 			log.Printf("[DEBUG] failed to open reader for %s: %v", source, err)
 			continue
@@ -96,8 +241,9 @@ func Probe(options ...func(*Reader)) (*Reader, error) {
 }
 
 // NewReader tries to open the specified memory source for reading.
-// Source should be one of: SourceKcore (/proc/kcore), SourceCrash (/dev/crash),
-// or SourceMem (/dev/mem). Optional options can be provided for the resulting Reader.
+// Source is typically one of: SourceKcore (/proc/kcore), SourceCrash (/dev/crash),
+// or SourceMem (/dev/mem), but can be any MemSource implementation.
+// Optional options can be provided for the resulting Reader.
 //
 // Example:
 //
@@ -107,12 +253,21 @@ func Probe(options ...func(*Reader)) (*Reader, error) {
 //		m.PageHeaderProvider = nil
 //	})
 func NewReader(source MemSource, options ...func(*Reader)) (reader *Reader, err error) {
+	return NewReaderContext(context.Background(), source, options...)
+}
+
+// NewReaderContext is like NewReader, but the provided context controls the
+// lifecycle of the resulting Reader. Cancelling the context, or exceeding its
+// deadline, stops any in-flight reads and causes Read to return ctx.Err().
+func NewReaderContext(ctx context.Context, source MemSource, options ...func(*Reader)) (reader *Reader, err error) {
 
 	reader = &Reader{
 		PageHeaderProvider: HeaderLime,
 		WithProgress:       true,
 		ByteOrder:          binary.LittleEndian,
+		PageRetries:        3,
 		source:             source,
+		parent:             ctx,
 	}
 
 	for _, option := range options {
@@ -120,92 +275,176 @@ func NewReader(source MemSource, options ...func(*Reader)) (reader *Reader, err
 	}
 
 	err = reader.Reset()
+	if err != nil {
+		reader.cancel()
+	}
 
 	log.Printf("[DEBUG] loaded reader (valid=%t): %+v", err == nil, *reader)
 
 	return
 }
 
+// Reset (re)initializes the reader for its memory source, so
+// the source can be read again from the start
 func (r *Reader) Reset() (err error) {
 
+	if r.cancel != nil {
+		r.cancel() // tear down anything still running from a previous read
+	}
+	if r.parent == nil {
+		r.parent = context.Background()
+	}
+	r.ctx, r.cancel = context.WithCancel(r.parent)
+
+	if r.input != nil {
+		r.input.Close() // close any input left open by a previous read
+	}
 	r.input = nil
 	r.reader = nil
 	r.size = 0
+	r.offset = 0
+	r.holes = nil
+	r.blocks = nil
+	r.hasher = nil
+	r.missingRanges = nil
+	r.kernelInfo = nil
 	r.bar = new(pb.ProgressBar)
+	r.badPages = new(badPages)
+
+	if err = r.Format.validate(r); err != nil {
+		return
+	}
+
+	if len(r.Hashes) > 0 {
+		if r.hasher, err = NewHasher(r.Hashes...); err != nil {
+			return
+		}
+	}
 
 	// Retain any cached memRanges, these are unlikely to have changed
-	if r.memRanges == nil {
-		r.memRanges, err = iomem.ReadRanges()
+	// Standalone sources describe their own ranges, so do not need them
+	if r.memRanges == nil && !standalone(r.source) {
+		var provider iomem.Provider
+		r.memRanges, provider, err = iomem.Detect()
 		if err != nil {
 			return
 		}
+		r.rangeProvider = provider.Name()
+	}
+	if !standalone(r.source) {
+		log.Printf("[DEBUG] using memory ranges from %s", r.rangeProvider)
 	}
 
 	log.Printf("[DEBUG] initializing reader for %s", r.source)
 
-	var blks blocks
-	if r.source.isPhysical() {
-		file, err := os.Open(string(r.source))
-		if err != nil {
-			return err
-		}
-		r.input = file
-		blks = physicalBlocks(file, r.memRanges, r.source.forcePageReads())
-	} else {
-		if err := verifySource(string(r.source)); err != nil {
-			return err
-		}
-		file, err := elf.Open(string(r.source))
-		if err != nil {
-			return err
+	file, err := r.source.Open()
+	if err != nil {
+		return err
+	}
+	r.input = file
+
+	if infoSource, ok := r.source.(KernelInfoSource); ok {
+		info, iErr := infoSource.KernelInfo(file)
+		if iErr != nil {
+			log.Printf("[WARN] failed to read kernel info from %s: %s", r.source, iErr)
 		}
-		r.input = file
-		blks = kcoreBlocks(file, r.memRanges)
+		r.kernelInfo = info
+	}
+
+	memRanges := r.memRanges
+	if standalone(r.source) {
+		memRanges = nil
 	}
 
+	rngs, err := r.source.Ranges(file, memRanges)
+	if err != nil {
+		return err
+	}
+
+	// Portions of system RAM not available from the source result in a partial capture
+	r.missingRanges = uncoveredRanges(memRanges, rngs)
+	for _, rng := range r.missingRanges {
+		log.Printf("[WARN] memory range not available from %s, omitting: %s", r.source, rng)
+	}
+
+	blks := r.sourceBlocks(file, rngs)
+
 	log.Printf("[DEBUG] loaded blocks:\n%s", blks)
 
-	if len(blks) != len(r.memRanges) {
+	if len(blks) == 0 {
 		return fmt.Errorf("unable to load necessary reader(s) for %s", r.source)
 	}
 
+	if r.Format == FormatPadded {
+		if r.holes, err = paddedHoles(blks); err != nil {
+			return fmt.Errorf("unable to use %s format for %s: %w", r.Format, r.source, err)
+		}
+	}
+
+	r.blocks = blks
 	r.reader, r.size = r.initBlockReaders(blks)
+	if r.StartOffset > r.size {
+		return fmt.Errorf("start offset %d exceeds the size of the output: %d", r.StartOffset, r.size)
+	}
+	r.offset = r.StartOffset
 
 	// We now know the expected total size to be read, so set it
 	r.bar.SetTotal(int64(r.size))
+	r.bar.SetCurrent(int64(r.offset))
 
 	return
 }
 
-// Size returns the expected size of the memory to be read by the reader
+// Size returns the expected size of the memory to be read by the reader.
+// If the Format is compressed (eg: FormatAVML), this is the size of the
+// memory before compression, since the compressed size is not known in advance.
 func (r *Reader) Size() uint64 {
 	return r.size
 }
 
-func applyPageWriter(r io.Reader, handlerFunc PageWriterFunc) io.Reader {
+// OutputRange is the physical address range of a block, and the offset of its memory within the output
+type OutputRange struct {
+	Start, End uint64 // physical address range of the block (End is exclusive)
+	Offset     uint64 // offset within the output at which Start is written
+}
+
+// OutputRanges returns the location of each block's memory within the output, in the
+// order the blocks are read. This is nil for compressed formats (eg: FormatAVML) or with
+// a PageHandler, since the offsets depend on the compressed data.
+func (r *Reader) OutputRanges() []OutputRange {
+	if r.Format.Compressed() || r.PageHandler != nil {
+		return nil
+	}
+
+	rngs := make([]OutputRange, 0, len(r.blocks))
+	for _, blk := range r.blocks {
+		rngs = append(rngs, OutputRange{Start: blk.start, End: blk.end, Offset: blk.output})
+	}
+	return rngs
+}
+
+// applyPageWriter runs the block's data through the PageWriterFunc, if one is specified.
+// Failures to read or write pages are returned as a *ReadError for the block
+func applyPageWriter(blk *block, r io.Reader, handlerFunc PageWriterFunc) io.Reader {
 	if handlerFunc == nil {
 		log.Print("[DEBUG] no in-line writer function specified, skipping")
 		return r
 	}
 
-	rPipe, wPipe := io.Pipe()
+	rPipe, wPipe := newPipe(blk.ctx)
 	writer := handlerFunc(wPipe)
 
 	go func() {
-		defer func() {
-			cErr := writer.Close()
-			if cErr != nil {
-				log.Fatalf("failed to close writer: %T; %s", writer, cErr)
-			}
-			cErr = wPipe.Close()
-			if cErr != nil {
-				log.Fatalf("failed to close pipe writer: %s", cErr)
-			}
-		}()
-
-		if _, err := io.Copy(writer, r); err != nil {
-			log.Fatalf("page writer failed: %s", err)
+		_, err := io.Copy(writer, r)
+		if err != nil {
+			err = blk.wrapError(err)
+		}
+
+		if cErr := writer.Close(); cErr != nil && err == nil {
+			err = blk.wrapError(fmt.Errorf("failed to close writer: %T; %w", writer, cErr))
 		}
+
+		wPipe.CloseWithError(err)
 	}()
 
 	return rPipe
@@ -0,0 +1,324 @@
+package memr
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+var testRanges = MemRanges{
+	{Start: 0x1000, End: 0x4fff},
+	{Start: 0x10000, End: 0x13fff},
+}
+
+// fakeSource is a physical MemSource that reads from an io.ReaderAt
+type fakeSource struct {
+	io.ReaderAt
+	pageAligned bool
+}
+
+func (f *fakeSource) String() string            { return "fake" }
+func (f *fakeSource) PageAligned() bool         { return f.pageAligned }
+func (f *fakeSource) Open() (SourceFile, error) { return f, nil }
+func (f *fakeSource) Close() error              { return nil }
+func (f *fakeSource) Ranges(file SourceFile, memRanges MemRanges) ([]SourceRange, error) {
+	return (&physicalSource{}).Ranges(file, memRanges)
+}
+
+func newTestReader(ctx context.Context, t *testing.T, source MemSource, options ...func(*Reader)) *Reader {
+	options = append([]func(*Reader){func(r *Reader) {
+		r.WithProgress = false
+		r.memRanges = testRanges
+	}}, options...)
+
+	reader, err := NewReaderContext(ctx, source, options...)
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	t.Cleanup(func() { reader.Close() })
+
+	return reader
+}
+
+// failingReaderAt fails all reads at or beyond the offset
+type failingReaderAt struct {
+	failAt int64
+	err    error
+}
+
+func (f *failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) <= f.failAt {
+		return len(p), nil
+	}
+	if off >= f.failAt {
+		return 0, f.err
+	}
+	return int(f.failAt - off), f.err
+}
+
+func TestReadError(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		source := &fakeSource{
+			ReaderAt:    &failingReaderAt{failAt: 0x10000 + 0x2000, err: syscall.EIO},
+			pageAligned: strict,
+		}
+		r := newTestReader(context.Background(), t, source, func(r *Reader) {
+			r.PageHandler = func(w io.Writer) io.WriteCloser {
+				return nopWriteCloser{w}
+			}
+		})
+
+		_, err := io.Copy(ioutil.Discard, r)
+
+		var rErr *ReadError
+		if !errors.As(err, &rErr) {
+			t.Fatalf("[strict=%t] expected *ReadError, got: %T (%v)", strict, err, err)
+		}
+		if !errors.Is(err, syscall.EIO) {
+			t.Errorf("[strict=%t] expected underlying EIO, got: %v", strict, rErr.Err)
+		}
+		if rErr.Source != source {
+			t.Errorf("[strict=%t] invalid source: %s", strict, rErr.Source)
+		}
+		if rErr.Start != 0x10000 {
+			t.Errorf("[strict=%t] invalid block start: %d", strict, rErr.Start)
+		}
+		if rErr.Offset != 0x2000 {
+			t.Errorf("[strict=%t] invalid offset: %d", strict, rErr.Offset)
+		}
+	}
+}
+
+func TestReadCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := &fakeSource{ReaderAt: &failingReaderAt{failAt: 1 << 32}, pageAligned: true}
+	r := newTestReader(ctx, t, source)
+
+	buf := make([]byte, 64)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("unexpected error before cancellation: %v", err)
+	}
+
+	cancel()
+
+	if _, err := io.Copy(ioutil.Discard, r); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+}
+
+// badPageReaderAt fills pages with 0xff, failing reads that overlap the bad page
+type badPageReaderAt struct {
+	bad  int64
+	pgsz int64
+}
+
+func (b *badPageReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < b.bad+b.pgsz && off+int64(len(p)) > b.bad {
+		return 0, &os.PathError{Op: "read", Path: "/dev/crash", Err: syscall.EFAULT}
+	}
+	for i := range p {
+		p[i] = 0xff
+	}
+	return len(p), nil
+}
+
+func TestSkipBadPages(t *testing.T) {
+	source := &fakeSource{ReaderAt: &badPageReaderAt{bad: 0x11000, pgsz: 0x1000}, pageAligned: true}
+	r := newTestReader(context.Background(), t, source, func(r *Reader) {
+		r.PageHeaderProvider = nil
+		r.SkipBadPages = true
+		r.PageRetries = 2
+	})
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(data) != 0x8000 {
+		t.Fatalf("invalid size read: %d", len(data))
+	}
+
+	// the bad page is the 2nd page of the 2nd range
+	for i, b := range data {
+		expected := byte(0xff)
+		if i >= 0x5000 && i < 0x6000 {
+			expected = 0
+		}
+		if b != expected {
+			t.Fatalf("invalid byte at %d: %x != %x", i, b, expected)
+		}
+	}
+
+	pages := r.BadPages()
+	if len(pages) != 1 {
+		t.Fatalf("expected 1 bad page, got: %d", len(pages))
+	}
+	if pages[0].Addr != 0x11000 || pages[0].Length != 0x1000 {
+		t.Errorf("invalid bad page: %s", pages[0])
+	}
+	if pages[0].Errno != syscall.EFAULT {
+		t.Errorf("invalid errno: %d", pages[0].Errno)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestHashes(t *testing.T) {
+	source := &fakeSource{ReaderAt: patternReaderAt{}}
+	reader := newTestReader(context.Background(), t, source, func(r *Reader) {
+		r.Hashes = []Hash{HashSHA256, HashBLAKE3, HashMD5}
+	})
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read source: %v", err)
+	}
+
+	if reader.BytesRead() != uint64(len(data)) {
+		t.Errorf("invalid bytes read: %d != %d", reader.BytesRead(), len(data))
+	}
+
+	sums := reader.ImageHashes()
+	if len(sums) != 3 {
+		t.Fatalf("unexpected image hashes: %v", sums)
+	}
+	if expected := sha256.Sum256(data); sums[HashSHA256] != hex.EncodeToString(expected[:]) {
+		t.Errorf("image hash does not match: %s", sums[HashSHA256])
+	}
+
+	rngs := reader.RangeHashes()
+	if len(rngs) != len(testRanges) {
+		t.Fatalf("unexpected range hashes: %v", rngs)
+	}
+	for i, rng := range rngs {
+		mem := make([]byte, rng.End-rng.Start)
+		patternReaderAt{}.ReadAt(mem, int64(rng.Start))
+		if expected := sha256.Sum256(mem); rng.Sums[HashSHA256] != hex.EncodeToString(expected[:]) {
+			t.Errorf("[%d] range hash does not match: %s", i, rng.Sums[HashSHA256])
+		}
+	}
+
+	if _, err := NewReader(source, func(r *Reader) {
+		r.memRanges = testRanges
+		r.Hashes = []Hash{"sha1"}
+	}); err == nil {
+		t.Error("expected unsupported hash")
+	}
+}
+
+func TestStartOffset(t *testing.T) {
+	formats := []Format{FormatDefault, FormatELF, FormatPadded}
+	for _, format := range formats {
+		format := format
+		for _, pageAligned := range []bool{false, true} {
+			source := &fakeSource{ReaderAt: patternReaderAt{}, pageAligned: pageAligned}
+			options := func(r *Reader) {
+				r.Format = format
+				r.Hashes = []Hash{HashSHA256}
+			}
+
+			expected, err := ioutil.ReadAll(newTestReader(context.Background(), t, source, options))
+			if err != nil {
+				t.Fatalf("[%s] failed to read source: %v", format, err)
+			}
+
+			// Offsets within a header, the first block, a later block, and at the end
+			for _, offset := range []uint64{1, 100, 0x2345, uint64(len(expected)) - 10, uint64(len(expected))} {
+				reader := newTestReader(context.Background(), t, source, options, func(r *Reader) {
+					r.StartOffset = offset
+				})
+				data, err := ioutil.ReadAll(reader)
+				if err != nil {
+					t.Fatalf("[%s@%d] failed to read source: %v", format, offset, err)
+				}
+				if !bytes.Equal(data, expected[offset:]) {
+					t.Errorf("[%s@%d] data does not match (page aligned=%t)", format, offset, pageAligned)
+				}
+				if reader.BytesRead() != uint64(len(expected)) {
+					t.Errorf("[%s@%d] invalid bytes read: %d != %d", format, offset, reader.BytesRead(), len(expected))
+				}
+
+				// Only ranges read in their entirety should be hashed
+				rngs := reader.RangeHashes()
+				if len(rngs) != len(testRanges) {
+					t.Fatalf("[%s@%d] unexpected range hashes: %v", format, offset, rngs)
+				}
+				if offset == 0x2345 && rngs[0].Sums != nil {
+					t.Errorf("[%s@%d] unexpected hashes for partially read range: %v", format, offset, rngs[0])
+				}
+				for i, rng := range rngs {
+					if rng.Sums == nil {
+						continue
+					}
+					mem := make([]byte, rng.End-rng.Start)
+					patternReaderAt{}.ReadAt(mem, int64(rng.Start))
+					if expected := sha256.Sum256(mem); rng.Sums[HashSHA256] != hex.EncodeToString(expected[:]) {
+						t.Errorf("[%s@%d:%d] range hash does not match: %s", format, offset, i, rng.Sums[HashSHA256])
+					}
+				}
+			}
+		}
+	}
+
+	source := &fakeSource{ReaderAt: patternReaderAt{}}
+	if _, err := NewReader(source, func(r *Reader) {
+		r.memRanges = testRanges
+		r.Format = FormatAVML
+		r.StartOffset = 1
+	}); err == nil {
+		t.Error("expected start offset to be rejected for a compressed format")
+	}
+	if _, err := NewReader(source, func(r *Reader) {
+		r.memRanges = testRanges
+		r.StartOffset = 1 << 30
+	}); err == nil {
+		t.Error("expected start offset beyond the output to be rejected")
+	}
+}
+
+func TestOutputRanges(t *testing.T) {
+	for _, format := range []Format{FormatDefault, FormatELF, FormatPadded} {
+		source := &fakeSource{ReaderAt: patternReaderAt{}}
+		reader := newTestReader(context.Background(), t, source, func(r *Reader) {
+			r.Format = format
+		})
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("[%s] failed to read source: %v", format, err)
+		}
+
+		rngs := reader.OutputRanges()
+		if len(rngs) != len(testRanges) {
+			t.Fatalf("[%s] unexpected output ranges: %v", format, rngs)
+		}
+		for i, rng := range rngs {
+			mem := make([]byte, rng.End-rng.Start)
+			patternReaderAt{}.ReadAt(mem, int64(rng.Start))
+			if !bytes.Equal(data[rng.Offset:rng.Offset+uint64(len(mem))], mem) {
+				t.Errorf("[%s:%d] memory is not at the output offset: %d", format, i, rng.Offset)
+			}
+		}
+	}
+
+	source := &fakeSource{ReaderAt: patternReaderAt{}}
+	reader := newTestReader(context.Background(), t, source, func(r *Reader) {
+		r.Format = FormatAVML
+	})
+	if rngs := reader.OutputRanges(); rngs != nil {
+		t.Errorf("unexpected output ranges for a compressed format: %v", rngs)
+	}
+}
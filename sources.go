@@ -1,29 +1,196 @@
 package memr
 
-// MemSource type used for memory sources
-type MemSource string
+import (
+	"io"
+	"log"
+	"sync"
 
-const (
+	"github.com/ryandeivert/memr/internal/iomem"
+	"github.com/ryandeivert/memr/internal/ranges"
+)
+
+// MemRanges is a list of physical memory ranges, as read from /proc/iomem
+type MemRanges = iomem.MemRanges
+
+// MemRange is a range of physical memory, as read from /proc/iomem.
+// Note: End is inclusive, matching the /proc/iomem format.
+type MemRange = iomem.MemRange
+
+// SourceFile is an opened MemSource from which memory is read
+type SourceFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// SourceRange maps a range of physical memory to the offset
+// within a SourceFile at which the range can be read
+type SourceRange struct {
+	Start, End uint64 // physical address range (End is exclusive)
+	Offset     int64  // offset within the SourceFile at which Start can be read
+}
+
+func (s SourceRange) size() uint64 {
+	return s.End - s.Start
+}
+
+// intersect clips the range to the physical address range (end exclusive),
+// returning false if the two do not overlap
+func (s SourceRange) intersect(start, end uint64) (SourceRange, bool) {
+	if s.Start >= end || start >= s.End {
+		return SourceRange{}, false
+	}
+	if s.Start < start {
+		s.Offset += int64(start - s.Start)
+		s.Start = start
+	}
+	if s.End > end {
+		s.End = end
+	}
+	return s, true
+}
+
+// clipOverlaps orders the ranges by physical address, clipping (or dropping)
+// any range that overlaps a preceding one so that no data is duplicated.
+// See ranges.Clip
+func clipOverlaps(rngs []SourceRange) []SourceRange {
+	converted := make([]ranges.Range, len(rngs))
+	for i, rng := range rngs {
+		converted[i] = ranges.Range(rng)
+	}
+
+	var clipped []SourceRange
+	for _, rng := range ranges.Clip(converted) {
+		clipped = append(clipped, SourceRange(rng))
+	}
+
+	return clipped
+}
+
+// uncoveredRanges returns the portions of the memory ranges
+// which are not covered by any of the ranges (sorted by start)
+func uncoveredRanges(memRanges MemRanges, rngs []SourceRange) MemRanges {
+	var uncovered MemRanges
+	for _, memRange := range memRanges {
+		pos, end := memRange.Start, memRange.End+1 // iomem ranges are inclusive
+		for _, rng := range rngs {
+			if rng.End <= pos || rng.Start >= end {
+				continue
+			}
+			if rng.Start > pos {
+				uncovered = append(uncovered, &MemRange{Start: pos, End: rng.Start - 1})
+			}
+			pos = rng.End
+			if pos >= end {
+				break
+			}
+		}
+		if pos < end {
+			uncovered = append(uncovered, &MemRange{Start: pos, End: end - 1})
+		}
+	}
+
+	return uncovered
+}
+
+// MemSource is implemented by all memory sources. Custom sources
+// can be made available to Probe() by using RegisterSource().
+type MemSource interface {
+	// String describes the source, typically using its path (eg: /proc/kcore)
+	String() string
+
+	// Open opens the source for reading
+	Open() (SourceFile, error)
+
+	// Ranges lists the ranges of physical memory to be read from the opened source,
+	// in the order they should be read. memRanges are the ranges of system RAM read
+	// from /proc/iomem, which a source can use to locate or filter its own ranges.
+	Ranges(file SourceFile, memRanges MemRanges) ([]SourceRange, error)
+}
+
+// PageAlignedSource can optionally be implemented by a MemSource that requires
+// reads to be aligned to, and sized in, whole OS pages (eg: /dev/crash)
+type PageAlignedSource interface {
+	PageAligned() bool
+}
+
+// StandaloneSource can optionally be implemented by a MemSource that describes its own
+// physical memory layout (eg: /proc/vmcore), and so does not use the ranges of system RAM
+// from /proc/iomem. The memRanges provided to Ranges() will be nil for these sources.
+type StandaloneSource interface {
+	Standalone() bool
+}
+
+var (
+	// SourceVmcore disignates /proc/vmcore (from within a kdump capture kernel) as the memory source
+	SourceVmcore MemSource = &vmcoreSource{path: "/proc/vmcore"}
 	// SourceKcore disignates /proc/kcore as the memory source
-	SourceKcore MemSource = "/proc/kcore"
+	SourceKcore MemSource = &kcoreSource{path: "/proc/kcore"}
 	// SourceCrash disignates /dev/crash as the memory source
-	SourceCrash MemSource = "/dev/crash"
+	SourceCrash MemSource = NewPhysicalSource("/dev/crash", true)
 	// SourceMem disignates /dev/mem as the memory source
-	SourceMem MemSource = "/dev/mem"
+	SourceMem MemSource = NewPhysicalSource("/dev/mem", false)
 )
 
-func allMemSources() []MemSource {
-	return []MemSource{
-		SourceKcore,
-		SourceCrash,
-		SourceMem,
+var (
+	sourcesMu sync.RWMutex
+	sources   []MemSource
+)
+
+func init() {
+	RegisterSource(SourceVmcore)
+	RegisterSource(SourceKcore)
+	RegisterSource(SourceCrash)
+	RegisterSource(SourceMem)
+}
+
+// RegisterSource makes a MemSource available to Probe() and LookupSource().
+// Sources are probed in the order in which they are registered, starting with the built-in
+// sources: /proc/vmcore, /proc/kcore, /dev/crash, /dev/mem. A source with the same
+// description (String()) as an already registered source replaces it in place.
+func RegisterSource(source MemSource) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+
+	for i, existing := range sources {
+		if existing.String() == source.String() {
+			log.Printf("[DEBUG] replacing registered source: %s", source)
+			sources[i] = source
+			return
+		}
+	}
+
+	sources = append(sources, source)
+}
+
+// LookupSource returns the registered MemSource with the specified
+// description (eg: /proc/kcore), or nil if no such source is registered
+func LookupSource(name string) MemSource {
+	for _, source := range allMemSources() {
+		if source.String() == name {
+			return source
+		}
 	}
+	return nil
+}
+
+// Sources returns all registered sources, in the order they are probed
+func Sources() []MemSource {
+	return allMemSources()
+}
+
+func allMemSources() []MemSource {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+
+	return append([]MemSource(nil), sources...)
 }
 
-func (d MemSource) isPhysical() bool {
-	return d != SourceKcore
+func pageAligned(source MemSource) bool {
+	aligned, ok := source.(PageAlignedSource)
+	return ok && aligned.PageAligned()
 }
 
-func (d MemSource) forcePageReads() bool {
-	return d == SourceCrash
+func standalone(source MemSource) bool {
+	s, ok := source.(StandaloneSource)
+	return ok && s.Standalone()
 }
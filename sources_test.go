@@ -0,0 +1,43 @@
+package memr
+
+import (
+	"testing"
+)
+
+func TestRegisterSource(t *testing.T) {
+	defer func(registered []MemSource) {
+		sources = registered
+	}(allMemSources())
+
+	first := &fakeSource{}
+	RegisterSource(first)
+
+	if LookupSource("fake") != first {
+		t.Fatal("registered source not found")
+	}
+
+	// registering a source with the same name should replace it in place
+	second := &fakeSource{pageAligned: true}
+	RegisterSource(second)
+
+	all := allMemSources()
+	if len(all) != 5 {
+		t.Fatalf("unexpected number of sources: %d", len(all))
+	}
+	if all[4] != second {
+		t.Errorf("source was not replaced: %v", all[4])
+	}
+
+	for i, name := range []string{"/proc/vmcore", "/proc/kcore", "/dev/crash", "/dev/mem"} {
+		if all[i].String() != name {
+			t.Errorf("[%d] unexpected source order: %s != %s", i, all[i], name)
+		}
+		if LookupSource(name) != all[i] {
+			t.Errorf("[%d] failed to look up source: %s", i, name)
+		}
+	}
+
+	if LookupSource("/dev/unknown") != nil {
+		t.Error("expected nil for unregistered source")
+	}
+}
@@ -0,0 +1,81 @@
+package memr
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+)
+
+// vmcoreSource reads from /proc/vmcore, which is available when running
+// within a kdump capture kernel. Memory of the crashed kernel is available
+// as PT_LOAD program segments, with physical addresses that can be used
+// directly. /proc/iomem describes the capture kernel, not the crashed one,
+// so it is not used by this source.
+type vmcoreSource struct {
+	path string
+}
+
+func (v *vmcoreSource) String() string {
+	return v.path
+}
+
+// Standalone satisfies the StandaloneSource interface, since the
+// ELF program headers describe the crashed kernel's memory
+func (v *vmcoreSource) Standalone() bool {
+	return true
+}
+
+func (v *vmcoreSource) Open() (SourceFile, error) {
+	if err := verifySource(v.path); err != nil {
+		return nil, err
+	}
+	return os.Open(v.path)
+}
+
+func (v *vmcoreSource) KernelInfo(file SourceFile) (*KernelInfo, error) {
+	elfFile, err := elf.NewFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return elfKernelInfo(elfFile)
+}
+
+func (v *vmcoreSource) Ranges(file SourceFile, _ MemRanges) ([]SourceRange, error) {
+	elfFile, err := elf.NewFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	rngs := vmcoreRanges(elfFile)
+	if len(rngs) == 0 {
+		return nil, fmt.Errorf("no loadable segments found in %s", v)
+	}
+
+	return rngs, nil
+}
+
+// vmcoreRanges reads the physical ranges of the PT_LOAD segments from the
+// *elf.File, ordered by physical address. Segments that overlap others, such
+// as the one mapping the kernel's text, are clipped to avoid duplicate data
+func vmcoreRanges(file *elf.File) []SourceRange {
+
+	var progs []*elf.Prog
+	for _, progHeader := range file.Progs {
+		// Only care about PT_LOAD program header types with data
+		if progHeader.Type != elf.PT_LOAD || progHeader.Filesz == 0 {
+			continue
+		}
+		progs = append(progs, progHeader)
+	}
+
+	var rngs []SourceRange
+	for _, progHeader := range progs {
+		rngs = append(rngs, SourceRange{
+			Start:  progHeader.Paddr,
+			End:    progHeader.Paddr + progHeader.Filesz,
+			Offset: int64(progHeader.Off),
+		})
+	}
+
+	return clipOverlaps(rngs)
+}
@@ -0,0 +1,96 @@
+package memr
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestVmcoreRanges(t *testing.T) {
+	load := uint32(elf.PT_LOAD)
+	progs := []elf.Prog64{
+		{Type: uint32(elf.PT_NOTE), Off: 0x800, Filesz: 0x100},
+		// RAM, out of order
+		{Type: load, Paddr: 0x10000, Off: 0x1000, Filesz: 0x4000, Memsz: 0x4000},
+		// kernel text, partially overlapping the end of the RAM above
+		{Type: load, Paddr: 0x12000, Off: 0x5000, Filesz: 0x4000, Memsz: 0x4000},
+		{Type: load, Paddr: 0x1000, Off: 0x9000, Filesz: 0x2000, Memsz: 0x2000},
+		// within the first RAM range
+		{Type: load, Paddr: 0x11000, Off: 0xb000, Filesz: 0x1000, Memsz: 0x1000},
+		// sharing the start of a larger range
+		{Type: load, Paddr: 0x1000, Off: 0xc000, Filesz: 0x1000, Memsz: 0x1000},
+		// without data
+		{Type: load, Paddr: 0x20000, Off: 0xd000, Filesz: 0, Memsz: 0x1000},
+	}
+
+	expected := []SourceRange{
+		{Start: 0x1000, End: 0x3000, Offset: 0x9000},
+		{Start: 0x10000, End: 0x14000, Offset: 0x1000},
+		{Start: 0x14000, End: 0x16000, Offset: 0x7000},
+	}
+
+	rngs := vmcoreRanges(testELF(t, progs))
+	if len(rngs) != len(expected) {
+		t.Fatalf("unexpected number of ranges: %d != %d (%+v)", len(rngs), len(expected), rngs)
+	}
+	for i, rng := range rngs {
+		if rng != expected[i] {
+			t.Errorf("[%d] invalid range: %+v != %+v", i, rng, expected[i])
+		}
+	}
+
+	// Write a vmcore, where each segment holds the pattern at its physical addresses
+	core := make([]byte, 0xd000)
+	var buf bytes.Buffer
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_CORE),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     uint64(binary.Size(elf.Header64{})),
+		Ehsize:    uint16(binary.Size(elf.Header64{})),
+		Phentsize: uint16(binary.Size(elf.Prog64{})),
+		Phnum:     uint16(len(progs)),
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	if err := binary.Write(&buf, binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, progs); err != nil {
+		t.Fatal(err)
+	}
+	copy(core, buf.Bytes())
+	for _, prog := range progs[1:] {
+		patternReaderAt{}.ReadAt(core[prog.Off:prog.Off+prog.Filesz], int64(prog.Paddr)) //nolint:errcheck
+	}
+
+	path := filepath.Join(t.TempDir(), "vmcore")
+	if err := ioutil.WriteFile(path, core, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The raw output holds each clipped range once, in order
+	reader := newTestReader(context.Background(), t, &vmcoreSource{path: path}, func(r *Reader) {
+		r.PageHeaderProvider = nil
+	})
+	raw, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read vmcore: %v", err)
+	}
+
+	var want []byte
+	for _, rng := range expected {
+		mem := make([]byte, rng.End-rng.Start)
+		patternReaderAt{}.ReadAt(mem, int64(rng.Start)) //nolint:errcheck
+		want = append(want, mem...)
+	}
+	if !bytes.Equal(raw, want) {
+		t.Errorf("raw output of %d bytes does not match the %d expected", len(raw), len(want))
+	}
+}